@@ -2,108 +2,210 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
+	"flag"
 	"fmt"
-	"log"
+	"log/slog"
 	"os"
+	"strings"
 	"time"
+	"tritontube/internal/config"
+	"tritontube/internal/logging"
 	"tritontube/internal/proto"
 
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/credentials/insecure"
 )
 
+// bearerToken presents an admin token with every call. gRPC refuses to send
+// it over a plaintext connection unless insecure is set.
+type bearerToken struct {
+	token    string
+	insecure bool
+}
+
+func (t bearerToken) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	return map[string]string{"authorization": "Bearer " + t.token}, nil
+}
+
+func (t bearerToken) RequireTransportSecurity() bool {
+	return !t.insecure
+}
+
+// bindFlags defines the command line flags of the settings in cfg, with
+// cfg's values as their defaults
+func bindFlags(fs *flag.FlagSet, cfg *config.Admin) {
+	fs.StringVar(&cfg.Token, "token", cfg.Token, "Admin bearer token (default $"+config.AdminEnvPrefix+"_TOKEN)")
+	fs.StringVar(&cfg.TokenFile, "token-file", cfg.TokenFile, "File holding the admin bearer token")
+	fs.DurationVar(&cfg.Timeout, "timeout", cfg.Timeout, "How long to wait for each call; a node migration carries on after it")
+	fs.StringVar(&cfg.TLSCA, "tls-ca", cfg.TLSCA, "CA bundle the server's certificate must be signed by (default system roots)")
+	fs.BoolVar(&cfg.Insecure, "insecure", cfg.Insecure, "Dial the server in plaintext, sending the token in the clear")
+	fs.StringVar(&cfg.Log.Level, "log-level", cfg.Log.Level, "Lowest level logged (debug, info, warn, error)")
+	fs.StringVar(&cfg.Log.Format, "log-format", cfg.Log.Format, "Log format (text, json)")
+}
+
 func main() {
-	if len(os.Args) < 3 { // Minimum 3 args: program, command, server_address
+	configPath := flag.String("config", "", "YAML configuration file (settings may also be given as "+config.AdminEnvPrefix+"_* environment variables)")
+	parsed := config.DefaultAdmin()
+	bindFlags(flag.CommandLine, &parsed)
+	flag.Usage = printUsageAndExit
+	flag.Parse()
+
+	cfg, err := config.LoadAdmin(*configPath)
+	if err != nil {
+		fmt.Println("Error:", err)
+		os.Exit(1)
+	}
+	loaded := flag.NewFlagSet("config", flag.ContinueOnError)
+	bindFlags(loaded, &cfg)
+	if err := config.ApplyFlags(flag.CommandLine, loaded); err != nil {
+		fmt.Println("Error:", err)
+		os.Exit(1)
+	}
+	if err := logging.Setup(os.Stderr, logging.Config{Level: cfg.Log.Level, Format: cfg.Log.Format}); err != nil {
+		fmt.Println("Error:", err)
+		os.Exit(1)
+	}
+
+	args := flag.Args()
+	if len(args) < 1 {
+		printUsageAndExit()
+	}
+	cmd := args[0]
+	wantArgs, ok := commandArgs[cmd]
+	if !ok {
+		fmt.Printf("Unknown command: %s\n", cmd)
+		printUsageAndExit()
+	}
+	// The server address may come from the configuration instead
+	rest := args[1:]
+	switch len(rest) {
+	case wantArgs + 1:
+		cfg.Server, rest = rest[0], rest[1:]
+	case wantArgs:
+	default:
 		printUsageAndExit()
 	}
 
-	cmd := os.Args[1]
-	serverAddr := os.Args[2]
+	if cfg.TokenFile != "" {
+		data, err := os.ReadFile(cfg.TokenFile)
+		if err != nil {
+			fatal(context.Background(), "Failed to read token file", "error", err)
+		}
+		cfg.Token = strings.TrimSpace(string(data))
+	}
+	if err := cfg.Validate(); err != nil {
+		fmt.Println("Error:", err)
+		os.Exit(1)
+	}
 
-	conn, err := grpc.NewClient(serverAddr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	creds := credentials.NewTLS(&tls.Config{MinVersion: tls.VersionTLS12})
+	if cfg.Insecure {
+		creds = insecure.NewCredentials()
+	} else if cfg.TLSCA != "" {
+		creds, err = credentials.NewClientTLSFromFile(cfg.TLSCA, "")
+		if err != nil {
+			fatal(context.Background(), "Failed to load CA bundle", "error", err)
+		}
+	}
+	conn, err := grpc.NewClient(cfg.Server,
+		grpc.WithTransportCredentials(creds),
+		grpc.WithPerRPCCredentials(bearerToken{token: cfg.Token, insecure: cfg.Insecure}),
+		grpc.WithUnaryInterceptor(logging.UnaryClientInterceptor()))
 	if err != nil {
-		log.Fatalf("Failed to connect to server: %v", err)
+		fatal(context.Background(), "Failed to connect to server", "error", err)
 	}
 	defer conn.Close()
 
 	client := proto.NewVideoContentAdminServiceClient(conn)
 
+	// The request ID lets the call be found in the web server's log
+	ctx := logging.WithRequestID(context.Background(), "")
+	slog.DebugContext(ctx, "Calling admin service", "server", cfg.Server, "command", cmd)
 	switch cmd {
 	case "add":
-		if len(os.Args) != 4 {
-			fmt.Println("Usage: add <server_address> <node_address>")
-			os.Exit(1)
-		}
-		addNode(client, os.Args[3])
+		addNode(ctx, client, rest[0], cfg.Timeout)
 	case "remove":
-		if len(os.Args) != 4 {
-			fmt.Println("Usage: remove <server_address> <node_address>")
-			os.Exit(1)
-		}
-		removeNode(client, os.Args[3])
+		removeNode(ctx, client, rest[0], cfg.Timeout)
 	case "list":
-		if len(os.Args) != 3 {
-			fmt.Println("Usage: list <server_address>")
-			os.Exit(1)
-		}
-		listNodes(client)
-	default:
-		fmt.Printf("Unknown command: %s\n", cmd)
-		printUsageAndExit()
+		listNodes(ctx, client, cfg.Timeout)
 	}
 }
 
+// commandArgs is the number of arguments each command takes after the
+// server address
+var commandArgs = map[string]int{"add": 1, "remove": 1, "list": 0}
+
 func printUsageAndExit() {
-	fmt.Println("Usage:")
-	fmt.Println("  add <server_address> <node_address>     - Add a node to the cluster")
-	fmt.Println("  remove <server_address> <node_address>  - Remove a node from the cluster")
-	fmt.Println("  list <server_address>                   - List all nodes in the cluster")
+	fmt.Println("Usage: admin [OPTIONS] COMMAND [<server_address>] [ARGS]")
+	fmt.Println()
+	fmt.Println("Commands:")
+	fmt.Println("  add <server_address> <node_address>     - Add a node to the cluster (operator)")
+	fmt.Println("  remove <server_address> <node_address>  - Remove a node from the cluster (operator)")
+	fmt.Println("  list <server_address>                   - List all nodes in the cluster (viewer)")
+	fmt.Println()
+	fmt.Println("The server address may be left out if the -config file sets it.")
+	fmt.Println()
+	fmt.Println("Options:")
+	flag.PrintDefaults()
 	os.Exit(1)
 }
 
-func addNode(client proto.VideoContentAdminServiceClient, nodeAddr string) {
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+// fatal logs an error with the request ID of ctx and exits
+func fatal(ctx context.Context, msg string, args ...any) {
+	slog.ErrorContext(ctx, msg, args...)
+	os.Exit(1)
+}
+
+func addNode(ctx context.Context, client proto.VideoContentAdminServiceClient, nodeAddr string, timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
 	defer cancel()
 
 	response, err := client.AddNode(ctx, &proto.AddNodeRequest{
 		NodeAddress: nodeAddr,
 	})
 	if err != nil {
-		log.Fatalf("AddNode RPC failed: %v", err)
+		fatal(ctx, "AddNode RPC failed", "error", err)
 	}
 
 	fmt.Printf("Successfully added node: %s\n", nodeAddr)
 	fmt.Printf("Number of files migrated: %d\n", response.MigratedFileCount)
 }
 
-func removeNode(client proto.VideoContentAdminServiceClient, nodeAddr string) {
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+func removeNode(ctx context.Context, client proto.VideoContentAdminServiceClient, nodeAddr string, timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
 	defer cancel()
 
 	response, err := client.RemoveNode(ctx, &proto.RemoveNodeRequest{
 		NodeAddress: nodeAddr,
 	})
 	if err != nil {
-		log.Fatalf("RemoveNode RPC failed: %v", err)
+		fatal(ctx, "RemoveNode RPC failed", "error", err)
 	}
 
 	fmt.Printf("Successfully removed node: %s\n", nodeAddr)
 	fmt.Printf("Number of files migrated: %d\n", response.MigratedFileCount)
 }
 
-func listNodes(client proto.VideoContentAdminServiceClient) {
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+func listNodes(ctx context.Context, client proto.VideoContentAdminServiceClient, timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
 	defer cancel()
 
 	response, err := client.ListNodes(ctx, &proto.ListNodesRequest{})
 	if err != nil {
-		log.Fatalf("ListNodes RPC failed: %v", err)
+		fatal(ctx, "ListNodes RPC failed", "error", err)
 	}
 
 	fmt.Println("Storage cluster nodes:")
 	if len(response.Nodes) == 0 {
 		fmt.Println("  No nodes in cluster")
+	} else if len(response.Statuses) == len(response.Nodes) {
+		for _, status := range response.Statuses {
+			fmt.Printf("  - %s (circuit breaker %s)\n", status.NodeAddress, status.BreakerState)
+		}
 	} else {
+		// A web server predating node statuses
 		for _, node := range response.Nodes {
 			fmt.Printf("  - %s\n", node)
 		}
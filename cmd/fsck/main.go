@@ -0,0 +1,200 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"tritontube/internal/config"
+	"tritontube/internal/tlsutil"
+	"tritontube/internal/web"
+
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+// printUsage prints the usage information for the application
+func printUsage() {
+	fmt.Println("Usage: ./fsck [OPTIONS] {-config FILE | METADATA_TYPE METADATA_OPTIONS CONTENT_TYPE CONTENT_OPTIONS}")
+	fmt.Println()
+	fmt.Println("Cross-checks the metadata catalog against the content store and reports")
+	fmt.Println("videos missing a manifest, segments referenced by a manifest but absent,")
+	fmt.Println("and content that no catalogued video references.")
+	fmt.Println()
+	fmt.Println("Arguments are the same as for the web server:")
+	fmt.Println("  METADATA_TYPE         Metadata service type (sqlite)")
+	fmt.Println("  METADATA_OPTIONS      Options for metadata service (e.g., db path)")
+	fmt.Println("  CONTENT_TYPE          Content service type (fs, nw)")
+	fmt.Println("  CONTENT_OPTIONS       Options for content service (e.g., base dir, network addresses)")
+	fmt.Println()
+	fmt.Println("Options:")
+	flag.PrintDefaults()
+	fmt.Println()
+	fmt.Println("Live streams are skipped, and so are uploads started less than")
+	fmt.Println("-pending-grace ago; older pending uploads are taken to be abandoned")
+	fmt.Println("and removed by -fix.")
+	fmt.Println()
+	fmt.Println("Example: ./fsck -fix sqlite db.db fs /path/to/videos")
+	fmt.Println("Example: ./fsck -config web.yaml")
+}
+
+func main() {
+	fix := flag.Bool("fix", false, "Remove unplayable videos and delete unreferenced content")
+	pendingGrace := flag.Duration("pending-grace", web.DefaultPendingGrace, "How long an upload may stay pending before it is taken to be abandoned")
+	storageTLSCert := flag.String("storage-tls-cert", "", "Client certificate presented to storage nodes (empty dials them in plaintext)")
+	storageTLSKey := flag.String("storage-tls-key", "", "Private key of the storage client certificate")
+	storageTLSCA := flag.String("storage-tls-ca", "", "CA bundle storage node certificates must be signed by (default system roots)")
+	placement := flag.String("placement", "", "How files are spread over storage nodes (ring, rendezvous, bounded-load, jump; default ring, or the configuration's)")
+	configPath := flag.String("config", "", "Web server configuration file to take the services from instead of the arguments")
+	flag.Usage = printUsage
+	flag.Parse()
+
+	var metadataServiceType, metadataServiceOptions, contentServiceType, contentServiceOptions string
+	placementPolicy := web.DefaultPlacementPolicy()
+	switch {
+	case len(flag.Args()) == 4:
+		metadataServiceType = flag.Arg(0)
+		metadataServiceOptions = flag.Arg(1)
+		contentServiceType = flag.Arg(2)
+		contentServiceOptions = flag.Arg(3)
+	case len(flag.Args()) == 0 && *configPath != "":
+		cfg, err := config.LoadWeb(*configPath)
+		if err != nil {
+			fmt.Println("Error loading configuration:", err)
+			os.Exit(2)
+		}
+		metadataServiceType = cfg.Metadata.Type
+		metadataServiceOptions = cfg.Metadata.Path
+		contentServiceType = cfg.Content.Type
+		contentServiceOptions = cfg.Content.Options()
+		if *storageTLSCert == "" && *storageTLSKey == "" {
+			*storageTLSCert, *storageTLSKey = cfg.Content.TLS.Cert, cfg.Content.TLS.Key
+		}
+		if *storageTLSCA == "" {
+			*storageTLSCA = cfg.Content.TLS.CA
+		}
+		placementPolicy.Strategy = cfg.Content.Placement.Strategy
+		placementPolicy.LoadFactor = cfg.Content.Placement.LoadFactor
+	default:
+		fmt.Println("Error: Incorrect number of arguments")
+		printUsage()
+		os.Exit(2)
+	}
+
+	// Construct metadata service
+	var metadataService web.VideoMetadataService
+	switch metadataServiceType {
+	case "sqlite":
+		var err error
+		metadataService, err = web.NewSQLiteVideoMetadataService(metadataServiceOptions)
+		if err != nil {
+			fmt.Println("Error creating SQLite metadata service:", err)
+			os.Exit(2)
+		}
+	default:
+		fmt.Println("Error: Unsupported metadata service type:", metadataServiceType)
+		os.Exit(2)
+	}
+
+	// Construct content service
+	var contentService web.VideoContentService
+	switch contentServiceType {
+	case "fs":
+		var err error
+		contentService, err = web.NewFSVideoContentService(contentServiceOptions)
+		if err != nil {
+			fmt.Println("Error creating filesystem content service:", err)
+			os.Exit(2)
+		}
+	case "nw":
+		var err error
+		var creds credentials.TransportCredentials = insecure.NewCredentials()
+		if *storageTLSCert != "" || *storageTLSKey != "" {
+			reloader, err := tlsutil.NewReloader(*storageTLSCert, *storageTLSKey, *storageTLSCA)
+			if err != nil {
+				fmt.Println("Error loading storage TLS certificate:", err)
+				os.Exit(2)
+			}
+			creds = credentials.NewTLS(reloader.ClientConfig())
+		} else if *storageTLSCA != "" {
+			fmt.Println("Error: -storage-tls-ca needs -storage-tls-cert and -storage-tls-key")
+			os.Exit(2)
+		}
+		nwService, err := web.NewNetworkVideoContentServiceWithCredentials(contentServiceOptions, creds)
+		if err != nil {
+			fmt.Println("Error creating network content service:", err)
+			os.Exit(2)
+		}
+		if *placement != "" {
+			placementPolicy.Strategy = *placement
+		}
+		if err := nwService.SetPlacementPolicy(placementPolicy); err != nil {
+			fmt.Println("Error setting placement strategy:", err)
+			os.Exit(2)
+		}
+		if err := web.CheckPlacement(metadataService, placementPolicy); err != nil {
+			fmt.Println("Error:", err)
+			os.Exit(2)
+		}
+		contentService = nwService
+	default:
+		fmt.Println("Error: Unsupported content service type:", contentServiceType)
+		os.Exit(2)
+	}
+
+	report, err := web.Fsck(metadataService, contentService, *fix, *pendingGrace)
+	if report != nil {
+		printReport(report)
+	}
+	if err != nil {
+		fmt.Println("Error:", err)
+		os.Exit(2)
+	}
+
+	if report.Clean() {
+		fmt.Println("No problems found")
+		return
+	}
+	if *fix {
+		fmt.Println("All problems above were repaired")
+		return
+	}
+	fmt.Println("Run again with -fix to repair")
+	os.Exit(1)
+}
+
+func printReport(report *web.FsckReport) {
+	for _, videoId := range report.PendingVideos {
+		fmt.Printf("PENDING UPLOAD    %s\n", videoId)
+	}
+	for _, videoId := range report.MissingManifest {
+		fmt.Printf("MISSING MANIFEST  %s\n", videoId)
+	}
+	for _, videoId := range report.InvalidManifest {
+		fmt.Printf("INVALID MANIFEST  %s\n", videoId)
+	}
+
+	videoIds := make([]string, 0, len(report.MissingSegments))
+	for videoId := range report.MissingSegments {
+		videoIds = append(videoIds, videoId)
+	}
+	sort.Strings(videoIds)
+	for _, videoId := range videoIds {
+		for _, filename := range report.MissingSegments[videoId] {
+			fmt.Printf("MISSING SEGMENT   %s/%s\n", videoId, filename)
+		}
+	}
+
+	for _, videoId := range report.OrphanedVideos {
+		fmt.Printf("NO METADATA       %s\n", videoId)
+	}
+	for _, key := range report.UnreferencedFiles {
+		fmt.Printf("UNREFERENCED      %s\n", key)
+	}
+	for _, videoId := range report.InProgressVideos {
+		fmt.Printf("IN PROGRESS       %s (skipped)\n", videoId)
+	}
+	for _, videoId := range report.UncheckedVideos {
+		fmt.Printf("NOT CHECKED       %s (manifest repeats segments up to an unknown end)\n", videoId)
+	}
+}
@@ -0,0 +1,270 @@
+// mockoidc is a minimal OpenID Connect provider for testing single sign-on.
+// It approves every authorization request for one configured user, without
+// a login page, and enforces the parts of the flow the web server relies on:
+// registered client and redirect URL, PKCE (S256), single-use codes and the
+// nonce.
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+)
+
+const keyID = "mockoidc"
+
+// authorization is an issued code waiting to be redeemed
+type authorization struct {
+	clientId      string
+	redirectURL   string
+	codeChallenge string
+	nonce         string
+	expires       time.Time
+}
+
+type provider struct {
+	issuer       string
+	clientId     string
+	clientSecret string
+	redirectURL  string
+	claims       map[string]interface{}
+
+	key    *rsa.PrivateKey
+	signer jose.Signer
+
+	mu    sync.Mutex
+	codes map[string]authorization
+}
+
+func main() {
+	port := flag.Int("port", 9000, "Port number for the provider")
+	issuer := flag.String("issuer", "", "Issuer URL (default http://localhost:PORT)")
+	clientId := flag.String("client-id", "tritontube", "Client ID of the web server")
+	clientSecret := flag.String("client-secret", "secret", "Client secret of the web server")
+	redirectURL := flag.String("redirect-url", "http://localhost:8080/login/oidc/callback", "Redirect URL registered for the client")
+	subject := flag.String("subject", "mock-user-1", "Subject (sub) of the user every login is approved for")
+	username := flag.String("username", "alice", "preferred_username claim of the user")
+	email := flag.String("email", "alice@example.com", "email claim of the user")
+	groups := flag.String("groups", "", "Comma-separated groups claim of the user")
+	flag.Parse()
+
+	if *issuer == "" {
+		*issuer = fmt.Sprintf("http://localhost:%d", *port)
+	}
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		log.Fatalf("Failed to generate signing key: %v", err)
+	}
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.RS256, Key: key},
+		(&jose.SignerOptions{}).WithType("JWT").WithHeader("kid", keyID))
+	if err != nil {
+		log.Fatalf("Failed to create signer: %v", err)
+	}
+
+	claims := map[string]interface{}{
+		"sub":                *subject,
+		"preferred_username": *username,
+		"email":              *email,
+	}
+	if *groups != "" {
+		claims["groups"] = strings.Split(*groups, ",")
+	}
+
+	p := &provider{
+		issuer:       *issuer,
+		clientId:     *clientId,
+		clientSecret: *clientSecret,
+		redirectURL:  *redirectURL,
+		claims:       claims,
+		key:          key,
+		signer:       signer,
+		codes:        make(map[string]authorization),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", p.handleDiscovery)
+	mux.HandleFunc("/jwks", p.handleJWKS)
+	mux.HandleFunc("/authorize", p.handleAuthorize)
+	mux.HandleFunc("/token", p.handleToken)
+
+	addr := fmt.Sprintf(":%d", *port)
+	fmt.Printf("Mock OIDC provider %s listening on %s, approving logins as %s\n", *issuer, addr, *username)
+	log.Fatal(http.ListenAndServe(addr, mux))
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// tokenError answers a token request the way RFC 6749 section 5.2 describes
+func tokenError(w http.ResponseWriter, code, description string) {
+	fmt.Printf("Token request rejected: %s: %s\n", code, description)
+	writeJSON(w, http.StatusBadRequest, map[string]string{"error": code, "error_description": description})
+}
+
+func (p *provider) handleDiscovery(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"issuer":                                p.issuer,
+		"authorization_endpoint":                p.issuer + "/authorize",
+		"token_endpoint":                        p.issuer + "/token",
+		"jwks_uri":                              p.issuer + "/jwks",
+		"response_types_supported":              []string{"code"},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+		"code_challenge_methods_supported":      []string{"S256"},
+		"token_endpoint_auth_methods_supported": []string{"client_secret_basic", "client_secret_post"},
+	})
+}
+
+func (p *provider) handleJWKS(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, jose.JSONWebKeySet{Keys: []jose.JSONWebKey{{
+		Key:       &p.key.PublicKey,
+		KeyID:     keyID,
+		Algorithm: string(jose.RS256),
+		Use:       "sig",
+	}}})
+}
+
+// handleAuthorize approves the request straight away and sends the browser
+// back to the client with a code
+func (p *provider) handleAuthorize(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	if query.Get("client_id") != p.clientId {
+		http.Error(w, "unknown client_id", http.StatusBadRequest)
+		return
+	}
+	// Never redirect to an unregistered URL, not even with an error
+	if query.Get("redirect_uri") != p.redirectURL {
+		http.Error(w, "redirect_uri is not registered", http.StatusBadRequest)
+		return
+	}
+
+	redirect, _ := url.Parse(p.redirectURL)
+	params := url.Values{"state": {query.Get("state")}}
+	switch {
+	case query.Get("response_type") != "code":
+		params.Set("error", "unsupported_response_type")
+	case !strings.Contains(" "+query.Get("scope")+" ", " openid "):
+		params.Set("error", "invalid_scope")
+	case query.Get("code_challenge") == "" || query.Get("code_challenge_method") != "S256":
+		params.Set("error", "invalid_request")
+		params.Set("error_description", "PKCE with S256 is required")
+	default:
+		code := randomString()
+		p.mu.Lock()
+		p.codes[code] = authorization{
+			clientId:      p.clientId,
+			redirectURL:   p.redirectURL,
+			codeChallenge: query.Get("code_challenge"),
+			nonce:         query.Get("nonce"),
+			expires:       time.Now().Add(time.Minute),
+		}
+		p.mu.Unlock()
+		params.Set("code", code)
+	}
+	redirect.RawQuery = params.Encode()
+	http.Redirect(w, r, redirect.String(), http.StatusFound)
+}
+
+func (p *provider) handleToken(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		tokenError(w, "invalid_request", err.Error())
+		return
+	}
+
+	clientId, clientSecret, ok := r.BasicAuth()
+	if ok {
+		clientId, _ = url.QueryUnescape(clientId)
+		clientSecret, _ = url.QueryUnescape(clientSecret)
+	} else {
+		clientId, clientSecret = r.PostForm.Get("client_id"), r.PostForm.Get("client_secret")
+	}
+	if clientId != p.clientId || subtle.ConstantTimeCompare([]byte(clientSecret), []byte(p.clientSecret)) != 1 {
+		w.Header().Set("WWW-Authenticate", `Basic realm="mockoidc"`)
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "invalid_client"})
+		return
+	}
+	if r.PostForm.Get("grant_type") != "authorization_code" {
+		tokenError(w, "unsupported_grant_type", r.PostForm.Get("grant_type"))
+		return
+	}
+
+	// Codes are single use whether or not the exchange succeeds
+	code := r.PostForm.Get("code")
+	p.mu.Lock()
+	auth, ok := p.codes[code]
+	delete(p.codes, code)
+	p.mu.Unlock()
+	if !ok || time.Now().After(auth.expires) || auth.clientId != clientId {
+		tokenError(w, "invalid_grant", "unknown or expired code")
+		return
+	}
+	if r.PostForm.Get("redirect_uri") != auth.redirectURL {
+		tokenError(w, "invalid_grant", "redirect_uri does not match the authorization request")
+		return
+	}
+	sum := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+	if base64.RawURLEncoding.EncodeToString(sum[:]) != auth.codeChallenge {
+		tokenError(w, "invalid_grant", "code_verifier does not match the code_challenge")
+		return
+	}
+
+	now := time.Now()
+	claims := map[string]interface{}{
+		"iss": p.issuer,
+		"aud": clientId,
+		"iat": now.Unix(),
+		"exp": now.Add(time.Hour).Unix(),
+	}
+	if auth.nonce != "" {
+		claims["nonce"] = auth.nonce
+	}
+	for name, value := range p.claims {
+		claims[name] = value
+	}
+	payload, _ := json.Marshal(claims)
+	signed, err := p.signer.Sign(payload)
+	if err != nil {
+		tokenError(w, "server_error", err.Error())
+		return
+	}
+	idToken, err := signed.CompactSerialize()
+	if err != nil {
+		tokenError(w, "server_error", err.Error())
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"access_token": randomString(),
+		"token_type":   "Bearer",
+		"expires_in":   3600,
+		"id_token":     idToken,
+	})
+}
+
+func randomString() string {
+	b := make([]byte, 24)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
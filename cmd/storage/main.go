@@ -1,42 +1,181 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"log"
+	"log/slog"
 	"net"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
 
+	"tritontube/internal/config"
+	"tritontube/internal/logging"
+	"tritontube/internal/metrics"
 	pb "tritontube/internal/proto"
 	"tritontube/internal/storage"
+	"tritontube/internal/tlsutil"
+	"tritontube/internal/tracing"
 )
 
+// bindFlags defines the command line flags of the settings in cfg, with
+// cfg's values as their defaults
+func bindFlags(fs *flag.FlagSet, cfg *config.Storage) {
+	fs.StringVar(&cfg.Host, "host", cfg.Host, "Host to listen on")
+	fs.IntVar(&cfg.Port, "port", cfg.Port, "Port to listen on")
+	fs.DurationVar(&cfg.ShutdownTimeout, "shutdown-timeout", cfg.ShutdownTimeout, "How long to wait on SIGTERM for in-flight calls before cancelling them")
+	fs.StringVar(&cfg.TLS.Cert, "tls-cert", cfg.TLS.Cert, "Server certificate file (empty serves plaintext gRPC)")
+	fs.StringVar(&cfg.TLS.Key, "tls-key", cfg.TLS.Key, "Server private key file")
+	fs.StringVar(&cfg.TLS.CA, "tls-ca", cfg.TLS.CA, "CA bundle client certificates must be signed by (empty accepts clients without one)")
+	fs.StringVar(&cfg.PeerTLS.Cert, "peer-tls-cert", cfg.PeerTLS.Cert, "Client certificate presented to other nodes when copying files to them (empty dials them in plaintext)")
+	fs.StringVar(&cfg.PeerTLS.Key, "peer-tls-key", cfg.PeerTLS.Key, "Private key of the peer client certificate")
+	fs.StringVar(&cfg.PeerTLS.CA, "peer-tls-ca", cfg.PeerTLS.CA, "CA bundle other nodes' certificates must be signed by (default system roots)")
+	fs.Var(&cfg.Peers, "peers", "Comma-separated addresses of the nodes this node copies files to during migrations, as the web server knows them (default any, if -tls-ca authenticates callers)")
+	fs.StringVar(&cfg.Tracing.Exporter, "tracing-exporter", cfg.Tracing.Exporter, "Where to send trace spans (none, stdout, otlp)")
+	fs.StringVar(&cfg.Tracing.Endpoint, "tracing-endpoint", cfg.Tracing.Endpoint, "host:port of the OTLP collector")
+	fs.StringVar(&cfg.Log.Level, "log-level", cfg.Log.Level, "Lowest level logged (debug, info, warn, error)")
+	fs.StringVar(&cfg.Log.Format, "log-format", cfg.Log.Format, "Log format (text, json)")
+	fs.IntVar(&cfg.MetricsPort, "metrics-port", cfg.MetricsPort, "Port to serve Prometheus metrics on at /metrics (0 disables them)")
+}
+
 func main() {
-	host := flag.String("host", "localhost", "Host to listen on")
-	port := flag.Int("port", 8090, "Port to listen on")
+	configPath := flag.String("config", "", "YAML configuration file (settings may also be given as "+config.StorageEnvPrefix+"_* environment variables)")
+	parsed := config.DefaultStorage()
+	bindFlags(flag.CommandLine, &parsed)
 	flag.Parse()
 
-	if flag.NArg() != 1 {
-		log.Fatal("Usage: storage -host HOST -port PORT STORAGE_DIR")
+	if flag.NArg() > 1 {
+		log.Fatal("Usage: storage [-config FILE] -host HOST -port PORT [-tls-cert FILE -tls-key FILE [-tls-ca FILE]] [STORAGE_DIR]")
 	}
 
-	storageDir := flag.Arg(0)
-	server, err := storage.NewStorageServer(storageDir)
+	cfg, err := config.LoadStorage(*configPath)
 	if err != nil {
-		log.Fatalf("Failed to create storage server: %v", err)
+		log.Fatalf("Failed to load configuration: %v", err)
+	}
+	loaded := flag.NewFlagSet("config", flag.ContinueOnError)
+	bindFlags(loaded, &cfg)
+	if err := config.ApplyFlags(flag.CommandLine, loaded); err != nil {
+		log.Fatalf("Failed to load configuration: %v", err)
+	}
+	if flag.NArg() == 1 {
+		cfg.Dir = flag.Arg(0)
+	}
+	if err := cfg.Validate(); err != nil {
+		log.Fatal(err)
+	}
+	if err := logging.Setup(os.Stderr, logging.Config{Level: cfg.Log.Level, Format: cfg.Log.Format}); err != nil {
+		log.Fatal(err)
 	}
 
-	lis, err := net.Listen("tcp", fmt.Sprintf("%s:%d", *host, *port))
+	shutdownTracing, err := tracing.Setup("tritontube-storage", tracing.Config{
+		Exporter:    cfg.Tracing.Exporter,
+		Endpoint:    cfg.Tracing.Endpoint,
+		Insecure:    cfg.Tracing.Insecure,
+		File:        cfg.Tracing.File,
+		SampleRatio: cfg.Tracing.SampleRatio,
+	})
 	if err != nil {
-		log.Fatalf("Failed to listen: %v", err)
+		fatal("Failed to set up tracing", "error", err)
+	}
+
+	server, err := storage.NewStorageServer(cfg.Dir)
+	if err != nil {
+		fatal("Failed to create storage server", "error", err)
+	}
+	if cfg.PeerTLS.Enabled() {
+		reloader, err := tlsutil.NewReloader(cfg.PeerTLS.Cert, cfg.PeerTLS.Key, cfg.PeerTLS.CA)
+		if err != nil {
+			fatal("Failed to load peer TLS certificate", "error", err)
+		}
+		reloader.ReloadOnSIGHUP()
+		server.SetPeerCredentials(credentials.NewTLS(reloader.ClientConfig()))
+	}
+	switch {
+	case len(cfg.Peers) > 0:
+		server.EnableCopyTo(cfg.Peers)
+	case cfg.TLS.CA != "":
+		// Only callers with a certificate the CA signed can name a destination
+		server.EnableCopyTo(nil)
+	default:
+		slog.Info("Copying files to other nodes is disabled without -peers or -tls-ca; migrations relay files through the web server")
+	}
+
+	var opts []grpc.ServerOption
+	if cfg.TLS.Enabled() {
+		reloader, err := tlsutil.NewReloader(cfg.TLS.Cert, cfg.TLS.Key, cfg.TLS.CA)
+		if err != nil {
+			fatal("Failed to load TLS certificate", "error", err)
+		}
+		opts = append(opts, grpc.Creds(credentials.NewTLS(reloader.ServerConfig())))
+		reloader.ReloadOnSIGHUP()
 	}
 
-	s := grpc.NewServer()
+	lis, err := net.Listen("tcp", fmt.Sprintf("%s:%d", cfg.Host, cfg.Port))
+	if err != nil {
+		fatal("Failed to listen", "error", err)
+	}
+
+	// Let writes still running when a shutdown times out finish
+	opts = append(opts,
+		grpc.WaitForHandlers(true),
+		grpc.ChainUnaryInterceptor(metrics.UnaryServerInterceptor(), logging.UnaryServerInterceptor()),
+		grpc.ChainStreamInterceptor(metrics.StreamServerInterceptor(), logging.StreamServerInterceptor()),
+		// Continue the traces of the web server's calls
+		grpc.StatsHandler(otelgrpc.NewServerHandler()),
+	)
+	s := grpc.NewServer(opts...)
 	pb.RegisterStorageServiceServer(s, server)
 
-	log.Printf("Storage server listening on %s:%d", *host, *port)
+	transport := "plaintext"
+	switch {
+	case cfg.TLS.CA != "":
+		transport = "mutual TLS"
+	case cfg.TLS.Cert != "":
+		transport = "TLS"
+	}
+	slog.Info("Storage server listening", "addr", lis.Addr().String(), "transport", transport, "dir", cfg.Dir)
+	if cfg.MetricsPort != 0 {
+		go metrics.Serve(fmt.Sprintf("%s:%d", cfg.Host, cfg.MetricsPort))
+	}
+	go stopOnSignal(s, cfg.ShutdownTimeout)
 	if err := s.Serve(lis); err != nil {
-		log.Fatalf("Failed to serve: %v", err)
+		fatal("Failed to serve", "error", err)
+	}
+	slog.Info("Storage server stopped")
+	if err := server.Close(); err != nil {
+		slog.Error("Failed to close index", "error", err)
 	}
+	if err := shutdownTracing(context.Background()); err != nil {
+		slog.Error("Failed to flush trace spans", "error", err)
+	}
+}
+
+// fatal logs an error that keeps the node from running and exits
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+// stopOnSignal stops the server gracefully on SIGTERM or Ctrl+C: it stops
+// accepting connections and lets in-flight reads and writes finish. Calls
+// still running after the timeout are cancelled.
+func stopOnSignal(s *grpc.Server, timeout time.Duration) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+	<-signals
+
+	slog.Info("Shutting down, waiting for in-flight calls", "timeout", timeout)
+	timer := time.AfterFunc(timeout, func() {
+		slog.Warn("Shutdown deadline passed, cancelling remaining calls")
+		s.Stop()
+	})
+	s.GracefulStop()
+	timer.Stop()
 }
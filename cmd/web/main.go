@@ -1,18 +1,33 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
+	"io"
+	"log/slog"
 	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"tritontube/internal/config"
+	"tritontube/internal/logging"
+	"tritontube/internal/metrics"
+	"tritontube/internal/tlsutil"
+	"tritontube/internal/tracing"
 	"tritontube/internal/web"
+
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
 )
 
 // printUsage prints the usage information for the application
 func printUsage() {
-	fmt.Println("Usage: ./program [OPTIONS] METADATA_TYPE METADATA_OPTIONS CONTENT_TYPE CONTENT_OPTIONS")
+	fmt.Println("Usage: ./program [OPTIONS] [METADATA_TYPE METADATA_OPTIONS CONTENT_TYPE CONTENT_OPTIONS]")
 	fmt.Println()
-	fmt.Println("Arguments:")
-	fmt.Println("  METADATA_TYPE         Metadata service type (sqlite, etcd)")
+	fmt.Println("Arguments (override the metadata and content sections of -config):")
+	fmt.Println("  METADATA_TYPE         Metadata service type (sqlite)")
 	fmt.Println("  METADATA_OPTIONS      Options for metadata service (e.g., db path)")
 	fmt.Println("  CONTENT_TYPE          Content service type (fs, nw)")
 	fmt.Println("  CONTENT_OPTIONS       Options for content service (e.g., base dir, network addresses)")
@@ -20,93 +35,364 @@ func printUsage() {
 	fmt.Println("Options:")
 	flag.PrintDefaults()
 	fmt.Println()
+	fmt.Println("Every setting can also be given in the -config file or as a " + config.WebEnvPrefix + "_*")
+	fmt.Println("environment variable; flags take precedence over both.")
+	fmt.Println()
 	fmt.Println("Example: ./program sqlite db.db fs /path/to/videos")
+	fmt.Println("Example: ./program -config web.yaml")
 }
 
-func main() {
-	// Define flags
-	port := flag.Int("port", 8080, "Port number for the web server")
-	host := flag.String("host", "0.0.0.0", "Host address for the web server")
+// bindFlags defines the command line flags of the settings in cfg, with
+// cfg's values as their defaults
+func bindFlags(fs *flag.FlagSet, cfg *config.Web) {
+	fs.IntVar(&cfg.Listen.Port, "port", cfg.Listen.Port, "Port number for the web server")
+	fs.StringVar(&cfg.Listen.Host, "host", cfg.Listen.Host, "Host address for the web server")
+	fs.StringVar(&cfg.TLS.Cert, "tls-cert", cfg.TLS.Cert, "Certificate file for HTTPS (empty serves plain HTTP)")
+	fs.StringVar(&cfg.TLS.Key, "tls-key", cfg.TLS.Key, "Private key file for HTTPS")
+	fs.IntVar(&cfg.Listen.HTTPRedirectPort, "http-redirect-port", cfg.Listen.HTTPRedirectPort, "Port redirecting plain HTTP to HTTPS (0 disables it)")
+	fs.IntVar(&cfg.Listen.MetricsPort, "metrics-port", cfg.Listen.MetricsPort, "Port to serve Prometheus metrics on at /metrics (0 disables them)")
+	fs.DurationVar(&cfg.Limits.ShutdownTimeout, "shutdown-timeout", cfg.Limits.ShutdownTimeout, "How long to wait on SIGTERM for uploads, live streams and migrations to finish before cancelling them")
+	fs.Int64Var(&cfg.Limits.MaxUploadMB, "max-upload-mb", cfg.Limits.MaxUploadMB, "Largest accepted upload in MB (0 means unlimited)")
+	fs.IntVar(&cfg.Live.RTMPPort, "rtmp-port", cfg.Live.RTMPPort, "First port of the RTMP live ingest range (0 disables live streaming)")
+	fs.IntVar(&cfg.Live.MaxStreams, "max-live-streams", cfg.Live.MaxStreams, "Maximum number of concurrent live streams")
+	fs.StringVar(&cfg.Accounts.RegisterRole, "register-role", cfg.Accounts.RegisterRole, "Role of accounts created on the registration page (viewer, uploader, admin)")
+	fs.BoolVar(&cfg.Accounts.NoRegistration, "no-registration", cfg.Accounts.NoRegistration, "Close the registration page")
+	fs.StringVar(&cfg.OIDC.Issuer, "oidc-issuer", cfg.OIDC.Issuer, "OpenID Connect issuer URL for single sign-on (empty disables it)")
+	fs.StringVar(&cfg.OIDC.ClientID, "oidc-client-id", cfg.OIDC.ClientID, "OpenID Connect client ID")
+	fs.StringVar(&cfg.OIDC.ClientSecret, "oidc-client-secret", cfg.OIDC.ClientSecret, "OpenID Connect client secret (default $OIDC_CLIENT_SECRET)")
+	fs.StringVar(&cfg.OIDC.RedirectURL, "oidc-redirect-url", cfg.OIDC.RedirectURL, "URL of /login/oidc/callback as the browser reaches it")
+	fs.StringVar(&cfg.OIDC.Name, "oidc-name", cfg.OIDC.Name, "Name of the identity provider shown on the login page")
+	fs.Var(&cfg.OIDC.Scopes, "oidc-scopes", "Comma-separated scopes to request besides openid, profile and email")
+	fs.StringVar(&cfg.OIDC.UsernameClaim, "oidc-username-claim", cfg.OIDC.UsernameClaim, "ID token claim used as the local username")
+	fs.StringVar(&cfg.OIDC.RolesClaim, "oidc-roles-claim", cfg.OIDC.RolesClaim, "ID token claim listing the user's groups or roles")
+	fs.Var(&cfg.OIDC.RoleMap, "oidc-role-map", "Comma-separated group=role pairs (roles: viewer, uploader, admin)")
+	fs.StringVar(&cfg.OIDC.DefaultRole, "oidc-default-role", cfg.OIDC.DefaultRole, "Role of single sign-on users no group maps to")
+	fs.BoolVar(&cfg.OIDC.Only, "oidc-only", cfg.OIDC.Only, "Disable local password logins and registration")
+	fs.StringVar(&cfg.AdminTokens, "admin-tokens", cfg.AdminTokens, "File of bearer tokens for the admin gRPC service (admin calls are refused without it)")
+	fs.StringVar(&cfg.AdminTLS.Cert, "admin-tls-cert", cfg.AdminTLS.Cert, "Certificate file for the admin gRPC service (default the HTTPS certificate)")
+	fs.StringVar(&cfg.AdminTLS.Key, "admin-tls-key", cfg.AdminTLS.Key, "Private key file for the admin gRPC service")
+	fs.BoolVar(&cfg.AdminInsecure, "admin-insecure", cfg.AdminInsecure, "Serve the admin gRPC service in plaintext if it has no certificate, sending admin tokens in the clear")
+	fs.StringVar(&cfg.Content.TLS.Cert, "storage-tls-cert", cfg.Content.TLS.Cert, "Client certificate presented to storage nodes (empty dials them in plaintext)")
+	fs.StringVar(&cfg.Content.TLS.Key, "storage-tls-key", cfg.Content.TLS.Key, "Private key of the storage client certificate")
+	fs.StringVar(&cfg.Content.TLS.CA, "storage-tls-ca", cfg.Content.TLS.CA, "CA bundle storage node certificates must be signed by (default system roots)")
+	fs.Int64Var(&cfg.Content.Cache.MemoryMB, "cache-mb", cfg.Content.Cache.MemoryMB, "Memory in MB for caching files read from storage nodes (0 disables the cache)")
+	fs.StringVar(&cfg.Content.Cache.Dir, "cache-dir", cfg.Content.Cache.Dir, "Directory for a second, on-disk cache tier (empty disables it)")
+	fs.Int64Var(&cfg.Content.Cache.DiskMB, "cache-disk-mb", cfg.Content.Cache.DiskMB, "Size in MB of the on-disk cache tier")
+	fs.DurationVar(&cfg.Content.Read.Timeout, "storage-read-timeout", cfg.Content.Read.Timeout, "How long each attempt to read a file from a storage node may take")
+	fs.IntVar(&cfg.Content.Read.Attempts, "storage-read-attempts", cfg.Content.Read.Attempts, "How many times a read failing with a transient error is tried")
+	fs.Float64Var(&cfg.Content.Read.HedgePercentile, "hedge-percentile", cfg.Content.Read.HedgePercentile, "Percentile of recent read latencies after which a read is also sent to the next node placement names for the file (0 disables hedging)")
+	fs.Float64Var(&cfg.Content.Breaker.ErrorRate, "breaker-error-rate", cfg.Content.Breaker.ErrorRate, "Fraction of a storage node's recent calls failing that opens its circuit breaker")
+	fs.DurationVar(&cfg.Content.Breaker.OpenFor, "breaker-open-for", cfg.Content.Breaker.OpenFor, "How long an open circuit breaker fails calls before probing its storage node")
+	fs.StringVar(&cfg.Content.Placement.Strategy, "placement", cfg.Content.Placement.Strategy, "How files are spread over storage nodes (ring, rendezvous, bounded-load, jump)")
+	fs.StringVar(&cfg.Tracing.Exporter, "tracing-exporter", cfg.Tracing.Exporter, "Where to send trace spans (none, stdout, otlp)")
+	fs.StringVar(&cfg.Tracing.Endpoint, "tracing-endpoint", cfg.Tracing.Endpoint, "host:port of the OTLP collector")
+	fs.StringVar(&cfg.Log.Level, "log-level", cfg.Log.Level, "Lowest level logged (debug, info, warn, error; debug includes ffmpeg's output)")
+	fs.StringVar(&cfg.Log.Format, "log-format", cfg.Log.Format, "Log format (text, json)")
+	fs.StringVar(&cfg.URLSigningKey, "url-signing-key", cfg.URLSigningKey, "Secret for signed links to private videos (default $URL_SIGNING_KEY, random if unset)")
+}
 
-	// Set custom usage message
+// loadConfig combines the defaults, the -config file, the environment, the
+// flags and the positional arguments, in increasing order of precedence
+func loadConfig() (config.Web, error) {
+	configPath := flag.String("config", "", "YAML configuration file")
+	parsed := config.DefaultWeb()
+	bindFlags(flag.CommandLine, &parsed)
 	flag.Usage = printUsage
-
-	// Parse flags
 	flag.Parse()
 
-	// Check if the correct number of positional arguments is provided
-	if len(flag.Args()) != 4 {
-		fmt.Println("Error: Incorrect number of arguments")
-		printUsage()
-		return
+	cfg, err := config.LoadWeb(*configPath)
+	if err != nil {
+		return cfg, err
+	}
+	loaded := flag.NewFlagSet("config", flag.ContinueOnError)
+	bindFlags(loaded, &cfg)
+	if err := config.ApplyFlags(flag.CommandLine, loaded); err != nil {
+		return cfg, err
+	}
+
+	switch flag.NArg() {
+	case 0:
+		if *configPath == "" && cfg.Content.Type == "" {
+			return cfg, fmt.Errorf("give either -config or the four positional arguments")
+		}
+	case 4:
+		cfg.Metadata.Type = flag.Arg(0)
+		cfg.Metadata.Path = flag.Arg(1)
+		cfg.Content.SetOptions(flag.Arg(2), flag.Arg(3))
+	default:
+		return cfg, fmt.Errorf("incorrect number of arguments")
+	}
+
+	// Older deployments set these secrets without the prefix
+	if cfg.OIDC.ClientSecret == "" {
+		cfg.OIDC.ClientSecret = os.Getenv("OIDC_CLIENT_SECRET")
+	}
+	if cfg.URLSigningKey == "" {
+		cfg.URLSigningKey = os.Getenv("URL_SIGNING_KEY")
 	}
+	return cfg, cfg.Validate()
+}
 
-	// Parse positional arguments
-	metadataServiceType := flag.Arg(0)
-	metadataServiceOptions := flag.Arg(1)
-	contentServiceType := flag.Arg(2)
-	contentServiceOptions := flag.Arg(3)
+func main() {
+	cfg, err := loadConfig()
+	if err != nil {
+		fmt.Println("Error:", err)
+		fmt.Println("Run with -h for usage")
+		os.Exit(2)
+	}
+	if err := logging.Setup(os.Stderr, logging.Config{Level: cfg.Log.Level, Format: cfg.Log.Format}); err != nil {
+		fmt.Println("Error:", err)
+		os.Exit(2)
+	}
 
-	// Validate port number (already an int from flag, check if positive)
-	if *port <= 0 {
-		fmt.Println("Error: Invalid port number:", *port)
-		printUsage()
+	shutdownTracing, err := tracing.Setup("tritontube-web", tracing.Config{
+		Exporter:    cfg.Tracing.Exporter,
+		Endpoint:    cfg.Tracing.Endpoint,
+		Insecure:    cfg.Tracing.Insecure,
+		File:        cfg.Tracing.File,
+		SampleRatio: cfg.Tracing.SampleRatio,
+	})
+	if err != nil {
+		slog.Error("Failed to set up tracing", "error", err)
 		return
 	}
+	// Runs after the server has stopped, so the spans of the last requests
+	// are sent too
+	defer shutdownTracing(context.Background())
 
 	// Construct metadata service
 	var metadataService web.VideoMetadataService
-	fmt.Println("Creating metadata service of type", metadataServiceType, "with options", metadataServiceOptions)
-	switch metadataServiceType {
+	slog.Info("Creating metadata service", "type", cfg.Metadata.Type, "options", cfg.Metadata.Path)
+	switch cfg.Metadata.Type {
 	case "sqlite":
 		var err error
-		metadataService, err = web.NewSQLiteVideoMetadataService(metadataServiceOptions)
+		metadataService, err = web.NewSQLiteVideoMetadataService(cfg.Metadata.Path)
 		if err != nil {
-			fmt.Println("Error creating SQLite metadata service:", err)
+			slog.Error("Failed to create SQLite metadata service", "error", err)
 			return
 		}
 	default:
-		fmt.Println("Error: Unsupported metadata service type:", metadataServiceType)
+		slog.Error("Unsupported metadata service type", "type", cfg.Metadata.Type)
 		return
 	}
 
+	// Close the database once the server has stopped
+	if closer, ok := metadataService.(io.Closer); ok {
+		defer closer.Close()
+	}
+
 	// Construct content service
 	var contentService web.VideoContentService
-	fmt.Println("Creating content service of type", contentServiceType, "with options", contentServiceOptions)
-	switch contentServiceType {
+	contentServiceOptions := cfg.Content.Options()
+	slog.Info("Creating content service", "type", cfg.Content.Type, "options", contentServiceOptions)
+	switch cfg.Content.Type {
 	case "fs":
 		var err error
 		contentService, err = web.NewFSVideoContentService(contentServiceOptions)
 		if err != nil {
-			fmt.Println("Error creating filesystem content service:", err)
+			slog.Error("Failed to create filesystem content service", "error", err)
 			return
 		}
 	case "nw":
 		var err error
-		contentService, err = web.NewNetworkVideoContentService(contentServiceOptions)
+		var creds credentials.TransportCredentials = insecure.NewCredentials()
+		if cfg.Content.TLS.Enabled() {
+			reloader, err := tlsutil.NewReloader(cfg.Content.TLS.Cert, cfg.Content.TLS.Key, cfg.Content.TLS.CA)
+			if err != nil {
+				slog.Error("Failed to load storage TLS certificate", "error", err)
+				return
+			}
+			reloader.ReloadOnSIGHUP()
+			creds = credentials.NewTLS(reloader.ClientConfig())
+		}
+		nwService, err := web.NewNetworkVideoContentServiceWithCredentials(contentServiceOptions, creds)
+		if err != nil {
+			slog.Error("Failed to create network content service", "error", err)
+			return
+		}
+		nwService.SetReadPolicy(web.ReadPolicy{
+			Timeout:         cfg.Content.Read.Timeout,
+			Attempts:        cfg.Content.Read.Attempts,
+			Backoff:         cfg.Content.Read.Backoff,
+			HedgePercentile: cfg.Content.Read.HedgePercentile,
+		})
+		nwService.SetBreakerPolicy(web.BreakerPolicy{
+			Window:    cfg.Content.Breaker.Window,
+			MinCalls:  cfg.Content.Breaker.MinCalls,
+			ErrorRate: cfg.Content.Breaker.ErrorRate,
+			SlowCall:  cfg.Content.Breaker.SlowCall,
+			SlowRate:  cfg.Content.Breaker.SlowRate,
+			OpenFor:   cfg.Content.Breaker.OpenFor,
+		})
+		err = nwService.SetPlacementPolicy(web.PlacementPolicy{
+			Strategy:   cfg.Content.Placement.Strategy,
+			LoadFactor: cfg.Content.Placement.LoadFactor,
+		})
 		if err != nil {
-			fmt.Println("Error creating network content service:", err)
+			slog.Error("Failed to set placement strategy", "error", err)
 			return
 		}
+		if cache := cfg.Content.Cache; cache.MemoryMB > 0 {
+			contentCache, err := web.NewContentCache(cache.MemoryMB<<20, cache.Dir, cache.DiskMB<<20)
+			if err != nil {
+				slog.Error("Failed to create content cache", "error", err)
+				return
+			}
+			nwService.SetCache(contentCache)
+		}
+		contentService = nwService
 	default:
-		fmt.Println("Error: Unsupported content service type:", contentServiceType)
+		slog.Error("Unsupported content service type", "type", cfg.Content.Type)
 		return
 	}
 
 	// Start the server
 	server := web.NewServer(metadataService, contentService)
-	listenAddr := fmt.Sprintf("%s:%d", *host, *port)
+	server.SetTranscodeProfile(web.TranscodeProfile{
+		VideoCodec:       cfg.Transcoding.VideoCodec,
+		AudioCodec:       cfg.Transcoding.AudioCodec,
+		VideoBitrate:     cfg.Transcoding.VideoBitrate,
+		AudioBitrate:     cfg.Transcoding.AudioBitrate,
+		KeyframeInterval: cfg.Transcoding.KeyframeInterval,
+		SegmentDuration:  cfg.Transcoding.SegmentDuration,
+	})
+	server.SetMaxUploadSize(cfg.Limits.MaxUploadMB << 20)
+	if users, ok := metadataService.(web.UserService); ok {
+		// Accounts are stored with the metadata, so every backend that can
+		// store them requires a login to upload
+		server.EnableAccounts(users)
+		role := web.Role(cfg.Accounts.RegisterRole)
+		if cfg.Accounts.NoRegistration {
+			role = ""
+		}
+		if err := server.SetRegistration(role); err != nil {
+			slog.Error("Failed to set up registration", "error", err)
+			return
+		}
+	}
+	if cfg.AdminTokens != "" {
+		auth, err := web.LoadAdminTokens(cfg.AdminTokens)
+		if err != nil {
+			slog.Error("Failed to load admin tokens", "error", err)
+			return
+		}
+		server.SetAdminAuth(auth)
+	} else if _, ok := contentService.(*web.NetworkVideoContentService); ok {
+		slog.Warn("No admin tokens given; the admin service refuses every call")
+	}
+	if cfg.URLSigningKey != "" {
+		server.SetURLSigningKey([]byte(cfg.URLSigningKey))
+	} else {
+		slog.Warn("No URL signing key set; links to private videos stop working on restart")
+	}
+	if cfg.OIDC.Issuer != "" {
+		roleMap := make(map[string]web.Role, len(cfg.OIDC.RoleMap))
+		for name, role := range cfg.OIDC.RoleMap {
+			roleMap[name] = web.Role(role)
+		}
+		err = server.EnableOIDC(context.Background(), web.OIDCConfig{
+			IssuerURL:            cfg.OIDC.Issuer,
+			ClientID:             cfg.OIDC.ClientID,
+			ClientSecret:         cfg.OIDC.ClientSecret,
+			RedirectURL:          cfg.OIDC.RedirectURL,
+			ProviderName:         cfg.OIDC.Name,
+			Scopes:               cfg.OIDC.Scopes,
+			UsernameClaim:        cfg.OIDC.UsernameClaim,
+			RolesClaim:           cfg.OIDC.RolesClaim,
+			RoleMap:              roleMap,
+			DefaultRole:          web.Role(cfg.OIDC.DefaultRole),
+			DisablePasswordLogin: cfg.OIDC.Only,
+		})
+		if err != nil {
+			slog.Error("Failed to enable single sign-on", "error", err)
+			return
+		}
+		slog.Info("Single sign-on enabled", "issuer", cfg.OIDC.Issuer)
+	}
+	if cfg.Live.RTMPPort > 0 {
+		slog.Info("Accepting live streams", "first_rtmp_port", cfg.Live.RTMPPort, "last_rtmp_port", cfg.Live.RTMPPort+cfg.Live.MaxStreams-1)
+		server.EnableLiveIngest(cfg.Listen.Host, cfg.Live.RTMPPort, cfg.Live.MaxStreams)
+	}
+	scheme := "http"
+	var httpsReloader *tlsutil.Reloader
+	if cfg.TLS.Enabled() {
+		httpsReloader, err = tlsutil.NewReloader(cfg.TLS.Cert, cfg.TLS.Key, "")
+		if err != nil {
+			slog.Error("Failed to load TLS certificate", "error", err)
+			return
+		}
+		httpsReloader.ReloadOnSIGHUP()
+		server.EnableTLS(httpsReloader.ServerConfig())
+		scheme = "https"
+	}
+	if _, ok := contentService.(*web.NetworkVideoContentService); ok {
+		// Admin tokens must not cross the network in the clear
+		switch {
+		case cfg.AdminTLS.Enabled():
+			reloader, err := tlsutil.NewReloader(cfg.AdminTLS.Cert, cfg.AdminTLS.Key, "")
+			if err != nil {
+				slog.Error("Failed to load admin TLS certificate", "error", err)
+				return
+			}
+			reloader.ReloadOnSIGHUP()
+			server.EnableAdminTLS(reloader.ServerConfig())
+		case httpsReloader != nil:
+			server.EnableAdminTLS(httpsReloader.ServerConfig())
+		default:
+			slog.Warn("Serving the admin service in plaintext; admin tokens are sent in the clear")
+		}
+	}
+	if cfg.Listen.MetricsPort != 0 {
+		go metrics.Serve(fmt.Sprintf("%s:%d", cfg.Listen.Host, cfg.Listen.MetricsPort))
+	}
+	var redirectServer *http.Server
+	if cfg.Listen.HTTPRedirectPort > 0 {
+		redirectAddr := fmt.Sprintf("%s:%d", cfg.Listen.Host, cfg.Listen.HTTPRedirectPort)
+		redirectLis, err := net.Listen("tcp", redirectAddr)
+		if err != nil {
+			slog.Error("Failed to start redirect listener", "error", err)
+			return
+		}
+		slog.Info("Redirecting HTTP to HTTPS", "addr", redirectAddr)
+		redirectServer = &http.Server{Handler: web.HTTPSRedirectHandler(cfg.Listen.Port)}
+		go func() {
+			if err := redirectServer.Serve(redirectLis); err != nil && err != http.ErrServerClosed {
+				slog.Error("Failed to serve HTTP redirects", "error", err)
+			}
+		}()
+	}
+
+	listenAddr := fmt.Sprintf("%s:%d", cfg.Listen.Host, cfg.Listen.Port)
 	lis, err := net.Listen("tcp", listenAddr)
 	if err != nil {
-		fmt.Println("Error starting listener:", err)
+		slog.Error("Failed to start listener", "error", err)
 		return
 	}
 	defer lis.Close()
 
-	fmt.Println("Starting web server on", listenAddr)
-	err = server.Start(lis)
-	if err != nil {
-		fmt.Println("Error starting server:", err)
+	// Stop gracefully on SIGTERM or Ctrl+C; a second signal exits at once
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+
+	slog.Info("Starting web server", "url", scheme+"://"+listenAddr)
+	serveErr := make(chan error, 1)
+	go func() { serveErr <- server.Start(lis) }()
+	select {
+	case err := <-serveErr:
+		slog.Error("Failed to start server", "error", err)
 		return
+	case <-ctx.Done():
+	}
+	stop()
+
+	slog.Info("Shutting down, waiting for uploads, live streams and migrations", "timeout", cfg.Limits.ShutdownTimeout)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.Limits.ShutdownTimeout)
+	defer cancel()
+	if redirectServer != nil {
+		redirectServer.Shutdown(shutdownCtx)
+	}
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		slog.Warn("Shutdown incomplete", "error", err)
 	}
+	slog.Info("Server stopped")
 }
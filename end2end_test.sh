@@ -32,7 +32,12 @@ sleep 2  # Give more time for storage nodes to start
 
 echo ""
 echo "🌐 Step 2: Starting web server (admin on 8081, using nodes 8090–8092)..."
-go run cmd/web/main.go sqlite ./tmp/metadata.db nw localhost:8081,localhost:8090,localhost:8091,localhost:8092 >> tmp/test.log 2>&1 &
+# Admin calls need a bearer token with the operator role
+export TRITONTUBE_ADMIN_TOKEN=$(head -c 24 /dev/urandom | od -An -tx1 | tr -d ' \n')
+echo "operator $TRITONTUBE_ADMIN_TOKEN end2end-test" > tmp/admin-tokens
+# Everything runs on localhost, so the admin service goes without TLS
+export TRITONTUBE_ADMIN_INSECURE=true
+go run cmd/web/main.go -admin-insecure -admin-tokens tmp/admin-tokens sqlite ./tmp/metadata.db nw localhost:8081,localhost:8090,localhost:8091,localhost:8092 >> tmp/test.log 2>&1 &
 sleep 2  # Give more time for web server to start
 
 echo
@@ -108,7 +113,7 @@ done
 sleep 2  # Give more time for storage nodes to start
 
 echo "> Rebooting web server on port 8080..."
-go run cmd/web/main.go sqlite ./tmp/metadata.db nw localhost:8081,localhost:8090,localhost:8091,localhost:8092 >> tmp/test.log 2>&1 &
+go run cmd/web/main.go -admin-insecure sqlite ./tmp/metadata.db nw localhost:8081,localhost:8090,localhost:8091,localhost:8092 >> tmp/test.log 2>&1 &
 sleep 2  # Give more time for web server to start
 
 echo
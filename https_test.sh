@@ -0,0 +1,146 @@
+#!/bin/bash
+
+# HTTPS test: serves the web interface with a self-signed certificate and
+# checks the handshake, HTTP/2, the HTTP to HTTPS redirect, and that renewed
+# certificates are picked up on file change and on SIGHUP while the server
+# keeps running.
+set -e
+rm -rf tmp  # comment out this line if you want to keep the data from ./tmp during testing
+
+# Ctrl+C or exit
+cleanup() {
+    echo "🧹 Cleaning up background processes..."
+    ps aux | grep go-build | awk '{print $2}' | xargs kill 2>/dev/null || true
+    echo "😉 Cleanup complete."
+}
+trap cleanup EXIT
+
+mkdir -p tmp/videos tmp/certs
+> tmp/test.log
+certs=tmp/certs
+failed=0
+
+pass() { echo "✅ PASS: $1"; }
+fail() { echo "❌ FAIL: $1"; failed=1; }
+
+# new_cert writes a fresh self-signed certificate for localhost
+new_cert() {
+    openssl req -x509 -newkey rsa:2048 -nodes -days 1 -subj "/CN=localhost" \
+        -addext "subjectAltName=DNS:localhost,IP:127.0.0.1" \
+        -keyout $certs/web.key -out $certs/web.crt 2>/dev/null
+}
+
+serial() {
+    openssl s_client -connect localhost:8443 -servername localhost </dev/null 2>/dev/null |
+        openssl x509 -noout -serial
+}
+
+echo "📜 Step 1: Generating a self-signed certificate..."
+new_cert
+cp $certs/web.crt $certs/first.crt
+
+echo
+echo "🌐 Step 2: Starting web server with HTTPS on 8443, redirecting HTTP on 8080..."
+go run cmd/web/main.go -port 8443 -http-redirect-port 8080 \
+    -tls-cert $certs/web.crt -tls-key $certs/web.key \
+    sqlite ./tmp/metadata.db fs ./tmp/videos >> tmp/test.log 2>&1 &
+sleep 4
+
+echo
+echo "🔐 Step 3: Checking the handshake..."
+version=$(curl -s --cacert $certs/first.crt -o /dev/null -w '%{http_version}' https://localhost:8443/)
+if [ "$version" = "2" ]; then
+    pass "index served over HTTPS with HTTP/2"
+elif [ -n "$version" ] && [ "$version" != "0" ]; then
+    fail "index served over HTTP/$version instead of HTTP/2"
+else
+    fail "HTTPS handshake failed"
+fi
+if curl -s -o /dev/null https://localhost:8443/ 2>/dev/null; then
+    fail "certificate is trusted without the self-signed CA"
+else
+    pass "certificate is not trusted without the self-signed CA"
+fi
+if [ "$(curl -s -o /dev/null -w '%{http_code}' http://localhost:8443/)" = "200" ]; then
+    fail "plain HTTP is served on the HTTPS port"
+else
+    pass "plain HTTP is not served on the HTTPS port"
+fi
+
+echo
+echo "↪️  Step 4: Checking the HTTP to HTTPS redirect..."
+redirect=$(curl -s -o /dev/null -w '%{http_code} %{redirect_url}' 'http://localhost:8080/videos/x?a=1')
+if [ "$redirect" = "301 https://localhost:8443/videos/x?a=1" ]; then
+    pass "GET is redirected permanently to HTTPS"
+else
+    fail "GET redirect is '$redirect'"
+fi
+redirect=$(curl -s -o /dev/null -w '%{http_code}' -X POST http://localhost:8080/login)
+if [ "$redirect" = "308" ]; then
+    pass "POST is redirected with 308, keeping the method"
+else
+    fail "POST redirect status is $redirect"
+fi
+
+echo
+echo "🔄 Step 5: Renewing the certificate while a connection stays open..."
+# This connection is opened before the renewal and sends its request after it
+(sleep 4; printf 'GET / HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n'; sleep 1) |
+    openssl s_client -quiet -connect localhost:8443 -servername localhost -alpn http/1.1 \
+    > tmp/old-connection.txt 2>/dev/null &
+old=$!
+before=$(serial)
+sleep 1  # make sure the rewritten files get a new modification time
+new_cert
+cp $certs/web.crt $certs/second.crt
+sleep 2  # the server checks for changed files at most once a second
+after=$(serial)
+if [ -n "$after" ] && [ "$before" != "$after" ]; then
+    pass "renewed certificate is served after a file change ($before → $after)"
+else
+    fail "renewed certificate is not served after a file change ($before → $after)"
+fi
+if curl -s --cacert $certs/second.crt -o /dev/null https://localhost:8443/; then
+    pass "handshake succeeds with the renewed certificate"
+else
+    fail "handshake fails with the renewed certificate"
+fi
+wait $old || true
+if head -1 tmp/old-connection.txt | grep -q '200 OK'; then
+    pass "connection opened before the renewal keeps working"
+else
+    fail "connection opened before the renewal was dropped"
+fi
+
+echo
+echo "📡 Step 6: Renewing the certificate and sending SIGHUP..."
+# Give the new files the old modification times so only SIGHUP can trigger
+# the reload
+cp -p $certs/web.crt $certs/web.crt.old
+cp -p $certs/web.key $certs/web.key.old
+new_cert
+touch -r $certs/web.crt.old $certs/web.crt
+touch -r $certs/web.key.old $certs/web.key
+before=$(serial)
+sleep 2
+if [ "$(serial)" = "$before" ]; then
+    pass "unchanged modification times do not trigger a reload"
+else
+    fail "certificate was reloaded without a change in modification time"
+fi
+pkill -HUP -f 'go-build.*/main( |$)' || true
+sleep 1
+after=$(serial)
+if [ -n "$after" ] && [ "$before" != "$after" ]; then
+    pass "renewed certificate is served after SIGHUP ($before → $after)"
+else
+    fail "renewed certificate is not served after SIGHUP ($before → $after)"
+fi
+
+echo
+if [ $failed -eq 0 ]; then
+    echo "🎉 All HTTPS checks passed"
+else
+    echo "💥 Some HTTPS checks failed, see tmp/test.log"
+    exit 1
+fi
@@ -0,0 +1,62 @@
+package config
+
+import (
+	"os"
+	"time"
+)
+
+// AdminEnvPrefix starts the environment variables of cmd/admin settings
+const AdminEnvPrefix = "TRITONTUBE_ADMIN"
+
+// Admin configures cmd/admin
+type Admin struct {
+	// Server is the web server's admin gRPC address
+	Server string `yaml:"server"`
+	// Token is the bearer token; TokenFile is read instead if it is set
+	Token     string        `yaml:"token"`
+	TokenFile string        `yaml:"token_file"`
+	Timeout   time.Duration `yaml:"timeout"`
+	// TLSCA is the CA bundle the server's certificate must be signed by,
+	// the system roots if empty; Insecure dials the server in plaintext
+	TLSCA    string `yaml:"tls_ca"`
+	Insecure bool   `yaml:"insecure"`
+	Log      Log    `yaml:"log"`
+}
+
+// DefaultAdmin returns the settings cmd/admin uses when nothing else is given
+func DefaultAdmin() Admin {
+	return Admin{Timeout: 30 * time.Second, Log: DefaultLog()}
+}
+
+// LoadAdmin returns the defaults overridden by the file at path (if not
+// empty) and by TRITONTUBE_ADMIN_* environment variables, such as
+// TRITONTUBE_ADMIN_TOKEN
+func LoadAdmin(path string) (Admin, error) {
+	cfg := DefaultAdmin()
+	err := load(&cfg, path, AdminEnvPrefix)
+	return cfg, err
+}
+
+// Validate reports every problem with the settings at once
+func (c *Admin) Validate() error {
+	var p problems
+	if c.Server == "" {
+		p.addf("server is required")
+	}
+	if c.Token == "" && c.TokenFile == "" {
+		p.addf("token or token_file is required")
+	}
+	if c.Timeout <= 0 {
+		p.addf("timeout must be positive")
+	}
+	if c.Insecure && c.TLSCA != "" {
+		p.addf("tls_ca cannot be used with insecure")
+	}
+	if c.TLSCA != "" {
+		if _, err := os.Stat(c.TLSCA); err != nil {
+			p.addf("tls_ca: %v", err)
+		}
+	}
+	p.checkLog("log", c.Log)
+	return p.err()
+}
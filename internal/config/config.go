@@ -0,0 +1,283 @@
+// Package config loads the configuration files of the TritonTube commands.
+//
+// A setting is taken from, in increasing order of precedence: the built-in
+// default, the YAML file given with -config, an environment variable, and a
+// command line flag. The environment variable of a setting is the command's
+// prefix followed by the setting's path in the file, upper-cased and joined
+// with underscores; e.g. content.nodes of cmd/web is
+// TRITONTUBE_WEB_CONTENT_NODES. Lists are written comma-separated and maps
+// as comma-separated key=value pairs.
+package config
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// StringList is a list setting. As a flag or environment variable it is
+// written comma-separated.
+type StringList []string
+
+func (l *StringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *StringList) Set(value string) error {
+	*l = nil
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			*l = append(*l, item)
+		}
+	}
+	return nil
+}
+
+// StringMap is a map setting. As a flag or environment variable it is
+// written as comma-separated key=value pairs.
+type StringMap map[string]string
+
+func (m *StringMap) String() string {
+	pairs := make([]string, 0, len(*m))
+	for key, value := range *m {
+		pairs = append(pairs, key+"="+value)
+	}
+	return strings.Join(pairs, ",")
+}
+
+func (m *StringMap) Set(value string) error {
+	*m = make(StringMap)
+	for _, pair := range strings.Split(value, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		key, value, ok := strings.Cut(pair, "=")
+		if !ok || strings.TrimSpace(key) == "" {
+			return fmt.Errorf("invalid pair %q, want key=value", pair)
+		}
+		(*m)[strings.TrimSpace(key)] = strings.TrimSpace(value)
+	}
+	return nil
+}
+
+// load fills cfg, which already holds the defaults, from the file at path
+// (if not empty) and then from the environment variables starting with
+// envPrefix
+func load(cfg interface{}, path string, envPrefix string) error {
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("failed to read config file: %v", err)
+		}
+		decoder := yaml.NewDecoder(bytes.NewReader(data))
+		// A misspelled setting would otherwise be silently ignored
+		decoder.KnownFields(true)
+		if err := decoder.Decode(cfg); err != nil && !errors.Is(err, io.EOF) {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+	}
+	return applyEnv(reflect.ValueOf(cfg).Elem(), envPrefix)
+}
+
+// applyEnv overrides the settings in v that have an environment variable set
+func applyEnv(v reflect.Value, prefix string) error {
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Type().Field(i)
+		name, _, _ := strings.Cut(field.Tag.Get("yaml"), ",")
+		if name == "" || name == "-" {
+			continue
+		}
+		envName := prefix + "_" + strings.ToUpper(name)
+		value := v.Field(i)
+
+		if value.Kind() == reflect.Struct {
+			if err := applyEnv(value, envName); err != nil {
+				return err
+			}
+			continue
+		}
+		raw, ok := os.LookupEnv(envName)
+		if !ok {
+			continue
+		}
+		if err := setValue(value, raw); err != nil {
+			return fmt.Errorf("invalid %s=%q: %v", envName, raw, err)
+		}
+	}
+	return nil
+}
+
+func setValue(value reflect.Value, raw string) error {
+	if setter, ok := value.Addr().Interface().(flag.Value); ok {
+		return setter.Set(raw)
+	}
+	if value.Type() == reflect.TypeOf(time.Duration(0)) {
+		d, err := time.ParseDuration(raw)
+		if err != nil {
+			return err
+		}
+		value.SetInt(int64(d))
+		return nil
+	}
+	switch value.Kind() {
+	case reflect.String:
+		value.SetString(raw)
+	case reflect.Int, reflect.Int64:
+		n, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil {
+			return err
+		}
+		value.SetInt(n)
+	case reflect.Float64:
+		f, err := strconv.ParseFloat(raw, 64)
+		if err != nil {
+			return err
+		}
+		value.SetFloat(f)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(raw)
+		if err != nil {
+			return err
+		}
+		value.SetBool(b)
+	default:
+		return fmt.Errorf("unsupported setting type %s", value.Type())
+	}
+	return nil
+}
+
+// ApplyFlags copies the flags set on the command line in parsed to the same
+// flags in fresh, which are bound to the loaded configuration, so they take
+// precedence over the file and the environment. Flags missing from fresh,
+// like -config itself, are skipped.
+func ApplyFlags(parsed *flag.FlagSet, fresh *flag.FlagSet) error {
+	var err error
+	parsed.Visit(func(f *flag.Flag) {
+		if err == nil && fresh.Lookup(f.Name) != nil {
+			err = fresh.Set(f.Name, f.Value.String())
+		}
+	})
+	return err
+}
+
+// problems collects validation errors so they can all be reported at once
+type problems []string
+
+func (p *problems) addf(format string, args ...interface{}) {
+	*p = append(*p, fmt.Sprintf(format, args...))
+}
+
+func (p problems) err() error {
+	if len(p) == 0 {
+		return nil
+	}
+	return fmt.Errorf("invalid configuration:\n  %s", strings.Join(p, "\n  "))
+}
+
+func (p *problems) checkPort(name string, port int, optional bool) {
+	if optional && port == 0 {
+		return
+	}
+	if port < 1 || port > 65535 {
+		p.addf("%s: %d is not a valid port", name, port)
+	}
+}
+
+// TLSFiles names a certificate, its key, and a CA bundle peers are checked
+// against
+type TLSFiles struct {
+	Cert string `yaml:"cert"`
+	Key  string `yaml:"key"`
+	CA   string `yaml:"ca"`
+}
+
+// Enabled reports whether a certificate is configured
+func (t TLSFiles) Enabled() bool {
+	return t.Cert != "" || t.Key != ""
+}
+
+func (p *problems) checkTLS(name string, t TLSFiles) {
+	if (t.Cert == "") != (t.Key == "") {
+		p.addf("%s: cert and key must be given together", name)
+	}
+	if t.CA != "" && t.Cert == "" {
+		p.addf("%s.ca needs cert and key", name)
+	}
+	for _, file := range []string{t.Cert, t.Key, t.CA} {
+		if file == "" {
+			continue
+		}
+		if _, err := os.Stat(file); err != nil {
+			p.addf("%s: %v", name, err)
+		}
+	}
+}
+
+// Tracing selects where OpenTelemetry spans are sent
+type Tracing struct {
+	// Exporter is none, stdout or otlp
+	Exporter string `yaml:"exporter"`
+	// Endpoint is the host:port of the OTLP collector
+	Endpoint string `yaml:"endpoint"`
+	// Insecure sends spans to the collector without TLS
+	Insecure bool `yaml:"insecure"`
+	// File receives the spans of the stdout exporter instead of stdout
+	File string `yaml:"file"`
+	// SampleRatio is the fraction of new traces that are recorded
+	SampleRatio float64 `yaml:"sample_ratio"`
+}
+
+// DefaultTracing records nothing until an exporter is chosen
+func DefaultTracing() Tracing {
+	return Tracing{Exporter: "none", Endpoint: "localhost:4317", SampleRatio: 1}
+}
+
+func (p *problems) checkTracing(name string, t Tracing) {
+	switch t.Exporter {
+	case "none", "stdout":
+	case "otlp":
+		if t.Endpoint == "" {
+			p.addf("%s.endpoint is required for the otlp exporter", name)
+		}
+	default:
+		p.addf("%s.exporter: unsupported exporter %q (none, stdout, otlp)", name, t.Exporter)
+	}
+	if t.SampleRatio < 0 || t.SampleRatio > 1 {
+		p.addf("%s.sample_ratio must be between 0 and 1", name)
+	}
+}
+
+// Log selects how a command logs
+type Log struct {
+	// Level is debug, info, warn or error
+	Level string `yaml:"level"`
+	// Format is text or json
+	Format string `yaml:"format"`
+}
+
+// DefaultLog logs at info level as text
+func DefaultLog() Log {
+	return Log{Level: "info", Format: "text"}
+}
+
+func (p *problems) checkLog(name string, l Log) {
+	switch strings.ToLower(l.Level) {
+	case "debug", "info", "warn", "error":
+	default:
+		p.addf("%s.level: unsupported level %q (debug, info, warn, error)", name, l.Level)
+	}
+	switch l.Format {
+	case "text", "json":
+	default:
+		p.addf("%s.format: unsupported format %q (text, json)", name, l.Format)
+	}
+}
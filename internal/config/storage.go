@@ -0,0 +1,73 @@
+package config
+
+import "time"
+
+// StorageEnvPrefix starts the environment variables of cmd/storage settings
+const StorageEnvPrefix = "TRITONTUBE_STORAGE"
+
+// Storage configures cmd/storage
+type Storage struct {
+	Host string `yaml:"host"`
+	Port int    `yaml:"port"`
+	// Dir is where the node keeps its files
+	Dir string `yaml:"dir"`
+	// TLS is the node's server certificate; with a CA, clients must present
+	// a certificate signed by it
+	TLS             TLSFiles      `yaml:"tls"`
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout"`
+	// PeerTLS is the client certificate the node presents when it copies
+	// files to other nodes during migrations; without it they are dialed in
+	// plaintext
+	PeerTLS TLSFiles `yaml:"peer_tls"`
+	// Peers are the node addresses, as the web server knows them, that the
+	// node copies files to when asked. Without them the node only copies
+	// files if tls.ca makes every caller present a certificate; otherwise
+	// the web server relays migrated files itself.
+	Peers StringList `yaml:"peers"`
+	// MetricsPort serves Prometheus metrics over plain HTTP at /metrics; 0
+	// disables it
+	MetricsPort int     `yaml:"metrics_port"`
+	Tracing     Tracing `yaml:"tracing"`
+	Log         Log     `yaml:"log"`
+}
+
+// DefaultStorage returns the settings cmd/storage uses when nothing else is
+// given
+func DefaultStorage() Storage {
+	return Storage{
+		Host:            "localhost",
+		Port:            8090,
+		ShutdownTimeout: 30 * time.Second,
+		Tracing:         DefaultTracing(),
+		Log:             DefaultLog(),
+	}
+}
+
+// LoadStorage returns the defaults overridden by the file at path (if not
+// empty) and by TRITONTUBE_STORAGE_* environment variables
+func LoadStorage(path string) (Storage, error) {
+	cfg := DefaultStorage()
+	err := load(&cfg, path, StorageEnvPrefix)
+	return cfg, err
+}
+
+// Validate reports every problem with the settings at once
+func (c *Storage) Validate() error {
+	var p problems
+	p.checkPort("port", c.Port, false)
+	if c.Dir == "" {
+		p.addf("dir is required")
+	}
+	p.checkTLS("tls", c.TLS)
+	p.checkTLS("peer_tls", c.PeerTLS)
+	p.checkPort("metrics_port", c.MetricsPort, true)
+	if c.MetricsPort == c.Port {
+		p.addf("metrics_port must differ from port")
+	}
+	if c.ShutdownTimeout <= 0 {
+		p.addf("shutdown_timeout must be positive")
+	}
+	p.checkTracing("tracing", c.Tracing)
+	p.checkLog("log", c.Log)
+	return p.err()
+}
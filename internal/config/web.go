@@ -0,0 +1,427 @@
+package config
+
+import (
+	"regexp"
+	"strings"
+	"time"
+)
+
+// WebEnvPrefix starts the environment variables of cmd/web settings
+const WebEnvPrefix = "TRITONTUBE_WEB"
+
+// Web configures cmd/web. An example file:
+//
+//	listen:
+//	  port: 8080
+//	metadata:
+//	  type: sqlite
+//	  path: ./metadata.db
+//	content:
+//	  type: nw
+//	  admin_addr: localhost:8081
+//	  nodes: [localhost:8090, localhost:8091, localhost:8092]
+//	admin_tokens: ./admin-tokens
+type Web struct {
+	Listen Listen   `yaml:"listen"`
+	TLS    TLSFiles `yaml:"tls"`
+
+	Metadata    Metadata    `yaml:"metadata"`
+	Content     Content     `yaml:"content"`
+	Transcoding Transcoding `yaml:"transcoding"`
+	Live        Live        `yaml:"live"`
+	Limits      Limits      `yaml:"limits"`
+	Accounts    Accounts    `yaml:"accounts"`
+	OIDC        OIDC        `yaml:"oidc"`
+	Tracing     Tracing     `yaml:"tracing"`
+	Log         Log         `yaml:"log"`
+
+	// AdminTokens is the file of bearer tokens for the admin gRPC service
+	AdminTokens string `yaml:"admin_tokens"`
+	// AdminTLS is the certificate the admin gRPC service is served with; the
+	// HTTPS certificate in TLS is used if it is not set
+	AdminTLS TLSFiles `yaml:"admin_tls"`
+	// AdminInsecure serves the admin gRPC service in plaintext when there is
+	// no certificate for it, sending admin tokens in the clear
+	AdminInsecure bool `yaml:"admin_insecure"`
+	// URLSigningKey is the secret signed links to private videos are made with
+	URLSigningKey string `yaml:"url_signing_key"`
+}
+
+// Listen is where the web server accepts connections
+type Listen struct {
+	Host string `yaml:"host"`
+	Port int    `yaml:"port"`
+	// HTTPRedirectPort serves redirects from plain HTTP to HTTPS; 0 disables it
+	HTTPRedirectPort int `yaml:"http_redirect_port"`
+	// MetricsPort serves Prometheus metrics over plain HTTP at /metrics; 0
+	// disables it
+	MetricsPort int `yaml:"metrics_port"`
+}
+
+// Metadata selects the video metadata backend
+type Metadata struct {
+	Type string `yaml:"type"` // sqlite
+	Path string `yaml:"path"` // database file
+}
+
+// Content selects the video content backend
+type Content struct {
+	Type string `yaml:"type"` // fs or nw
+
+	// Dir is the video directory of the fs backend
+	Dir string `yaml:"dir"`
+
+	// AdminAddr is where the nw backend serves the admin gRPC service, and
+	// Nodes are the storage nodes it starts with
+	AdminAddr string     `yaml:"admin_addr"`
+	Nodes     StringList `yaml:"nodes"`
+	// TLS is the client certificate storage nodes are dialed with
+	TLS TLSFiles `yaml:"tls"`
+	// Cache keeps recently read files of the nw backend
+	Cache Cache `yaml:"cache"`
+	// Read bounds and retries the nw backend's reads from storage nodes
+	Read Read `yaml:"read"`
+	// Breaker stops calling storage nodes that keep failing
+	Breaker Breaker `yaml:"breaker"`
+	// Placement picks the storage node each file is stored on
+	Placement Placement `yaml:"placement"`
+}
+
+// Placement selects how files are spread over storage nodes
+type Placement struct {
+	// Strategy is ring, rendezvous, bounded-load or jump
+	Strategy string `yaml:"strategy"`
+	// LoadFactor caps each node's share of the key space under bounded-load,
+	// as a multiple of an even share
+	LoadFactor float64 `yaml:"load_factor"`
+}
+
+// Breaker configures the circuit breaker of each storage node
+type Breaker struct {
+	// Window is how many recent calls to a node are judged, once there are
+	// at least MinCalls of them
+	Window   int `yaml:"window"`
+	MinCalls int `yaml:"min_calls"`
+	// ErrorRate is the fraction of failed calls that opens the breaker
+	ErrorRate float64 `yaml:"error_rate"`
+	// SlowRate is the fraction of calls slower than SlowCall that opens the
+	// breaker; 0 ignores latency
+	SlowCall time.Duration `yaml:"slow_call"`
+	SlowRate float64       `yaml:"slow_rate"`
+	// OpenFor is how long an open breaker fails calls before probing the node
+	OpenFor time.Duration `yaml:"open_for"`
+}
+
+// Read bounds, retries and hedges reads from storage nodes
+type Read struct {
+	// Timeout bounds each attempt
+	Timeout time.Duration `yaml:"timeout"`
+	// Attempts is how often a read failing with a transient error is tried
+	Attempts int `yaml:"attempts"`
+	// Backoff is the base of the jittered wait between attempts
+	Backoff time.Duration `yaml:"backoff"`
+	// HedgePercentile of recent read latencies is how long a read waits
+	// before it is also sent to the next node placement names for the file;
+	// 0 disables hedging
+	HedgePercentile float64 `yaml:"hedge_percentile"`
+}
+
+// Cache bounds the in-memory and on-disk tiers of the content cache
+type Cache struct {
+	// MemoryMB is the size of the memory tier; 0 disables the cache
+	MemoryMB int64 `yaml:"memory_mb"`
+	// Dir holds the disk tier; empty keeps the cache in memory only
+	Dir    string `yaml:"dir"`
+	DiskMB int64  `yaml:"disk_mb"`
+}
+
+// Options returns the content backend options in the form the web package's
+// constructors take them
+func (c Content) Options() string {
+	if c.Type == "nw" {
+		return strings.Join(append([]string{c.AdminAddr}, c.Nodes...), ",")
+	}
+	return c.Dir
+}
+
+// SetOptions sets the backend from the CONTENT_TYPE and CONTENT_OPTIONS
+// command line arguments
+func (c *Content) SetOptions(contentType string, options string) {
+	c.Type = contentType
+	switch contentType {
+	case "fs":
+		c.Dir = options
+	case "nw":
+		parts := strings.Split(options, ",")
+		c.AdminAddr = parts[0]
+		c.Nodes = parts[1:]
+	}
+}
+
+// Transcoding is the ffmpeg profile uploads and live streams are encoded with
+type Transcoding struct {
+	VideoCodec   string `yaml:"video_codec"`
+	AudioCodec   string `yaml:"audio_codec"`
+	VideoBitrate string `yaml:"video_bitrate"`
+	AudioBitrate string `yaml:"audio_bitrate"`
+	// KeyframeInterval is in frames; segments start on keyframes
+	KeyframeInterval int `yaml:"keyframe_interval"`
+	// SegmentDuration is in seconds
+	SegmentDuration int `yaml:"segment_duration"`
+}
+
+// Live configures RTMP live ingest
+type Live struct {
+	// RTMPPort is the first port of the ingest range; 0 disables live streaming
+	RTMPPort   int `yaml:"rtmp_port"`
+	MaxStreams int `yaml:"max_streams"`
+}
+
+// Limits bounds what the web server takes on
+type Limits struct {
+	// MaxUploadMB is the largest accepted upload; 0 means unlimited
+	MaxUploadMB int64 `yaml:"max_upload_mb"`
+	// ShutdownTimeout is how long a shutdown waits for running work
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout"`
+}
+
+// Accounts configures the local accounts of the sqlite metadata backend
+type Accounts struct {
+	// RegisterRole is the role of accounts created on the registration page
+	RegisterRole string `yaml:"register_role"`
+	// NoRegistration closes the registration page
+	NoRegistration bool `yaml:"no_registration"`
+}
+
+// OIDC configures single sign-on; it is off while Issuer is empty
+type OIDC struct {
+	Issuer        string     `yaml:"issuer"`
+	ClientID      string     `yaml:"client_id"`
+	ClientSecret  string     `yaml:"client_secret"`
+	RedirectURL   string     `yaml:"redirect_url"`
+	Name          string     `yaml:"name"`
+	Scopes        StringList `yaml:"scopes"`
+	UsernameClaim string     `yaml:"username_claim"`
+	RolesClaim    string     `yaml:"roles_claim"`
+	RoleMap       StringMap  `yaml:"role_map"`
+	DefaultRole   string     `yaml:"default_role"`
+	Only          bool       `yaml:"only"`
+}
+
+// DefaultWeb returns the settings cmd/web uses when nothing else is given
+func DefaultWeb() Web {
+	return Web{
+		Listen:   Listen{Host: "0.0.0.0", Port: 8080},
+		Metadata: Metadata{Type: "sqlite"},
+		Transcoding: Transcoding{
+			VideoCodec:       "libx264",
+			AudioCodec:       "aac",
+			VideoBitrate:     "3000k",
+			AudioBitrate:     "128k",
+			KeyframeInterval: 120,
+			SegmentDuration:  4,
+		},
+		Content: Content{
+			Read: Read{Timeout: 10 * time.Second, Attempts: 3, Backoff: 50 * time.Millisecond, HedgePercentile: 95},
+			Breaker: Breaker{
+				Window:    20,
+				MinCalls:  10,
+				ErrorRate: 0.5,
+				SlowCall:  5 * time.Second,
+				SlowRate:  0.5,
+				OpenFor:   10 * time.Second,
+			},
+			Placement: Placement{Strategy: "ring", LoadFactor: 1.25},
+		},
+		Live:     Live{MaxStreams: 4},
+		Limits:   Limits{ShutdownTimeout: 30 * time.Second},
+		Accounts: Accounts{RegisterRole: "viewer"},
+		OIDC: OIDC{
+			Name:          "SSO",
+			UsernameClaim: "preferred_username",
+			RolesClaim:    "groups",
+			DefaultRole:   "uploader",
+		},
+		Tracing: DefaultTracing(),
+		Log:     DefaultLog(),
+	}
+}
+
+// LoadWeb returns the defaults overridden by the file at path (if not
+// empty) and by TRITONTUBE_WEB_* environment variables
+func LoadWeb(path string) (Web, error) {
+	cfg := DefaultWeb()
+	err := load(&cfg, path, WebEnvPrefix)
+	return cfg, err
+}
+
+var bitratePattern = regexp.MustCompile(`^[0-9]+[kKmM]?$`)
+
+// Validate reports every problem with the settings at once
+func (c *Web) Validate() error {
+	var p problems
+
+	p.checkPort("listen.port", c.Listen.Port, false)
+	p.checkPort("listen.http_redirect_port", c.Listen.HTTPRedirectPort, true)
+	if c.Listen.HTTPRedirectPort != 0 {
+		if !c.TLS.Enabled() {
+			p.addf("listen.http_redirect_port needs tls.cert and tls.key")
+		}
+		if c.Listen.HTTPRedirectPort == c.Listen.Port {
+			p.addf("listen.http_redirect_port must differ from listen.port")
+		}
+	}
+	p.checkPort("listen.metrics_port", c.Listen.MetricsPort, true)
+	if c.Listen.MetricsPort != 0 && (c.Listen.MetricsPort == c.Listen.Port || c.Listen.MetricsPort == c.Listen.HTTPRedirectPort) {
+		p.addf("listen.metrics_port must differ from listen.port and listen.http_redirect_port")
+	}
+	p.checkTLS("tls", c.TLS)
+	if c.TLS.CA != "" {
+		p.addf("tls.ca is not supported; browsers do not present client certificates")
+	}
+
+	switch c.Metadata.Type {
+	case "sqlite":
+		if c.Metadata.Path == "" {
+			p.addf("metadata.path is required for the sqlite backend")
+		}
+	case "":
+		p.addf("metadata.type is required (sqlite)")
+	default:
+		p.addf("metadata.type: unsupported backend %q (sqlite)", c.Metadata.Type)
+	}
+
+	switch c.Content.Type {
+	case "fs":
+		if c.Content.Dir == "" {
+			p.addf("content.dir is required for the fs backend")
+		}
+	case "nw":
+		if c.Content.AdminAddr == "" {
+			p.addf("content.admin_addr is required for the nw backend")
+		}
+		if len(c.Content.Nodes) == 0 {
+			p.addf("content.nodes needs at least one storage node for the nw backend")
+		}
+		seen := make(map[string]bool)
+		for _, node := range c.Content.Nodes {
+			if seen[node] {
+				p.addf("content.nodes lists %s twice", node)
+			}
+			seen[node] = true
+		}
+		p.checkTLS("content.tls", c.Content.TLS)
+		p.checkTLS("admin_tls", c.AdminTLS)
+		if c.AdminTLS.CA != "" {
+			p.addf("admin_tls.ca is not supported; admin callers authenticate with tokens")
+		}
+		if !c.AdminTLS.Enabled() && !c.TLS.Enabled() && !c.AdminInsecure {
+			p.addf("the admin service needs admin_tls or tls so admin tokens are not sent in the clear, or admin_insecure")
+		}
+		if c.Content.Cache.MemoryMB < 0 || c.Content.Cache.DiskMB < 0 {
+			p.addf("content.cache sizes must not be negative")
+		}
+		if c.Content.Cache.Dir != "" && c.Content.Cache.DiskMB == 0 {
+			p.addf("content.cache.dir needs content.cache.disk_mb")
+		}
+		if c.Content.Cache.Dir != "" && c.Content.Cache.MemoryMB == 0 {
+			p.addf("content.cache.dir needs content.cache.memory_mb")
+		}
+		if c.Content.Read.Timeout <= 0 {
+			p.addf("content.read.timeout must be positive")
+		}
+		if c.Content.Read.Attempts < 1 {
+			p.addf("content.read.attempts must be at least 1")
+		}
+		if c.Content.Read.Backoff < 0 {
+			p.addf("content.read.backoff must not be negative")
+		}
+		if h := c.Content.Read.HedgePercentile; h < 0 || h >= 100 {
+			p.addf("content.read.hedge_percentile must be at least 0 and below 100")
+		}
+		b := c.Content.Breaker
+		if b.Window < 1 || b.MinCalls < 1 || b.MinCalls > b.Window {
+			p.addf("content.breaker.min_calls must be between 1 and content.breaker.window")
+		}
+		if b.ErrorRate <= 0 || b.ErrorRate > 1 {
+			p.addf("content.breaker.error_rate must be above 0 and at most 1")
+		}
+		if b.SlowRate < 0 || b.SlowRate > 1 {
+			p.addf("content.breaker.slow_rate must be between 0 and 1")
+		}
+		if b.SlowRate > 0 && b.SlowCall <= 0 {
+			p.addf("content.breaker.slow_call must be positive")
+		}
+		if b.OpenFor <= 0 {
+			p.addf("content.breaker.open_for must be positive")
+		}
+		switch c.Content.Placement.Strategy {
+		case "ring", "rendezvous", "bounded-load", "jump":
+		default:
+			p.addf("content.placement.strategy: unsupported strategy %q (ring, rendezvous, bounded-load, jump)", c.Content.Placement.Strategy)
+		}
+		if c.Content.Placement.LoadFactor < 1 {
+			p.addf("content.placement.load_factor must be at least 1")
+		}
+	case "":
+		p.addf("content.type is required (fs, nw)")
+	default:
+		p.addf("content.type: unsupported backend %q (fs, nw)", c.Content.Type)
+	}
+
+	t := c.Transcoding
+	if t.VideoCodec == "" || t.AudioCodec == "" {
+		p.addf("transcoding.video_codec and transcoding.audio_codec are required")
+	}
+	if !bitratePattern.MatchString(t.VideoBitrate) {
+		p.addf("transcoding.video_bitrate: %q is not a bitrate like 3000k", t.VideoBitrate)
+	}
+	if !bitratePattern.MatchString(t.AudioBitrate) {
+		p.addf("transcoding.audio_bitrate: %q is not a bitrate like 128k", t.AudioBitrate)
+	}
+	if t.KeyframeInterval <= 0 {
+		p.addf("transcoding.keyframe_interval must be positive")
+	}
+	if t.SegmentDuration <= 0 {
+		p.addf("transcoding.segment_duration must be positive")
+	}
+
+	if c.Live.RTMPPort != 0 {
+		p.checkPort("live.rtmp_port", c.Live.RTMPPort, false)
+		if c.Live.MaxStreams <= 0 {
+			p.addf("live.max_streams must be positive")
+		} else {
+			p.checkPort("last live stream port", c.Live.RTMPPort+c.Live.MaxStreams-1, false)
+		}
+	}
+
+	if c.Limits.MaxUploadMB < 0 {
+		p.addf("limits.max_upload_mb must not be negative")
+	}
+	if c.Limits.ShutdownTimeout <= 0 {
+		p.addf("limits.shutdown_timeout must be positive")
+	}
+
+	switch c.Accounts.RegisterRole {
+	case "viewer", "uploader", "admin":
+	default:
+		p.addf("accounts.register_role: unsupported role %q (viewer, uploader, admin)", c.Accounts.RegisterRole)
+	}
+
+	if c.OIDC.Issuer != "" {
+		if c.OIDC.ClientID == "" {
+			p.addf("oidc.client_id is required for single sign-on")
+		}
+		if c.OIDC.RedirectURL == "" {
+			p.addf("oidc.redirect_url is required for single sign-on")
+		}
+		if c.Metadata.Type != "sqlite" {
+			p.addf("oidc needs a metadata backend that stores accounts (sqlite)")
+		}
+	}
+
+	p.checkTracing("tracing", c.Tracing)
+	p.checkLog("log", c.Log)
+
+	return p.err()
+}
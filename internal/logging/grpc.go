@@ -0,0 +1,92 @@
+package logging
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// requestIDMetadataKey is the gRPC metadata a request ID travels in
+const requestIDMetadataKey = "x-request-id"
+
+// UnaryClientInterceptor sends the request ID of the call's context along
+// with the call
+func UnaryClientInterceptor() grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		if id := RequestID(ctx); id != "" {
+			ctx = metadata.AppendToOutgoingContext(ctx, requestIDMetadataKey, id)
+		}
+		return invoker(ctx, method, req, reply, cc, opts...)
+	}
+}
+
+// StreamClientInterceptor sends the request ID of the call's context along
+// with streaming calls
+func StreamClientInterceptor() grpc.StreamClientInterceptor {
+	return func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+		if id := RequestID(ctx); id != "" {
+			ctx = metadata.AppendToOutgoingContext(ctx, requestIDMetadataKey, id)
+		}
+		return streamer(ctx, desc, cc, method, opts...)
+	}
+}
+
+// incomingContext returns ctx with the request ID the caller sent, or a new
+// one if it sent none
+func incomingContext(ctx context.Context) context.Context {
+	md, _ := metadata.FromIncomingContext(ctx)
+	id := ""
+	if values := md.Get(requestIDMetadataKey); len(values) > 0 {
+		id = values[0]
+	}
+	return WithRequestID(ctx, id)
+}
+
+// logCall logs a finished call: successful ones at debug level since a video
+// is thousands of them, failed ones at warn level
+func logCall(ctx context.Context, method string, start time.Time, err error) {
+	if err == nil {
+		slog.DebugContext(ctx, "gRPC call", "method", method, "duration", time.Since(start))
+		return
+	}
+	slog.WarnContext(ctx, "gRPC call failed", "method", method, "duration", time.Since(start),
+		"code", status.Code(err).String(), "error", status.Convert(err).Message())
+}
+
+// UnaryServerInterceptor puts the caller's request ID into the context of
+// unary calls and logs them
+func UnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		ctx = incomingContext(ctx)
+		start := time.Now()
+		resp, err := handler(ctx, req)
+		logCall(ctx, info.FullMethod, start, err)
+		return resp, err
+	}
+}
+
+// StreamServerInterceptor puts the caller's request ID into the context of
+// streaming calls and logs them
+func StreamServerInterceptor() grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		ctx := incomingContext(ss.Context())
+		start := time.Now()
+		err := handler(srv, &contextStream{ServerStream: ss, ctx: ctx})
+		logCall(ctx, info.FullMethod, start, err)
+		return err
+	}
+}
+
+// contextStream is a server stream with a replaced context
+type contextStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *contextStream) Context() context.Context {
+	return s.ctx
+}
@@ -0,0 +1,122 @@
+// Package logging sets up the structured log/slog logging of the TritonTube
+// commands and carries request IDs from the web server to the storage nodes.
+//
+// A request ID is minted for every HTTP request (or taken from its
+// X-Request-ID header) and stored in the request's context. Records logged
+// with a context that holds one get a request_id attribute, and gRPC calls
+// made with such a context pass it on as x-request-id metadata, so the log
+// lines of a request can be found on every process it touched.
+package logging
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+)
+
+// Formats the log can be written in
+const (
+	FormatText = "text"
+	FormatJSON = "json"
+)
+
+// Config selects how a process logs
+type Config struct {
+	// Level is debug, info, warn or error
+	Level string
+	// Format is text or json
+	Format string
+}
+
+// ParseLevel turns a level name into a slog level
+func ParseLevel(name string) (slog.Level, error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(name)); err != nil {
+		return level, fmt.Errorf("unknown log level %q (debug, info, warn, error)", name)
+	}
+	return level, nil
+}
+
+// Setup makes a logger writing to out the default slog logger. The standard
+// log package is routed through it too.
+func Setup(out io.Writer, cfg Config) error {
+	level, err := ParseLevel(cfg.Level)
+	if err != nil {
+		return err
+	}
+	opts := &slog.HandlerOptions{Level: level}
+	var handler slog.Handler
+	switch strings.ToLower(cfg.Format) {
+	case FormatText, "":
+		handler = slog.NewTextHandler(out, opts)
+	case FormatJSON:
+		handler = slog.NewJSONHandler(out, opts)
+	default:
+		return fmt.Errorf("unknown log format %q (text, json)", cfg.Format)
+	}
+	slog.SetDefault(slog.New(requestIDHandler{handler}))
+	return nil
+}
+
+type requestIDKey struct{}
+
+// NewRequestID returns a random request ID
+func NewRequestID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// validRequestID reports whether an ID sent by a client is safe to log and
+// pass on; anything else is replaced by a fresh one
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 64 {
+		return false
+	}
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == '.') {
+			return false
+		}
+	}
+	return true
+}
+
+// WithRequestID returns a context carrying the given request ID, or a new
+// one if id is empty or not safe to use
+func WithRequestID(ctx context.Context, id string) context.Context {
+	if !validRequestID(id) {
+		id = NewRequestID()
+	}
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// RequestID returns the request ID carried by ctx, or "" if there is none
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// requestIDHandler adds the request ID of the context a record is logged
+// with to the record
+type requestIDHandler struct {
+	slog.Handler
+}
+
+func (h requestIDHandler) Handle(ctx context.Context, record slog.Record) error {
+	if id := RequestID(ctx); id != "" {
+		record.AddAttrs(slog.String("request_id", id))
+	}
+	return h.Handler.Handle(ctx, record)
+}
+
+func (h requestIDHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return requestIDHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h requestIDHandler) WithGroup(name string) slog.Handler {
+	return requestIDHandler{h.Handler.WithGroup(name)}
+}
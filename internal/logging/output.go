@@ -0,0 +1,73 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"strings"
+	"sync"
+)
+
+// outputTailLines is the number of lines an Output keeps for Tail
+const outputTailLines = 20
+
+// Output collects what a child process such as ffmpeg prints. Every line is
+// logged at debug level with the attributes of its job, so the output of
+// concurrent jobs stays apart, and the last lines are kept to explain a
+// failure. It is safe to use as both Stdout and Stderr of a command.
+type Output struct {
+	ctx   context.Context
+	attrs []any
+
+	mu      sync.Mutex
+	partial []byte
+	tail    []string
+}
+
+// NewOutput returns an Output that logs with ctx's request ID and the given
+// key-value attributes
+func NewOutput(ctx context.Context, attrs ...any) *Output {
+	return &Output{ctx: ctx, attrs: attrs}
+}
+
+func (o *Output) Write(p []byte) (int, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	o.partial = append(o.partial, p...)
+	for {
+		// ffmpeg redraws its progress line with carriage returns
+		i := bytes.IndexAny(o.partial, "\r\n")
+		if i < 0 {
+			break
+		}
+		o.line(string(o.partial[:i]))
+		o.partial = o.partial[i+1:]
+	}
+	return len(p), nil
+}
+
+func (o *Output) line(line string) {
+	line = strings.TrimSpace(line)
+	if line == "" {
+		return
+	}
+	slog.DebugContext(o.ctx, line, o.attrs...)
+	o.tail = append(o.tail, line)
+	if len(o.tail) > outputTailLines {
+		o.tail = o.tail[1:]
+	}
+}
+
+// Tail returns the last lines printed, e.g. to be logged when the process
+// failed
+func (o *Output) Tail() string {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	lines := o.tail
+	if len(o.partial) > 0 {
+		lines = append(lines[:len(lines):len(lines)], string(o.partial))
+	}
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,75 @@
+// Package metrics holds the Prometheus metrics shared by the TritonTube
+// servers and the handler that exposes them at /metrics.
+//
+// Every metric is registered with the default registry, which also carries
+// the Go runtime and process metrics.
+package metrics
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+)
+
+var (
+	grpcServerRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "tritontube_grpc_server_requests_total",
+		Help: "gRPC calls handled, by method and status code.",
+	}, []string{"method", "code"})
+
+	grpcServerDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "tritontube_grpc_server_request_duration_seconds",
+		Help:    "Time taken to handle gRPC calls, by method.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"method"})
+)
+
+// Handler serves the metrics in the Prometheus text format
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
+
+// Serve serves the metrics at /metrics on their own plain HTTP listener, so
+// they stay off the port the public is let in on. It only returns if the
+// listener fails.
+func Serve(addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", Handler())
+	slog.Info("Serving metrics", "url", "http://"+addr+"/metrics")
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		slog.Error("Failed to serve metrics", "error", err)
+	}
+}
+
+// observeGRPC records a finished gRPC call
+func observeGRPC(method string, start time.Time, err error) {
+	grpcServerRequests.WithLabelValues(method, status.Code(err).String()).Inc()
+	grpcServerDuration.WithLabelValues(method).Observe(time.Since(start).Seconds())
+}
+
+// UnaryServerInterceptor counts and times unary gRPC calls
+func UnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		start := time.Now()
+		resp, err := handler(ctx, req)
+		observeGRPC(info.FullMethod, start, err)
+		return resp, err
+	}
+}
+
+// StreamServerInterceptor counts and times streaming gRPC calls
+func StreamServerInterceptor() grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		start := time.Now()
+		err := handler(srv, ss)
+		observeGRPC(info.FullMethod, start, err)
+		return err
+	}
+}
@@ -234,8 +234,10 @@ func (*ListNodesRequest) Descriptor() ([]byte, []int) {
 }
 
 type ListNodesResponse struct {
-	state         protoimpl.MessageState `protogen:"open.v1"`
-	Nodes         []string               `protobuf:"bytes,1,rep,name=nodes,proto3" json:"nodes,omitempty"`
+	state protoimpl.MessageState `protogen:"open.v1"`
+	Nodes []string               `protobuf:"bytes,1,rep,name=nodes,proto3" json:"nodes,omitempty"`
+	// Health of each node, in the order of nodes
+	Statuses      []*NodeStatus `protobuf:"bytes,2,rep,name=statuses,proto3" json:"statuses,omitempty"`
 	unknownFields protoimpl.UnknownFields
 	sizeCache     protoimpl.SizeCache
 }
@@ -277,6 +279,66 @@ func (x *ListNodesResponse) GetNodes() []string {
 	return nil
 }
 
+func (x *ListNodesResponse) GetStatuses() []*NodeStatus {
+	if x != nil {
+		return x.Statuses
+	}
+	return nil
+}
+
+type NodeStatus struct {
+	state       protoimpl.MessageState `protogen:"open.v1"`
+	NodeAddress string                 `protobuf:"bytes,1,opt,name=node_address,json=nodeAddress,proto3" json:"node_address,omitempty"`
+	// Circuit breaker state: closed, open or half-open
+	BreakerState  string `protobuf:"bytes,2,opt,name=breaker_state,json=breakerState,proto3" json:"breaker_state,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *NodeStatus) Reset() {
+	*x = NodeStatus{}
+	mi := &file_proto_admin_proto_msgTypes[6]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *NodeStatus) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*NodeStatus) ProtoMessage() {}
+
+func (x *NodeStatus) ProtoReflect() protoreflect.Message {
+	mi := &file_proto_admin_proto_msgTypes[6]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use NodeStatus.ProtoReflect.Descriptor instead.
+func (*NodeStatus) Descriptor() ([]byte, []int) {
+	return file_proto_admin_proto_rawDescGZIP(), []int{6}
+}
+
+func (x *NodeStatus) GetNodeAddress() string {
+	if x != nil {
+		return x.NodeAddress
+	}
+	return ""
+}
+
+func (x *NodeStatus) GetBreakerState() string {
+	if x != nil {
+		return x.BreakerState
+	}
+	return ""
+}
+
 var File_proto_admin_proto protoreflect.FileDescriptor
 
 const file_proto_admin_proto_rawDesc = "" +
@@ -291,9 +353,14 @@ const file_proto_admin_proto_rawDesc = "" +
 	"\fnode_address\x18\x01 \x01(\tR\vnodeAddress\"D\n" +
 	"\x12RemoveNodeResponse\x12.\n" +
 	"\x13migrated_file_count\x18\x01 \x01(\x05R\x11migratedFileCount\"\x12\n" +
-	"\x10ListNodesRequest\")\n" +
+	"\x10ListNodesRequest\"]\n" +
 	"\x11ListNodesResponse\x12\x14\n" +
-	"\x05nodes\x18\x01 \x03(\tR\x05nodes2\xf5\x01\n" +
+	"\x05nodes\x18\x01 \x03(\tR\x05nodes\x122\n" +
+	"\bstatuses\x18\x02 \x03(\v2\x16.tritontube.NodeStatusR\bstatuses\"T\n" +
+	"\n" +
+	"NodeStatus\x12!\n" +
+	"\fnode_address\x18\x01 \x01(\tR\vnodeAddress\x12#\n" +
+	"\rbreaker_state\x18\x02 \x01(\tR\fbreakerState2\xf5\x01\n" +
 	"\x18VideoContentAdminService\x12B\n" +
 	"\aAddNode\x12\x1a.tritontube.AddNodeRequest\x1a\x1b.tritontube.AddNodeResponse\x12K\n" +
 	"\n" +
@@ -312,7 +379,7 @@ func file_proto_admin_proto_rawDescGZIP() []byte {
 	return file_proto_admin_proto_rawDescData
 }
 
-var file_proto_admin_proto_msgTypes = make([]protoimpl.MessageInfo, 6)
+var file_proto_admin_proto_msgTypes = make([]protoimpl.MessageInfo, 7)
 var file_proto_admin_proto_goTypes = []any{
 	(*AddNodeRequest)(nil),     // 0: tritontube.AddNodeRequest
 	(*AddNodeResponse)(nil),    // 1: tritontube.AddNodeResponse
@@ -320,19 +387,21 @@ var file_proto_admin_proto_goTypes = []any{
 	(*RemoveNodeResponse)(nil), // 3: tritontube.RemoveNodeResponse
 	(*ListNodesRequest)(nil),   // 4: tritontube.ListNodesRequest
 	(*ListNodesResponse)(nil),  // 5: tritontube.ListNodesResponse
+	(*NodeStatus)(nil),         // 6: tritontube.NodeStatus
 }
 var file_proto_admin_proto_depIdxs = []int32{
-	0, // 0: tritontube.VideoContentAdminService.AddNode:input_type -> tritontube.AddNodeRequest
-	2, // 1: tritontube.VideoContentAdminService.RemoveNode:input_type -> tritontube.RemoveNodeRequest
-	4, // 2: tritontube.VideoContentAdminService.ListNodes:input_type -> tritontube.ListNodesRequest
-	1, // 3: tritontube.VideoContentAdminService.AddNode:output_type -> tritontube.AddNodeResponse
-	3, // 4: tritontube.VideoContentAdminService.RemoveNode:output_type -> tritontube.RemoveNodeResponse
-	5, // 5: tritontube.VideoContentAdminService.ListNodes:output_type -> tritontube.ListNodesResponse
-	3, // [3:6] is the sub-list for method output_type
-	0, // [0:3] is the sub-list for method input_type
-	0, // [0:0] is the sub-list for extension type_name
-	0, // [0:0] is the sub-list for extension extendee
-	0, // [0:0] is the sub-list for field type_name
+	6, // 0: tritontube.ListNodesResponse.statuses:type_name -> tritontube.NodeStatus
+	0, // 1: tritontube.VideoContentAdminService.AddNode:input_type -> tritontube.AddNodeRequest
+	2, // 2: tritontube.VideoContentAdminService.RemoveNode:input_type -> tritontube.RemoveNodeRequest
+	4, // 3: tritontube.VideoContentAdminService.ListNodes:input_type -> tritontube.ListNodesRequest
+	1, // 4: tritontube.VideoContentAdminService.AddNode:output_type -> tritontube.AddNodeResponse
+	3, // 5: tritontube.VideoContentAdminService.RemoveNode:output_type -> tritontube.RemoveNodeResponse
+	5, // 6: tritontube.VideoContentAdminService.ListNodes:output_type -> tritontube.ListNodesResponse
+	4, // [4:7] is the sub-list for method output_type
+	1, // [1:4] is the sub-list for method input_type
+	1, // [1:1] is the sub-list for extension type_name
+	1, // [1:1] is the sub-list for extension extendee
+	0, // [0:1] is the sub-list for field type_name
 }
 
 func init() { file_proto_admin_proto_init() }
@@ -346,7 +415,7 @@ func file_proto_admin_proto_init() {
 			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
 			RawDescriptor: unsafe.Slice(unsafe.StringData(file_proto_admin_proto_rawDesc), len(file_proto_admin_proto_rawDesc)),
 			NumEnums:      0,
-			NumMessages:   6,
+			NumMessages:   7,
 			NumExtensions: 0,
 			NumServices:   1,
 		},
@@ -121,10 +121,13 @@ func (x *ReadResponse) GetContent() []byte {
 
 // Request to write a file
 type WriteRequest struct {
-	state         protoimpl.MessageState `protogen:"open.v1"`
-	VideoId       string                 `protobuf:"bytes,1,opt,name=video_id,json=videoId,proto3" json:"video_id,omitempty"`
-	Filename      string                 `protobuf:"bytes,2,opt,name=filename,proto3" json:"filename,omitempty"`
-	Content       []byte                 `protobuf:"bytes,3,opt,name=content,proto3" json:"content,omitempty"`
+	state    protoimpl.MessageState `protogen:"open.v1"`
+	VideoId  string                 `protobuf:"bytes,1,opt,name=video_id,json=videoId,proto3" json:"video_id,omitempty"`
+	Filename string                 `protobuf:"bytes,2,opt,name=filename,proto3" json:"filename,omitempty"`
+	Content  []byte                 `protobuf:"bytes,3,opt,name=content,proto3" json:"content,omitempty"`
+	// Set in the last chunk only, if at all: the hex SHA-256 of the whole
+	// file, which is refused if what arrived does not match it
+	Checksum      string `protobuf:"bytes,4,opt,name=checksum,proto3" json:"checksum,omitempty"`
 	unknownFields protoimpl.UnknownFields
 	sizeCache     protoimpl.SizeCache
 }
@@ -180,6 +183,13 @@ func (x *WriteRequest) GetContent() []byte {
 	return nil
 }
 
+func (x *WriteRequest) GetChecksum() string {
+	if x != nil {
+		return x.Checksum
+	}
+	return ""
+}
+
 // Response for write operation
 type WriteResponse struct {
 	state         protoimpl.MessageState `protogen:"open.v1"`
@@ -325,7 +335,11 @@ func (x *DeleteResponse) GetSuccess() bool {
 
 // Request to list video IDs
 type ListVideoIDsRequest struct {
-	state         protoimpl.MessageState `protogen:"open.v1"`
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// Most video IDs to return; 0 or more than 10000 returns 10000
+	PageSize int32 `protobuf:"varint,1,opt,name=page_size,json=pageSize,proto3" json:"page_size,omitempty"`
+	// next_page_token of the previous page; empty for the first page
+	PageToken     string `protobuf:"bytes,2,opt,name=page_token,json=pageToken,proto3" json:"page_token,omitempty"`
 	unknownFields protoimpl.UnknownFields
 	sizeCache     protoimpl.SizeCache
 }
@@ -360,10 +374,26 @@ func (*ListVideoIDsRequest) Descriptor() ([]byte, []int) {
 	return file_storage_proto_rawDescGZIP(), []int{6}
 }
 
+func (x *ListVideoIDsRequest) GetPageSize() int32 {
+	if x != nil {
+		return x.PageSize
+	}
+	return 0
+}
+
+func (x *ListVideoIDsRequest) GetPageToken() string {
+	if x != nil {
+		return x.PageToken
+	}
+	return ""
+}
+
 // Response containing list of video IDs
 type ListVideoIDsResponse struct {
-	state         protoimpl.MessageState `protogen:"open.v1"`
-	VideoIds      []string               `protobuf:"bytes,1,rep,name=video_ids,json=videoIds,proto3" json:"video_ids,omitempty"`
+	state    protoimpl.MessageState `protogen:"open.v1"`
+	VideoIds []string               `protobuf:"bytes,1,rep,name=video_ids,json=videoIds,proto3" json:"video_ids,omitempty"`
+	// Token of the next page; empty after the last page
+	NextPageToken string `protobuf:"bytes,2,opt,name=next_page_token,json=nextPageToken,proto3" json:"next_page_token,omitempty"`
 	unknownFields protoimpl.UnknownFields
 	sizeCache     protoimpl.SizeCache
 }
@@ -405,10 +435,21 @@ func (x *ListVideoIDsResponse) GetVideoIds() []string {
 	return nil
 }
 
+func (x *ListVideoIDsResponse) GetNextPageToken() string {
+	if x != nil {
+		return x.NextPageToken
+	}
+	return ""
+}
+
 // Request to list files for a video
 type ListFilesRequest struct {
-	state         protoimpl.MessageState `protogen:"open.v1"`
-	VideoId       string                 `protobuf:"bytes,1,opt,name=video_id,json=videoId,proto3" json:"video_id,omitempty"`
+	state   protoimpl.MessageState `protogen:"open.v1"`
+	VideoId string                 `protobuf:"bytes,1,opt,name=video_id,json=videoId,proto3" json:"video_id,omitempty"`
+	// Most file names to return; 0 or more than 10000 returns 10000
+	PageSize int32 `protobuf:"varint,2,opt,name=page_size,json=pageSize,proto3" json:"page_size,omitempty"`
+	// next_page_token of the previous page; empty for the first page
+	PageToken     string `protobuf:"bytes,3,opt,name=page_token,json=pageToken,proto3" json:"page_token,omitempty"`
 	unknownFields protoimpl.UnknownFields
 	sizeCache     protoimpl.SizeCache
 }
@@ -450,10 +491,26 @@ func (x *ListFilesRequest) GetVideoId() string {
 	return ""
 }
 
+func (x *ListFilesRequest) GetPageSize() int32 {
+	if x != nil {
+		return x.PageSize
+	}
+	return 0
+}
+
+func (x *ListFilesRequest) GetPageToken() string {
+	if x != nil {
+		return x.PageToken
+	}
+	return ""
+}
+
 // Response containing list of files
 type ListFilesResponse struct {
-	state         protoimpl.MessageState `protogen:"open.v1"`
-	Filenames     []string               `protobuf:"bytes,1,rep,name=filenames,proto3" json:"filenames,omitempty"`
+	state     protoimpl.MessageState `protogen:"open.v1"`
+	Filenames []string               `protobuf:"bytes,1,rep,name=filenames,proto3" json:"filenames,omitempty"`
+	// Token of the next page; empty after the last page
+	NextPageToken string `protobuf:"bytes,2,opt,name=next_page_token,json=nextPageToken,proto3" json:"next_page_token,omitempty"`
 	unknownFields protoimpl.UnknownFields
 	sizeCache     protoimpl.SizeCache
 }
@@ -495,40 +552,952 @@ func (x *ListFilesResponse) GetFilenames() []string {
 	return nil
 }
 
-var File_storage_proto protoreflect.FileDescriptor
+func (x *ListFilesResponse) GetNextPageToken() string {
+	if x != nil {
+		return x.NextPageToken
+	}
+	return ""
+}
 
-const file_storage_proto_rawDesc = "" +
-	"\n" +
-	"\rstorage.proto\x12\x05proto\"D\n" +
-	"\vReadRequest\x12\x19\n" +
-	"\bvideo_id\x18\x01 \x01(\tR\avideoId\x12\x1a\n" +
-	"\bfilename\x18\x02 \x01(\tR\bfilename\"(\n" +
-	"\fReadResponse\x12\x18\n" +
-	"\acontent\x18\x01 \x01(\fR\acontent\"_\n" +
-	"\fWriteRequest\x12\x19\n" +
-	"\bvideo_id\x18\x01 \x01(\tR\avideoId\x12\x1a\n" +
-	"\bfilename\x18\x02 \x01(\tR\bfilename\x12\x18\n" +
-	"\acontent\x18\x03 \x01(\fR\acontent\")\n" +
-	"\rWriteResponse\x12\x18\n" +
-	"\asuccess\x18\x01 \x01(\bR\asuccess\"F\n" +
-	"\rDeleteRequest\x12\x19\n" +
-	"\bvideo_id\x18\x01 \x01(\tR\avideoId\x12\x1a\n" +
-	"\bfilename\x18\x02 \x01(\tR\bfilename\"*\n" +
-	"\x0eDeleteResponse\x12\x18\n" +
-	"\asuccess\x18\x01 \x01(\bR\asuccess\"\x15\n" +
-	"\x13ListVideoIDsRequest\"3\n" +
-	"\x14ListVideoIDsResponse\x12\x1b\n" +
-	"\tvideo_ids\x18\x01 \x03(\tR\bvideoIds\"-\n" +
-	"\x10ListFilesRequest\x12\x19\n" +
-	"\bvideo_id\x18\x01 \x01(\tR\avideoId\"1\n" +
-	"\x11ListFilesResponse\x12\x1c\n" +
-	"\tfilenames\x18\x01 \x03(\tR\tfilenames2\xbf\x02\n" +
-	"\x0eStorageService\x121\n" +
-	"\x04Read\x12\x12.proto.ReadRequest\x1a\x13.proto.ReadResponse\"\x00\x124\n" +
-	"\x05Write\x12\x13.proto.WriteRequest\x1a\x14.proto.WriteResponse\"\x00\x127\n" +
-	"\x06Delete\x12\x14.proto.DeleteRequest\x1a\x15.proto.DeleteResponse\"\x00\x12I\n" +
-	"\fListVideoIDs\x12\x1a.proto.ListVideoIDsRequest\x1a\x1b.proto.ListVideoIDsResponse\"\x00\x12@\n" +
-	"\tListFiles\x12\x17.proto.ListFilesRequest\x1a\x18.proto.ListFilesResponse\"\x00B\x1bZ\x19tritontube/internal/protob\x06proto3"
+// Request to copy a file to another node
+type CopyToRequest struct {
+	state    protoimpl.MessageState `protogen:"open.v1"`
+	VideoId  string                 `protobuf:"bytes,1,opt,name=video_id,json=videoId,proto3" json:"video_id,omitempty"`
+	Filename string                 `protobuf:"bytes,2,opt,name=filename,proto3" json:"filename,omitempty"`
+	// Address of the receiving node, as the web server dials it
+	Destination   string `protobuf:"bytes,3,opt,name=destination,proto3" json:"destination,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *CopyToRequest) Reset() {
+	*x = CopyToRequest{}
+	mi := &file_storage_proto_msgTypes[10]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *CopyToRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*CopyToRequest) ProtoMessage() {}
+
+func (x *CopyToRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_storage_proto_msgTypes[10]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use CopyToRequest.ProtoReflect.Descriptor instead.
+func (*CopyToRequest) Descriptor() ([]byte, []int) {
+	return file_storage_proto_rawDescGZIP(), []int{10}
+}
+
+func (x *CopyToRequest) GetVideoId() string {
+	if x != nil {
+		return x.VideoId
+	}
+	return ""
+}
+
+func (x *CopyToRequest) GetFilename() string {
+	if x != nil {
+		return x.Filename
+	}
+	return ""
+}
+
+func (x *CopyToRequest) GetDestination() string {
+	if x != nil {
+		return x.Destination
+	}
+	return ""
+}
+
+// Response for copy operation, describing the file that was sent
+type CopyToResponse struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	Size  int64                  `protobuf:"varint,1,opt,name=size,proto3" json:"size,omitempty"`
+	// Hex SHA-256 of the content
+	Checksum      string `protobuf:"bytes,2,opt,name=checksum,proto3" json:"checksum,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *CopyToResponse) Reset() {
+	*x = CopyToResponse{}
+	mi := &file_storage_proto_msgTypes[11]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *CopyToResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*CopyToResponse) ProtoMessage() {}
+
+func (x *CopyToResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_storage_proto_msgTypes[11]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use CopyToResponse.ProtoReflect.Descriptor instead.
+func (*CopyToResponse) Descriptor() ([]byte, []int) {
+	return file_storage_proto_rawDescGZIP(), []int{11}
+}
+
+func (x *CopyToResponse) GetSize() int64 {
+	if x != nil {
+		return x.Size
+	}
+	return 0
+}
+
+func (x *CopyToResponse) GetChecksum() string {
+	if x != nil {
+		return x.Checksum
+	}
+	return ""
+}
+
+// Part of a file sent to WriteStream
+type WriteChunk struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// Set in the first chunk only
+	VideoId  string `protobuf:"bytes,1,opt,name=video_id,json=videoId,proto3" json:"video_id,omitempty"`
+	Filename string `protobuf:"bytes,2,opt,name=filename,proto3" json:"filename,omitempty"`
+	Content  []byte `protobuf:"bytes,3,opt,name=content,proto3" json:"content,omitempty"`
+	// Set in the last chunk only, if at all: the hex SHA-256 of the whole
+	// file, which is refused if what arrived does not match it
+	Checksum      string `protobuf:"bytes,4,opt,name=checksum,proto3" json:"checksum,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *WriteChunk) Reset() {
+	*x = WriteChunk{}
+	mi := &file_storage_proto_msgTypes[12]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *WriteChunk) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*WriteChunk) ProtoMessage() {}
+
+func (x *WriteChunk) ProtoReflect() protoreflect.Message {
+	mi := &file_storage_proto_msgTypes[12]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use WriteChunk.ProtoReflect.Descriptor instead.
+func (*WriteChunk) Descriptor() ([]byte, []int) {
+	return file_storage_proto_rawDescGZIP(), []int{12}
+}
+
+func (x *WriteChunk) GetVideoId() string {
+	if x != nil {
+		return x.VideoId
+	}
+	return ""
+}
+
+func (x *WriteChunk) GetFilename() string {
+	if x != nil {
+		return x.Filename
+	}
+	return ""
+}
+
+func (x *WriteChunk) GetContent() []byte {
+	if x != nil {
+		return x.Content
+	}
+	return nil
+}
+
+func (x *WriteChunk) GetChecksum() string {
+	if x != nil {
+		return x.Checksum
+	}
+	return ""
+}
+
+// Response for streamed write operation, describing the file that was written
+type WriteStreamResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Size          int64                  `protobuf:"varint,1,opt,name=size,proto3" json:"size,omitempty"`
+	Checksum      string                 `protobuf:"bytes,2,opt,name=checksum,proto3" json:"checksum,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *WriteStreamResponse) Reset() {
+	*x = WriteStreamResponse{}
+	mi := &file_storage_proto_msgTypes[13]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *WriteStreamResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*WriteStreamResponse) ProtoMessage() {}
+
+func (x *WriteStreamResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_storage_proto_msgTypes[13]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use WriteStreamResponse.ProtoReflect.Descriptor instead.
+func (*WriteStreamResponse) Descriptor() ([]byte, []int) {
+	return file_storage_proto_rawDescGZIP(), []int{13}
+}
+
+func (x *WriteStreamResponse) GetSize() int64 {
+	if x != nil {
+		return x.Size
+	}
+	return 0
+}
+
+func (x *WriteStreamResponse) GetChecksum() string {
+	if x != nil {
+		return x.Checksum
+	}
+	return ""
+}
+
+// Request to describe a file
+type StatRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	VideoId       string                 `protobuf:"bytes,1,opt,name=video_id,json=videoId,proto3" json:"video_id,omitempty"`
+	Filename      string                 `protobuf:"bytes,2,opt,name=filename,proto3" json:"filename,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *StatRequest) Reset() {
+	*x = StatRequest{}
+	mi := &file_storage_proto_msgTypes[14]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *StatRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*StatRequest) ProtoMessage() {}
+
+func (x *StatRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_storage_proto_msgTypes[14]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use StatRequest.ProtoReflect.Descriptor instead.
+func (*StatRequest) Descriptor() ([]byte, []int) {
+	return file_storage_proto_rawDescGZIP(), []int{14}
+}
+
+func (x *StatRequest) GetVideoId() string {
+	if x != nil {
+		return x.VideoId
+	}
+	return ""
+}
+
+func (x *StatRequest) GetFilename() string {
+	if x != nil {
+		return x.Filename
+	}
+	return ""
+}
+
+// Response describing a file
+type StatResponse struct {
+	state    protoimpl.MessageState `protogen:"open.v1"`
+	Size     int64                  `protobuf:"varint,1,opt,name=size,proto3" json:"size,omitempty"`
+	Checksum string                 `protobuf:"bytes,2,opt,name=checksum,proto3" json:"checksum,omitempty"`
+	// Last modification time in nanoseconds since the Unix epoch
+	MtimeUnixNano int64 `protobuf:"varint,3,opt,name=mtime_unix_nano,json=mtimeUnixNano,proto3" json:"mtime_unix_nano,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *StatResponse) Reset() {
+	*x = StatResponse{}
+	mi := &file_storage_proto_msgTypes[15]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *StatResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*StatResponse) ProtoMessage() {}
+
+func (x *StatResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_storage_proto_msgTypes[15]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use StatResponse.ProtoReflect.Descriptor instead.
+func (*StatResponse) Descriptor() ([]byte, []int) {
+	return file_storage_proto_rawDescGZIP(), []int{15}
+}
+
+func (x *StatResponse) GetSize() int64 {
+	if x != nil {
+		return x.Size
+	}
+	return 0
+}
+
+func (x *StatResponse) GetChecksum() string {
+	if x != nil {
+		return x.Checksum
+	}
+	return ""
+}
+
+func (x *StatResponse) GetMtimeUnixNano() int64 {
+	if x != nil {
+		return x.MtimeUnixNano
+	}
+	return 0
+}
+
+// Request to list every file
+type ListAllKeysRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ListAllKeysRequest) Reset() {
+	*x = ListAllKeysRequest{}
+	mi := &file_storage_proto_msgTypes[16]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ListAllKeysRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ListAllKeysRequest) ProtoMessage() {}
+
+func (x *ListAllKeysRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_storage_proto_msgTypes[16]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ListAllKeysRequest.ProtoReflect.Descriptor instead.
+func (*ListAllKeysRequest) Descriptor() ([]byte, []int) {
+	return file_storage_proto_rawDescGZIP(), []int{16}
+}
+
+// A stored file
+type KeyInfo struct {
+	state    protoimpl.MessageState `protogen:"open.v1"`
+	VideoId  string                 `protobuf:"bytes,1,opt,name=video_id,json=videoId,proto3" json:"video_id,omitempty"`
+	Filename string                 `protobuf:"bytes,2,opt,name=filename,proto3" json:"filename,omitempty"`
+	Size     int64                  `protobuf:"varint,3,opt,name=size,proto3" json:"size,omitempty"`
+	// Hex SHA-256 of the content
+	Checksum      string `protobuf:"bytes,4,opt,name=checksum,proto3" json:"checksum,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *KeyInfo) Reset() {
+	*x = KeyInfo{}
+	mi := &file_storage_proto_msgTypes[17]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *KeyInfo) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*KeyInfo) ProtoMessage() {}
+
+func (x *KeyInfo) ProtoReflect() protoreflect.Message {
+	mi := &file_storage_proto_msgTypes[17]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use KeyInfo.ProtoReflect.Descriptor instead.
+func (*KeyInfo) Descriptor() ([]byte, []int) {
+	return file_storage_proto_rawDescGZIP(), []int{17}
+}
+
+func (x *KeyInfo) GetVideoId() string {
+	if x != nil {
+		return x.VideoId
+	}
+	return ""
+}
+
+func (x *KeyInfo) GetFilename() string {
+	if x != nil {
+		return x.Filename
+	}
+	return ""
+}
+
+func (x *KeyInfo) GetSize() int64 {
+	if x != nil {
+		return x.Size
+	}
+	return 0
+}
+
+func (x *KeyInfo) GetChecksum() string {
+	if x != nil {
+		return x.Checksum
+	}
+	return ""
+}
+
+// Outcome of one file of a batch
+type ItemStatus struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// gRPC status code; 0 (OK) if the file was handled
+	Code          int32  `protobuf:"varint,1,opt,name=code,proto3" json:"code,omitempty"`
+	Message       string `protobuf:"bytes,2,opt,name=message,proto3" json:"message,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ItemStatus) Reset() {
+	*x = ItemStatus{}
+	mi := &file_storage_proto_msgTypes[18]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ItemStatus) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ItemStatus) ProtoMessage() {}
+
+func (x *ItemStatus) ProtoReflect() protoreflect.Message {
+	mi := &file_storage_proto_msgTypes[18]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ItemStatus.ProtoReflect.Descriptor instead.
+func (*ItemStatus) Descriptor() ([]byte, []int) {
+	return file_storage_proto_rawDescGZIP(), []int{18}
+}
+
+func (x *ItemStatus) GetCode() int32 {
+	if x != nil {
+		return x.Code
+	}
+	return 0
+}
+
+func (x *ItemStatus) GetMessage() string {
+	if x != nil {
+		return x.Message
+	}
+	return ""
+}
+
+// Request to write several files
+type BatchWriteRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Items         []*WriteRequest        `protobuf:"bytes,1,rep,name=items,proto3" json:"items,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *BatchWriteRequest) Reset() {
+	*x = BatchWriteRequest{}
+	mi := &file_storage_proto_msgTypes[19]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *BatchWriteRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*BatchWriteRequest) ProtoMessage() {}
+
+func (x *BatchWriteRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_storage_proto_msgTypes[19]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use BatchWriteRequest.ProtoReflect.Descriptor instead.
+func (*BatchWriteRequest) Descriptor() ([]byte, []int) {
+	return file_storage_proto_rawDescGZIP(), []int{19}
+}
+
+func (x *BatchWriteRequest) GetItems() []*WriteRequest {
+	if x != nil {
+		return x.Items
+	}
+	return nil
+}
+
+// Response to a batch write, with one status per file
+type BatchWriteResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Statuses      []*ItemStatus          `protobuf:"bytes,1,rep,name=statuses,proto3" json:"statuses,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *BatchWriteResponse) Reset() {
+	*x = BatchWriteResponse{}
+	mi := &file_storage_proto_msgTypes[20]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *BatchWriteResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*BatchWriteResponse) ProtoMessage() {}
+
+func (x *BatchWriteResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_storage_proto_msgTypes[20]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use BatchWriteResponse.ProtoReflect.Descriptor instead.
+func (*BatchWriteResponse) Descriptor() ([]byte, []int) {
+	return file_storage_proto_rawDescGZIP(), []int{20}
+}
+
+func (x *BatchWriteResponse) GetStatuses() []*ItemStatus {
+	if x != nil {
+		return x.Statuses
+	}
+	return nil
+}
+
+// Request to read several files
+type BatchReadRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Items         []*ReadRequest         `protobuf:"bytes,1,rep,name=items,proto3" json:"items,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *BatchReadRequest) Reset() {
+	*x = BatchReadRequest{}
+	mi := &file_storage_proto_msgTypes[21]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *BatchReadRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*BatchReadRequest) ProtoMessage() {}
+
+func (x *BatchReadRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_storage_proto_msgTypes[21]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use BatchReadRequest.ProtoReflect.Descriptor instead.
+func (*BatchReadRequest) Descriptor() ([]byte, []int) {
+	return file_storage_proto_rawDescGZIP(), []int{21}
+}
+
+func (x *BatchReadRequest) GetItems() []*ReadRequest {
+	if x != nil {
+		return x.Items
+	}
+	return nil
+}
+
+// One file of a batch read
+type BatchReadResult struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Status        *ItemStatus            `protobuf:"bytes,1,opt,name=status,proto3" json:"status,omitempty"`
+	Content       []byte                 `protobuf:"bytes,2,opt,name=content,proto3" json:"content,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *BatchReadResult) Reset() {
+	*x = BatchReadResult{}
+	mi := &file_storage_proto_msgTypes[22]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *BatchReadResult) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*BatchReadResult) ProtoMessage() {}
+
+func (x *BatchReadResult) ProtoReflect() protoreflect.Message {
+	mi := &file_storage_proto_msgTypes[22]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use BatchReadResult.ProtoReflect.Descriptor instead.
+func (*BatchReadResult) Descriptor() ([]byte, []int) {
+	return file_storage_proto_rawDescGZIP(), []int{22}
+}
+
+func (x *BatchReadResult) GetStatus() *ItemStatus {
+	if x != nil {
+		return x.Status
+	}
+	return nil
+}
+
+func (x *BatchReadResult) GetContent() []byte {
+	if x != nil {
+		return x.Content
+	}
+	return nil
+}
+
+// Response to a batch read, with one result per file
+type BatchReadResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Results       []*BatchReadResult     `protobuf:"bytes,1,rep,name=results,proto3" json:"results,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *BatchReadResponse) Reset() {
+	*x = BatchReadResponse{}
+	mi := &file_storage_proto_msgTypes[23]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *BatchReadResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*BatchReadResponse) ProtoMessage() {}
+
+func (x *BatchReadResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_storage_proto_msgTypes[23]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use BatchReadResponse.ProtoReflect.Descriptor instead.
+func (*BatchReadResponse) Descriptor() ([]byte, []int) {
+	return file_storage_proto_rawDescGZIP(), []int{23}
+}
+
+func (x *BatchReadResponse) GetResults() []*BatchReadResult {
+	if x != nil {
+		return x.Results
+	}
+	return nil
+}
+
+// Request to delete several files
+type BatchDeleteRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Items         []*DeleteRequest       `protobuf:"bytes,1,rep,name=items,proto3" json:"items,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *BatchDeleteRequest) Reset() {
+	*x = BatchDeleteRequest{}
+	mi := &file_storage_proto_msgTypes[24]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *BatchDeleteRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*BatchDeleteRequest) ProtoMessage() {}
+
+func (x *BatchDeleteRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_storage_proto_msgTypes[24]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use BatchDeleteRequest.ProtoReflect.Descriptor instead.
+func (*BatchDeleteRequest) Descriptor() ([]byte, []int) {
+	return file_storage_proto_rawDescGZIP(), []int{24}
+}
+
+func (x *BatchDeleteRequest) GetItems() []*DeleteRequest {
+	if x != nil {
+		return x.Items
+	}
+	return nil
+}
+
+// Response to a batch delete, with one status per file
+type BatchDeleteResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Statuses      []*ItemStatus          `protobuf:"bytes,1,rep,name=statuses,proto3" json:"statuses,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *BatchDeleteResponse) Reset() {
+	*x = BatchDeleteResponse{}
+	mi := &file_storage_proto_msgTypes[25]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *BatchDeleteResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*BatchDeleteResponse) ProtoMessage() {}
+
+func (x *BatchDeleteResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_storage_proto_msgTypes[25]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use BatchDeleteResponse.ProtoReflect.Descriptor instead.
+func (*BatchDeleteResponse) Descriptor() ([]byte, []int) {
+	return file_storage_proto_rawDescGZIP(), []int{25}
+}
+
+func (x *BatchDeleteResponse) GetStatuses() []*ItemStatus {
+	if x != nil {
+		return x.Statuses
+	}
+	return nil
+}
+
+var File_storage_proto protoreflect.FileDescriptor
+
+const file_storage_proto_rawDesc = "" +
+	"\n" +
+	"\rstorage.proto\x12\x05proto\"D\n" +
+	"\vReadRequest\x12\x19\n" +
+	"\bvideo_id\x18\x01 \x01(\tR\avideoId\x12\x1a\n" +
+	"\bfilename\x18\x02 \x01(\tR\bfilename\"(\n" +
+	"\fReadResponse\x12\x18\n" +
+	"\acontent\x18\x01 \x01(\fR\acontent\"{\n" +
+	"\fWriteRequest\x12\x19\n" +
+	"\bvideo_id\x18\x01 \x01(\tR\avideoId\x12\x1a\n" +
+	"\bfilename\x18\x02 \x01(\tR\bfilename\x12\x18\n" +
+	"\acontent\x18\x03 \x01(\fR\acontent\x12\x1a\n" +
+	"\bchecksum\x18\x04 \x01(\tR\bchecksum\")\n" +
+	"\rWriteResponse\x12\x18\n" +
+	"\asuccess\x18\x01 \x01(\bR\asuccess\"F\n" +
+	"\rDeleteRequest\x12\x19\n" +
+	"\bvideo_id\x18\x01 \x01(\tR\avideoId\x12\x1a\n" +
+	"\bfilename\x18\x02 \x01(\tR\bfilename\"*\n" +
+	"\x0eDeleteResponse\x12\x18\n" +
+	"\asuccess\x18\x01 \x01(\bR\asuccess\"Q\n" +
+	"\x13ListVideoIDsRequest\x12\x1b\n" +
+	"\tpage_size\x18\x01 \x01(\x05R\bpageSize\x12\x1d\n" +
+	"\n" +
+	"page_token\x18\x02 \x01(\tR\tpageToken\"[\n" +
+	"\x14ListVideoIDsResponse\x12\x1b\n" +
+	"\tvideo_ids\x18\x01 \x03(\tR\bvideoIds\x12&\n" +
+	"\x0fnext_page_token\x18\x02 \x01(\tR\rnextPageToken\"i\n" +
+	"\x10ListFilesRequest\x12\x19\n" +
+	"\bvideo_id\x18\x01 \x01(\tR\avideoId\x12\x1b\n" +
+	"\tpage_size\x18\x02 \x01(\x05R\bpageSize\x12\x1d\n" +
+	"\n" +
+	"page_token\x18\x03 \x01(\tR\tpageToken\"Y\n" +
+	"\x11ListFilesResponse\x12\x1c\n" +
+	"\tfilenames\x18\x01 \x03(\tR\tfilenames\x12&\n" +
+	"\x0fnext_page_token\x18\x02 \x01(\tR\rnextPageToken\"h\n" +
+	"\rCopyToRequest\x12\x19\n" +
+	"\bvideo_id\x18\x01 \x01(\tR\avideoId\x12\x1a\n" +
+	"\bfilename\x18\x02 \x01(\tR\bfilename\x12 \n" +
+	"\vdestination\x18\x03 \x01(\tR\vdestination\"@\n" +
+	"\x0eCopyToResponse\x12\x12\n" +
+	"\x04size\x18\x01 \x01(\x03R\x04size\x12\x1a\n" +
+	"\bchecksum\x18\x02 \x01(\tR\bchecksum\"y\n" +
+	"\n" +
+	"WriteChunk\x12\x19\n" +
+	"\bvideo_id\x18\x01 \x01(\tR\avideoId\x12\x1a\n" +
+	"\bfilename\x18\x02 \x01(\tR\bfilename\x12\x18\n" +
+	"\acontent\x18\x03 \x01(\fR\acontent\x12\x1a\n" +
+	"\bchecksum\x18\x04 \x01(\tR\bchecksum\"E\n" +
+	"\x13WriteStreamResponse\x12\x12\n" +
+	"\x04size\x18\x01 \x01(\x03R\x04size\x12\x1a\n" +
+	"\bchecksum\x18\x02 \x01(\tR\bchecksum\"D\n" +
+	"\vStatRequest\x12\x19\n" +
+	"\bvideo_id\x18\x01 \x01(\tR\avideoId\x12\x1a\n" +
+	"\bfilename\x18\x02 \x01(\tR\bfilename\"f\n" +
+	"\fStatResponse\x12\x12\n" +
+	"\x04size\x18\x01 \x01(\x03R\x04size\x12\x1a\n" +
+	"\bchecksum\x18\x02 \x01(\tR\bchecksum\x12&\n" +
+	"\x0fmtime_unix_nano\x18\x03 \x01(\x03R\rmtimeUnixNano\"\x14\n" +
+	"\x12ListAllKeysRequest\"p\n" +
+	"\aKeyInfo\x12\x19\n" +
+	"\bvideo_id\x18\x01 \x01(\tR\avideoId\x12\x1a\n" +
+	"\bfilename\x18\x02 \x01(\tR\bfilename\x12\x12\n" +
+	"\x04size\x18\x03 \x01(\x03R\x04size\x12\x1a\n" +
+	"\bchecksum\x18\x04 \x01(\tR\bchecksum\":\n" +
+	"\n" +
+	"ItemStatus\x12\x12\n" +
+	"\x04code\x18\x01 \x01(\x05R\x04code\x12\x18\n" +
+	"\amessage\x18\x02 \x01(\tR\amessage\">\n" +
+	"\x11BatchWriteRequest\x12)\n" +
+	"\x05items\x18\x01 \x03(\v2\x13.proto.WriteRequestR\x05items\"C\n" +
+	"\x12BatchWriteResponse\x12-\n" +
+	"\bstatuses\x18\x01 \x03(\v2\x11.proto.ItemStatusR\bstatuses\"<\n" +
+	"\x10BatchReadRequest\x12(\n" +
+	"\x05items\x18\x01 \x03(\v2\x12.proto.ReadRequestR\x05items\"V\n" +
+	"\x0fBatchReadResult\x12)\n" +
+	"\x06status\x18\x01 \x01(\v2\x11.proto.ItemStatusR\x06status\x12\x18\n" +
+	"\acontent\x18\x02 \x01(\fR\acontent\"E\n" +
+	"\x11BatchReadResponse\x120\n" +
+	"\aresults\x18\x01 \x03(\v2\x16.proto.BatchReadResultR\aresults\"@\n" +
+	"\x12BatchDeleteRequest\x12*\n" +
+	"\x05items\x18\x01 \x03(\v2\x14.proto.DeleteRequestR\x05items\"D\n" +
+	"\x13BatchDeleteResponse\x12-\n" +
+	"\bstatuses\x18\x01 \x03(\v2\x11.proto.ItemStatusR\bstatuses2\xfa\x05\n" +
+	"\x0eStorageService\x121\n" +
+	"\x04Read\x12\x12.proto.ReadRequest\x1a\x13.proto.ReadResponse\"\x00\x124\n" +
+	"\x05Write\x12\x13.proto.WriteRequest\x1a\x14.proto.WriteResponse\"\x00\x127\n" +
+	"\x06Delete\x12\x14.proto.DeleteRequest\x1a\x15.proto.DeleteResponse\"\x00\x12I\n" +
+	"\fListVideoIDs\x12\x1a.proto.ListVideoIDsRequest\x1a\x1b.proto.ListVideoIDsResponse\"\x00\x12@\n" +
+	"\tListFiles\x12\x17.proto.ListFilesRequest\x1a\x18.proto.ListFilesResponse\"\x00\x127\n" +
+	"\x06CopyTo\x12\x14.proto.CopyToRequest\x1a\x15.proto.CopyToResponse\"\x00\x12@\n" +
+	"\vWriteStream\x12\x11.proto.WriteChunk\x1a\x1a.proto.WriteStreamResponse\"\x00(\x01\x121\n" +
+	"\x04Stat\x12\x12.proto.StatRequest\x1a\x13.proto.StatResponse\"\x00\x12<\n" +
+	"\vListAllKeys\x12\x19.proto.ListAllKeysRequest\x1a\x0e.proto.KeyInfo\"\x000\x01\x12C\n" +
+	"\n" +
+	"BatchWrite\x12\x18.proto.BatchWriteRequest\x1a\x19.proto.BatchWriteResponse\"\x00\x12@\n" +
+	"\tBatchRead\x12\x17.proto.BatchReadRequest\x1a\x18.proto.BatchReadResponse\"\x00\x12F\n" +
+	"\vBatchDelete\x12\x19.proto.BatchDeleteRequest\x1a\x1a.proto.BatchDeleteResponse\"\x00B\x1bZ\x19tritontube/internal/protob\x06proto3"
 
 var (
 	file_storage_proto_rawDescOnce sync.Once
@@ -542,7 +1511,7 @@ func file_storage_proto_rawDescGZIP() []byte {
 	return file_storage_proto_rawDescData
 }
 
-var file_storage_proto_msgTypes = make([]protoimpl.MessageInfo, 10)
+var file_storage_proto_msgTypes = make([]protoimpl.MessageInfo, 26)
 var file_storage_proto_goTypes = []any{
 	(*ReadRequest)(nil),          // 0: proto.ReadRequest
 	(*ReadResponse)(nil),         // 1: proto.ReadResponse
@@ -554,23 +1523,60 @@ var file_storage_proto_goTypes = []any{
 	(*ListVideoIDsResponse)(nil), // 7: proto.ListVideoIDsResponse
 	(*ListFilesRequest)(nil),     // 8: proto.ListFilesRequest
 	(*ListFilesResponse)(nil),    // 9: proto.ListFilesResponse
+	(*CopyToRequest)(nil),        // 10: proto.CopyToRequest
+	(*CopyToResponse)(nil),       // 11: proto.CopyToResponse
+	(*WriteChunk)(nil),           // 12: proto.WriteChunk
+	(*WriteStreamResponse)(nil),  // 13: proto.WriteStreamResponse
+	(*StatRequest)(nil),          // 14: proto.StatRequest
+	(*StatResponse)(nil),         // 15: proto.StatResponse
+	(*ListAllKeysRequest)(nil),   // 16: proto.ListAllKeysRequest
+	(*KeyInfo)(nil),              // 17: proto.KeyInfo
+	(*ItemStatus)(nil),           // 18: proto.ItemStatus
+	(*BatchWriteRequest)(nil),    // 19: proto.BatchWriteRequest
+	(*BatchWriteResponse)(nil),   // 20: proto.BatchWriteResponse
+	(*BatchReadRequest)(nil),     // 21: proto.BatchReadRequest
+	(*BatchReadResult)(nil),      // 22: proto.BatchReadResult
+	(*BatchReadResponse)(nil),    // 23: proto.BatchReadResponse
+	(*BatchDeleteRequest)(nil),   // 24: proto.BatchDeleteRequest
+	(*BatchDeleteResponse)(nil),  // 25: proto.BatchDeleteResponse
 }
 var file_storage_proto_depIdxs = []int32{
-	0, // 0: proto.StorageService.Read:input_type -> proto.ReadRequest
-	2, // 1: proto.StorageService.Write:input_type -> proto.WriteRequest
-	4, // 2: proto.StorageService.Delete:input_type -> proto.DeleteRequest
-	6, // 3: proto.StorageService.ListVideoIDs:input_type -> proto.ListVideoIDsRequest
-	8, // 4: proto.StorageService.ListFiles:input_type -> proto.ListFilesRequest
-	1, // 5: proto.StorageService.Read:output_type -> proto.ReadResponse
-	3, // 6: proto.StorageService.Write:output_type -> proto.WriteResponse
-	5, // 7: proto.StorageService.Delete:output_type -> proto.DeleteResponse
-	7, // 8: proto.StorageService.ListVideoIDs:output_type -> proto.ListVideoIDsResponse
-	9, // 9: proto.StorageService.ListFiles:output_type -> proto.ListFilesResponse
-	5, // [5:10] is the sub-list for method output_type
-	0, // [0:5] is the sub-list for method input_type
-	0, // [0:0] is the sub-list for extension type_name
-	0, // [0:0] is the sub-list for extension extendee
-	0, // [0:0] is the sub-list for field type_name
+	2,  // 0: proto.BatchWriteRequest.items:type_name -> proto.WriteRequest
+	18, // 1: proto.BatchWriteResponse.statuses:type_name -> proto.ItemStatus
+	0,  // 2: proto.BatchReadRequest.items:type_name -> proto.ReadRequest
+	18, // 3: proto.BatchReadResult.status:type_name -> proto.ItemStatus
+	22, // 4: proto.BatchReadResponse.results:type_name -> proto.BatchReadResult
+	4,  // 5: proto.BatchDeleteRequest.items:type_name -> proto.DeleteRequest
+	18, // 6: proto.BatchDeleteResponse.statuses:type_name -> proto.ItemStatus
+	0,  // 7: proto.StorageService.Read:input_type -> proto.ReadRequest
+	2,  // 8: proto.StorageService.Write:input_type -> proto.WriteRequest
+	4,  // 9: proto.StorageService.Delete:input_type -> proto.DeleteRequest
+	6,  // 10: proto.StorageService.ListVideoIDs:input_type -> proto.ListVideoIDsRequest
+	8,  // 11: proto.StorageService.ListFiles:input_type -> proto.ListFilesRequest
+	10, // 12: proto.StorageService.CopyTo:input_type -> proto.CopyToRequest
+	12, // 13: proto.StorageService.WriteStream:input_type -> proto.WriteChunk
+	14, // 14: proto.StorageService.Stat:input_type -> proto.StatRequest
+	16, // 15: proto.StorageService.ListAllKeys:input_type -> proto.ListAllKeysRequest
+	19, // 16: proto.StorageService.BatchWrite:input_type -> proto.BatchWriteRequest
+	21, // 17: proto.StorageService.BatchRead:input_type -> proto.BatchReadRequest
+	24, // 18: proto.StorageService.BatchDelete:input_type -> proto.BatchDeleteRequest
+	1,  // 19: proto.StorageService.Read:output_type -> proto.ReadResponse
+	3,  // 20: proto.StorageService.Write:output_type -> proto.WriteResponse
+	5,  // 21: proto.StorageService.Delete:output_type -> proto.DeleteResponse
+	7,  // 22: proto.StorageService.ListVideoIDs:output_type -> proto.ListVideoIDsResponse
+	9,  // 23: proto.StorageService.ListFiles:output_type -> proto.ListFilesResponse
+	11, // 24: proto.StorageService.CopyTo:output_type -> proto.CopyToResponse
+	13, // 25: proto.StorageService.WriteStream:output_type -> proto.WriteStreamResponse
+	15, // 26: proto.StorageService.Stat:output_type -> proto.StatResponse
+	17, // 27: proto.StorageService.ListAllKeys:output_type -> proto.KeyInfo
+	20, // 28: proto.StorageService.BatchWrite:output_type -> proto.BatchWriteResponse
+	23, // 29: proto.StorageService.BatchRead:output_type -> proto.BatchReadResponse
+	25, // 30: proto.StorageService.BatchDelete:output_type -> proto.BatchDeleteResponse
+	19, // [19:31] is the sub-list for method output_type
+	7,  // [7:19] is the sub-list for method input_type
+	7,  // [7:7] is the sub-list for extension type_name
+	7,  // [7:7] is the sub-list for extension extendee
+	0,  // [0:7] is the sub-list for field type_name
 }
 
 func init() { file_storage_proto_init() }
@@ -584,7 +1590,7 @@ func file_storage_proto_init() {
 			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
 			RawDescriptor: unsafe.Slice(unsafe.StringData(file_storage_proto_rawDesc), len(file_storage_proto_rawDesc)),
 			NumEnums:      0,
-			NumMessages:   10,
+			NumMessages:   26,
 			NumExtensions: 0,
 			NumServices:   1,
 		},
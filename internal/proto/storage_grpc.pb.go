@@ -24,6 +24,13 @@ const (
 	StorageService_Delete_FullMethodName       = "/proto.StorageService/Delete"
 	StorageService_ListVideoIDs_FullMethodName = "/proto.StorageService/ListVideoIDs"
 	StorageService_ListFiles_FullMethodName    = "/proto.StorageService/ListFiles"
+	StorageService_CopyTo_FullMethodName       = "/proto.StorageService/CopyTo"
+	StorageService_WriteStream_FullMethodName  = "/proto.StorageService/WriteStream"
+	StorageService_Stat_FullMethodName         = "/proto.StorageService/Stat"
+	StorageService_ListAllKeys_FullMethodName  = "/proto.StorageService/ListAllKeys"
+	StorageService_BatchWrite_FullMethodName   = "/proto.StorageService/BatchWrite"
+	StorageService_BatchRead_FullMethodName    = "/proto.StorageService/BatchRead"
+	StorageService_BatchDelete_FullMethodName  = "/proto.StorageService/BatchDelete"
 )
 
 // StorageServiceClient is the client API for StorageService service.
@@ -42,6 +49,21 @@ type StorageServiceClient interface {
 	ListVideoIDs(ctx context.Context, in *ListVideoIDsRequest, opts ...grpc.CallOption) (*ListVideoIDsResponse, error)
 	// List all files for a video stored on this node
 	ListFiles(ctx context.Context, in *ListFilesRequest, opts ...grpc.CallOption) (*ListFilesResponse, error)
+	// Copy a file straight to another node, which receives it through
+	// WriteStream, so migrations do not pass it through the web server
+	CopyTo(ctx context.Context, in *CopyToRequest, opts ...grpc.CallOption) (*CopyToResponse, error)
+	// Write a file sent in chunks; the first chunk names the file, and the
+	// file is only kept if it matches the checksum of the last chunk
+	WriteStream(ctx context.Context, opts ...grpc.CallOption) (grpc.ClientStreamingClient[WriteChunk, WriteStreamResponse], error)
+	// Describe a file stored on this node
+	Stat(ctx context.Context, in *StatRequest, opts ...grpc.CallOption) (*StatResponse, error)
+	// Stream every file stored on this node, ordered by video ID and file name
+	ListAllKeys(ctx context.Context, in *ListAllKeysRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[KeyInfo], error)
+	// Write, read or delete several files in one call. Every file is handled
+	// on its own and gets its own status, in the order of the request.
+	BatchWrite(ctx context.Context, in *BatchWriteRequest, opts ...grpc.CallOption) (*BatchWriteResponse, error)
+	BatchRead(ctx context.Context, in *BatchReadRequest, opts ...grpc.CallOption) (*BatchReadResponse, error)
+	BatchDelete(ctx context.Context, in *BatchDeleteRequest, opts ...grpc.CallOption) (*BatchDeleteResponse, error)
 }
 
 type storageServiceClient struct {
@@ -102,6 +124,88 @@ func (c *storageServiceClient) ListFiles(ctx context.Context, in *ListFilesReque
 	return out, nil
 }
 
+func (c *storageServiceClient) CopyTo(ctx context.Context, in *CopyToRequest, opts ...grpc.CallOption) (*CopyToResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(CopyToResponse)
+	err := c.cc.Invoke(ctx, StorageService_CopyTo_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *storageServiceClient) WriteStream(ctx context.Context, opts ...grpc.CallOption) (grpc.ClientStreamingClient[WriteChunk, WriteStreamResponse], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &StorageService_ServiceDesc.Streams[0], StorageService_WriteStream_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[WriteChunk, WriteStreamResponse]{ClientStream: stream}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type StorageService_WriteStreamClient = grpc.ClientStreamingClient[WriteChunk, WriteStreamResponse]
+
+func (c *storageServiceClient) Stat(ctx context.Context, in *StatRequest, opts ...grpc.CallOption) (*StatResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(StatResponse)
+	err := c.cc.Invoke(ctx, StorageService_Stat_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *storageServiceClient) ListAllKeys(ctx context.Context, in *ListAllKeysRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[KeyInfo], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &StorageService_ServiceDesc.Streams[1], StorageService_ListAllKeys_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[ListAllKeysRequest, KeyInfo]{ClientStream: stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type StorageService_ListAllKeysClient = grpc.ServerStreamingClient[KeyInfo]
+
+func (c *storageServiceClient) BatchWrite(ctx context.Context, in *BatchWriteRequest, opts ...grpc.CallOption) (*BatchWriteResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(BatchWriteResponse)
+	err := c.cc.Invoke(ctx, StorageService_BatchWrite_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *storageServiceClient) BatchRead(ctx context.Context, in *BatchReadRequest, opts ...grpc.CallOption) (*BatchReadResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(BatchReadResponse)
+	err := c.cc.Invoke(ctx, StorageService_BatchRead_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *storageServiceClient) BatchDelete(ctx context.Context, in *BatchDeleteRequest, opts ...grpc.CallOption) (*BatchDeleteResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(BatchDeleteResponse)
+	err := c.cc.Invoke(ctx, StorageService_BatchDelete_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 // StorageServiceServer is the server API for StorageService service.
 // All implementations must embed UnimplementedStorageServiceServer
 // for forward compatibility.
@@ -118,6 +222,21 @@ type StorageServiceServer interface {
 	ListVideoIDs(context.Context, *ListVideoIDsRequest) (*ListVideoIDsResponse, error)
 	// List all files for a video stored on this node
 	ListFiles(context.Context, *ListFilesRequest) (*ListFilesResponse, error)
+	// Copy a file straight to another node, which receives it through
+	// WriteStream, so migrations do not pass it through the web server
+	CopyTo(context.Context, *CopyToRequest) (*CopyToResponse, error)
+	// Write a file sent in chunks; the first chunk names the file, and the
+	// file is only kept if it matches the checksum of the last chunk
+	WriteStream(grpc.ClientStreamingServer[WriteChunk, WriteStreamResponse]) error
+	// Describe a file stored on this node
+	Stat(context.Context, *StatRequest) (*StatResponse, error)
+	// Stream every file stored on this node, ordered by video ID and file name
+	ListAllKeys(*ListAllKeysRequest, grpc.ServerStreamingServer[KeyInfo]) error
+	// Write, read or delete several files in one call. Every file is handled
+	// on its own and gets its own status, in the order of the request.
+	BatchWrite(context.Context, *BatchWriteRequest) (*BatchWriteResponse, error)
+	BatchRead(context.Context, *BatchReadRequest) (*BatchReadResponse, error)
+	BatchDelete(context.Context, *BatchDeleteRequest) (*BatchDeleteResponse, error)
 	mustEmbedUnimplementedStorageServiceServer()
 }
 
@@ -143,6 +262,27 @@ func (UnimplementedStorageServiceServer) ListVideoIDs(context.Context, *ListVide
 func (UnimplementedStorageServiceServer) ListFiles(context.Context, *ListFilesRequest) (*ListFilesResponse, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method ListFiles not implemented")
 }
+func (UnimplementedStorageServiceServer) CopyTo(context.Context, *CopyToRequest) (*CopyToResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method CopyTo not implemented")
+}
+func (UnimplementedStorageServiceServer) WriteStream(grpc.ClientStreamingServer[WriteChunk, WriteStreamResponse]) error {
+	return status.Errorf(codes.Unimplemented, "method WriteStream not implemented")
+}
+func (UnimplementedStorageServiceServer) Stat(context.Context, *StatRequest) (*StatResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Stat not implemented")
+}
+func (UnimplementedStorageServiceServer) ListAllKeys(*ListAllKeysRequest, grpc.ServerStreamingServer[KeyInfo]) error {
+	return status.Errorf(codes.Unimplemented, "method ListAllKeys not implemented")
+}
+func (UnimplementedStorageServiceServer) BatchWrite(context.Context, *BatchWriteRequest) (*BatchWriteResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method BatchWrite not implemented")
+}
+func (UnimplementedStorageServiceServer) BatchRead(context.Context, *BatchReadRequest) (*BatchReadResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method BatchRead not implemented")
+}
+func (UnimplementedStorageServiceServer) BatchDelete(context.Context, *BatchDeleteRequest) (*BatchDeleteResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method BatchDelete not implemented")
+}
 func (UnimplementedStorageServiceServer) mustEmbedUnimplementedStorageServiceServer() {}
 func (UnimplementedStorageServiceServer) testEmbeddedByValue()                        {}
 
@@ -254,6 +394,114 @@ func _StorageService_ListFiles_Handler(srv interface{}, ctx context.Context, dec
 	return interceptor(ctx, in, info, handler)
 }
 
+func _StorageService_CopyTo_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(CopyToRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(StorageServiceServer).CopyTo(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: StorageService_CopyTo_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(StorageServiceServer).CopyTo(ctx, req.(*CopyToRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _StorageService_WriteStream_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(StorageServiceServer).WriteStream(&grpc.GenericServerStream[WriteChunk, WriteStreamResponse]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type StorageService_WriteStreamServer = grpc.ClientStreamingServer[WriteChunk, WriteStreamResponse]
+
+func _StorageService_Stat_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(StatRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(StorageServiceServer).Stat(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: StorageService_Stat_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(StorageServiceServer).Stat(ctx, req.(*StatRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _StorageService_ListAllKeys_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(ListAllKeysRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(StorageServiceServer).ListAllKeys(m, &grpc.GenericServerStream[ListAllKeysRequest, KeyInfo]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type StorageService_ListAllKeysServer = grpc.ServerStreamingServer[KeyInfo]
+
+func _StorageService_BatchWrite_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(BatchWriteRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(StorageServiceServer).BatchWrite(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: StorageService_BatchWrite_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(StorageServiceServer).BatchWrite(ctx, req.(*BatchWriteRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _StorageService_BatchRead_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(BatchReadRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(StorageServiceServer).BatchRead(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: StorageService_BatchRead_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(StorageServiceServer).BatchRead(ctx, req.(*BatchReadRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _StorageService_BatchDelete_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(BatchDeleteRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(StorageServiceServer).BatchDelete(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: StorageService_BatchDelete_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(StorageServiceServer).BatchDelete(ctx, req.(*BatchDeleteRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
 // StorageService_ServiceDesc is the grpc.ServiceDesc for StorageService service.
 // It's only intended for direct use with grpc.RegisterService,
 // and not to be introspected or modified (even as a copy)
@@ -281,7 +529,38 @@ var StorageService_ServiceDesc = grpc.ServiceDesc{
 			MethodName: "ListFiles",
 			Handler:    _StorageService_ListFiles_Handler,
 		},
+		{
+			MethodName: "CopyTo",
+			Handler:    _StorageService_CopyTo_Handler,
+		},
+		{
+			MethodName: "Stat",
+			Handler:    _StorageService_Stat_Handler,
+		},
+		{
+			MethodName: "BatchWrite",
+			Handler:    _StorageService_BatchWrite_Handler,
+		},
+		{
+			MethodName: "BatchRead",
+			Handler:    _StorageService_BatchRead_Handler,
+		},
+		{
+			MethodName: "BatchDelete",
+			Handler:    _StorageService_BatchDelete_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "WriteStream",
+			Handler:       _StorageService_WriteStream_Handler,
+			ClientStreams: true,
+		},
+		{
+			StreamName:    "ListAllKeys",
+			Handler:       _StorageService_ListAllKeys_Handler,
+			ServerStreams: true,
+		},
 	},
-	Streams:  []grpc.StreamDesc{},
 	Metadata: "storage.proto",
 }
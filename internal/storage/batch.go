@@ -0,0 +1,72 @@
+package storage
+
+import (
+	"context"
+	"os"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "tritontube/internal/proto"
+)
+
+const (
+	// maxBatchReadFiles and maxBatchReadBytes bound what one BatchRead
+	// answers, whatever the caller asks for, keeping the response below
+	// gRPC's 4 MB default message size limit. Files past them are answered
+	// with ResourceExhausted, for the caller to read on their own.
+	maxBatchReadFiles = 64
+	maxBatchReadBytes = 3 << 20
+)
+
+// itemStatus describes the outcome of one file of a batch
+func itemStatus(err error) *pb.ItemStatus {
+	st := status.Convert(err)
+	return &pb.ItemStatus{Code: int32(st.Code()), Message: st.Message()}
+}
+
+// BatchWrite writes every file of the request. A file that cannot be written
+// does not keep the others from being written.
+func (s *StorageServer) BatchWrite(ctx context.Context, req *pb.BatchWriteRequest) (*pb.BatchWriteResponse, error) {
+	resp := &pb.BatchWriteResponse{Statuses: make([]*pb.ItemStatus, len(req.Items))}
+	for i, item := range req.Items {
+		resp.Statuses[i] = itemStatus(s.writeFile(item))
+	}
+	return resp, nil
+}
+
+// BatchRead reads the files of the request, as many as fit in one response.
+// The first file is always read, however large.
+func (s *StorageServer) BatchRead(ctx context.Context, req *pb.BatchReadRequest) (*pb.BatchReadResponse, error) {
+	resp := &pb.BatchReadResponse{Results: make([]*pb.BatchReadResult, len(req.Items))}
+	var size int64
+	for i, item := range req.Items {
+		if i > 0 && (i >= maxBatchReadFiles || size+s.fileSize(item) > maxBatchReadBytes) {
+			err := status.Errorf(codes.ResourceExhausted, "batch is too large for %s/%s, read it on its own", item.VideoId, item.Filename)
+			resp.Results[i] = &pb.BatchReadResult{Status: itemStatus(err)}
+			continue
+		}
+		content, err := s.readFile(item)
+		resp.Results[i] = &pb.BatchReadResult{Status: itemStatus(err), Content: content}
+		size += int64(len(content))
+	}
+	return resp, nil
+}
+
+// fileSize returns the size of a file, 0 if it cannot be read
+func (s *StorageServer) fileSize(req *pb.ReadRequest) int64 {
+	info, err := os.Stat(s.getFilePath(req.VideoId, req.Filename))
+	if err != nil {
+		return 0
+	}
+	return info.Size()
+}
+
+// BatchDelete deletes every file of the request
+func (s *StorageServer) BatchDelete(ctx context.Context, req *pb.BatchDeleteRequest) (*pb.BatchDeleteResponse, error) {
+	resp := &pb.BatchDeleteResponse{Statuses: make([]*pb.ItemStatus, len(req.Items))}
+	for i, item := range req.Items {
+		resp.Statuses[i] = itemStatus(s.deleteFile(item))
+	}
+	return resp, nil
+}
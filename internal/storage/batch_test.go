@@ -0,0 +1,89 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+
+	pb "tritontube/internal/proto"
+)
+
+func TestBatchReadStatuses(t *testing.T) {
+	const mb = 1 << 20
+	tests := []struct {
+		name  string
+		sizes []int // of the files read in turn; -1 for a missing file
+		want  []codes.Code
+	}{
+		{"every file", []int{10, 20, 30}, []codes.Code{codes.OK, codes.OK, codes.OK}},
+		{"missing file", []int{10, -1, 30}, []codes.Code{codes.OK, codes.NotFound, codes.OK}},
+		{"up to the byte cap", []int{mb, mb, mb, 1}, []codes.Code{codes.OK, codes.OK, codes.OK, codes.ResourceExhausted}},
+		{"smaller files still fit", []int{2 * mb, 2 * mb, 10}, []codes.Code{codes.OK, codes.ResourceExhausted, codes.OK}},
+		{"missing files do not count", []int{-1, 3 * mb, -1}, []codes.Code{codes.NotFound, codes.OK, codes.NotFound}},
+		{"large first file", []int{5 * mb, 10}, []codes.Code{codes.OK, codes.ResourceExhausted}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := testServer(t)
+			req := &pb.BatchReadRequest{}
+			for i, size := range tt.sizes {
+				item := &pb.ReadRequest{VideoId: "v", Filename: fmt.Sprintf("f%d", i)}
+				if size >= 0 {
+					content := bytes.Repeat([]byte{byte(i)}, size)
+					if err := s.writeFile(&pb.WriteRequest{VideoId: item.VideoId, Filename: item.Filename, Content: content}); err != nil {
+						t.Fatal(err)
+					}
+				}
+				req.Items = append(req.Items, item)
+			}
+
+			resp, err := s.BatchRead(context.Background(), req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(resp.Results) != len(tt.want) {
+				t.Fatalf("BatchRead() answered %d of %d files", len(resp.Results), len(tt.want))
+			}
+			for i, result := range resp.Results {
+				if code := codes.Code(result.Status.Code); code != tt.want[i] {
+					t.Errorf("file %d: %v (%s), want %v", i, code, result.Status.Message, tt.want[i])
+				}
+				if wantSize := tt.sizes[i]; tt.want[i] == codes.OK && len(result.Content) != wantSize {
+					t.Errorf("file %d: %d bytes, want %d", i, len(result.Content), wantSize)
+				}
+				if tt.want[i] != codes.OK && len(result.Content) != 0 {
+					t.Errorf("file %d: content sent with status %v", i, tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestBatchReadFileCap(t *testing.T) {
+	s := testServer(t)
+	req := &pb.BatchReadRequest{}
+	for i := 0; i < maxBatchReadFiles+6; i++ {
+		item := &pb.ReadRequest{VideoId: "v", Filename: fmt.Sprintf("f%d", i)}
+		if err := s.writeFile(&pb.WriteRequest{VideoId: item.VideoId, Filename: item.Filename, Content: []byte("x")}); err != nil {
+			t.Fatal(err)
+		}
+		req.Items = append(req.Items, item)
+	}
+
+	resp, err := s.BatchRead(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, result := range resp.Results {
+		want := codes.OK
+		if i >= maxBatchReadFiles {
+			want = codes.ResourceExhausted
+		}
+		if code := codes.Code(result.Status.Code); code != want {
+			t.Errorf("file %d: %v, want %v", i, code, want)
+		}
+	}
+}
@@ -0,0 +1,263 @@
+package storage
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/status"
+
+	"tritontube/internal/logging"
+	pb "tritontube/internal/proto"
+)
+
+const (
+	// copyChunkSize is how much of a file each WriteChunk carries
+	copyChunkSize = 1 << 20
+	// incomingPrefix names the files WriteStream receives into; they are
+	// renamed into place once complete, and removed on startup if left over
+	incomingPrefix = ".incoming-"
+)
+
+// SetPeerCredentials sets the credentials CopyTo dials other nodes with,
+// e.g. a client certificate they accept. Nodes are dialed in plaintext
+// otherwise. It must be called before the server is used.
+func (s *StorageServer) SetPeerCredentials(creds credentials.TransportCredentials) {
+	s.peerCreds = creds
+}
+
+// EnableCopyTo lets callers have this node send files to other nodes with
+// CopyTo. Callers pick the destination, so the node would dial any address
+// it is asked to: peers limits it to the given node addresses. Nil allows
+// any destination, which is only safe when every caller is authenticated by
+// a client certificate. Without it, CopyTo is unimplemented and the web
+// server relays files itself. It must be called before the server is used.
+func (s *StorageServer) EnableCopyTo(peers []string) {
+	s.copyTo = true
+	if peers != nil {
+		s.copyPeers = make(map[string]bool, len(peers))
+		for _, peer := range peers {
+			s.copyPeers[peer] = true
+		}
+	}
+}
+
+// peer returns the connection to another node, dialing it the first time
+func (s *StorageServer) peer(addr string) (*grpc.ClientConn, error) {
+	s.peersMu.Lock()
+	defer s.peersMu.Unlock()
+
+	if conn, ok := s.peers[addr]; ok {
+		return conn, nil
+	}
+	conn, err := grpc.Dial(addr,
+		grpc.WithTransportCredentials(s.peerCreds),
+		grpc.WithUnaryInterceptor(logging.UnaryClientInterceptor()),
+		grpc.WithStreamInterceptor(logging.StreamClientInterceptor()),
+		grpc.WithStatsHandler(otelgrpc.NewClientHandler()),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to node %s: %v", addr, err)
+	}
+	s.peers[addr] = conn
+	return conn, nil
+}
+
+// removeIncoming deletes files left by transfers that never finished
+func removeIncoming(storageDir string) error {
+	entries, err := os.ReadDir(storageDir)
+	if err != nil {
+		return fmt.Errorf("failed to read storage directory: %v", err)
+	}
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), incomingPrefix) {
+			os.Remove(filepath.Join(storageDir, entry.Name()))
+		}
+	}
+	return nil
+}
+
+// CopyTo streams a file to the destination node, and fails unless the
+// destination received exactly what was sent
+func (s *StorageServer) CopyTo(ctx context.Context, req *pb.CopyToRequest) (*pb.CopyToResponse, error) {
+	if !s.copyTo {
+		return nil, status.Error(codes.Unimplemented, "CopyTo is not enabled on this node")
+	}
+	if s.copyPeers != nil && !s.copyPeers[req.Destination] {
+		return nil, status.Errorf(codes.PermissionDenied, "node %s is not a peer of this node", req.Destination)
+	}
+	file, err := os.Open(s.getFilePath(req.VideoId, req.Filename))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read file: %v", err)
+	}
+	defer file.Close()
+
+	conn, err := s.peer(req.Destination)
+	if err != nil {
+		return nil, err
+	}
+	stream, err := pb.NewStorageServiceClient(conn).WriteStream(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to copy to node %s: %v", req.Destination, err)
+	}
+
+	hash := sha256.New()
+	var size int64
+	chunk := &pb.WriteChunk{VideoId: req.VideoId, Filename: req.Filename}
+	for {
+		// A sent chunk may still be looked at by stats handlers, so each
+		// gets its own buffer
+		buf := make([]byte, copyChunkSize)
+		n, readErr := io.ReadFull(file, buf)
+		if readErr != nil && readErr != io.EOF && readErr != io.ErrUnexpectedEOF {
+			stream.CloseSend()
+			return nil, fmt.Errorf("failed to read file: %v", readErr)
+		}
+		if n > 0 || size == 0 {
+			hash.Write(buf[:n])
+			size += int64(n)
+			chunk.Content = buf[:n]
+			if err := stream.Send(chunk); err != nil {
+				// The stream's actual error comes with its response
+				_, err = stream.CloseAndRecv()
+				return nil, fmt.Errorf("failed to copy to node %s: %v", req.Destination, err)
+			}
+			chunk = &pb.WriteChunk{}
+		}
+		if readErr != nil {
+			break
+		}
+	}
+	checksum := hex.EncodeToString(hash.Sum(nil))
+	// The destination refuses the file if it does not match
+	if err := stream.Send(&pb.WriteChunk{Checksum: checksum}); err != nil {
+		_, err = stream.CloseAndRecv()
+		return nil, fmt.Errorf("failed to copy to node %s: %v", req.Destination, err)
+	}
+	resp, err := stream.CloseAndRecv()
+	if err != nil {
+		return nil, fmt.Errorf("failed to copy to node %s: %v", req.Destination, err)
+	}
+	bytesRead.Add(float64(size))
+
+	if resp.Size != size || resp.Checksum != checksum {
+		return nil, status.Errorf(codes.DataLoss, "node %s received %d bytes with checksum %s, sent %d bytes with checksum %s",
+			req.Destination, resp.Size, resp.Checksum, size, checksum)
+	}
+	return &pb.CopyToResponse{Size: size, Checksum: checksum}, nil
+}
+
+// WriteStream receives a file in chunks. It only replaces the stored file
+// once every chunk arrived and the content matches the checksum the sender
+// gave, so a broken or corrupted transfer leaves nothing behind.
+func (s *StorageServer) WriteStream(stream pb.StorageService_WriteStreamServer) error {
+	chunk, err := stream.Recv()
+	if err == io.EOF {
+		return status.Error(codes.InvalidArgument, "no file was sent")
+	}
+	if err != nil {
+		return err
+	}
+	if chunk.VideoId == "" || chunk.Filename == "" {
+		return status.Error(codes.InvalidArgument, "the first chunk must name the file")
+	}
+	videoID, filename := chunk.VideoId, chunk.Filename
+
+	incoming, err := os.CreateTemp(s.storageDir, incomingPrefix+"*")
+	if err != nil {
+		return fmt.Errorf("failed to create file: %v", err)
+	}
+	defer func() {
+		incoming.Close()
+		os.Remove(incoming.Name())
+	}()
+
+	hash := sha256.New()
+	out := io.MultiWriter(incoming, hash)
+	var size int64
+	var want string // checksum the sender expects; senders before it send none
+	for {
+		if _, err := out.Write(chunk.Content); err != nil {
+			return fmt.Errorf("failed to write file: %v", err)
+		}
+		size += int64(len(chunk.Content))
+		if chunk.Checksum != "" {
+			want = chunk.Checksum
+		}
+
+		chunk, err = stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if err := incoming.Close(); err != nil {
+		return fmt.Errorf("failed to write file: %v", err)
+	}
+
+	checksum := hex.EncodeToString(hash.Sum(nil))
+	if want != "" && want != checksum {
+		return status.Errorf(codes.DataLoss, "received %s/%s with checksum %s, sent with checksum %s", videoID, filename, checksum, want)
+	}
+	if err := s.replaceFile(incoming.Name(), videoID, filename, checksum); err != nil {
+		return err
+	}
+	bytesWritten.Add(float64(size))
+
+	return stream.SendAndClose(&pb.WriteStreamResponse{Size: size, Checksum: checksum})
+}
+
+// replaceFile moves a received file into place and indexes it
+func (s *StorageServer) replaceFile(received, videoID, filename, checksum string) error {
+	filePath := s.getFilePath(videoID, filename)
+	defer s.lockVideo(videoID)()
+
+	if err := os.MkdirAll(filepath.Dir(filePath), 0755); err != nil {
+		return fmt.Errorf("failed to create directory: %v", err)
+	}
+	if err := os.Rename(received, filePath); err != nil {
+		return fmt.Errorf("failed to write file: %v", err)
+	}
+	return s.indexFile(videoID, filename, checksum)
+}
+
+// Stat describes a file from the index. A file changed or added behind the
+// node's back is checksummed again and reindexed.
+func (s *StorageServer) Stat(ctx context.Context, req *pb.StatRequest) (*pb.StatResponse, error) {
+	defer s.lockVideo(req.VideoId)()
+	info, err := os.Stat(s.getFilePath(req.VideoId, req.Filename))
+	if os.IsNotExist(err) {
+		s.index.remove(req.VideoId, req.Filename)
+		return nil, status.Errorf(codes.NotFound, "no file %s/%s", req.VideoId, req.Filename)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read file: %v", err)
+	}
+
+	f, ok, err := s.index.get(req.VideoId, req.Filename)
+	if err != nil {
+		return nil, err
+	}
+	if !ok || f.Size != info.Size() || !f.ModTime.Equal(info.ModTime()) {
+		checksum, err := checksumFile(s.getFilePath(req.VideoId, req.Filename))
+		if err != nil {
+			return nil, err
+		}
+		f = fileInfo{VideoID: req.VideoId, Filename: req.Filename, Size: info.Size(), Checksum: checksum, ModTime: info.ModTime()}
+		if err := s.index.put(f); err != nil {
+			return nil, err
+		}
+	}
+	return &pb.StatResponse{Size: f.Size, Checksum: f.Checksum, MtimeUnixNano: f.ModTime.UnixNano()}, nil
+}
@@ -0,0 +1,159 @@
+package storage
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"testing"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "tritontube/internal/proto"
+)
+
+// fakeWriteStream hands WriteStream the given chunks and keeps its response
+type fakeWriteStream struct {
+	grpc.ServerStream
+	chunks []*pb.WriteChunk
+	resp   *pb.WriteStreamResponse
+}
+
+func (f *fakeWriteStream) Recv() (*pb.WriteChunk, error) {
+	if len(f.chunks) == 0 {
+		return nil, io.EOF
+	}
+	chunk := f.chunks[0]
+	f.chunks = f.chunks[1:]
+	return chunk, nil
+}
+
+func (f *fakeWriteStream) SendAndClose(resp *pb.WriteStreamResponse) error {
+	f.resp = resp
+	return nil
+}
+
+func checksumOf(content string) string {
+	sum := sha256.Sum256([]byte(content))
+	return hex.EncodeToString(sum[:])
+}
+
+func TestWriteStreamChecksum(t *testing.T) {
+	tests := []struct {
+		name     string
+		checksum string // sent in the last chunk
+		wantCode codes.Code
+	}{
+		{"matching checksum", checksumOf("hello world"), codes.OK},
+		{"no checksum from an older sender", "", codes.OK},
+		{"mismatched checksum", checksumOf("something else"), codes.DataLoss},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := testServer(t)
+			stream := &fakeWriteStream{chunks: []*pb.WriteChunk{
+				{VideoId: "v", Filename: "f", Content: []byte("hello ")},
+				{Content: []byte("world")},
+				{Checksum: tt.checksum},
+			}}
+
+			err := s.WriteStream(stream)
+			if code := status.Code(err); code != tt.wantCode {
+				t.Fatalf("WriteStream() = %v, want code %v", err, tt.wantCode)
+			}
+			content, readErr := os.ReadFile(s.getFilePath("v", "f"))
+			_, indexed, indexErr := s.index.get("v", "f")
+			if indexErr != nil {
+				t.Fatal(indexErr)
+			}
+			if err != nil {
+				if readErr == nil || indexed {
+					t.Errorf("refused file was stored: %q, indexed %v", content, indexed)
+				}
+			} else {
+				if string(content) != "hello world" || !indexed {
+					t.Errorf("stored %q (%v), indexed %v, want %q", content, readErr, indexed, "hello world")
+				}
+				if stream.resp.Checksum != checksumOf("hello world") || stream.resp.Size != 11 {
+					t.Errorf("WriteStream() answered %v", stream.resp)
+				}
+			}
+
+			entries, err := os.ReadDir(s.storageDir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, entry := range entries {
+				if strings.HasPrefix(entry.Name(), incomingPrefix) {
+					t.Errorf("%s left behind", entry.Name())
+				}
+			}
+		})
+	}
+}
+
+// serve serves s on a local port and returns its address
+func serve(t *testing.T, s *StorageServer) string {
+	t.Helper()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := grpc.NewServer()
+	pb.RegisterStorageServiceServer(server, s)
+	go server.Serve(lis)
+	t.Cleanup(server.Stop)
+	return lis.Addr().String()
+}
+
+func TestCopyToDestinations(t *testing.T) {
+	dst := testServer(t)
+	dstAddr := serve(t, dst)
+
+	tests := []struct {
+		name        string
+		enabled     bool
+		peers       []string
+		destination string
+		wantCode    codes.Code
+	}{
+		{"disabled", false, nil, dstAddr, codes.Unimplemented},
+		{"to a peer", true, []string{dstAddr}, dstAddr, codes.OK},
+		{"to another address", true, []string{dstAddr}, "169.254.169.254:80", codes.PermissionDenied},
+		{"any destination", true, nil, dstAddr, codes.OK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			src := testServer(t)
+			if tt.enabled {
+				src.EnableCopyTo(tt.peers)
+			}
+			if err := src.writeFile(&pb.WriteRequest{VideoId: "v", Filename: tt.name, Content: []byte(tt.name)}); err != nil {
+				t.Fatal(err)
+			}
+
+			resp, err := src.CopyTo(context.Background(), &pb.CopyToRequest{VideoId: "v", Filename: tt.name, Destination: tt.destination})
+			if code := status.Code(err); code != tt.wantCode {
+				t.Fatalf("CopyTo() = %v, want code %v", err, tt.wantCode)
+			}
+			if err != nil {
+				if len(src.peers) != 0 {
+					t.Errorf("refused CopyTo() dialed %d nodes", len(src.peers))
+				}
+				return
+			}
+			if resp.Checksum != checksumOf(tt.name) {
+				t.Errorf("CopyTo() checksum %s, want %s", resp.Checksum, checksumOf(tt.name))
+			}
+			content, err := os.ReadFile(dst.getFilePath("v", tt.name))
+			if err != nil || string(content) != tt.name {
+				t.Errorf("destination has %q, %v, want %q", content, err, tt.name)
+			}
+		})
+	}
+}
@@ -0,0 +1,368 @@
+package storage
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// IndexFile is the name of the index database in a node's storage directory.
+// Being a file, it is never taken for a video, which are directories.
+const IndexFile = ".index.db"
+
+var (
+	indexedVideos = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "tritontube_storage_videos",
+		Help: "Videos with at least one file on this node.",
+	})
+	indexedFiles = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "tritontube_storage_files",
+		Help: "Files stored on this node.",
+	})
+	indexedBytes = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "tritontube_storage_bytes",
+		Help: "Total size of the files stored on this node.",
+	})
+)
+
+// fileInfo describes a stored file
+type fileInfo struct {
+	VideoID  string
+	Filename string
+	Size     int64
+	Checksum string // hex SHA-256 of the content
+	ModTime  time.Time
+}
+
+// index is a node's SQLite catalog of the files it stores, so listings and
+// stats do not have to scan the storage directory. It is rebuilt from disk
+// when the node starts, and kept up to date by the node's own writes and
+// deletes; files changed behind the node's back are picked up on restart.
+type index struct {
+	db *sql.DB
+
+	// mu serializes writes so the counts below follow the table; they are
+	// loaded by rebuild and adjusted by put and remove
+	mu         sync.Mutex
+	videoFiles map[string]int64 // files stored per video
+	fileCount  int64
+	byteCount  int64
+}
+
+func openIndex(path string) (*index, error) {
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open index: %v", err)
+	}
+	_, err = db.Exec(`
+		PRAGMA journal_mode = WAL;
+		CREATE TABLE IF NOT EXISTS files (
+			video_id TEXT NOT NULL,
+			filename TEXT NOT NULL,
+			size INTEGER NOT NULL,
+			checksum TEXT NOT NULL,
+			mtime INTEGER NOT NULL,
+			PRIMARY KEY (video_id, filename)
+		)
+	`)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to create index: %v", err)
+	}
+	return &index{db: db, videoFiles: make(map[string]int64)}, nil
+}
+
+// put adds or replaces a file
+func (x *index) put(f fileInfo) error {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	old, replaced, err := x.get(f.VideoID, f.Filename)
+	if err != nil {
+		return fmt.Errorf("failed to index file: %v", err)
+	}
+	_, err = x.db.Exec(`
+		INSERT INTO files (video_id, filename, size, checksum, mtime) VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT (video_id, filename) DO UPDATE SET size = excluded.size, checksum = excluded.checksum, mtime = excluded.mtime
+	`, f.VideoID, f.Filename, f.Size, f.Checksum, f.ModTime.UnixNano())
+	if err != nil {
+		return fmt.Errorf("failed to index file: %v", err)
+	}
+	if replaced {
+		x.byteCount += f.Size - old.Size
+	} else {
+		x.videoFiles[f.VideoID]++
+		x.fileCount++
+		x.byteCount += f.Size
+	}
+	x.publish()
+	return nil
+}
+
+// remove drops a file
+func (x *index) remove(videoID, filename string) error {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	old, indexed, err := x.get(videoID, filename)
+	if err != nil {
+		return fmt.Errorf("failed to unindex file: %v", err)
+	}
+	if !indexed {
+		return nil
+	}
+	_, err = x.db.Exec(`DELETE FROM files WHERE video_id = ? AND filename = ?`, videoID, filename)
+	if err != nil {
+		return fmt.Errorf("failed to unindex file: %v", err)
+	}
+	if x.videoFiles[videoID]--; x.videoFiles[videoID] <= 0 {
+		delete(x.videoFiles, videoID)
+	}
+	x.fileCount--
+	x.byteCount -= old.Size
+	x.publish()
+	return nil
+}
+
+// get returns a file, or false if it is not indexed
+func (x *index) get(videoID, filename string) (fileInfo, bool, error) {
+	f := fileInfo{VideoID: videoID, Filename: filename}
+	var mtime int64
+	err := x.db.QueryRow(`SELECT size, checksum, mtime FROM files WHERE video_id = ? AND filename = ?`,
+		videoID, filename).Scan(&f.Size, &f.Checksum, &mtime)
+	if err == sql.ErrNoRows {
+		return f, false, nil
+	}
+	if err != nil {
+		return f, false, fmt.Errorf("failed to look up file: %v", err)
+	}
+	f.ModTime = time.Unix(0, mtime)
+	return f, true, nil
+}
+
+// videoIDs returns up to limit video IDs after the given one, in order; a
+// limit of 0 returns all of them
+func (x *index) videoIDs(after string, limit int) ([]string, error) {
+	rows, err := x.db.Query(`SELECT DISTINCT video_id FROM files WHERE video_id > ? ORDER BY video_id LIMIT ?`,
+		after, sqlLimit(limit))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list videos: %v", err)
+	}
+	defer rows.Close()
+
+	videoIDs := []string{}
+	for rows.Next() {
+		var videoID string
+		if err := rows.Scan(&videoID); err != nil {
+			return nil, fmt.Errorf("failed to list videos: %v", err)
+		}
+		videoIDs = append(videoIDs, videoID)
+	}
+	return videoIDs, rows.Err()
+}
+
+// files returns up to limit files of a video after the given file name, in
+// order; a limit of 0 returns all of them
+func (x *index) files(videoID, after string, limit int) ([]fileInfo, error) {
+	rows, err := x.db.Query(`SELECT filename, size, checksum, mtime FROM files WHERE video_id = ? AND filename > ? ORDER BY filename LIMIT ?`,
+		videoID, after, sqlLimit(limit))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list files: %v", err)
+	}
+	defer rows.Close()
+
+	files := []fileInfo{}
+	for rows.Next() {
+		f := fileInfo{VideoID: videoID}
+		var mtime int64
+		if err := rows.Scan(&f.Filename, &f.Size, &f.Checksum, &mtime); err != nil {
+			return nil, fmt.Errorf("failed to list files: %v", err)
+		}
+		f.ModTime = time.Unix(0, mtime)
+		files = append(files, f)
+	}
+	return files, rows.Err()
+}
+
+// keys returns up to limit files of any video after the given one, ordered
+// by video ID and file name
+func (x *index) keys(afterVideo, afterFile string, limit int) ([]fileInfo, error) {
+	rows, err := x.db.Query(`SELECT video_id, filename, size, checksum, mtime FROM files WHERE (video_id, filename) > (?, ?) ORDER BY video_id, filename LIMIT ?`,
+		afterVideo, afterFile, sqlLimit(limit))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list files: %v", err)
+	}
+	defer rows.Close()
+
+	files := []fileInfo{}
+	for rows.Next() {
+		var f fileInfo
+		var mtime int64
+		if err := rows.Scan(&f.VideoID, &f.Filename, &f.Size, &f.Checksum, &mtime); err != nil {
+			return nil, fmt.Errorf("failed to list files: %v", err)
+		}
+		f.ModTime = time.Unix(0, mtime)
+		files = append(files, f)
+	}
+	return files, rows.Err()
+}
+
+// sqlLimit turns a limit of 0 into SQLite's "no limit"
+func sqlLimit(limit int) int {
+	if limit <= 0 {
+		return -1
+	}
+	return limit
+}
+
+// loadCounts counts the files of every video and their size, once after a
+// rebuild; put and remove keep the counts up to date from then on. x.mu must
+// be held.
+func (x *index) loadCounts() error {
+	rows, err := x.db.Query(`SELECT video_id, COUNT(*), SUM(size) FROM files GROUP BY video_id`)
+	if err != nil {
+		return fmt.Errorf("failed to count files: %v", err)
+	}
+	defer rows.Close()
+
+	videoFiles := make(map[string]int64)
+	var fileCount, byteCount int64
+	for rows.Next() {
+		var videoID string
+		var files, bytes int64
+		if err := rows.Scan(&videoID, &files, &bytes); err != nil {
+			return fmt.Errorf("failed to count files: %v", err)
+		}
+		videoFiles[videoID] = files
+		fileCount += files
+		byteCount += bytes
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to count files: %v", err)
+	}
+	x.videoFiles, x.fileCount, x.byteCount = videoFiles, fileCount, byteCount
+	x.publish()
+	return nil
+}
+
+// publish exports the counts as gauges. x.mu must be held.
+func (x *index) publish() {
+	indexedVideos.Set(float64(len(x.videoFiles)))
+	indexedFiles.Set(float64(x.fileCount))
+	indexedBytes.Set(float64(x.byteCount))
+}
+
+// rebuild makes the index match the files in storageDir. Files whose size
+// and modification time are unchanged keep their checksum; the others are
+// read again.
+func (x *index) rebuild(storageDir string) error {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	start := time.Now()
+	known := make(map[[2]string]fileInfo)
+	rows, err := x.db.Query(`SELECT video_id, filename, size, checksum, mtime FROM files`)
+	if err != nil {
+		return fmt.Errorf("failed to read index: %v", err)
+	}
+	for rows.Next() {
+		var f fileInfo
+		var mtime int64
+		if err := rows.Scan(&f.VideoID, &f.Filename, &f.Size, &f.Checksum, &mtime); err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to read index: %v", err)
+		}
+		f.ModTime = time.Unix(0, mtime)
+		known[[2]string{f.VideoID, f.Filename}] = f
+	}
+	rows.Close()
+
+	tx, err := x.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to rebuild index: %v", err)
+	}
+	defer tx.Rollback()
+
+	videos, err := os.ReadDir(storageDir)
+	if err != nil {
+		return fmt.Errorf("failed to read storage directory: %v", err)
+	}
+	var hashed int
+	for _, video := range videos {
+		if !video.IsDir() {
+			continue
+		}
+		entries, err := os.ReadDir(filepath.Join(storageDir, video.Name()))
+		if err != nil {
+			return fmt.Errorf("failed to read video directory: %v", err)
+		}
+		for _, entry := range entries {
+			if entry.IsDir() {
+				continue
+			}
+			info, err := entry.Info()
+			if err != nil {
+				return fmt.Errorf("failed to read video directory: %v", err)
+			}
+			key := [2]string{video.Name(), entry.Name()}
+			f, ok := known[key]
+			delete(known, key)
+			if ok && f.Size == info.Size() && f.ModTime.Equal(info.ModTime()) {
+				continue
+			}
+			checksum, err := checksumFile(filepath.Join(storageDir, video.Name(), entry.Name()))
+			if err != nil {
+				return err
+			}
+			hashed++
+			_, err = tx.Exec(`
+				INSERT INTO files (video_id, filename, size, checksum, mtime) VALUES (?, ?, ?, ?, ?)
+				ON CONFLICT (video_id, filename) DO UPDATE SET size = excluded.size, checksum = excluded.checksum, mtime = excluded.mtime
+			`, video.Name(), entry.Name(), info.Size(), checksum, info.ModTime().UnixNano())
+			if err != nil {
+				return fmt.Errorf("failed to index file: %v", err)
+			}
+		}
+	}
+	// Whatever is left is gone from disk
+	for _, f := range known {
+		if _, err := tx.Exec(`DELETE FROM files WHERE video_id = ? AND filename = ?`, f.VideoID, f.Filename); err != nil {
+			return fmt.Errorf("failed to unindex file: %v", err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to rebuild index: %v", err)
+	}
+
+	if err := x.loadCounts(); err != nil {
+		return err
+	}
+	slog.Info("Indexed stored files", "videos", len(x.videoFiles), "files", x.fileCount, "checksummed", hashed, "removed", len(known), "duration", time.Since(start))
+	return nil
+}
+
+// checksumFile returns the hex SHA-256 of a file's content
+func checksumFile(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read file: %v", err)
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", fmt.Errorf("failed to read file: %v", err)
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
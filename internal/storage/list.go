@@ -0,0 +1,70 @@
+package storage
+
+import (
+	"encoding/base64"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "tritontube/internal/proto"
+)
+
+const (
+	// maxPageSize bounds a page of a listing, keeping responses well below
+	// gRPC's message size limit
+	maxPageSize = 10000
+	// keyBatchSize is how many files ListAllKeys reads from the index at a
+	// time
+	keyBatchSize = 1000
+)
+
+// pageToken returns the token of the page after the given last entry
+func pageToken(last string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(last))
+}
+
+// parsePage returns the entry a page starts after, and how many entries it
+// holds at most
+func parsePage(token string, size int32) (string, int, error) {
+	if size < 0 {
+		return "", 0, status.Error(codes.InvalidArgument, "page size must not be negative")
+	}
+	after, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return "", 0, status.Error(codes.InvalidArgument, "invalid page token")
+	}
+	limit := int(size)
+	if limit == 0 || limit > maxPageSize {
+		limit = maxPageSize
+	}
+	return string(after), limit, nil
+}
+
+// ListAllKeys streams every file on the node. The index is read in batches,
+// so files written or deleted meanwhile, e.g. by a migration walking the
+// listing, neither stall it nor make it skip files.
+func (s *StorageServer) ListAllKeys(req *pb.ListAllKeysRequest, stream pb.StorageService_ListAllKeysServer) error {
+	var afterVideo, afterFile string
+	for {
+		files, err := s.index.keys(afterVideo, afterFile, keyBatchSize)
+		if err != nil {
+			return err
+		}
+		for _, f := range files {
+			err := stream.Send(&pb.KeyInfo{
+				VideoId:  f.VideoID,
+				Filename: f.Filename,
+				Size:     f.Size,
+				Checksum: f.Checksum,
+			})
+			if err != nil {
+				return err
+			}
+		}
+		if len(files) < keyBatchSize {
+			return nil
+		}
+		last := files[len(files)-1]
+		afterVideo, afterFile = last.VideoID, last.Filename
+	}
+}
@@ -0,0 +1,230 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "tritontube/internal/proto"
+)
+
+// putKeys indexes files without storing them; listings only read the index
+func putKeys(t *testing.T, s *StorageServer, keys ...string) {
+	t.Helper()
+	for _, key := range keys {
+		videoID, filename, _ := strings.Cut(key, "/")
+		if err := s.index.put(fileInfo{VideoID: videoID, Filename: filename, Size: 1, Checksum: "c"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestListVideoIDsPages(t *testing.T) {
+	tests := []struct {
+		name      string
+		videos    int
+		pageSize  int32
+		wantPages []int // videos on each page
+	}{
+		{"one page", 3, 0, []int{3}},
+		{"last page shorter", 7, 3, []int{3, 3, 1}},
+		{"last page full", 6, 3, []int{3, 3, 0}},
+		{"no videos", 0, 3, []int{0}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := testServer(t)
+			var want []string
+			for i := 0; i < tt.videos; i++ {
+				videoID := fmt.Sprintf("video%02d", i)
+				// Videos with several files are listed once
+				putKeys(t, s, videoID+"/manifest.mpd", videoID+"/chunk-0.m4s")
+				want = append(want, videoID)
+			}
+
+			var got []string
+			req := &pb.ListVideoIDsRequest{PageSize: tt.pageSize}
+			for page := 0; ; page++ {
+				if page == len(tt.wantPages) {
+					t.Fatalf("more than %d pages", len(tt.wantPages))
+				}
+				resp, err := s.ListVideoIDs(context.Background(), req)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(resp.VideoIds) != tt.wantPages[page] {
+					t.Errorf("page %d holds %d videos, want %d", page, len(resp.VideoIds), tt.wantPages[page])
+				}
+				got = append(got, resp.VideoIds...)
+				if resp.NextPageToken == "" {
+					if page != len(tt.wantPages)-1 {
+						t.Errorf("listing ended after page %d, want %d pages", page, len(tt.wantPages))
+					}
+					break
+				}
+				req.PageToken = resp.NextPageToken
+			}
+			if fmt.Sprint(got) != fmt.Sprint(want) {
+				t.Errorf("listed %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestListPageErrors(t *testing.T) {
+	s := testServer(t)
+	for _, req := range []*pb.ListFilesRequest{
+		{VideoId: "v", PageToken: "not base64!"},
+		{VideoId: "v", PageSize: -1},
+	} {
+		if _, err := s.ListFiles(context.Background(), req); status.Code(err) != codes.InvalidArgument {
+			t.Errorf("ListFiles(%v) = %v, want code %v", req, err, codes.InvalidArgument)
+		}
+	}
+}
+
+// A page continues after the last file listed, so files added or deleted
+// between pages are listed once or not at all
+func TestListFilesChangesBetweenPages(t *testing.T) {
+	s := testServer(t)
+	putKeys(t, s, "v/a", "v/b", "v/c", "v/d", "v/e", "w/a")
+
+	first, err := s.ListFiles(context.Background(), &pb.ListFilesRequest{VideoId: "v", PageSize: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(first.Filenames) != "[a b]" || first.NextPageToken == "" {
+		t.Fatalf("first page = %v, token %q", first.Filenames, first.NextPageToken)
+	}
+
+	// Added before the cursor, added after it, deleted after it
+	putKeys(t, s, "v/a0", "v/bb")
+	if err := s.index.remove("v", "c"); err != nil {
+		t.Fatal(err)
+	}
+
+	var rest []string
+	req := &pb.ListFilesRequest{VideoId: "v", PageSize: 2, PageToken: first.NextPageToken}
+	for {
+		resp, err := s.ListFiles(context.Background(), req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rest = append(rest, resp.Filenames...)
+		if resp.NextPageToken == "" {
+			break
+		}
+		req.PageToken = resp.NextPageToken
+	}
+	if got, want := fmt.Sprint(rest), "[bb d e]"; got != want {
+		t.Errorf("rest of the listing = %s, want %s", got, want)
+	}
+}
+
+// fakeKeyStream collects what ListAllKeys sends, calling onSend after each
+type fakeKeyStream struct {
+	grpc.ServerStream
+	keys   []string
+	onSend func(sent int)
+}
+
+func (f *fakeKeyStream) Send(key *pb.KeyInfo) error {
+	f.keys = append(f.keys, key.VideoId+"/"+key.Filename)
+	if f.onSend != nil {
+		f.onSend(len(f.keys))
+	}
+	return nil
+}
+
+func TestListAllKeys(t *testing.T) {
+	tests := []struct {
+		name  string
+		files int
+	}{
+		{"no files", 0},
+		{"one batch", keyBatchSize - 1},
+		{"exactly one batch", keyBatchSize},
+		{"several batches", 2*keyBatchSize + 5},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := testServer(t)
+			var want []string
+			for i := 0; i < tt.files; i++ {
+				key := fmt.Sprintf("video%d/chunk-%05d.m4s", i%3, i)
+				putKeys(t, s, key)
+				want = append(want, key)
+			}
+
+			stream := &fakeKeyStream{}
+			if err := s.ListAllKeys(&pb.ListAllKeysRequest{}, stream); err != nil {
+				t.Fatal(err)
+			}
+			if len(stream.keys) != len(want) {
+				t.Fatalf("listed %d files, want %d", len(stream.keys), len(want))
+			}
+			seen := make(map[string]bool)
+			for i, key := range stream.keys {
+				if i > 0 && key <= stream.keys[i-1] {
+					t.Fatalf("%s listed after %s", key, stream.keys[i-1])
+				}
+				seen[key] = true
+			}
+			for _, key := range want {
+				if !seen[key] {
+					t.Errorf("%s not listed", key)
+				}
+			}
+		})
+	}
+}
+
+func TestListAllKeysChangesWhileListing(t *testing.T) {
+	s := testServer(t)
+	for i := 0; i < 2*keyBatchSize; i++ {
+		putKeys(t, s, fmt.Sprintf("v/%05d", i))
+	}
+
+	stream := &fakeKeyStream{}
+	stream.onSend = func(sent int) {
+		if sent != 10 {
+			return
+		}
+		// While the first batch is sent: a file added before the cursor, one
+		// added in the next batch, and one deleted from the next batch
+		putKeys(t, s, "v/00000a", fmt.Sprintf("v/%05da", keyBatchSize+10))
+		if err := s.index.remove("v", fmt.Sprintf("%05d", keyBatchSize+20)); err != nil {
+			t.Error(err)
+		}
+	}
+	if err := s.ListAllKeys(&pb.ListAllKeysRequest{}, stream); err != nil {
+		t.Fatal(err)
+	}
+
+	listed := make(map[string]int)
+	for _, key := range stream.keys {
+		listed[key]++
+	}
+	for key, n := range listed {
+		if n > 1 {
+			t.Errorf("%s listed %d times", key, n)
+		}
+	}
+	if listed["v/00000a"] != 0 {
+		t.Error("file added before the cursor was listed")
+	}
+	if added := fmt.Sprintf("v/%05da", keyBatchSize+10); listed[added] != 1 {
+		t.Errorf("%s added ahead of the cursor was not listed", added)
+	}
+	if deleted := fmt.Sprintf("v/%05d", keyBatchSize+20); listed[deleted] != 0 {
+		t.Errorf("%s deleted ahead of the cursor was listed", deleted)
+	}
+	if want := 2 * keyBatchSize; len(stream.keys) != want {
+		t.Errorf("listed %d files, want %d", len(stream.keys), want)
+	}
+}
@@ -4,17 +4,58 @@ package storage
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
+	"hash/fnv"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
 
 	pb "tritontube/internal/proto"
 )
 
+var (
+	bytesRead = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "tritontube_storage_bytes_read_total",
+		Help: "Bytes of files read from this node.",
+	})
+	bytesWritten = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "tritontube_storage_bytes_written_total",
+		Help: "Bytes of files written to this node.",
+	})
+)
+
+// videoLockStripes is how many locks the node's videos are spread over
+const videoLockStripes = 64
+
 type StorageServer struct {
 	pb.UnimplementedStorageServiceServer
 	storageDir string
+	index      *index
+
+	// videoLocks serialize changes to a video's files with the index
+	// entries recording them, so the index and its gauges follow the disk.
+	// Locking by video also covers creating and removing its directory.
+	videoLocks [videoLockStripes]sync.Mutex
+
+	// Connections to the nodes CopyTo sends files to
+	peerCreds credentials.TransportCredentials
+	peersMu   sync.Mutex
+	peers     map[string]*grpc.ClientConn
+	// copyTo is false until EnableCopyTo; copyPeers are the destinations
+	// it allows, any if nil
+	copyTo    bool
+	copyPeers map[string]bool
 }
 
 func NewStorageServer(storageDir string) (*StorageServer, error) {
@@ -22,7 +63,53 @@ func NewStorageServer(storageDir string) (*StorageServer, error) {
 	if err := os.MkdirAll(storageDir, 0755); err != nil {
 		return nil, fmt.Errorf("failed to create storage directory: %v", err)
 	}
-	return &StorageServer{storageDir: storageDir}, nil
+	if err := removeIncoming(storageDir); err != nil {
+		return nil, err
+	}
+	index, err := openIndex(filepath.Join(storageDir, IndexFile))
+	if err != nil {
+		return nil, err
+	}
+	if err := index.rebuild(storageDir); err != nil {
+		index.db.Close()
+		return nil, err
+	}
+	return &StorageServer{
+		storageDir: storageDir,
+		index:      index,
+		peerCreds:  insecure.NewCredentials(),
+		peers:      make(map[string]*grpc.ClientConn),
+	}, nil
+}
+
+// Close closes the node's index
+func (s *StorageServer) Close() error {
+	return s.index.db.Close()
+}
+
+// indexFile records a file just written, whose checksum is known
+func (s *StorageServer) indexFile(videoID, filename, checksum string) error {
+	info, err := os.Stat(s.getFilePath(videoID, filename))
+	if err != nil {
+		return fmt.Errorf("failed to index file: %v", err)
+	}
+	return s.index.put(fileInfo{
+		VideoID:  videoID,
+		Filename: filename,
+		Size:     info.Size(),
+		Checksum: checksum,
+		ModTime:  info.ModTime(),
+	})
+}
+
+// lockVideo locks changes to videoID's files until the returned func is
+// called
+func (s *StorageServer) lockVideo(videoID string) func() {
+	h := fnv.New32a()
+	h.Write([]byte(videoID))
+	mu := &s.videoLocks[h.Sum32()%videoLockStripes]
+	mu.Lock()
+	return mu.Unlock
 }
 
 func (s *StorageServer) getFilePath(videoID, filename string) string {
@@ -30,36 +117,75 @@ func (s *StorageServer) getFilePath(videoID, filename string) string {
 }
 
 func (s *StorageServer) Read(ctx context.Context, req *pb.ReadRequest) (*pb.ReadResponse, error) {
+	content, err := s.readFile(req)
+	if err != nil {
+		return nil, err
+	}
+	return &pb.ReadResponse{Content: content}, nil
+}
+
+func (s *StorageServer) Write(ctx context.Context, req *pb.WriteRequest) (*pb.WriteResponse, error) {
+	if err := s.writeFile(req); err != nil {
+		return nil, err
+	}
+	return &pb.WriteResponse{Success: true}, nil
+}
+
+func (s *StorageServer) Delete(ctx context.Context, req *pb.DeleteRequest) (*pb.DeleteResponse, error) {
+	if err := s.deleteFile(req); err != nil {
+		return nil, err
+	}
+	return &pb.DeleteResponse{Success: true}, nil
+}
+
+// readFile returns the content of a file
+func (s *StorageServer) readFile(req *pb.ReadRequest) ([]byte, error) {
 	filePath := s.getFilePath(req.VideoId, req.Filename)
 	content, err := ioutil.ReadFile(filePath)
+	if os.IsNotExist(err) {
+		return nil, status.Errorf(codes.NotFound, "no file %s/%s", req.VideoId, req.Filename)
+	}
 	if err != nil {
 		return nil, fmt.Errorf("failed to read file: %v", err)
 	}
-	return &pb.ReadResponse{Content: content}, nil
+	bytesRead.Add(float64(len(content)))
+	return content, nil
 }
 
-func (s *StorageServer) Write(ctx context.Context, req *pb.WriteRequest) (*pb.WriteResponse, error) {
+// writeFile stores a file and records it in the index
+func (s *StorageServer) writeFile(req *pb.WriteRequest) error {
 	filePath := s.getFilePath(req.VideoId, req.Filename)
+	defer s.lockVideo(req.VideoId)()
 
 	// Create directory if it doesn't exist
 	dir := filepath.Dir(filePath)
 	if err := os.MkdirAll(dir, 0755); err != nil {
-		return nil, fmt.Errorf("failed to create directory: %v", err)
+		return fmt.Errorf("failed to create directory: %v", err)
 	}
 
 	// Write file
 	if err := ioutil.WriteFile(filePath, req.Content, 0644); err != nil {
-		return nil, fmt.Errorf("failed to write file: %v", err)
+		return fmt.Errorf("failed to write file: %v", err)
 	}
-
-	return &pb.WriteResponse{Success: true}, nil
+	bytesWritten.Add(float64(len(req.Content)))
+	sum := sha256.Sum256(req.Content)
+	return s.indexFile(req.VideoId, req.Filename, hex.EncodeToString(sum[:]))
 }
 
-func (s *StorageServer) Delete(ctx context.Context, req *pb.DeleteRequest) (*pb.DeleteResponse, error) {
+// deleteFile removes a file and its entry in the index
+func (s *StorageServer) deleteFile(req *pb.DeleteRequest) error {
 	filePath := s.getFilePath(req.VideoId, req.Filename)
+	defer s.lockVideo(req.VideoId)()
 
 	if err := os.Remove(filePath); err != nil {
-		return nil, fmt.Errorf("failed to delete file: %v", err)
+		if os.IsNotExist(err) {
+			s.index.remove(req.VideoId, req.Filename)
+			return status.Errorf(codes.NotFound, "no file %s/%s", req.VideoId, req.Filename)
+		}
+		return fmt.Errorf("failed to delete file: %v", err)
+	}
+	if err := s.index.remove(req.VideoId, req.Filename); err != nil {
+		return err
 	}
 
 	// Try to remove the video directory if it's empty
@@ -68,48 +194,41 @@ func (s *StorageServer) Delete(ctx context.Context, req *pb.DeleteRequest) (*pb.
 		// Ignore error if directory is not empty
 	}
 
-	return &pb.DeleteResponse{Success: true}, nil
+	return nil
 }
 
 func (s *StorageServer) ListVideoIDs(ctx context.Context, req *pb.ListVideoIDsRequest) (*pb.ListVideoIDsResponse, error) {
-	// Read all directories in the storage directory
-	entries, err := ioutil.ReadDir(s.storageDir)
+	after, limit, err := parsePage(req.PageToken, req.PageSize)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read storage directory: %v", err)
+		return nil, err
 	}
-
-	// Collect all directory names as video IDs
-	videoIDs := make([]string, 0, len(entries))
-	for _, entry := range entries {
-		if entry.IsDir() {
-			videoIDs = append(videoIDs, entry.Name())
-		}
+	videoIDs, err := s.index.videoIDs(after, limit)
+	if err != nil {
+		return nil, err
 	}
-
-	return &pb.ListVideoIDsResponse{VideoIds: videoIDs}, nil
+	resp := &pb.ListVideoIDsResponse{VideoIds: videoIDs}
+	if len(videoIDs) == limit {
+		resp.NextPageToken = pageToken(videoIDs[len(videoIDs)-1])
+	}
+	return resp, nil
 }
 
 func (s *StorageServer) ListFiles(ctx context.Context, req *pb.ListFilesRequest) (*pb.ListFilesResponse, error) {
-	videoDir := filepath.Join(s.storageDir, req.VideoId)
-
-	// Check if video directory exists
-	if _, err := os.Stat(videoDir); os.IsNotExist(err) {
-		return &pb.ListFilesResponse{Filenames: []string{}}, nil
+	after, limit, err := parsePage(req.PageToken, req.PageSize)
+	if err != nil {
+		return nil, err
 	}
-
-	// Read all files in the video directory
-	entries, err := ioutil.ReadDir(videoDir)
+	files, err := s.index.files(req.VideoId, after, limit)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read video directory: %v", err)
+		return nil, err
 	}
-
-	// Collect all file names
-	filenames := make([]string, 0, len(entries))
-	for _, entry := range entries {
-		if !entry.IsDir() {
-			filenames = append(filenames, entry.Name())
-		}
+	filenames := make([]string, 0, len(files))
+	for _, f := range files {
+		filenames = append(filenames, f.Filename)
 	}
-
-	return &pb.ListFilesResponse{Filenames: filenames}, nil
+	resp := &pb.ListFilesResponse{Filenames: filenames}
+	if len(filenames) == limit {
+		resp.NextPageToken = pageToken(filenames[len(filenames)-1])
+	}
+	return resp, nil
 }
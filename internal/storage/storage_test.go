@@ -0,0 +1,92 @@
+package storage
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"sync"
+	"testing"
+
+	pb "tritontube/internal/proto"
+)
+
+func testServer(t *testing.T) *StorageServer {
+	t.Helper()
+	s, err := NewStorageServer(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+// checkIndex fails unless the index and its counts describe exactly the
+// given files
+func checkIndex(t *testing.T, s *StorageServer, videoIDs, filenames []string) {
+	t.Helper()
+	var files, bytes int64
+	videoFiles := make(map[string]int64)
+	for _, videoID := range videoIDs {
+		for _, filename := range filenames {
+			info, statErr := os.Stat(s.getFilePath(videoID, filename))
+			f, ok, err := s.index.get(videoID, filename)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ok != (statErr == nil) {
+				t.Fatalf("%s/%s indexed %v, on disk %v", videoID, filename, ok, statErr == nil)
+			}
+			if !ok {
+				continue
+			}
+			if f.Size != info.Size() {
+				t.Errorf("%s/%s indexed with %d bytes, has %d", videoID, filename, f.Size, info.Size())
+			}
+			files++
+			bytes += info.Size()
+			videoFiles[videoID]++
+		}
+	}
+
+	s.index.mu.Lock()
+	defer s.index.mu.Unlock()
+	if s.index.fileCount != files || s.index.byteCount != bytes {
+		t.Errorf("index counts %d files, %d bytes, want %d, %d", s.index.fileCount, s.index.byteCount, files, bytes)
+	}
+	for _, videoID := range videoIDs {
+		if s.index.videoFiles[videoID] != videoFiles[videoID] {
+			t.Errorf("index counts %d files of %s, want %d", s.index.videoFiles[videoID], videoID, videoFiles[videoID])
+		}
+	}
+}
+
+func TestWriteDeleteKeepIndex(t *testing.T) {
+	s := testServer(t)
+	videoIDs := []string{"a", "b"}
+	filenames := []string{"manifest.mpd", "chunk-0.m4s", "chunk-1.m4s"}
+
+	var wg sync.WaitGroup
+	for worker := 0; worker < 8; worker++ {
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+			r := rand.New(rand.NewSource(seed))
+			for i := 0; i < 200; i++ {
+				videoID := videoIDs[r.Intn(len(videoIDs))]
+				filename := filenames[r.Intn(len(filenames))]
+				if r.Intn(2) == 0 {
+					content := []byte(fmt.Sprintf("%0*d", r.Intn(100), i))
+					if err := s.writeFile(&pb.WriteRequest{VideoId: videoID, Filename: filename, Content: content}); err != nil {
+						t.Errorf("writeFile(%s/%s) = %v", videoID, filename, err)
+					}
+				} else {
+					// NotFound is fine, the file may not be there
+					s.deleteFile(&pb.DeleteRequest{VideoId: videoID, Filename: filename})
+				}
+			}
+		}(int64(worker))
+	}
+	wg.Wait()
+
+	checkIndex(t, s, videoIDs, filenames)
+}
@@ -0,0 +1,221 @@
+// Package tlsutil loads TLS certificates from files and picks up new
+// versions of them without a restart, so certificates can be rotated on
+// running web servers and storage nodes.
+package tlsutil
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// checkInterval bounds how often the files are checked for changes
+const checkInterval = time.Second
+
+// Reloader holds a certificate, its key and optionally a CA bundle read from
+// files. Handshakes check at most once per checkInterval whether any of the
+// files changed and reload them if so; Reload forces a reload, e.g. on
+// SIGHUP. A reload that fails keeps the previous certificates in use.
+type Reloader struct {
+	certFile string
+	keyFile  string
+	caFile   string // empty if peers are not verified against a private CA
+
+	mu        sync.RWMutex
+	cert      *tls.Certificate
+	pool      *x509.CertPool
+	modTimes  [3]time.Time
+	lastCheck time.Time
+}
+
+// NewReloader loads the certificate and key, and the CA bundle if caFile is
+// not empty
+func NewReloader(certFile, keyFile, caFile string) (*Reloader, error) {
+	r := &Reloader{certFile: certFile, keyFile: keyFile, caFile: caFile}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Reload reads the files again
+func (r *Reloader) Reload() error {
+	modTimes, err := r.modTimes3()
+	if err != nil {
+		return err
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load certificate %s: %v", r.certFile, err)
+	}
+	var pool *x509.CertPool
+	if r.caFile != "" {
+		data, err := os.ReadFile(r.caFile)
+		if err != nil {
+			return fmt.Errorf("failed to read CA bundle: %v", err)
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return fmt.Errorf("no certificates found in CA bundle %s", r.caFile)
+		}
+	}
+
+	r.mu.Lock()
+	r.cert = &cert
+	r.pool = pool
+	r.modTimes = modTimes
+	r.lastCheck = time.Now()
+	r.mu.Unlock()
+	return nil
+}
+
+// ReloadOnSIGHUP reloads the files whenever the process gets SIGHUP, in
+// addition to the reload on file changes
+func (r *Reloader) ReloadOnSIGHUP() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			if err := r.Reload(); err != nil {
+				slog.Error("Failed to reload TLS certificate", "cert", r.certFile, "error", err)
+			} else {
+				slog.Info("Reloaded TLS certificate", "cert", r.certFile)
+			}
+		}
+	}()
+}
+
+func (r *Reloader) modTimes3() ([3]time.Time, error) {
+	var times [3]time.Time
+	for i, file := range []string{r.certFile, r.keyFile, r.caFile} {
+		if file == "" {
+			continue
+		}
+		info, err := os.Stat(file)
+		if err != nil {
+			return times, fmt.Errorf("failed to stat %s: %v", file, err)
+		}
+		times[i] = info.ModTime()
+	}
+	return times, nil
+}
+
+// current returns the loaded certificate and CA pool, reloading them first
+// if the files changed since they were read
+func (r *Reloader) current() (*tls.Certificate, *x509.CertPool) {
+	r.mu.RLock()
+	cert, pool, due := r.cert, r.pool, time.Since(r.lastCheck) >= checkInterval
+	r.mu.RUnlock()
+	if !due {
+		return cert, pool
+	}
+
+	r.mu.Lock()
+	r.lastCheck = time.Now()
+	r.mu.Unlock()
+	// A file that is half written or briefly missing during a rotation is
+	// simply tried again at a later handshake
+	if modTimes, err := r.modTimes3(); err == nil && modTimes != r.loadedModTimes() {
+		if err := r.Reload(); err != nil {
+			slog.Warn("Keeping previous TLS certificate", "cert", r.certFile, "error", err)
+		} else {
+			slog.Info("Reloaded TLS certificate", "cert", r.certFile)
+		}
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cert, r.pool
+}
+
+func (r *Reloader) loadedModTimes() [3]time.Time {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.modTimes
+}
+
+// ServerConfig returns a server configuration that always presents the
+// current certificate. With a CA bundle, clients must present a certificate
+// signed by it (mutual TLS).
+//
+// The configuration is otherwise left alone, so gRPC and net/http can still
+// add the application protocols they negotiate to it.
+func (r *Reloader) ServerConfig() *tls.Config {
+	config := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			cert, _ := r.current()
+			return cert, nil
+		},
+	}
+	if r.caFile != "" {
+		// ClientCAs cannot follow a changing CA bundle, so the chain is
+		// checked by VerifyPeerCertificate against the current one instead
+		config.ClientAuth = tls.RequireAnyClientCert
+		config.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			_, pool := r.current()
+			return verifyChain(rawCerts, pool, "", x509.ExtKeyUsageClientAuth)
+		}
+	}
+	return config
+}
+
+// ClientConfig returns a client configuration that presents the current
+// certificate and verifies servers against the current CA bundle, or the
+// system roots if there is none.
+func (r *Reloader) ClientConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			cert, _ := r.current()
+			return cert, nil
+		},
+		// RootCAs cannot follow a changing CA bundle either. The built-in
+		// verification is therefore replaced by VerifyConnection, which does
+		// the same checks against the current bundle; it is never skipped.
+		InsecureSkipVerify: true,
+		VerifyConnection: func(state tls.ConnectionState) error {
+			_, pool := r.current()
+			var rawCerts [][]byte
+			for _, cert := range state.PeerCertificates {
+				rawCerts = append(rawCerts, cert.Raw)
+			}
+			return verifyChain(rawCerts, pool, state.ServerName, x509.ExtKeyUsageServerAuth)
+		},
+	}
+}
+
+// verifyChain checks a peer's certificate chain like crypto/tls does when
+// it verifies peers itself. A nil pool means the system roots; an empty
+// dnsName skips the host name check, as is usual for client certificates.
+func verifyChain(rawCerts [][]byte, roots *x509.CertPool, dnsName string, usage x509.ExtKeyUsage) error {
+	if len(rawCerts) == 0 {
+		return fmt.Errorf("peer presented no certificate")
+	}
+	certs := make([]*x509.Certificate, len(rawCerts))
+	for i, raw := range rawCerts {
+		cert, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return fmt.Errorf("failed to parse peer certificate: %v", err)
+		}
+		certs[i] = cert
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err := certs[0].Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		DNSName:       dnsName,
+		KeyUsages:     []x509.ExtKeyUsage{usage},
+	})
+	return err
+}
@@ -0,0 +1,109 @@
+// Package tracing sets up OpenTelemetry tracing for the TritonTube servers.
+//
+// Trace context travels between the web server and the storage nodes in the
+// W3C traceparent header, which the gRPC instrumentation in the web and
+// storage packages adds to and reads from the call metadata. Incoming HTTP
+// requests may carry one too, so a trace can start at a load balancer.
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+// Exporters are where finished spans can be sent
+const (
+	// ExporterNone records no spans; trace context is still passed on
+	ExporterNone = "none"
+	// ExporterStdout writes every span as a JSON object, one after another
+	ExporterStdout = "stdout"
+	// ExporterOTLP sends spans to an OpenTelemetry collector over gRPC
+	ExporterOTLP = "otlp"
+)
+
+// Config selects the exporter of a process
+type Config struct {
+	Exporter string
+	// Endpoint is the host:port of the OTLP collector
+	Endpoint string
+	// Insecure sends spans to the collector without TLS
+	Insecure bool
+	// File receives the spans of the stdout exporter; empty means stdout
+	File string
+	// SampleRatio is the fraction of new traces that are recorded. Calls that
+	// are part of a trace follow the decision of their caller.
+	SampleRatio float64
+}
+
+// Setup installs the global tracer provider and propagator for the service
+// with the given name. The returned function flushes the spans still
+// buffered and must be called before the process exits.
+func Setup(serviceName string, cfg Config) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{}, propagation.Baggage{}))
+
+	var exporter sdktrace.SpanExporter
+	var closer io.Closer
+	switch cfg.Exporter {
+	case ExporterNone, "":
+		return func(context.Context) error { return nil }, nil
+	case ExporterStdout:
+		var out io.Writer = os.Stdout
+		if cfg.File != "" {
+			file, err := os.OpenFile(cfg.File, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+			if err != nil {
+				return nil, fmt.Errorf("failed to open trace file: %v", err)
+			}
+			out, closer = file, file
+		}
+		var err error
+		exporter, err = stdouttrace.New(stdouttrace.WithWriter(out))
+		if err != nil {
+			return nil, fmt.Errorf("failed to create stdout exporter: %v", err)
+		}
+	case ExporterOTLP:
+		opts := []otlptracegrpc.Option{otlptracegrpc.WithEndpoint(cfg.Endpoint)}
+		if cfg.Insecure {
+			opts = append(opts, otlptracegrpc.WithInsecure())
+		}
+		var err error
+		// The connection is made lazily, so a collector that is not up yet
+		// does not keep the server from starting
+		exporter, err = otlptracegrpc.New(context.Background(), opts...)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create OTLP exporter: %v", err)
+		}
+	default:
+		return nil, fmt.Errorf("unknown trace exporter %q", cfg.Exporter)
+	}
+
+	res, err := resource.Merge(resource.Default(),
+		resource.NewSchemaless(attribute.String("service.name", serviceName)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to describe service: %v", err)
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(cfg.SampleRatio))),
+	)
+	otel.SetTracerProvider(provider)
+
+	return func(ctx context.Context) error {
+		err := provider.Shutdown(ctx)
+		if closer != nil {
+			closer.Close()
+		}
+		return err
+	}, nil
+}
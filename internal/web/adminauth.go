@@ -0,0 +1,172 @@
+package web
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+
+	"tritontube/internal/proto"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// AdminRole is what a caller of the admin gRPC service is allowed to do
+type AdminRole string
+
+const (
+	// AdminRoleViewer may inspect the cluster
+	AdminRoleViewer AdminRole = "viewer"
+	// AdminRoleOperator may also add and remove storage nodes
+	AdminRoleOperator AdminRole = "operator"
+)
+
+// adminRoleRank orders the roles; a role may call everything a lower one may
+var adminRoleRank = map[AdminRole]int{AdminRoleViewer: 1, AdminRoleOperator: 2}
+
+// adminMethodRoles is the least privileged role allowed to call each admin
+// RPC. Methods missing here need the operator role.
+var adminMethodRoles = map[string]AdminRole{
+	proto.VideoContentAdminService_ListNodes_FullMethodName:  AdminRoleViewer,
+	proto.VideoContentAdminService_AddNode_FullMethodName:    AdminRoleOperator,
+	proto.VideoContentAdminService_RemoveNode_FullMethodName: AdminRoleOperator,
+}
+
+// adminPrincipal is the holder of an admin token
+type adminPrincipal struct {
+	name string
+	role AdminRole
+}
+
+// AdminAuthenticator checks the bearer tokens sent to the admin gRPC
+// service. Only SHA-256 hashes of the tokens are kept, which also makes the
+// lookup independent of how much of a guessed token is right.
+type AdminAuthenticator struct {
+	tokens map[[sha256.Size]byte]adminPrincipal
+}
+
+// SetAdminAuth sets the tokens the admin gRPC service accepts. Without them
+// every admin call is refused. It must be called before Start.
+func (s *server) SetAdminAuth(auth *AdminAuthenticator) {
+	s.adminAuth = auth
+}
+
+// EnableAdminTLS serves the admin gRPC service over TLS with the given
+// configuration, so bearer tokens are not sent in the clear. Without it the
+// service is served in plaintext. It must be called before Start.
+func (s *server) EnableAdminTLS(config *tls.Config) {
+	s.adminTLSConfig = config
+}
+
+// LoadAdminTokens reads an admin token file. Every non-empty line that does
+// not start with '#' holds a role, a token and optionally a name used in
+// the logs:
+//
+//	operator 6f1c0a0e4b2d... ops-team
+//	viewer   92be77d3c1aa... dashboard
+func LoadAdminTokens(path string) (*AdminAuthenticator, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open admin token file: %v", err)
+	}
+	defer file.Close()
+
+	auth := &AdminAuthenticator{tokens: make(map[[sha256.Size]byte]adminPrincipal)}
+	scanner := bufio.NewScanner(file)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 || len(fields) > 3 {
+			return nil, fmt.Errorf("%s:%d: want \"role token [name]\"", path, lineNumber)
+		}
+		role := AdminRole(fields[0])
+		if _, ok := adminRoleRank[role]; !ok {
+			return nil, fmt.Errorf("%s:%d: unknown role %q", path, lineNumber, role)
+		}
+		name := fmt.Sprintf("token on line %d", lineNumber)
+		if len(fields) == 3 {
+			name = fields[2]
+		}
+		auth.tokens[sha256.Sum256([]byte(fields[1]))] = adminPrincipal{name: name, role: role}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read admin token file: %v", err)
+	}
+	if len(auth.tokens) == 0 {
+		return nil, fmt.Errorf("%s holds no tokens", path)
+	}
+	return auth, nil
+}
+
+// authorize checks that the bearer token sent with a call grants the role
+// the method needs. A nil authenticator refuses every call.
+func (a *AdminAuthenticator) authorize(ctx context.Context, fullMethod string) (*adminPrincipal, error) {
+	if a == nil {
+		return nil, status.Error(codes.Unauthenticated, "admin service has no tokens configured")
+	}
+
+	md, _ := metadata.FromIncomingContext(ctx)
+	values := md.Get("authorization")
+	if len(values) == 0 {
+		return nil, status.Error(codes.Unauthenticated, "missing bearer token")
+	}
+	scheme, token, ok := strings.Cut(values[0], " ")
+	if !ok || !strings.EqualFold(scheme, "bearer") || token == "" {
+		return nil, status.Error(codes.Unauthenticated, "malformed authorization header")
+	}
+	principal, ok := a.tokens[sha256.Sum256([]byte(token))]
+	if !ok {
+		return nil, status.Error(codes.Unauthenticated, "invalid bearer token")
+	}
+
+	required, ok := adminMethodRoles[fullMethod]
+	if !ok {
+		required = AdminRoleOperator
+	}
+	if adminRoleRank[principal.role] < adminRoleRank[required] {
+		return nil, status.Errorf(codes.PermissionDenied, "%s needs the %s role, %s is a %s",
+			fullMethod, required, principal.name, principal.role)
+	}
+	return &principal, nil
+}
+
+// UnaryInterceptor authorizes unary admin calls and logs the ones that change
+// the cluster
+func (a *AdminAuthenticator) UnaryInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		principal, err := a.authorize(ctx, info.FullMethod)
+		if err != nil {
+			slog.WarnContext(ctx, "Admin call rejected", "method", info.FullMethod, "error", err)
+			return nil, err
+		}
+		if adminMethodRoles[info.FullMethod] != AdminRoleViewer {
+			slog.InfoContext(ctx, "Admin call", "method", info.FullMethod, "principal", principal.name)
+		}
+		return handler(ctx, req)
+	}
+}
+
+// StreamInterceptor authorizes streaming admin calls
+func (a *AdminAuthenticator) StreamInterceptor() grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		principal, err := a.authorize(ss.Context(), info.FullMethod)
+		if err != nil {
+			slog.WarnContext(ss.Context(), "Admin call rejected", "method", info.FullMethod, "error", err)
+			return err
+		}
+		if adminMethodRoles[info.FullMethod] != AdminRoleViewer {
+			slog.InfoContext(ss.Context(), "Admin call", "method", info.FullMethod, "principal", principal.name)
+		}
+		return handler(srv, ss)
+	}
+}
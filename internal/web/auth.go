@@ -0,0 +1,408 @@
+package web
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	// sessionCookieName is the cookie holding a logged in browser's session token
+	sessionCookieName = "tritontube_session"
+	// sessionTTL is how long a login lasts
+	sessionTTL = 7 * 24 * time.Hour
+	// csrfFieldName is the form field carrying the session's CSRF token
+	csrfFieldName = "csrf_token"
+	// loginCSRFCookieName holds the CSRF token of the login and registration
+	// forms, which are posted before there is a session to keep it in
+	loginCSRFCookieName = "tritontube_login_csrf"
+
+	minPasswordLength = 8
+	// maxPasswordLength is the longest password bcrypt can hash
+	maxPasswordLength = 72
+)
+
+var usernamePattern = regexp.MustCompile(`^[A-Za-z0-9_.-]{1,32}$`)
+
+// EnableAccounts requires users to log in before they upload or stream, and
+// records who uploaded each video. Accounts and sessions are kept in users.
+// Accounts created on the registration page are viewers.
+func (s *server) EnableAccounts(users UserService) {
+	s.users = users
+	s.registerRole = RoleViewer
+}
+
+// SetRegistration sets the role of accounts created on the registration
+// page; an empty role closes the page so accounts only come from single
+// sign-on or the database. It must be called after EnableAccounts.
+func (s *server) SetRegistration(role Role) error {
+	if role != "" && !role.Valid() {
+		return fmt.Errorf("invalid registration role %q", role)
+	}
+	s.registerRole = role
+	return nil
+}
+
+// randomToken returns a random URL-safe token for session IDs and CSRF tokens
+func randomToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate token: %v", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+var (
+	dummyPasswordHashOnce sync.Once
+	dummyPasswordHash     []byte
+)
+
+// checkPassword verifies a login. An unknown username costs as much as a
+// wrong password so response times don't reveal which accounts exist.
+func checkPassword(user *User, password string) bool {
+	if user == nil {
+		dummyPasswordHashOnce.Do(func() {
+			dummyPasswordHash, _ = bcrypt.GenerateFromPassword([]byte("not a real password"), bcrypt.DefaultCost)
+		})
+		bcrypt.CompareHashAndPassword(dummyPasswordHash, []byte(password))
+		return false
+	}
+	return bcrypt.CompareHashAndPassword(user.PasswordHash, []byte(password)) == nil
+}
+
+// currentSession returns the session of the logged in user making the
+// request, or nil for anonymous requests
+func (s *server) currentSession(r *http.Request) *Session {
+	if s.users == nil {
+		return nil
+	}
+	cookie, err := r.Cookie(sessionCookieName)
+	if err != nil || cookie.Value == "" {
+		return nil
+	}
+	session, err := s.users.ReadSession(cookie.Value)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to read session", "error", err)
+		return nil
+	}
+	return session
+}
+
+// requireLogin returns the session of the user making the request. Anonymous
+// users are sent to the login page and ok is false. With accounts disabled
+// every request is let through without a session.
+func (s *server) requireLogin(w http.ResponseWriter, r *http.Request) (session *Session, ok bool) {
+	if s.users == nil {
+		return nil, true
+	}
+	if session = s.currentSession(r); session != nil {
+		return session, true
+	}
+
+	// Come back to the page the form was on once logged in
+	next := "/"
+	if r.Method == http.MethodGet {
+		next = r.URL.RequestURI()
+	}
+	http.Redirect(w, r, "/login?next="+url.QueryEscape(next), http.StatusSeeOther)
+	return nil, false
+}
+
+// requireUploader is requireLogin for pages that upload or stream; users
+// whose role does not allow that are turned away
+func (s *server) requireUploader(w http.ResponseWriter, r *http.Request) (*Session, bool) {
+	session, ok := s.requireLogin(w, r)
+	if !ok {
+		return nil, false
+	}
+	if session != nil && !session.canUpload() {
+		http.Error(w, "Your account may not upload videos", http.StatusForbidden)
+		return nil, false
+	}
+	return session, true
+}
+
+// canUpload reports whether the session's user may upload and stream
+func (session *Session) canUpload() bool {
+	return session.Role == RoleUploader || session.Role == RoleAdmin
+}
+
+// checkCSRF rejects a state-changing request whose form does not carry the
+// session's CSRF token. The form must already be parsed for multipart
+// requests.
+func (s *server) checkCSRF(w http.ResponseWriter, r *http.Request, session *Session) bool {
+	if session == nil {
+		return true
+	}
+	token := r.FormValue(csrfFieldName)
+	if subtle.ConstantTimeCompare([]byte(token), []byte(session.CSRFToken)) != 1 {
+		http.Error(w, "Invalid CSRF token", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// startSession logs the browser in as username
+func (s *server) startSession(w http.ResponseWriter, r *http.Request, username string) error {
+	token, err := randomToken()
+	if err != nil {
+		return err
+	}
+	csrfToken, err := randomToken()
+	if err != nil {
+		return err
+	}
+	session := Session{
+		Token:     token,
+		Username:  username,
+		CSRFToken: csrfToken,
+		ExpiresAt: time.Now().Add(sessionTTL),
+	}
+	if err := s.users.CreateSession(session); err != nil {
+		return fmt.Errorf("failed to create session: %v", err)
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    token,
+		Path:     "/",
+		Expires:  session.ExpiresAt,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return nil
+}
+
+// safeRedirectTarget only allows redirects to paths on this server, so the
+// login form cannot be used to send users elsewhere
+func safeRedirectTarget(next string) string {
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") {
+		return "/"
+	}
+	return next
+}
+
+// loginCSRFToken returns the CSRF token the login and registration forms
+// carry, setting the cookie it is checked against if the browser has none
+func loginCSRFToken(w http.ResponseWriter, r *http.Request) (string, error) {
+	if cookie, err := r.Cookie(loginCSRFCookieName); err == nil && cookie.Value != "" {
+		return cookie.Value, nil
+	}
+	token, err := randomToken()
+	if err != nil {
+		return "", err
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     loginCSRFCookieName,
+		Value:    token,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteStrictMode,
+	})
+	return token, nil
+}
+
+// checkLoginCSRF rejects a login or registration whose form does not carry
+// the token in the browser's login CSRF cookie, so other sites cannot log
+// a visitor into an account of theirs
+func checkLoginCSRF(w http.ResponseWriter, r *http.Request) bool {
+	cookie, err := r.Cookie(loginCSRFCookieName)
+	if err != nil || cookie.Value == "" ||
+		subtle.ConstantTimeCompare([]byte(r.FormValue(csrfFieldName)), []byte(cookie.Value)) != 1 {
+		http.Error(w, "Invalid CSRF token", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+func (s *server) renderAuthPage(w http.ResponseWriter, r *http.Request, page string, status int, next, errorMessage string) {
+	tmpl, err := template.New("auth").Parse(page)
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	csrfToken, err := loginCSRFToken(w, r)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to render page", "error", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	data := struct {
+		Next          string
+		Error         string
+		CSRFToken     string
+		PasswordLogin bool
+		Registration  bool
+		SSOName       string
+	}{
+		Next:          next,
+		Error:         errorMessage,
+		CSRFToken:     csrfToken,
+		PasswordLogin: s.passwordLoginEnabled(),
+		Registration:  s.registrationEnabled(),
+	}
+	if s.oidc != nil {
+		data.SSOName = s.oidc.config.ProviderName
+	}
+	w.WriteHeader(status)
+	if err := tmpl.Execute(w, data); err != nil {
+		slog.Error("Failed to render page", "error", err)
+	}
+}
+
+func (s *server) handleLogin(w http.ResponseWriter, r *http.Request) {
+	if s.users == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	next := safeRedirectTarget(r.FormValue("next"))
+	switch r.Method {
+	case http.MethodGet:
+		s.renderAuthPage(w, r, loginHTML, http.StatusOK, next, "")
+	case http.MethodPost:
+		if !s.passwordLoginEnabled() {
+			http.Error(w, "Password login is disabled", http.StatusForbidden)
+			return
+		}
+		if !checkLoginCSRF(w, r) {
+			return
+		}
+		username := r.FormValue("username")
+		user, err := s.users.ReadUser(username)
+		if err != nil {
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		if !checkPassword(user, r.FormValue("password")) {
+			s.renderAuthPage(w, r, loginHTML, http.StatusUnauthorized, next, "Invalid username or password")
+			return
+		}
+		if err := s.startSession(w, r, user.Username); err != nil {
+			slog.ErrorContext(r.Context(), "Login failed", "username", username, "error", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		http.Redirect(w, r, next, http.StatusSeeOther)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *server) handleRegister(w http.ResponseWriter, r *http.Request) {
+	if !s.registrationEnabled() {
+		http.NotFound(w, r)
+		return
+	}
+
+	next := safeRedirectTarget(r.FormValue("next"))
+	switch r.Method {
+	case http.MethodGet:
+		s.renderAuthPage(w, r, registerHTML, http.StatusOK, next, "")
+	case http.MethodPost:
+		if !checkLoginCSRF(w, r) {
+			return
+		}
+		username := r.FormValue("username")
+		password := r.FormValue("password")
+		if !usernamePattern.MatchString(username) {
+			s.renderAuthPage(w, r, registerHTML, http.StatusBadRequest, next,
+				"Usernames are 1-32 letters, digits, '.', '_' or '-'")
+			return
+		}
+		if len(password) < minPasswordLength || len(password) > maxPasswordLength {
+			s.renderAuthPage(w, r, registerHTML, http.StatusBadRequest, next,
+				fmt.Sprintf("Passwords must be %d to %d characters long", minPasswordLength, maxPasswordLength))
+			return
+		}
+		if password != r.FormValue("confirm") {
+			s.renderAuthPage(w, r, registerHTML, http.StatusBadRequest, next, "Passwords do not match")
+			return
+		}
+
+		existing, err := s.users.ReadUser(username)
+		if err != nil {
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		if existing != nil {
+			s.renderAuthPage(w, r, registerHTML, http.StatusConflict, next, "Username is already taken")
+			return
+		}
+
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+		if err != nil {
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		if err := s.users.CreateUser(username, hash, s.registerRole); err != nil {
+			// Lost a race with another registration of the same name
+			slog.WarnContext(r.Context(), "Registration failed", "username", username, "error", err)
+			s.renderAuthPage(w, r, registerHTML, http.StatusConflict, next, "Username is already taken")
+			return
+		}
+		if err := s.startSession(w, r, username); err != nil {
+			slog.ErrorContext(r.Context(), "Login failed", "username", username, "error", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		http.Redirect(w, r, next, http.StatusSeeOther)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// passwordLoginEnabled reports whether local accounts may log in with a
+// password; single sign-on can replace them
+func (s *server) passwordLoginEnabled() bool {
+	return s.oidc == nil || !s.oidc.config.DisablePasswordLogin
+}
+
+// registrationEnabled reports whether anyone may create a local account
+func (s *server) registrationEnabled() bool {
+	return s.users != nil && s.passwordLoginEnabled() && s.registerRole != ""
+}
+
+func (s *server) handleLogout(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if s.users == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	if session := s.currentSession(r); session != nil {
+		if !s.checkCSRF(w, r, session) {
+			return
+		}
+		if err := s.users.DeleteSession(session.Token); err != nil {
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
@@ -0,0 +1,177 @@
+package web
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testAccounts returns a server with accounts kept in a temporary SQLite
+// database
+func testAccounts(t *testing.T) (*server, *SQLiteVideoMetadataService) {
+	t.Helper()
+	metadata, err := NewSQLiteVideoMetadataService(t.TempDir() + "/metadata.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { metadata.Close() })
+	s := NewServer(metadata, nil)
+	s.EnableAccounts(metadata)
+	return s, metadata
+}
+
+var csrfFieldPattern = regexp.MustCompile(`name="csrf_token" value="([^"]*)"`)
+
+// postAuthForm fetches the form at path like a browser, then posts form with
+// the CSRF token the page carried if withToken is set
+func postAuthForm(t *testing.T, handler http.HandlerFunc, path string, form url.Values, withToken bool) *httptest.ResponseRecorder {
+	t.Helper()
+	page := httptest.NewRecorder()
+	handler(page, httptest.NewRequest(http.MethodGet, path, nil))
+	match := csrfFieldPattern.FindStringSubmatch(page.Body.String())
+	if page.Code != http.StatusOK || match == nil {
+		t.Fatalf("GET %s = %d without a CSRF token", path, page.Code)
+	}
+	if withToken {
+		form.Set(csrfFieldName, match[1])
+	}
+
+	req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	for _, cookie := range page.Result().Cookies() {
+		req.AddCookie(cookie)
+	}
+	rec := httptest.NewRecorder()
+	handler(rec, req)
+	return rec
+}
+
+func registration(username string) url.Values {
+	return url.Values{"username": {username}, "password": {"password123"}, "confirm": {"password123"}}
+}
+
+func TestRegisterRole(t *testing.T) {
+	tests := []struct {
+		name     string
+		role     Role
+		set      bool
+		wantRole Role
+	}{
+		{"viewer by default", "", false, RoleViewer},
+		{"configured role", RoleUploader, true, RoleUploader},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, metadata := testAccounts(t)
+			if tt.set {
+				if err := s.SetRegistration(tt.role); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			rec := postAuthForm(t, s.handleRegister, "/register", registration("alice"), true)
+			if rec.Code != http.StatusSeeOther {
+				t.Fatalf("POST /register = %d: %s", rec.Code, rec.Body)
+			}
+			user, err := metadata.ReadUser("alice")
+			if err != nil || user == nil {
+				t.Fatalf("ReadUser() = %v, %v", user, err)
+			}
+			if user.Role != tt.wantRole {
+				t.Errorf("registered as %q, want %q", user.Role, tt.wantRole)
+			}
+		})
+	}
+}
+
+func TestRegistrationClosed(t *testing.T) {
+	s, _ := testAccounts(t)
+	if err := s.SetRegistration("root"); err == nil {
+		t.Error("SetRegistration(\"root\") succeeded")
+	}
+	if err := s.SetRegistration(""); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, method := range []string{http.MethodGet, http.MethodPost} {
+		rec := httptest.NewRecorder()
+		s.handleRegister(rec, httptest.NewRequest(method, "/register", nil))
+		if rec.Code != http.StatusNotFound {
+			t.Errorf("%s /register = %d, want %d", method, rec.Code, http.StatusNotFound)
+		}
+	}
+	rec := httptest.NewRecorder()
+	s.handleLogin(rec, httptest.NewRequest(http.MethodGet, "/login", nil))
+	if strings.Contains(rec.Body.String(), `href="/register`) {
+		t.Error("login page links to the closed registration page")
+	}
+}
+
+func TestAuthFormsCheckCSRF(t *testing.T) {
+	tests := []struct {
+		name      string
+		path      string
+		form      url.Values
+		withToken bool
+		wantCode  int
+	}{
+		{"login with token", "/login", url.Values{"username": {"bob"}, "password": {"password123"}}, true, http.StatusSeeOther},
+		{"login without token", "/login", url.Values{"username": {"bob"}, "password": {"password123"}}, false, http.StatusForbidden},
+		{"register with token", "/register", registration("carol"), true, http.StatusSeeOther},
+		{"register without token", "/register", registration("carol"), false, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, _ := testAccounts(t)
+			postAuthForm(t, s.handleRegister, "/register", registration("bob"), true)
+
+			handler := s.handleLogin
+			if tt.path == "/register" {
+				handler = s.handleRegister
+			}
+			rec := postAuthForm(t, handler, tt.path, tt.form, tt.withToken)
+			if rec.Code != tt.wantCode {
+				t.Errorf("POST %s = %d, want %d", tt.path, rec.Code, tt.wantCode)
+			}
+		})
+	}
+
+	// A token from another browser's cookie does not count
+	s, _ := testAccounts(t)
+	form := registration("dave")
+	form.Set(csrfFieldName, "forged")
+	req := httptest.NewRequest(http.MethodPost, "/register", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.AddCookie(&http.Cookie{Name: loginCSRFCookieName, Value: "other"})
+	rec := httptest.NewRecorder()
+	s.handleRegister(rec, req)
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("POST /register with a mismatched token = %d, want %d", rec.Code, http.StatusForbidden)
+	}
+}
+
+func TestDeleteUserCascades(t *testing.T) {
+	_, metadata := testAccounts(t)
+	if err := metadata.CreateUser("alice", []byte("hash"), RoleViewer); err != nil {
+		t.Fatal(err)
+	}
+	session := Session{Token: "token", Username: "alice", CSRFToken: "csrf", ExpiresAt: time.Now().Add(time.Hour)}
+	if err := metadata.CreateSession(session); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := metadata.db.Exec("DELETE FROM users WHERE username = ?", "alice"); err != nil {
+		t.Fatal(err)
+	}
+	var sessions int
+	if err := metadata.db.QueryRow("SELECT COUNT(*) FROM sessions").Scan(&sessions); err != nil {
+		t.Fatal(err)
+	}
+	if sessions != 0 {
+		t.Errorf("%d sessions left after deleting their user, want 0", sessions)
+	}
+}
@@ -0,0 +1,127 @@
+package web
+
+import (
+	"context"
+	"fmt"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"tritontube/internal/proto"
+)
+
+const (
+	// maxBatchFiles is the most files sent to a storage node in one batch call
+	maxBatchFiles = 16
+	// maxBatchBytes bounds the size of the files in a batch, keeping it well
+	// below gRPC's 4 MB message size limit. A larger file is sent on its own.
+	maxBatchBytes = 2 << 20
+)
+
+// batchFile is a file of a video written in a batch
+type batchFile struct {
+	filename string
+	data     []byte
+}
+
+// itemError returns the error of one file of a batch, nil if it succeeded
+func itemError(s *proto.ItemStatus) error {
+	if s == nil || codes.Code(s.Code) == codes.OK {
+		return nil
+	}
+	return status.Error(codes.Code(s.Code), s.Message)
+}
+
+// batchErrors returns err for each of n files
+func batchErrors(n int, err error) []error {
+	errs := make([]error, n)
+	for i := range errs {
+		errs[i] = err
+	}
+	return errs
+}
+
+// batchWrite writes several files to a node in one call and returns the
+// error of every file, nil where it was written. Nodes without BatchWrite
+// get one Write call per file.
+func batchWrite(ctx context.Context, client proto.StorageServiceClient, items []*proto.WriteRequest) []error {
+	resp, err := client.BatchWrite(ctx, &proto.BatchWriteRequest{Items: items})
+	if status.Code(err) == codes.Unimplemented {
+		errs := make([]error, len(items))
+		for i, item := range items {
+			_, errs[i] = client.Write(ctx, item)
+		}
+		return errs
+	}
+	if err != nil {
+		return batchErrors(len(items), err)
+	}
+	if len(resp.Statuses) != len(items) {
+		return batchErrors(len(items), fmt.Errorf("node answered %d of %d writes", len(resp.Statuses), len(items)))
+	}
+	errs := make([]error, len(items))
+	for i, s := range resp.Statuses {
+		errs[i] = itemError(s)
+	}
+	return errs
+}
+
+// batchRead reads several files from a node in one call and returns their
+// contents and the error of every file. Nodes without BatchRead get one Read
+// call per file, as do the files a node could not fit in its answer.
+func batchRead(ctx context.Context, client proto.StorageServiceClient, items []*proto.ReadRequest) ([][]byte, []error) {
+	contents := make([][]byte, len(items))
+	resp, err := client.BatchRead(ctx, &proto.BatchReadRequest{Items: items})
+	if status.Code(err) == codes.Unimplemented {
+		errs := make([]error, len(items))
+		for i, item := range items {
+			var file *proto.ReadResponse
+			if file, errs[i] = client.Read(ctx, item); errs[i] == nil {
+				contents[i] = file.Content
+			}
+		}
+		return contents, errs
+	}
+	if err != nil {
+		return contents, batchErrors(len(items), err)
+	}
+	if len(resp.Results) != len(items) {
+		return contents, batchErrors(len(items), fmt.Errorf("node answered %d of %d reads", len(resp.Results), len(items)))
+	}
+	errs := make([]error, len(items))
+	for i, result := range resp.Results {
+		contents[i], errs[i] = result.Content, itemError(result.Status)
+		if status.Code(errs[i]) == codes.ResourceExhausted {
+			var file *proto.ReadResponse
+			if file, errs[i] = client.Read(ctx, items[i]); errs[i] == nil {
+				contents[i] = file.Content
+			}
+		}
+	}
+	return contents, errs
+}
+
+// batchDelete deletes several files from a node in one call and returns the
+// error of every file, nil where it was deleted. Nodes without BatchDelete
+// get one Delete call per file.
+func batchDelete(ctx context.Context, client proto.StorageServiceClient, items []*proto.DeleteRequest) []error {
+	resp, err := client.BatchDelete(ctx, &proto.BatchDeleteRequest{Items: items})
+	if status.Code(err) == codes.Unimplemented {
+		errs := make([]error, len(items))
+		for i, item := range items {
+			_, errs[i] = client.Delete(ctx, item)
+		}
+		return errs
+	}
+	if err != nil {
+		return batchErrors(len(items), err)
+	}
+	if len(resp.Statuses) != len(items) {
+		return batchErrors(len(items), fmt.Errorf("node answered %d of %d deletes", len(resp.Statuses), len(items)))
+	}
+	errs := make([]error, len(items))
+	for i, s := range resp.Statuses {
+		errs[i] = itemError(s)
+	}
+	return errs
+}
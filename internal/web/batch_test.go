@@ -0,0 +1,135 @@
+package web
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"tritontube/internal/proto"
+)
+
+// statusOf returns the status of one file of a batch
+func statusOf(code codes.Code) *proto.ItemStatus {
+	return &proto.ItemStatus{Code: int32(code), Message: code.String()}
+}
+
+func TestBatchRead(t *testing.T) {
+	items := []*proto.ReadRequest{
+		{VideoId: "v", Filename: "a"},
+		{VideoId: "v", Filename: "b"},
+		{VideoId: "v", Filename: "c"},
+	}
+	tests := []struct {
+		name      string
+		batchRead func(*proto.BatchReadRequest) (*proto.BatchReadResponse, error)
+		wantCodes []codes.Code
+		wantReads int32 // single reads made
+	}{
+		{"every file", func(req *proto.BatchReadRequest) (*proto.BatchReadResponse, error) {
+			resp := &proto.BatchReadResponse{}
+			for _, item := range req.Items {
+				resp.Results = append(resp.Results, &proto.BatchReadResult{Status: statusOf(codes.OK), Content: []byte(item.Filename)})
+			}
+			return resp, nil
+		}, []codes.Code{codes.OK, codes.OK, codes.OK}, 0},
+		{"per-file statuses", func(req *proto.BatchReadRequest) (*proto.BatchReadResponse, error) {
+			return &proto.BatchReadResponse{Results: []*proto.BatchReadResult{
+				{Status: statusOf(codes.OK), Content: []byte("a")},
+				{Status: statusOf(codes.NotFound)},
+				{Status: statusOf(codes.OK), Content: []byte("c")},
+			}}, nil
+		}, []codes.Code{codes.OK, codes.NotFound, codes.OK}, 0},
+		{"files past the node's cap are read on their own", func(req *proto.BatchReadRequest) (*proto.BatchReadResponse, error) {
+			return &proto.BatchReadResponse{Results: []*proto.BatchReadResult{
+				{Status: statusOf(codes.OK), Content: []byte("a")},
+				{Status: statusOf(codes.ResourceExhausted)},
+				{Status: statusOf(codes.ResourceExhausted)},
+			}}, nil
+		}, []codes.Code{codes.OK, codes.OK, codes.OK}, 2},
+		{"node without BatchRead", nil, []codes.Code{codes.OK, codes.OK, codes.OK}, 3},
+		{"call fails", func(req *proto.BatchReadRequest) (*proto.BatchReadResponse, error) {
+			return nil, status.Error(codes.Unavailable, "down")
+		}, []codes.Code{codes.Unavailable, codes.Unavailable, codes.Unavailable}, 0},
+		{"answer for fewer files", func(req *proto.BatchReadRequest) (*proto.BatchReadResponse, error) {
+			return &proto.BatchReadResponse{Results: []*proto.BatchReadResult{{Status: statusOf(codes.OK)}}}, nil
+		}, []codes.Code{codes.Unknown, codes.Unknown, codes.Unknown}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &fakeStorageClient{read: answers(codes.OK), batchRead: tt.batchRead}
+
+			contents, errs := batchRead(context.Background(), client, items)
+			for i, err := range errs {
+				if code := status.Code(err); code != tt.wantCodes[i] {
+					t.Errorf("file %s: %v, want %v", items[i].Filename, err, tt.wantCodes[i])
+				}
+				if err == nil && string(contents[i]) != items[i].Filename {
+					t.Errorf("file %s: read %q", items[i].Filename, contents[i])
+				}
+			}
+			if reads := client.calls.Load(); reads != tt.wantReads {
+				t.Errorf("read %d files on their own, want %d", reads, tt.wantReads)
+			}
+		})
+	}
+}
+
+func TestRelayFilesBatchesByReadSize(t *testing.T) {
+	// An older walk did not know these sizes
+	sizes := []int{maxBatchBytes / 2, maxBatchBytes / 2, maxBatchBytes / 2, 10, maxBatchBytes + 1, 10}
+	var keys []*proto.KeyInfo
+	for i := range sizes {
+		keys = append(keys, &proto.KeyInfo{VideoId: "v", Filename: fmt.Sprintf("f%d", i)})
+	}
+	src := &fakeStorageClient{read: func(ctx context.Context, req *proto.ReadRequest) (*proto.ReadResponse, error) {
+		var i int
+		fmt.Sscanf(req.Filename, "f%d", &i)
+		return &proto.ReadResponse{Content: bytes.Repeat([]byte("x"), sizes[i])}, nil
+	}}
+	var batches [][]string
+	dst := &fakeStorageClient{batchWrite: func(req *proto.BatchWriteRequest) (*proto.BatchWriteResponse, error) {
+		resp := &proto.BatchWriteResponse{}
+		var names []string
+		size := 0
+		for _, item := range req.Items {
+			names = append(names, item.Filename)
+			size += len(item.Content)
+			resp.Statuses = append(resp.Statuses, statusOf(codes.OK))
+		}
+		if len(req.Items) > 1 && size > maxBatchBytes {
+			return nil, status.Errorf(codes.ResourceExhausted, "%d bytes", size)
+		}
+		batches = append(batches, names)
+		return resp, nil
+	}}
+
+	copied, err := relayFiles(context.Background(), keys, src, dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, c := range copied {
+		if c.Size != int64(sizes[i]) {
+			t.Errorf("file %d copied with %d bytes, want %d", i, c.Size, sizes[i])
+		}
+	}
+	want := "[[f0 f1] [f2 f3] [f4] [f5]]"
+	if got := fmt.Sprint(batches); got != want {
+		t.Errorf("written in batches %s, want %s", got, want)
+	}
+
+	// Files the destination refuses fail the relay
+	dst.batchWrite = func(req *proto.BatchWriteRequest) (*proto.BatchWriteResponse, error) {
+		resp := &proto.BatchWriteResponse{}
+		for range req.Items {
+			resp.Statuses = append(resp.Statuses, statusOf(codes.Internal))
+		}
+		return resp, nil
+	}
+	if _, err := relayFiles(context.Background(), keys, src, dst); err == nil {
+		t.Errorf("relayFiles() = %v, want the destination's error", err)
+	}
+}
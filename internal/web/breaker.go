@@ -0,0 +1,275 @@
+package web
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"tritontube/internal/proto"
+)
+
+// BreakerPolicy decides when the circuit breaker of a storage node opens and
+// when it lets a probe through again
+type BreakerPolicy struct {
+	// Window is how many of a node's most recent calls are judged
+	Window int
+	// MinCalls is how many calls the window needs before it can open
+	MinCalls int
+	// ErrorRate is the fraction of failed calls in the window that opens it
+	ErrorRate float64
+	// SlowCall is how long a call may take before it counts as slow, and
+	// SlowRate the fraction of slow calls that opens the breaker; a SlowRate
+	// of 0 ignores latency
+	SlowCall time.Duration
+	SlowRate float64
+	// OpenFor is how long an open breaker fails calls before it lets a probe
+	// through
+	OpenFor time.Duration
+}
+
+// DefaultBreakerPolicy opens a node's breaker when half of its last 20 calls
+// failed or took over 5 seconds, and probes it every 10 seconds
+func DefaultBreakerPolicy() BreakerPolicy {
+	return BreakerPolicy{
+		Window:    20,
+		MinCalls:  10,
+		ErrorRate: 0.5,
+		SlowCall:  5 * time.Second,
+		SlowRate:  0.5,
+		OpenFor:   10 * time.Second,
+	}
+}
+
+// SetBreakerPolicy replaces DefaultBreakerPolicy. It must be called before
+// the service is used.
+func (s *NetworkVideoContentService) SetBreakerPolicy(policy BreakerPolicy) {
+	s.breakerPolicy = policy
+}
+
+// breakerState is the state of a circuit breaker
+type breakerState int
+
+const (
+	// breakerClosed lets every call through
+	breakerClosed breakerState = iota
+	// breakerOpen fails calls without making them
+	breakerOpen
+	// breakerHalfOpen lets a single probe through, whose outcome closes or
+	// reopens the breaker
+	breakerHalfOpen
+)
+
+func (b breakerState) String() string {
+	switch b {
+	case breakerOpen:
+		return "open"
+	case breakerHalfOpen:
+		return "half-open"
+	}
+	return "closed"
+}
+
+// breakerOutcome is how a call went, as far as a breaker is concerned
+type breakerOutcome int
+
+const (
+	callSucceeded breakerOutcome = iota
+	callFailed
+	callSlow
+	// callIgnored says nothing about the node, e.g. a call cancelled by the
+	// caller or a file that does not exist
+	callIgnored
+)
+
+// breaker is the circuit breaker of one storage node
+type breaker struct {
+	nodeAddr string
+	policy   *BreakerPolicy   // the service's, which may be set after dialing
+	now      func() time.Time // time.Now, or a fake clock in tests
+
+	mu       sync.Mutex
+	state    breakerState
+	outcomes []breakerOutcome // ring buffer of the most recent calls
+	next     int
+	openedAt time.Time
+	probing  bool // a half-open breaker's probe is in flight
+}
+
+// newBreaker creates a closed breaker, whose state is published once the
+// node it guards is connected
+func newBreaker(nodeAddr string, policy *BreakerPolicy) *breaker {
+	return &breaker{nodeAddr: nodeAddr, policy: policy, now: time.Now}
+}
+
+// errBreakerOpen is returned for calls to a node whose breaker is open. It
+// is not a gRPC status, so reads fail over to another replica instead of
+// being retried against the same node.
+type errBreakerOpen struct {
+	nodeAddr string
+}
+
+func (e errBreakerOpen) Error() string {
+	return fmt.Sprintf("circuit breaker of node %s is open", e.nodeAddr)
+}
+
+// allow reports whether a call may be made, and whether it is the probe of a
+// half-open breaker
+func (b *breaker) allow() (probe bool, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case breakerOpen:
+		if b.now().Sub(b.openedAt) < b.policy.OpenFor {
+			return false, errBreakerOpen{b.nodeAddr}
+		}
+		b.setState(breakerHalfOpen)
+		fallthrough
+	case breakerHalfOpen:
+		if b.probing {
+			return false, errBreakerOpen{b.nodeAddr}
+		}
+		b.probing = true
+		return true, nil
+	}
+	return false, nil
+}
+
+// record takes the outcome of a call allow let through
+func (b *breaker) record(probe bool, outcome breakerOutcome) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if probe {
+		b.probing = false
+		switch outcome {
+		case callSucceeded:
+			b.outcomes = b.outcomes[:0]
+			b.next = 0
+			b.setState(breakerClosed)
+		case callFailed, callSlow:
+			b.open()
+		}
+		return
+	}
+	if b.state != breakerClosed || outcome == callIgnored {
+		// Calls let through before the breaker opened still finish
+		return
+	}
+
+	if len(b.outcomes) < b.policy.Window {
+		b.outcomes = append(b.outcomes, outcome)
+	} else {
+		b.outcomes[b.next] = outcome
+		b.next = (b.next + 1) % b.policy.Window
+	}
+	if len(b.outcomes) < b.policy.MinCalls {
+		return
+	}
+	var failed, slow int
+	for _, o := range b.outcomes {
+		switch o {
+		case callFailed:
+			failed++
+		case callSlow:
+			slow++
+		}
+	}
+	calls := float64(len(b.outcomes))
+	if float64(failed)/calls >= b.policy.ErrorRate ||
+		(b.policy.SlowRate > 0 && float64(slow)/calls >= b.policy.SlowRate) {
+		b.open()
+	}
+}
+
+// open fails calls for the next OpenFor. b.mu must be held.
+func (b *breaker) open() {
+	b.openedAt = b.now()
+	b.setState(breakerOpen)
+}
+
+// setState moves the breaker to a new state. b.mu must be held.
+func (b *breaker) setState(state breakerState) {
+	if b.state == state {
+		return
+	}
+	slog.Warn("Storage node circuit breaker changed state", "node", b.nodeAddr, "from", b.state.String(), "to", state.String())
+	b.state = state
+	breakerTransitions.WithLabelValues(b.nodeAddr, state.String()).Inc()
+	b.publish()
+}
+
+// publish exports the breaker's state as a gauge per state
+func (b *breaker) publish() {
+	for _, state := range []breakerState{breakerClosed, breakerOpen, breakerHalfOpen} {
+		value := 0.0
+		if state == b.state {
+			value = 1
+		}
+		breakerStates.WithLabelValues(b.nodeAddr, state.String()).Set(value)
+	}
+}
+
+// unpublish removes the metrics of a node that left the cluster
+func (b *breaker) unpublish() {
+	for _, state := range []breakerState{breakerClosed, breakerOpen, breakerHalfOpen} {
+		breakerStates.DeleteLabelValues(b.nodeAddr, state.String())
+	}
+}
+
+// currentState returns the breaker's state
+func (b *breaker) currentState() breakerState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
+
+// classify judges the outcome of a call to the given method
+func (b *breaker) classify(method string, err error, elapsed time.Duration) breakerOutcome {
+	switch status.Code(err) {
+	case codes.OK:
+		if b.policy.SlowRate > 0 && elapsed > b.policy.SlowCall {
+			return callSlow
+		}
+		return callSucceeded
+	case codes.Unknown:
+		// Nodes predating NotFound answer a read of a missing file this way
+		if method == proto.StorageService_Read_FullMethodName {
+			return callIgnored
+		}
+		return callFailed
+	case codes.Unavailable, codes.DeadlineExceeded, codes.ResourceExhausted,
+		codes.Aborted, codes.Internal, codes.DataLoss:
+		return callFailed
+	}
+	// Canceled, NotFound, InvalidArgument and the like are the caller's doing
+	return callIgnored
+}
+
+// breakerInterceptor fails calls to a node while its breaker is open, and
+// feeds the breaker the outcome of the calls it lets through
+func breakerInterceptor(b *breaker) grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		probe, err := b.allow()
+		if err != nil {
+			breakerRejections.WithLabelValues(b.nodeAddr).Inc()
+			return err
+		}
+		start := b.now()
+		err = invoker(ctx, method, req, reply, cc, opts...)
+		outcome := b.classify(method, err, b.now().Sub(start))
+		if ctx.Err() == context.Canceled && outcome != callSucceeded {
+			// The caller gave up, e.g. on a hedged read another replica won.
+			// Running out of time is the node's doing and does count.
+			outcome = callIgnored
+		}
+		b.record(probe, outcome)
+		return err
+	}
+}
@@ -0,0 +1,228 @@
+package web
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/status"
+
+	"tritontube/internal/proto"
+)
+
+// fakeClock is a breaker's clock that only moves when told to
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+var testBreakerPolicy = BreakerPolicy{
+	Window:    4,
+	MinCalls:  2,
+	ErrorRate: 0.5,
+	SlowCall:  time.Second,
+	SlowRate:  0.5,
+	OpenFor:   10 * time.Second,
+}
+
+// breakerCall is a call made through a breaker: the clock is moved by wait
+// first, the node takes took to answer with code
+type breakerCall struct {
+	wait      time.Duration
+	method    string // proto.StorageService_Write_FullMethodName if empty
+	code      codes.Code
+	took      time.Duration
+	cancelled bool // the caller gave up
+
+	wantRejected bool
+	wantState    breakerState
+}
+
+func TestBreaker(t *testing.T) {
+	const openFor = 10 * time.Second
+	tests := []struct {
+		name  string
+		calls []breakerCall
+	}{
+		{"stays closed below min calls", []breakerCall{
+			{code: codes.Unavailable, wantState: breakerClosed},
+		}},
+		{"opens on the error rate", []breakerCall{
+			{code: codes.OK, wantState: breakerClosed},
+			{code: codes.Unavailable, wantState: breakerOpen},
+			{code: codes.OK, wantRejected: true, wantState: breakerOpen},
+			{wait: openFor - time.Millisecond, code: codes.OK, wantRejected: true, wantState: breakerOpen},
+		}},
+		{"closes after a successful probe", []breakerCall{
+			{code: codes.Internal, wantState: breakerClosed},
+			{code: codes.DeadlineExceeded, wantState: breakerOpen},
+			{wait: openFor, code: codes.OK, wantState: breakerClosed},
+			// The window starts over, without the failures that opened it
+			{code: codes.Unavailable, wantState: breakerClosed},
+		}},
+		{"reopens after a failed probe", []breakerCall{
+			{code: codes.Unavailable, wantState: breakerClosed},
+			{code: codes.Unavailable, wantState: breakerOpen},
+			{wait: openFor, code: codes.Unavailable, wantState: breakerOpen},
+			{code: codes.OK, wantRejected: true, wantState: breakerOpen},
+			{wait: openFor, code: codes.OK, wantState: breakerClosed},
+		}},
+		{"opens on slow calls", []breakerCall{
+			{code: codes.OK, took: 2 * time.Second, wantState: breakerClosed},
+			{code: codes.OK, took: 2 * time.Second, wantState: breakerOpen},
+			{wait: openFor, code: codes.OK, took: 2 * time.Second, wantState: breakerOpen},
+		}},
+		{"window forgets old failures", []breakerCall{
+			{code: codes.OK, wantState: breakerClosed},
+			{code: codes.OK, wantState: breakerClosed},
+			{code: codes.OK, wantState: breakerClosed},
+			{code: codes.Unavailable, wantState: breakerClosed},
+			{code: codes.OK, wantState: breakerClosed},
+			{code: codes.OK, wantState: breakerClosed},
+			{code: codes.OK, wantState: breakerClosed},
+			{code: codes.Unavailable, wantState: breakerClosed},
+		}},
+		{"missing files are not failures", []breakerCall{
+			{code: codes.NotFound, wantState: breakerClosed},
+			{code: codes.NotFound, wantState: breakerClosed},
+			{code: codes.NotFound, wantState: breakerClosed},
+			{method: proto.StorageService_Read_FullMethodName, code: codes.Unknown, wantState: breakerClosed},
+			{method: proto.StorageService_Read_FullMethodName, code: codes.Unknown, wantState: breakerClosed},
+			{code: codes.InvalidArgument, wantState: breakerClosed},
+			// Only the calls above that count are in the window
+			{code: codes.OK, wantState: breakerClosed},
+			{code: codes.Unavailable, wantState: breakerOpen},
+		}},
+		{"unknown counts outside reads", []breakerCall{
+			{code: codes.Unknown, wantState: breakerClosed},
+			{code: codes.Unknown, wantState: breakerOpen},
+		}},
+		{"cancelled calls are not failures", []breakerCall{
+			{code: codes.Canceled, cancelled: true, wantState: breakerClosed},
+			{code: codes.Unavailable, cancelled: true, wantState: breakerClosed},
+			{code: codes.OK, wantState: breakerClosed},
+			{code: codes.OK, wantState: breakerClosed},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clock := &fakeClock{now: time.Unix(0, 0)}
+			policy := testBreakerPolicy
+			b := newBreaker("node", &policy)
+			b.now = clock.Now
+			intercept := breakerInterceptor(b)
+
+			for i, call := range tt.calls {
+				clock.Advance(call.wait)
+				ctx, cancel := context.WithCancel(context.Background())
+				if call.cancelled {
+					cancel()
+				}
+				invoked := false
+				invoker := func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+					invoked = true
+					clock.Advance(call.took)
+					return status.Error(call.code, call.code.String())
+				}
+				method := call.method
+				if method == "" {
+					method = proto.StorageService_Write_FullMethodName
+				}
+				err := intercept(ctx, method, nil, nil, nil, invoker)
+				cancel()
+
+				var open errBreakerOpen
+				if rejected := errors.As(err, &open); rejected != call.wantRejected || invoked == call.wantRejected {
+					t.Fatalf("call %d: rejected %v, node called %v, want rejected %v", i, rejected, invoked, call.wantRejected)
+				}
+				if state := b.currentState(); state != call.wantState {
+					t.Fatalf("call %d: breaker %v, want %v", i, state, call.wantState)
+				}
+			}
+		})
+	}
+}
+
+func TestBreakerSingleProbe(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	policy := testBreakerPolicy
+	b := newBreaker("node", &policy)
+	b.now = clock.Now
+	b.record(false, callFailed)
+	b.record(false, callFailed)
+
+	clock.Advance(policy.OpenFor)
+	probe, err := b.allow()
+	if err != nil || !probe {
+		t.Fatalf("allow() after OpenFor = %v, %v, want the probe", probe, err)
+	}
+	if state := b.currentState(); state != breakerHalfOpen {
+		t.Errorf("breaker %v while probing, want %v", state, breakerHalfOpen)
+	}
+	if _, err := b.allow(); err == nil {
+		t.Error("allow() let a second call through while probing")
+	}
+	// A call let through before the breaker opened does not close it
+	b.record(false, callSucceeded)
+	if state := b.currentState(); state != breakerHalfOpen {
+		t.Errorf("breaker %v after an old call finished, want %v", state, breakerHalfOpen)
+	}
+	b.record(true, callSucceeded)
+	if state := b.currentState(); state != breakerClosed {
+		t.Errorf("breaker %v after the probe succeeded, want %v", state, breakerClosed)
+	}
+}
+
+func TestBreakerFollowsNode(t *testing.T) {
+	const node = "127.0.0.1:1"
+	s, err := NewNetworkVideoContentService("admin," + node)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := s.conns[node]
+	if s.breakers[node] == nil || conn == nil {
+		t.Fatalf("added node has breaker %v, connection %v", s.breakers[node], conn)
+	}
+
+	if err := s.removeNode(node); err != nil {
+		t.Fatal(err)
+	}
+	if s.breakers[node] != nil || s.conns[node] != nil {
+		t.Error("removed node kept its breaker or connection")
+	}
+	if state := conn.GetState(); state != connectivity.Shutdown {
+		t.Errorf("removed node's connection is %v, want %v", state, connectivity.Shutdown)
+	}
+	if breakerStates.DeleteLabelValues(node, breakerClosed.String()) {
+		t.Error("removed node's breaker state is still published")
+	}
+
+	// A node that cannot be dialed leaves nothing behind
+	s.creds = nil
+	if err := s.addNode(node); err == nil {
+		t.Fatal("addNode() without credentials succeeded")
+	}
+	if s.breakers[node] != nil || s.conns[node] != nil || s.client(node) != nil {
+		t.Error("failed addNode() kept a breaker, connection or client")
+	}
+	if breakerStates.DeleteLabelValues(node, breakerClosed.String()) {
+		t.Error("failed addNode() published a breaker state")
+	}
+}
@@ -0,0 +1,288 @@
+package web
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// cacheFileSuffix marks the files of the disk tier, which are all removed
+// when a cache is created since the index of what they hold is not kept
+const cacheFileSuffix = ".cache"
+
+// ContentCache keeps recently read video files in memory and optionally on
+// disk, each tier bounded in bytes and evicting the least recently used
+// files first. Concurrent misses of the same file share a single backend
+// read.
+//
+// The cache only sees the writes of its own process, so every web server
+// in front of the same storage nodes must run the one content service that
+// writes a video, as is the case for uploads and live streams.
+type ContentCache struct {
+	dir string // disk tier directory; empty without a disk tier
+
+	mu      sync.Mutex
+	memory  *lru
+	disk    *lru // nil without a disk tier
+	flights map[string]*cacheFlight
+	seq     uint64 // makes disk tier file names unique
+}
+
+// cacheFlight is a backend read that callers missing the same key wait for
+type cacheFlight struct {
+	done chan struct{}
+	data []byte
+	err  error
+}
+
+// NewContentCache creates a cache holding up to memoryBytes in memory and,
+// if dir is not empty, up to diskBytes in files in dir
+func NewContentCache(memoryBytes int64, dir string, diskBytes int64) (*ContentCache, error) {
+	c := &ContentCache{
+		memory:  newLRU(memoryBytes),
+		flights: make(map[string]*cacheFlight),
+	}
+	if dir != "" {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, fmt.Errorf("failed to create cache directory: %v", err)
+		}
+		// Files left by an earlier run may be stale
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read cache directory: %v", err)
+		}
+		for _, entry := range entries {
+			if strings.HasSuffix(entry.Name(), cacheFileSuffix) {
+				os.Remove(filepath.Join(dir, entry.Name()))
+			}
+		}
+		c.dir = dir
+		c.disk = newLRU(diskBytes)
+	}
+	return c, nil
+}
+
+// Read returns the cached data of key, or calls load and caches its result.
+// load runs without ctx's cancellation, since other callers may be waiting
+// for it too; each caller stops waiting when its own ctx is done.
+func (c *ContentCache) Read(ctx context.Context, key string, load func(context.Context) ([]byte, error)) ([]byte, error) {
+	span := trace.SpanFromContext(ctx)
+
+	c.mu.Lock()
+	if entry, ok := c.memory.get(key); ok {
+		c.mu.Unlock()
+		cacheLookups.WithLabelValues("memory_hit").Inc()
+		span.SetAttributes(attribute.String("tritontube.cache", "memory_hit"))
+		return entry.data, nil
+	}
+	if c.disk != nil {
+		if entry, ok := c.disk.get(key); ok {
+			path := entry.path
+			c.mu.Unlock()
+			// The file may have been evicted since; that is just a miss
+			if data, err := os.ReadFile(path); err == nil {
+				cacheLookups.WithLabelValues("disk_hit").Inc()
+				span.SetAttributes(attribute.String("tritontube.cache", "disk_hit"))
+				c.promote(key, data)
+				return data, nil
+			}
+			c.mu.Lock()
+		}
+	}
+	flight, shared := c.flights[key]
+	if !shared {
+		flight = &cacheFlight{done: make(chan struct{})}
+		c.flights[key] = flight
+		go c.fill(context.WithoutCancel(ctx), key, flight, load)
+	}
+	c.mu.Unlock()
+
+	if shared {
+		cacheLookups.WithLabelValues("shared").Inc()
+		span.SetAttributes(attribute.String("tritontube.cache", "shared"))
+	} else {
+		cacheLookups.WithLabelValues("miss").Inc()
+		span.SetAttributes(attribute.String("tritontube.cache", "miss"))
+	}
+	select {
+	case <-flight.done:
+		return flight.data, flight.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// fill runs the backend read of a flight and caches the data, unless the key
+// was invalidated while it ran
+func (c *ContentCache) fill(ctx context.Context, key string, flight *cacheFlight, load func(context.Context) ([]byte, error)) {
+	flight.data, flight.err = load(ctx)
+	defer close(flight.done)
+
+	var path string
+	if flight.err == nil && c.disk != nil && c.disk.fits(int64(len(flight.data))) {
+		path = c.writeFile(key, flight.data)
+	}
+
+	c.mu.Lock()
+	current := c.flights[key] == flight
+	if current {
+		delete(c.flights, key)
+	}
+	var evicted []string
+	if current && flight.err == nil {
+		c.memory.add(key, int64(len(flight.data)), flight.data, "")
+		if path != "" {
+			evicted = c.disk.add(key, int64(len(flight.data)), nil, path)
+			path = ""
+		}
+	}
+	c.updateGauges()
+	c.mu.Unlock()
+
+	if path != "" {
+		// Invalidated while being read; the data may be stale
+		os.Remove(path)
+	}
+	removeFiles(evicted)
+}
+
+// promote copies a file read from the disk tier into memory, unless it was
+// invalidated in the meantime
+func (c *ContentCache) promote(key string, data []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.disk.get(key); ok {
+		c.memory.add(key, int64(len(data)), data, "")
+		c.updateGauges()
+	}
+}
+
+// writeFile stores data in a new file of the disk tier and returns its path,
+// or "" if it could not be written
+func (c *ContentCache) writeFile(key string, data []byte) string {
+	c.mu.Lock()
+	c.seq++
+	name := fmt.Sprintf("%x-%d%s", sha256.Sum256([]byte(key)), c.seq, cacheFileSuffix)
+	c.mu.Unlock()
+
+	path := filepath.Join(c.dir, name)
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		slog.Warn("Failed to write cache file", "key", key, "error", err)
+		os.Remove(path)
+		return ""
+	}
+	return path
+}
+
+// Invalidate drops key from both tiers. A read of key that is still running
+// is not cached when it finishes.
+func (c *ContentCache) Invalidate(key string) {
+	c.mu.Lock()
+	c.memory.remove(key)
+	var path string
+	if c.disk != nil {
+		if entry, ok := c.disk.remove(key); ok {
+			path = entry.path
+		}
+	}
+	delete(c.flights, key)
+	c.updateGauges()
+	c.mu.Unlock()
+
+	if path != "" {
+		os.Remove(path)
+	}
+}
+
+// updateGauges publishes the size of both tiers. c.mu must be held.
+func (c *ContentCache) updateGauges() {
+	cacheBytes.WithLabelValues("memory").Set(float64(c.memory.bytes))
+	if c.disk != nil {
+		cacheBytes.WithLabelValues("disk").Set(float64(c.disk.bytes))
+	}
+}
+
+func removeFiles(paths []string) {
+	for _, path := range paths {
+		os.Remove(path)
+	}
+}
+
+// lru is a size-bounded index of cached files, most recently used first
+type lru struct {
+	maxBytes int64
+	bytes    int64
+	order    *list.List
+	items    map[string]*list.Element
+}
+
+type lruEntry struct {
+	key  string
+	size int64
+	data []byte // memory tier
+	path string // disk tier
+}
+
+func newLRU(maxBytes int64) *lru {
+	return &lru{maxBytes: maxBytes, order: list.New(), items: make(map[string]*list.Element)}
+}
+
+// fits reports whether an entry of the given size can be cached at all
+func (l *lru) fits(size int64) bool {
+	return size <= l.maxBytes
+}
+
+func (l *lru) get(key string) (*lruEntry, bool) {
+	element, ok := l.items[key]
+	if !ok {
+		return nil, false
+	}
+	l.order.MoveToFront(element)
+	return element.Value.(*lruEntry), true
+}
+
+// add caches an entry, replacing an older one of the same key, and evicts
+// least recently used entries until the tier fits its bound again. It
+// returns the files of the evicted disk tier entries, which the caller must
+// remove.
+func (l *lru) add(key string, size int64, data []byte, path string) []string {
+	var evicted []string
+	if old, ok := l.remove(key); ok && old.path != "" {
+		evicted = append(evicted, old.path)
+	}
+	if !l.fits(size) {
+		if path != "" {
+			evicted = append(evicted, path)
+		}
+		return evicted
+	}
+	l.items[key] = l.order.PushFront(&lruEntry{key: key, size: size, data: data, path: path})
+	l.bytes += size
+	for l.bytes > l.maxBytes {
+		oldest, _ := l.remove(l.order.Back().Value.(*lruEntry).key)
+		if oldest.path != "" {
+			evicted = append(evicted, oldest.path)
+		}
+	}
+	return evicted
+}
+
+func (l *lru) remove(key string) (*lruEntry, bool) {
+	element, ok := l.items[key]
+	if !ok {
+		return nil, false
+	}
+	entry := l.order.Remove(element).(*lruEntry)
+	delete(l.items, key)
+	l.bytes -= entry.size
+	return entry, true
+}
@@ -0,0 +1,312 @@
+package web
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"tritontube/internal/proto"
+)
+
+// loadCounter returns a load answering what content returns and counting
+// its calls
+func loadCounter(calls *atomic.Int32, content func() string) func(context.Context) ([]byte, error) {
+	return func(context.Context) ([]byte, error) {
+		calls.Add(1)
+		return []byte(content()), nil
+	}
+}
+
+func TestContentCacheCoalescesMisses(t *testing.T) {
+	cache, err := NewContentCache(1<<20, "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var calls atomic.Int32
+	release := make(chan struct{})
+	load := func(ctx context.Context) ([]byte, error) {
+		calls.Add(1)
+		<-release
+		return []byte("data"), nil
+	}
+
+	// A caller giving up does not cancel the read the others wait for
+	ctx, cancel := context.WithCancel(context.Background())
+	quitter := make(chan error, 1)
+	go func() {
+		_, err := cache.Read(ctx, "v/f", load)
+		quitter <- err
+	}()
+	for calls.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	const readers = 10
+	var wg sync.WaitGroup
+	results := make([]string, readers)
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			data, err := cache.Read(context.Background(), "v/f", load)
+			if err != nil {
+				t.Errorf("Read() = %v", err)
+			}
+			results[i] = string(data)
+		}(i)
+	}
+	cancel()
+	if err := <-quitter; !errors.Is(err, context.Canceled) {
+		t.Errorf("Read() of a cancelled caller = %v, want %v", err, context.Canceled)
+	}
+	// Give the readers time to join the flight; any that come later hit
+	// the cache
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if n := calls.Load(); n != 1 {
+		t.Errorf("load called %d times, want 1", n)
+	}
+	for i, data := range results {
+		if data != "data" {
+			t.Errorf("reader %d got %q, want %q", i, data, "data")
+		}
+	}
+	if _, err := cache.Read(context.Background(), "v/f", load); err != nil || calls.Load() != 1 {
+		t.Errorf("Read() after the flight = %v with %d loads, want a hit", err, calls.Load())
+	}
+}
+
+func TestContentCacheDoesNotCacheErrors(t *testing.T) {
+	cache, err := NewContentCache(1<<20, "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var calls atomic.Int32
+	failing := func(context.Context) ([]byte, error) {
+		calls.Add(1)
+		return nil, errors.New("node down")
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := cache.Read(context.Background(), "v/f", failing); err == nil {
+			t.Fatal("Read() succeeded")
+		}
+	}
+	if n := calls.Load(); n != 2 {
+		t.Errorf("load called %d times, want 2", n)
+	}
+}
+
+func TestLRUEvictsByBytes(t *testing.T) {
+	type op struct {
+		get  string // key to look up, or
+		add  string // key to add with size
+		size int64
+	}
+	tests := []struct {
+		name      string
+		maxBytes  int64
+		ops       []op
+		wantKeys  []string // most recently used first
+		wantBytes int64
+	}{
+		{"under the bound", 10, []op{{add: "a", size: 4}, {add: "b", size: 4}}, []string{"b", "a"}, 8},
+		{"evicts the oldest", 10, []op{{add: "a", size: 4}, {add: "b", size: 4}, {add: "c", size: 4}}, []string{"c", "b"}, 8},
+		{"get keeps an entry", 10, []op{{add: "a", size: 4}, {add: "b", size: 4}, {get: "a"}, {add: "c", size: 4}}, []string{"c", "a"}, 8},
+		{"evicts several small entries", 10, []op{{add: "a", size: 3}, {add: "b", size: 3}, {add: "c", size: 3}, {add: "d", size: 9}}, []string{"d"}, 9},
+		{"too large is not cached", 10, []op{{add: "a", size: 4}, {add: "b", size: 11}}, []string{"a"}, 4},
+		{"replacing resizes", 10, []op{{add: "a", size: 4}, {add: "b", size: 4}, {add: "a", size: 6}}, []string{"a", "b"}, 10},
+		{"exactly the bound", 10, []op{{add: "a", size: 10}}, []string{"a"}, 10},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := newLRU(tt.maxBytes)
+			for _, op := range tt.ops {
+				if op.get != "" {
+					l.get(op.get)
+				} else {
+					l.add(op.add, op.size, nil, "")
+				}
+			}
+			var keys []string
+			for e := l.order.Front(); e != nil; e = e.Next() {
+				keys = append(keys, e.Value.(*lruEntry).key)
+			}
+			if strings.Join(keys, ",") != strings.Join(tt.wantKeys, ",") {
+				t.Errorf("cached %v, want %v", keys, tt.wantKeys)
+			}
+			if l.bytes != tt.wantBytes {
+				t.Errorf("cached %d bytes, want %d", l.bytes, tt.wantBytes)
+			}
+		})
+	}
+}
+
+func TestContentCacheDiskTier(t *testing.T) {
+	dir := t.TempDir()
+	stale := dir + "/old" + cacheFileSuffix
+	if err := os.WriteFile(stale, []byte("stale"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// Memory holds one file, disk two
+	cache, err := NewContentCache(4, dir, 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(stale); !os.IsNotExist(err) {
+		t.Errorf("file of an earlier run was kept")
+	}
+
+	var calls atomic.Int32
+	for _, key := range []string{"a", "b", "c", "b"} {
+		if _, err := cache.Read(context.Background(), key, loadCounter(&calls, func() string { return "1234" })); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// a was evicted from both tiers, b came back from disk
+	if n := calls.Load(); n != 3 {
+		t.Errorf("load called %d times, want 3", n)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Errorf("%d files in the disk tier, want 2", len(entries))
+	}
+}
+
+func TestContentCacheInvalidate(t *testing.T) {
+	tests := []struct {
+		name string
+		dir  bool
+	}{
+		{"memory", false},
+		{"memory and disk", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var dir string
+			if tt.dir {
+				dir = t.TempDir()
+			}
+			cache, err := NewContentCache(1<<20, dir, 1<<20)
+			if err != nil {
+				t.Fatal(err)
+			}
+			content := "old"
+			var calls atomic.Int32
+			load := loadCounter(&calls, func() string { return content })
+
+			cache.Read(context.Background(), "v/f", load)
+			content = "new"
+			cache.Invalidate("v/f")
+			data, err := cache.Read(context.Background(), "v/f", load)
+			if err != nil || string(data) != "new" {
+				t.Errorf("Read() after Invalidate() = %q, %v, want %q", data, err, "new")
+			}
+			if n := calls.Load(); n != 2 {
+				t.Errorf("load called %d times, want 2", n)
+			}
+		})
+	}
+}
+
+// A file changed while it is being read must not be cached with the content
+// read before the change
+func TestContentCacheInvalidateDuringRead(t *testing.T) {
+	cache, err := NewContentCache(1<<20, "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	started, release := make(chan struct{}), make(chan struct{})
+	go cache.Read(context.Background(), "v/f", func(context.Context) ([]byte, error) {
+		close(started)
+		<-release
+		return []byte("old"), nil
+	})
+	<-started
+	cache.Invalidate("v/f")
+	close(release)
+
+	data, err := cache.Read(context.Background(), "v/f", func(context.Context) ([]byte, error) {
+		return []byte("new"), nil
+	})
+	if err != nil || string(data) != "new" {
+		t.Errorf("Read() = %q, %v, want %q", data, err, "new")
+	}
+	time.Sleep(10 * time.Millisecond) // let the invalidated read finish
+	cache.mu.Lock()
+	entry, ok := cache.memory.get("v/f")
+	cache.mu.Unlock()
+	if !ok || string(entry.data) != "new" {
+		t.Errorf("cached %v, want %q", entry, "new")
+	}
+}
+
+func TestNetworkServiceInvalidatesCache(t *testing.T) {
+	var mu sync.Mutex
+	stored := make(map[string]string)
+	client := &fakeStorageClient{
+		read: func(ctx context.Context, req *proto.ReadRequest) (*proto.ReadResponse, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			content, ok := stored[req.VideoId+"/"+req.Filename]
+			if !ok {
+				return nil, fmt.Errorf("no file")
+			}
+			return &proto.ReadResponse{Content: []byte(content)}, nil
+		},
+		write: func(req *proto.WriteRequest) {
+			mu.Lock()
+			defer mu.Unlock()
+			stored[req.VideoId+"/"+req.Filename] = string(req.Content)
+		},
+		del: func(req *proto.DeleteRequest) {
+			mu.Lock()
+			defer mu.Unlock()
+			delete(stored, req.VideoId+"/"+req.Filename)
+		},
+	}
+	cache, err := NewContentCache(1<<20, "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &NetworkVideoContentService{
+		clients:    map[string]proto.StorageServiceClient{"node": client},
+		placement:  newRingPlacement(),
+		readPolicy: ReadPolicy{Timeout: time.Second, Attempts: 1},
+	}
+	s.placement.Add("node")
+	s.SetCache(cache)
+
+	steps := []struct {
+		name    string
+		change  func() error
+		want    string
+		wantErr bool
+	}{
+		{"write", func() error { return s.Write("v", "f", []byte("one")) }, "one", false},
+		{"overwrite", func() error { return s.Write("v", "f", []byte("two")) }, "two", false},
+		{"batch write", func() error {
+			return errors.Join(s.WriteBatch(context.Background(), "v", []batchFile{{filename: "f", data: []byte("three")}})...)
+		}, "three", false},
+		{"delete", func() error { return s.Delete("v", "f") }, "", true},
+	}
+	for _, step := range steps {
+		if err := step.change(); err != nil {
+			t.Fatalf("%s: %v", step.name, err)
+		}
+		data, err := s.Read("v", "f")
+		if (err != nil) != step.wantErr || string(data) != step.want {
+			t.Errorf("Read() after %s = %q, %v, want %q", step.name, data, err, step.want)
+		}
+	}
+}
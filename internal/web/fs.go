@@ -14,8 +14,10 @@ type FSVideoContentService struct {
 	baseDir string
 }
 
-// Uncomment the following line to ensure FSVideoContentService implements VideoContentService
-// var _ VideoContentService = (*FSVideoContentService)(nil)
+var _ VideoContentService = (*FSVideoContentService)(nil)
+
+// fsTempDirName is the directory under baseDir that handleUpload uses for raw uploads
+const fsTempDirName = "temp"
 
 func NewFSVideoContentService(baseDir string) (*FSVideoContentService, error) {
 	// Create base directory if it doesn't exist
@@ -48,3 +50,48 @@ func (s *FSVideoContentService) Write(videoId string, filename string, data []by
 	path := filepath.Join(videoDir, filename)
 	return ioutil.WriteFile(path, data, 0644)
 }
+
+func (s *FSVideoContentService) Delete(videoId string, filename string) error {
+	path := filepath.Join(s.baseDir, videoId, filename)
+	if err := os.Remove(path); err != nil {
+		return err
+	}
+
+	// Remove the video directory once its last file is gone; this fails
+	// harmlessly while other files remain
+	os.Remove(filepath.Dir(path))
+	return nil
+}
+
+func (s *FSVideoContentService) ListVideos() ([]string, error) {
+	entries, err := ioutil.ReadDir(s.baseDir)
+	if err != nil {
+		return nil, err
+	}
+
+	videoIds := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		if entry.IsDir() && entry.Name() != fsTempDirName {
+			videoIds = append(videoIds, entry.Name())
+		}
+	}
+	return videoIds, nil
+}
+
+func (s *FSVideoContentService) ListFiles(videoId string) ([]string, error) {
+	entries, err := ioutil.ReadDir(filepath.Join(s.baseDir, videoId))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []string{}, nil
+		}
+		return nil, err
+	}
+
+	filenames := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			filenames = append(filenames, entry.Name())
+		}
+	}
+	return filenames, nil
+}
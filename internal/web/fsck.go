@@ -0,0 +1,213 @@
+package web
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// DefaultPendingGrace is how long after it started an upload that is still
+// pending is taken to be running rather than abandoned
+const DefaultPendingGrace = 24 * time.Hour
+
+// FsckReport describes the inconsistencies found between the metadata
+// catalog and the content store.
+type FsckReport struct {
+	// PendingVideos lists videos whose upload started longer than the grace
+	// period ago and never completed
+	PendingVideos []string
+	// MissingManifest lists catalogued videos that have no manifest.mpd
+	MissingManifest []string
+	// InvalidManifest lists catalogued videos whose manifest cannot be parsed
+	InvalidManifest []string
+	// MissingSegments maps a video ID to the files its manifest references but which are absent
+	MissingSegments map[string][]string
+	// OrphanedVideos lists videos that have content but no metadata
+	OrphanedVideos []string
+	// UnreferencedFiles lists "videoId/filename" entries of catalogued videos
+	// that the manifest does not reference
+	UnreferencedFiles []string
+	// UncheckedVideos lists videos whose manifest does not tell which
+	// segments it covers; their files are left alone
+	UncheckedVideos []string
+	// InProgressVideos lists live streams and uploads started within the
+	// grace period; they are left alone
+	InProgressVideos []string
+}
+
+// Clean reports whether no inconsistencies were found
+func (r *FsckReport) Clean() bool {
+	return len(r.PendingVideos) == 0 && len(r.MissingManifest) == 0 &&
+		len(r.InvalidManifest) == 0 && len(r.MissingSegments) == 0 &&
+		len(r.OrphanedVideos) == 0 && len(r.UnreferencedFiles) == 0
+}
+
+// Fsck cross-checks every video in the metadata catalog against the content
+// store. With fix set, videos that cannot be played (abandoned uploads,
+// missing or invalid manifest, missing segments) are removed from both
+// stores, and content that nothing references is deleted. Live streams and
+// uploads pending for less than pendingGrace are skipped. The returned report
+// always describes the state found before any repair.
+func Fsck(metadataService VideoMetadataService, contentService VideoContentService, fix bool, pendingGrace time.Duration) (*FsckReport, error) {
+	report := &FsckReport{MissingSegments: make(map[string][]string)}
+
+	videos, err := metadataService.List()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list metadata: %v", err)
+	}
+	// Everything stored is listed up front, in one pass where the content
+	// service allows it
+	inventory, err := listInventory(contentService)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list content: %v", err)
+	}
+
+	catalogued := make(map[string]bool, len(videos))
+	for _, video := range videos {
+		catalogued[video.Id] = true
+		if video.Status == VideoStatusLive ||
+			video.Status == VideoStatusPending && time.Since(video.UploadedAt) < pendingGrace {
+			// Its segments are still being written
+			report.InProgressVideos = append(report.InProgressVideos, video.Id)
+			continue
+		}
+
+		files := inventory[video.Id]
+		present := make(map[string]bool, len(files))
+		for _, filename := range files {
+			present[filename] = true
+		}
+
+		broken := false
+		if video.Status != VideoStatusReady {
+			// An upload that was interrupted before its saga could roll
+			// back; its content is incomplete by definition
+			report.PendingVideos = append(report.PendingVideos, video.Id)
+			broken = true
+		} else if !present[manifestFilename] {
+			report.MissingManifest = append(report.MissingManifest, video.Id)
+			broken = true
+		} else {
+			referenced, err := readManifestReferences(contentService, video.Id)
+			if errors.Is(err, errOpenEndedTimeline) {
+				report.UncheckedVideos = append(report.UncheckedVideos, video.Id)
+			} else if err != nil {
+				report.InvalidManifest = append(report.InvalidManifest, video.Id)
+				broken = true
+			} else {
+				for _, filename := range referenced {
+					if !present[filename] {
+						report.MissingSegments[video.Id] = append(report.MissingSegments[video.Id], filename)
+						broken = true
+					}
+					delete(present, filename)
+				}
+				delete(present, manifestFilename)
+
+				// Whatever is left is stored but not part of the manifest
+				var unreferenced []string
+				for filename := range present {
+					unreferenced = append(unreferenced, filename)
+				}
+				sort.Strings(unreferenced)
+				for _, filename := range unreferenced {
+					report.UnreferencedFiles = append(report.UnreferencedFiles, video.Id+"/"+filename)
+					if fix && !broken {
+						if err := contentService.Delete(video.Id, filename); err != nil {
+							return report, fmt.Errorf("failed to delete %s/%s: %v", video.Id, filename, err)
+						}
+					}
+				}
+			}
+		}
+
+		if fix && broken {
+			if err := deleteVideoContent(contentService, video.Id); err != nil {
+				return report, err
+			}
+			if err := metadataService.Delete(video.Id); err != nil {
+				return report, fmt.Errorf("failed to delete metadata of %s: %v", video.Id, err)
+			}
+		}
+	}
+
+	contentIds := make([]string, 0, len(inventory))
+	for videoId := range inventory {
+		if !catalogued[videoId] {
+			contentIds = append(contentIds, videoId)
+		}
+	}
+	sort.Strings(contentIds)
+	for _, videoId := range contentIds {
+		report.OrphanedVideos = append(report.OrphanedVideos, videoId)
+		if fix {
+			if err := deleteVideoContent(contentService, videoId); err != nil {
+				return report, err
+			}
+		}
+	}
+
+	return report, nil
+}
+
+// readManifestReferences reads a video's manifest and returns the files it references
+func readManifestReferences(contentService VideoContentService, videoId string) ([]string, error) {
+	data, err := contentService.Read(videoId, manifestFilename)
+	if err != nil {
+		return nil, err
+	}
+	root, err := parseMPD(data)
+	if err != nil {
+		return nil, err
+	}
+	return mpdReferencedFiles(root)
+}
+
+// listInventory returns the files stored for every video in contentService,
+// walking the whole store at once if the service supports it
+func listInventory(contentService VideoContentService) (map[string][]string, error) {
+	inventory := make(map[string][]string)
+	if walker, ok := contentService.(InventoryVideoContentService); ok {
+		seen := make(map[string]bool)
+		err := walker.WalkFiles(func(videoId string, filename string) error {
+			// A file caught mid-migration can be listed by two nodes
+			if key := videoId + "/" + filename; !seen[key] {
+				seen[key] = true
+				inventory[videoId] = append(inventory[videoId], filename)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		return inventory, nil
+	}
+
+	videoIds, err := contentService.ListVideos()
+	if err != nil {
+		return nil, err
+	}
+	for _, videoId := range videoIds {
+		files, err := contentService.ListFiles(videoId)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list files of %s: %v", videoId, err)
+		}
+		inventory[videoId] = files
+	}
+	return inventory, nil
+}
+
+// deleteVideoContent removes every file stored for a video
+func deleteVideoContent(contentService VideoContentService, videoId string) error {
+	files, err := contentService.ListFiles(videoId)
+	if err != nil {
+		return fmt.Errorf("failed to list files of %s: %v", videoId, err)
+	}
+	for _, filename := range files {
+		if err := contentService.Delete(videoId, filename); err != nil {
+			return fmt.Errorf("failed to delete %s/%s: %v", videoId, filename, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,41 @@
+package web
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// EnableTLS makes Start serve HTTPS, with HTTP/2, using the given
+// configuration. Certificates are taken from its GetCertificate callback on
+// every handshake, so a configuration backed by a tlsutil.Reloader picks up
+// renewed certificates without dropping open connections. It must be
+// called before Start.
+func (s *server) EnableTLS(config *tls.Config) {
+	s.tlsConfig = config
+}
+
+// HTTPSRedirectHandler redirects every plain HTTP request to the same URL
+// on the HTTPS port
+func HTTPSRedirectHandler(httpsPort int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			// No port in the Host header; JoinHostPort adds the brackets of
+			// an IPv6 address back
+			host = strings.Trim(r.Host, "[]")
+		}
+		if httpsPort != 443 {
+			host = net.JoinHostPort(host, strconv.Itoa(httpsPort))
+		}
+		target := "https://" + host + r.URL.RequestURI()
+		// Browsers turn a POST into a GET on 301; 308 keeps the method
+		status := http.StatusMovedPermanently
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			status = http.StatusPermanentRedirect
+		}
+		http.Redirect(w, r, target, status)
+	})
+}
@@ -1,19 +1,162 @@
 package web
 
-import "time"
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// VideoStatus is the lifecycle state of a video in the metadata catalog
+type VideoStatus string
+
+const (
+	// VideoStatusPending marks a video whose content is still being written
+	VideoStatusPending VideoStatus = "pending"
+	// VideoStatusReady marks a video whose content is complete and playable
+	VideoStatusReady VideoStatus = "ready"
+	// VideoStatusLive marks a live stream whose segments are still being produced
+	VideoStatusLive VideoStatus = "live"
+)
+
+// Visibility controls who can find and watch a video
+type Visibility string
+
+const (
+	// VisibilityPublic videos are listed on the index and playable by anyone
+	VisibilityPublic Visibility = "public"
+	// VisibilityUnlisted videos are playable by anyone who has the link but not listed
+	VisibilityUnlisted Visibility = "unlisted"
+	// VisibilityPrivate videos are only playable by their owner or through a signed link
+	VisibilityPrivate Visibility = "private"
+)
+
+// Valid reports whether v is one of the known visibilities
+func (v Visibility) Valid() bool {
+	return v == VisibilityPublic || v == VisibilityUnlisted || v == VisibilityPrivate
+}
 
 type VideoMetadata struct {
 	Id         string
 	UploadedAt time.Time
+	Status     VideoStatus
+	Owner      string // username of the uploader, empty for videos uploaded before accounts existed
+	Visibility Visibility
 }
 
+// ErrVideoExists is returned by VideoMetadataService.Create when the ID is
+// already in the catalog
+var ErrVideoExists = errors.New("video already exists")
+
 type VideoMetadataService interface {
 	Read(id string) (*VideoMetadata, error)
+	// List returns every video in the catalog regardless of its status
 	List() ([]VideoMetadata, error)
-	Create(videoId string, uploadedAt time.Time) error
+	// Create adds a video owned by owner to the catalog in the pending state,
+	// failing with ErrVideoExists if the ID is taken
+	Create(videoId string, owner string, uploadedAt time.Time) error
+	SetStatus(id string, status VideoStatus) error
+	SetVisibility(id string, visibility Visibility) error
+	Delete(id string) error
 }
 
 type VideoContentService interface {
 	Read(videoId string, filename string) ([]byte, error)
 	Write(videoId string, filename string, data []byte) error
+	Delete(videoId string, filename string) error
+	// ListVideos returns the IDs of all videos that have at least one file stored
+	ListVideos() ([]string, error)
+	// ListFiles returns the names of all files stored for a video
+	ListFiles(videoId string) ([]string, error)
+}
+
+// ContextVideoContentService is a content service whose reads and writes
+// can carry a context, e.g. the trace of the request they are made for
+type ContextVideoContentService interface {
+	VideoContentService
+	ReadContext(ctx context.Context, videoId string, filename string) ([]byte, error)
+	WriteContext(ctx context.Context, videoId string, filename string, data []byte) error
+}
+
+// readContent reads a file through contentService, passing ctx on if the
+// service takes one
+func readContent(ctx context.Context, contentService VideoContentService, videoId string, filename string) ([]byte, error) {
+	if ctxService, ok := contentService.(ContextVideoContentService); ok {
+		return ctxService.ReadContext(ctx, videoId, filename)
+	}
+	return contentService.Read(videoId, filename)
+}
+
+// writeContent writes a file through contentService, passing ctx on if the
+// service takes one
+func writeContent(ctx context.Context, contentService VideoContentService, videoId string, filename string, data []byte) error {
+	if ctxService, ok := contentService.(ContextVideoContentService); ok {
+		return ctxService.WriteContext(ctx, videoId, filename, data)
+	}
+	return contentService.Write(videoId, filename, data)
+}
+
+// InventoryVideoContentService is a content service that can list every
+// file it stores in one pass instead of video by video
+type InventoryVideoContentService interface {
+	VideoContentService
+	// WalkFiles calls fn for every stored file and stops at the first error fn returns
+	WalkFiles(fn func(videoId string, filename string) error) error
+}
+
+// Role is what a user is allowed to do on the web server
+type Role string
+
+const (
+	// RoleViewer may watch videos but not upload or stream
+	RoleViewer Role = "viewer"
+	// RoleUploader may upload videos and start live streams
+	RoleUploader Role = "uploader"
+	// RoleAdmin may also end other users' live streams
+	RoleAdmin Role = "admin"
+)
+
+// Valid reports whether r is one of the known roles
+func (r Role) Valid() bool {
+	return r == RoleViewer || r == RoleUploader || r == RoleAdmin
+}
+
+type User struct {
+	Username     string
+	PasswordHash []byte // empty for users that only log in through single sign-on
+	Role         Role
+	CreatedAt    time.Time
+}
+
+// Session is a logged in browser. The CSRF token is embedded in the forms
+// served to that browser and must come back with every state-changing request.
+type Session struct {
+	Token     string
+	Username  string
+	Role      Role // the user's current role, filled in by ReadSession
+	CSRFToken string
+	ExpiresAt time.Time
+}
+
+type UserService interface {
+	// CreateUser registers a user; it fails if the username is taken
+	CreateUser(username string, passwordHash []byte, role Role) error
+	// ReadUser returns nil if there is no such user
+	ReadUser(username string) (*User, error)
+	SetRole(username string, role Role) error
+	// ReadIdentity returns the user linked to an identity provider's subject,
+	// or "" if the subject has not logged in before
+	ReadIdentity(issuer string, subject string) (string, error)
+	LinkIdentity(issuer string, subject string, username string) error
+	CreateSession(session Session) error
+	// ReadSession returns nil if the session does not exist or has expired
+	ReadSession(token string) (*Session, error)
+	DeleteSession(token string) error
+}
+
+// SettingService keeps settings the web server must remember across
+// restarts, such as the placement files were last moved to
+type SettingService interface {
+	// Setting returns "" if the setting was never set
+	Setting(key string) (string, error)
+	SetSetting(key string, value string) error
 }
@@ -0,0 +1,403 @@
+package web
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"html/template"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+
+	"tritontube/internal/logging"
+)
+
+const (
+	// liveWindowSize is the number of segments kept in a live manifest
+	liveWindowSize = 5
+	// liveExtraWindowSize is the number of segments ffmpeg keeps on disk
+	// after they leave the manifest; they are long published by then
+	liveExtraWindowSize = 5
+)
+
+var (
+	// errStreamLive is returned when a stream with the same ID is already live
+	errStreamLive = errors.New("stream is already live")
+	// errNoLiveSlots is returned when every RTMP port is taken
+	errNoLiveSlots = errors.New("all live stream slots are in use")
+	// errShuttingDown is returned when a stream is started during a shutdown
+	errShuttingDown = errors.New("server is shutting down")
+)
+
+// liveStreamIdPattern restricts live stream IDs to names that are safe in
+// RTMP URLs and storage paths
+var liveStreamIdPattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// liveStream is one live ingest: an ffmpeg process listening for an RTMP
+// publisher and writing a sliding-window DASH stream
+type liveStream struct {
+	id    string
+	owner string
+	port  int
+	cmd   *exec.Cmd
+	dir   string
+
+	// ctx carries the request ID of the request that started the stream
+	ctx    context.Context
+	output *logging.Output // what ffmpeg prints
+
+	// Guarded by liveManager.mu: ffmpeg is running, and cmd is set, once
+	// started; stopRequested is a stop that came in while it was starting
+	started       bool
+	stopRequested bool
+}
+
+// liveManager hands out RTMP ports to live streams. ffmpeg accepts a single
+// publisher per listening port, so every stream gets its own port from the
+// range [basePort, basePort+maxStreams).
+type liveManager struct {
+	host       string
+	basePort   int
+	maxStreams int
+
+	mu      sync.Mutex
+	streams map[string]*liveStream
+	closed  bool // refuses new streams during a shutdown
+}
+
+// EnableLiveIngest turns on live streaming. Streams listen for RTMP
+// publishers on host, each on its own port starting at basePort.
+func (s *server) EnableLiveIngest(host string, basePort int, maxStreams int) {
+	s.live = &liveManager{
+		host:       host,
+		basePort:   basePort,
+		maxStreams: maxStreams,
+		streams:    make(map[string]*liveStream),
+	}
+}
+
+// reserve allocates a port for a new stream. It fails with errStreamLive if
+// the ID is already streaming and errNoLiveSlots if every port is taken.
+func (m *liveManager) reserve(id string, owner string) (*liveStream, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.closed {
+		return nil, errShuttingDown
+	}
+	if _, ok := m.streams[id]; ok {
+		return nil, errStreamLive
+	}
+	used := make(map[int]bool, len(m.streams))
+	for _, stream := range m.streams {
+		used[stream.port] = true
+	}
+	for port := m.basePort; port < m.basePort+m.maxStreams; port++ {
+		if !used[port] {
+			stream := &liveStream{id: id, owner: owner, port: port, dir: filepath.Join("tmp", "live", id)}
+			m.streams[id] = stream
+			return stream, nil
+		}
+	}
+	return nil, errNoLiveSlots
+}
+
+func (m *liveManager) release(id string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.streams, id)
+}
+
+// markStarted records that a stream's ffmpeg is running as cmd. It returns
+// false if a shutdown began or a stop came in meanwhile, in which case the
+// stream should end at once.
+func (m *liveManager) markStarted(stream *liveStream, cmd *exec.Cmd) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	stream.cmd = cmd
+	stream.started = true
+	return !m.closed && !stream.stopRequested
+}
+
+// stop asks the ffmpeg of a stream to finish, or has markStarted end it if
+// it is still starting. Only the user who started a stream, or an admin, may
+// end it.
+func (m *liveManager) stop(id string, session *Session) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	stream := m.streams[id]
+	if stream == nil {
+		return fmt.Errorf("stream %s is not live", id)
+	}
+	if session != nil && stream.owner != session.Username && session.Role != RoleAdmin {
+		return fmt.Errorf("stream %s belongs to another user", id)
+	}
+	if !stream.started {
+		stream.stopRequested = true
+		return nil
+	}
+	return stream.cmd.Process.Signal(os.Interrupt)
+}
+
+// close refuses new streams and returns the ones whose ffmpeg is running.
+// Streams still starting are ended by markStarted.
+func (m *liveManager) close() []*liveStream {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.closed = true
+	streams := make([]*liveStream, 0, len(m.streams))
+	for _, stream := range m.streams {
+		if stream.started {
+			streams = append(streams, stream)
+		}
+	}
+	return streams
+}
+
+// ingestURL is the address ffmpeg listens on for the stream's publisher
+func (m *liveManager) ingestURL(stream *liveStream) string {
+	return fmt.Sprintf("rtmp://%s/live/%s", net.JoinHostPort(m.host, strconv.Itoa(stream.port)), stream.id)
+}
+
+// startLiveStream creates the catalog entry of a live stream owned by owner
+// and starts the ffmpeg process that waits for its publisher. The stream
+// logs with the request ID of ctx. It fails with ErrVideoExists or
+// errStreamLive if the ID is taken, and with errNoLiveSlots or
+// errShuttingDown if no stream can start now.
+func (s *server) startLiveStream(ctx context.Context, id string, owner string) (*liveStream, error) {
+	metadata, err := s.metadataService.Read(id)
+	if err != nil {
+		return nil, err
+	}
+	if metadata != nil {
+		return nil, ErrVideoExists
+	}
+
+	stream, err := s.live.reserve(id, owner)
+	if err != nil {
+		return nil, err
+	}
+	saga := &uploadSaga{videoId: id}
+	saga.compensate(func() error { s.live.release(id); return nil })
+
+	if err := os.MkdirAll(stream.dir, 0755); err != nil {
+		saga.rollback()
+		return nil, fmt.Errorf("failed to create output directory: %v", err)
+	}
+	saga.compensate(func() error { return os.RemoveAll(stream.dir) })
+
+	// Listen for a single RTMP publisher and write a live DASH stream with a
+	// sliding-window manifest
+	args := []string{"-listen", "1", "-i", s.live.ingestURL(stream)}
+	args = append(args, s.profile.dashEncodingArgs()...)
+	args = append(args,
+		"-window_size", strconv.Itoa(liveWindowSize),
+		"-extra_window_size", strconv.Itoa(liveExtraWindowSize),
+		"-remove_at_exit", "0",
+		filepath.Join(stream.dir, manifestFilename))
+	// A shutdown that runs out of time kills ffmpeg; what was streamed until
+	// then is still archived
+	cmd := exec.CommandContext(s.workCtx, "ffmpeg", args...)
+	stream.ctx = context.WithoutCancel(ctx)
+	stream.output = logging.NewOutput(stream.ctx, "stream_id", id)
+	cmd.Stdout = stream.output
+	cmd.Stderr = stream.output
+
+	if err := s.metadataService.Create(id, owner, time.Now()); errors.Is(err, ErrVideoExists) {
+		saga.rollback()
+		return nil, err
+	} else if err != nil {
+		saga.rollback()
+		return nil, fmt.Errorf("failed to create metadata: %v", err)
+	}
+	saga.compensate(func() error { return s.metadataService.Delete(id) })
+
+	if err := s.metadataService.SetStatus(id, VideoStatusLive); err != nil {
+		saga.rollback()
+		return nil, fmt.Errorf("failed to mark video live: %v", err)
+	}
+
+	if !s.beginWork() {
+		saga.rollback()
+		return nil, errShuttingDown
+	}
+	if err := cmd.Start(); err != nil {
+		s.work.Done()
+		saga.rollback()
+		return nil, fmt.Errorf("failed to start ffmpeg: %v", err)
+	}
+	if !s.live.markStarted(stream, cmd) {
+		cmd.Process.Signal(os.Interrupt)
+	}
+
+	go s.runLiveStream(stream)
+	return stream, nil
+}
+
+// runLiveStream publishes the stream's segments and manifest through the
+// content service while ffmpeg produces them. Once ffmpeg exits the stream is
+// archived as an on-demand video.
+func (s *server) runLiveStream(stream *liveStream) {
+	defer s.work.Done()
+	defer s.live.release(stream.id)
+	defer os.RemoveAll(stream.dir)
+
+	archive := newLiveArchive()
+	publisher := newSegmentPublisher(stream.ctx, s.contentService, stream.id)
+	watcher := watchSegments(stream.dir, publisher, true, archive.record, func() { stream.cmd.Process.Kill() })
+
+	if err := stream.cmd.Wait(); err != nil {
+		slog.WarnContext(stream.ctx, "Live stream ffmpeg exited", "stream_id", stream.id, "error", err, "output", stream.output.Tail())
+	}
+	scanErr := watcher.finish()
+	publishErr := publisher.wait()
+
+	err := publishErr
+	if err == nil {
+		err = scanErr
+	}
+	if err == nil {
+		err = s.archiveLiveStream(stream.id, archive, publisher)
+	}
+	if err != nil {
+		// Nothing playable is left; take the stream off the index
+		slog.ErrorContext(stream.ctx, "Live stream could not be archived", "stream_id", stream.id, "error", err)
+		if err := deleteVideoContent(s.contentService, stream.id); err != nil {
+			slog.ErrorContext(stream.ctx, "Failed to delete live stream content", "stream_id", stream.id, "error", err)
+		}
+		if err := s.metadataService.Delete(stream.id); err != nil {
+			slog.ErrorContext(stream.ctx, "Failed to delete live stream metadata", "stream_id", stream.id, "error", err)
+		}
+		return
+	}
+	slog.InfoContext(stream.ctx, "Live stream ended and was archived", "stream_id", stream.id)
+}
+
+// archiveLiveStream turns a finished live stream into a regular video: its
+// manifest is replaced by a static one covering every segment that was
+// streamed, and the catalog entry is marked ready.
+func (s *server) archiveLiveStream(id string, archive *liveArchive, publisher *segmentPublisher) error {
+	if archive.empty() {
+		return fmt.Errorf("nothing was streamed")
+	}
+	manifest, err := archive.staticManifest()
+	if err != nil {
+		return fmt.Errorf("failed to build on-demand manifest: %v", err)
+	}
+	if err := publisher.writeData(manifestFilename, manifest); err != nil {
+		return err
+	}
+	if err := s.metadataService.SetStatus(id, VideoStatusReady); err != nil {
+		return fmt.Errorf("failed to mark video ready: %v", err)
+	}
+	return nil
+}
+
+// stopLiveStream asks ffmpeg to finish the stream as if the publisher had
+// disconnected. Only the user who started a stream, or an admin, may end it.
+func (s *server) stopLiveStream(id string, session *Session) error {
+	return s.live.stop(id, session)
+}
+
+func (s *server) handleLiveStart(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if s.live == nil {
+		http.Error(w, "Live streaming is not enabled", http.StatusNotFound)
+		return
+	}
+
+	session, ok := s.requireUploader(w, r)
+	if !ok || !s.checkCSRF(w, r, session) {
+		return
+	}
+	owner := ""
+	if session != nil {
+		owner = session.Username
+	}
+
+	id := r.FormValue("id")
+	if !liveStreamIdPattern.MatchString(id) {
+		http.Error(w, "Invalid stream ID", http.StatusBadRequest)
+		return
+	}
+
+	stream, err := s.startLiveStream(r.Context(), id, owner)
+	switch {
+	case errors.Is(err, ErrVideoExists):
+		http.Error(w, "Video already exists", http.StatusConflict)
+		return
+	case errors.Is(err, errStreamLive):
+		http.Error(w, "Stream is already live", http.StatusConflict)
+		return
+	case errors.Is(err, errNoLiveSlots):
+		http.Error(w, "All live stream slots are in use, try again later", http.StatusServiceUnavailable)
+		return
+	case errors.Is(err, errShuttingDown):
+		http.Error(w, "Server is shutting down", http.StatusServiceUnavailable)
+		return
+	case err != nil:
+		slog.ErrorContext(r.Context(), "Failed to start live stream", "stream_id", id, "error", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	// Publishers reach the listener through the same host name as the web server
+	host := r.Host
+	if h, _, err := net.SplitHostPort(r.Host); err == nil {
+		host = h
+	}
+	data := struct {
+		Id         string
+		PublishURL string
+		CSRFToken  string
+	}{
+		Id:         stream.id,
+		PublishURL: fmt.Sprintf("rtmp://%s/live/%s", net.JoinHostPort(host, strconv.Itoa(stream.port)), stream.id),
+	}
+	if session != nil {
+		data.CSRFToken = session.CSRFToken
+	}
+
+	tmpl, err := template.New("live").Parse(liveHTML)
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if err := tmpl.Execute(w, data); err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+}
+
+func (s *server) handleLiveStop(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if s.live == nil {
+		http.Error(w, "Live streaming is not enabled", http.StatusNotFound)
+		return
+	}
+
+	session, ok := s.requireLogin(w, r)
+	if !ok || !s.checkCSRF(w, r, session) {
+		return
+	}
+
+	if err := s.stopLiveStream(r.FormValue("id"), session); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
@@ -0,0 +1,28 @@
+package web
+
+import (
+	"os/exec"
+	"testing"
+)
+
+func TestLiveManagerStopWhileStarting(t *testing.T) {
+	m := &liveManager{basePort: 1935, maxStreams: 2, streams: make(map[string]*liveStream)}
+	stream, err := m.reserve("show", "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.stop("show", &Session{Username: "bob", Role: RoleUploader}); err == nil {
+		t.Error("stop() by another user succeeded")
+	}
+	// ffmpeg is not running yet, so there is nothing to signal
+	if err := m.stop("show", &Session{Username: "alice", Role: RoleUploader}); err != nil {
+		t.Fatalf("stop() while starting = %v", err)
+	}
+	if m.markStarted(stream, exec.Command("ffmpeg")) {
+		t.Error("markStarted() = true after a stop came in, want the stream ended at once")
+	}
+	if err := m.stop("missing", nil); err == nil {
+		t.Error("stop() of a stream that is not live succeeded")
+	}
+}
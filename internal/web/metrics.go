@@ -0,0 +1,180 @@
+package web
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+
+	"tritontube/internal/logging"
+)
+
+var (
+	httpRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "tritontube_http_requests_total",
+		Help: "HTTP requests handled, by handler and status code.",
+	}, []string{"handler", "code"})
+
+	httpDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "tritontube_http_request_duration_seconds",
+		Help:    "Time taken to handle HTTP requests, by handler.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"handler"})
+
+	contentBytesServed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "tritontube_content_bytes_served_total",
+		Help: "Bytes of video content sent to players, by file type (manifest or segment).",
+	}, []string{"type"})
+
+	transcodeDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name: "tritontube_transcode_duration_seconds",
+		Help: "Time taken to transcode uploads to DASH, including failed attempts.",
+		// Uploads take from seconds to many minutes
+		Buckets: prometheus.ExponentialBuckets(1, 2, 12),
+	})
+
+	transcodeFailures = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "tritontube_transcode_failures_total",
+		Help: "Uploads that failed to transcode to DASH.",
+	})
+
+	migrationFiles = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "tritontube_migration_files_total",
+		Help: "Files moved between storage nodes, by operation (add, remove or placement).",
+	}, []string{"operation"})
+
+	migrationBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "tritontube_migration_bytes_total",
+		Help: "Bytes moved between storage nodes, by operation (add, remove or placement).",
+	}, []string{"operation"})
+
+	ringNodes = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "tritontube_ring_nodes",
+		Help: "Storage nodes on the consistent hash ring.",
+	})
+
+	cacheLookups = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "tritontube_content_cache_lookups_total",
+		Help: "Content cache lookups, by result (memory_hit, disk_hit, miss, or shared for misses that waited for another caller's read).",
+	}, []string{"result"})
+
+	cacheBytes = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "tritontube_content_cache_bytes",
+		Help: "Bytes held by the content cache, by tier (memory or disk).",
+	}, []string{"tier"})
+
+	storageReadRetries = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "tritontube_storage_read_retries_total",
+		Help: "Reads from storage nodes tried again after a transient error.",
+	})
+
+	hedgedReads = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "tritontube_storage_hedged_reads_total",
+		Help: "Hedged reads sent to the next node after the hedge delay, and those that answered first, by outcome (sent or won).",
+	}, []string{"outcome"})
+
+	breakerStates = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "tritontube_storage_breaker_state",
+		Help: "Circuit breaker state of each storage node; 1 for the current state (closed, open or half-open), 0 for the others.",
+	}, []string{"node", "state"})
+
+	breakerTransitions = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "tritontube_storage_breaker_transitions_total",
+		Help: "Circuit breaker state changes, by node and the state entered.",
+	}, []string{"node", "state"})
+
+	breakerRejections = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "tritontube_storage_breaker_rejections_total",
+		Help: "Calls to storage nodes failed without being made because the node's circuit breaker was open.",
+	}, []string{"node"})
+
+	storageRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "tritontube_storage_requests_total",
+		Help: "Calls made to storage nodes, by node, method and status code.",
+	}, []string{"node", "method", "code"})
+
+	storageDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "tritontube_storage_request_duration_seconds",
+		Help:    "Time taken by calls to storage nodes, by node and method.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"node", "method"})
+)
+
+// statusRecorder remembers the status code a handler responded with
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(data []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	return r.ResponseWriter.Write(data)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// instrument counts, times, traces and logs the requests of a handler under
+// the given name, which should be the pattern it is registered with so the
+// number of label values stays bounded. Every request gets a request ID,
+// which is sent back in the X-Request-ID header.
+func instrument(name string, handler http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		r = r.WithContext(logging.WithRequestID(r.Context(), r.Header.Get("X-Request-ID")))
+		requestID := logging.RequestID(r.Context())
+		w.Header().Set("X-Request-ID", requestID)
+		r, span := startRequestSpan(r, name)
+		defer span.End()
+		span.SetAttributes(attribute.String("tritontube.request_id", requestID))
+
+		recorder := &statusRecorder{ResponseWriter: w}
+		handler(recorder, r)
+		if recorder.status == 0 {
+			recorder.status = http.StatusOK
+		}
+		duration := time.Since(start)
+		httpRequests.WithLabelValues(name, strconv.Itoa(recorder.status)).Inc()
+		httpDuration.WithLabelValues(name).Observe(duration.Seconds())
+		span.SetAttributes(attribute.Int("http.response.status_code", recorder.status))
+		if recorder.status >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(recorder.status))
+		}
+		slog.InfoContext(r.Context(), "HTTP request",
+			"method", r.Method,
+			"path", r.URL.Path,
+			"status", recorder.status,
+			"duration", duration)
+	})
+}
+
+// storageClientInterceptor counts and times the calls made to one storage
+// node, so error rates can be told apart per node
+func storageClientInterceptor(nodeAddr string) grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		start := time.Now()
+		err := invoker(ctx, method, req, reply, cc, opts...)
+		storageRequests.WithLabelValues(nodeAddr, method, status.Code(err).String()).Inc()
+		storageDuration.WithLabelValues(nodeAddr, method).Observe(time.Since(start).Seconds())
+		return err
+	}
+}
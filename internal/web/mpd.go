@@ -0,0 +1,418 @@
+package web
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// manifestFilename is the name convertToDASH gives the DASH manifest of every video
+const manifestFilename = "manifest.mpd"
+
+// mpdNode is a generic XML element of a DASH manifest. It is decoded with
+// RawToken so namespace prefixes are kept exactly as written.
+type mpdNode struct {
+	Name     xml.Name
+	Attrs    []xml.Attr
+	Children []*mpdNode
+	Text     string
+}
+
+// parseMPD parses a DASH manifest into a tree of mpdNodes and returns the root element
+func parseMPD(data []byte) (*mpdNode, error) {
+	decoder := xml.NewDecoder(bytes.NewReader(data))
+
+	var root *mpdNode
+	var stack []*mpdNode
+	for {
+		token, err := decoder.RawToken()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse manifest: %v", err)
+		}
+
+		switch t := token.(type) {
+		case xml.StartElement:
+			node := &mpdNode{Name: t.Name, Attrs: append([]xml.Attr(nil), t.Attr...)}
+			if len(stack) > 0 {
+				parent := stack[len(stack)-1]
+				parent.Children = append(parent.Children, node)
+			} else if root == nil {
+				root = node
+			}
+			stack = append(stack, node)
+		case xml.EndElement:
+			if len(stack) == 0 {
+				return nil, fmt.Errorf("failed to parse manifest: unexpected </%s>", t.Name.Local)
+			}
+			stack = stack[:len(stack)-1]
+		case xml.CharData:
+			if len(stack) > 0 {
+				stack[len(stack)-1].Text += strings.TrimSpace(string(t))
+			}
+		}
+	}
+
+	if root == nil || root.Name.Local != "MPD" {
+		return nil, fmt.Errorf("failed to parse manifest: missing MPD element")
+	}
+	return root, nil
+}
+
+// attr returns the value of the named attribute, or "" if it is not set
+func (n *mpdNode) attr(name string) string {
+	for _, a := range n.Attrs {
+		if a.Name.Space == "" && a.Name.Local == name {
+			return a.Value
+		}
+	}
+	return ""
+}
+
+// child returns the first direct child with the given local name
+func (n *mpdNode) child(name string) *mpdNode {
+	for _, c := range n.Children {
+		if c.Name.Local == name {
+			return c
+		}
+	}
+	return nil
+}
+
+// children returns all direct children with the given local name
+func (n *mpdNode) children(name string) []*mpdNode {
+	var result []*mpdNode
+	for _, c := range n.Children {
+		if c.Name.Local == name {
+			result = append(result, c)
+		}
+	}
+	return result
+}
+
+// mpdSegmentTimelineEntry is one <S> element of a SegmentTimeline
+type mpdSegmentTimelineEntry struct {
+	T int64 // start time, -1 if omitted
+	D int64 // duration
+	R int64 // repeat count, -1 to repeat up to the next S@t or the end of the period
+}
+
+// errOpenEndedTimeline is returned for a SegmentTimeline whose last <S>
+// repeats up to the end of a period of unknown length, so the segments it
+// covers cannot be listed
+var errOpenEndedTimeline = errors.New("segment timeline repeats up to the end of a period of unknown length")
+
+// timelineTimes returns the start time of every segment of a timeline. An
+// entry with a negative repeat count is repeated up to the next entry's
+// start time or, for the last entry, up to end; end is in the timeline's
+// timescale and negative if unknown.
+func timelineTimes(entries []mpdSegmentTimelineEntry, end int64) ([]int64, error) {
+	var times []int64
+	var t int64
+	for i, entry := range entries {
+		if entry.T >= 0 {
+			t = entry.T
+		}
+		if entry.D <= 0 {
+			return nil, fmt.Errorf("invalid S@d %d", entry.D)
+		}
+		repeat := entry.R
+		if repeat < 0 {
+			until := end
+			if i+1 < len(entries) {
+				until = entries[i+1].T
+			}
+			if until < 0 {
+				return nil, errOpenEndedTimeline
+			}
+			// Every segment starting before until belongs to this entry
+			repeat = (until-t+entry.D-1)/entry.D - 1
+		}
+		for j := int64(0); j <= repeat; j++ {
+			times = append(times, t)
+			t += entry.D
+		}
+	}
+	return times, nil
+}
+
+// periodEnd returns the end of a period in the timescale of a
+// SegmentTemplate, or -1 if the manifest does not say how long it is
+func periodEnd(root, period, template *mpdNode) (int64, error) {
+	duration, err := parseISODuration(period.attr("duration"))
+	if err != nil {
+		return 0, err
+	}
+	if duration == 0 {
+		presentation, err := parseISODuration(root.attr("mediaPresentationDuration"))
+		if err != nil {
+			return 0, err
+		}
+		start, err := parseISODuration(period.attr("start"))
+		if err != nil {
+			return 0, err
+		}
+		duration = presentation - start
+	}
+	if duration <= 0 {
+		return -1, nil
+	}
+
+	timescale := int64(1)
+	if v := template.attr("timescale"); v != "" {
+		if timescale, err = strconv.ParseInt(v, 10, 64); err != nil || timescale <= 0 {
+			return 0, fmt.Errorf("invalid timescale %q", v)
+		}
+	}
+	var offset int64
+	if v := template.attr("presentationTimeOffset"); v != "" {
+		if offset, err = strconv.ParseInt(v, 10, 64); err != nil {
+			return 0, fmt.Errorf("invalid presentationTimeOffset %q: %v", v, err)
+		}
+	}
+	return offset + int64(math.Ceil(duration.Seconds()*float64(timescale))), nil
+}
+
+// timelineEntries decodes the <S> children of a SegmentTimeline element
+func timelineEntries(timeline *mpdNode) ([]mpdSegmentTimelineEntry, error) {
+	var entries []mpdSegmentTimelineEntry
+	for _, s := range timeline.children("S") {
+		entry := mpdSegmentTimelineEntry{T: -1}
+		var err error
+		if v := s.attr("t"); v != "" {
+			if entry.T, err = strconv.ParseInt(v, 10, 64); err != nil {
+				return nil, fmt.Errorf("invalid S@t %q: %v", v, err)
+			}
+		}
+		if entry.D, err = strconv.ParseInt(s.attr("d"), 10, 64); err != nil {
+			return nil, fmt.Errorf("invalid S@d %q: %v", s.attr("d"), err)
+		}
+		if v := s.attr("r"); v != "" {
+			if entry.R, err = strconv.ParseInt(v, 10, 64); err != nil {
+				return nil, fmt.Errorf("invalid S@r %q: %v", v, err)
+			}
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+var segmentTemplateIdentifier = regexp.MustCompile(`\$(RepresentationID|Number|Bandwidth|Time)(%0(\d+)d)?\$`)
+
+// expandSegmentTemplate substitutes the DASH template identifiers in a
+// SegmentTemplate@media or @initialization attribute
+func expandSegmentTemplate(template, representationId, bandwidth string, number, time int64) string {
+	expanded := segmentTemplateIdentifier.ReplaceAllStringFunc(template, func(match string) string {
+		parts := segmentTemplateIdentifier.FindStringSubmatch(match)
+		var value int64
+		switch parts[1] {
+		case "RepresentationID":
+			return representationId
+		case "Bandwidth":
+			return bandwidth
+		case "Number":
+			value = number
+		case "Time":
+			value = time
+		}
+		if parts[3] != "" {
+			width, _ := strconv.Atoi(parts[3])
+			return fmt.Sprintf("%0*d", width, value)
+		}
+		return strconv.FormatInt(value, 10)
+	})
+	return strings.ReplaceAll(expanded, "$$", "$")
+}
+
+// mpdReferencedFiles returns the names of every file (initialization and media
+// segments) that the manifest refers to through its SegmentTemplates. It
+// returns errOpenEndedTimeline if it cannot tell where a timeline ends.
+func mpdReferencedFiles(root *mpdNode) ([]string, error) {
+	presentationDuration, err := parseISODuration(root.attr("mediaPresentationDuration"))
+	if err != nil {
+		return nil, err
+	}
+
+	var files []string
+	seen := make(map[string]bool)
+	add := func(name string) {
+		if name != "" && !seen[name] {
+			seen[name] = true
+			files = append(files, name)
+		}
+	}
+
+	for _, period := range root.children("Period") {
+		for _, adaptationSet := range period.children("AdaptationSet") {
+			for _, representation := range adaptationSet.children("Representation") {
+				template := representationTemplate(adaptationSet, representation)
+				if template == nil {
+					continue
+				}
+
+				id := representation.attr("id")
+				bandwidth := representation.attr("bandwidth")
+				add(expandSegmentTemplate(template.attr("initialization"), id, bandwidth, 0, 0))
+
+				media := template.attr("media")
+				if media == "" {
+					continue
+				}
+				number := int64(1)
+				if v := template.attr("startNumber"); v != "" {
+					if number, err = strconv.ParseInt(v, 10, 64); err != nil {
+						return nil, fmt.Errorf("invalid startNumber %q: %v", v, err)
+					}
+				}
+
+				if timeline := template.child("SegmentTimeline"); timeline != nil {
+					entries, err := timelineEntries(timeline)
+					if err != nil {
+						return nil, err
+					}
+					end, err := periodEnd(root, period, template)
+					if err != nil {
+						return nil, err
+					}
+					times, err := timelineTimes(entries, end)
+					if err != nil {
+						return nil, err
+					}
+					for i, t := range times {
+						add(expandSegmentTemplate(media, id, bandwidth, number+int64(i), t))
+					}
+					continue
+				}
+
+				// Without a timeline the segment count follows from the fixed duration
+				duration, _ := strconv.ParseFloat(template.attr("duration"), 64)
+				timescale := 1.0
+				if v := template.attr("timescale"); v != "" {
+					timescale, _ = strconv.ParseFloat(v, 64)
+				}
+				if duration <= 0 || timescale <= 0 || presentationDuration <= 0 {
+					continue
+				}
+				count := int64(math.Ceil(presentationDuration.Seconds() / (duration / timescale)))
+				for i := int64(0); i < count; i++ {
+					add(expandSegmentTemplate(media, id, bandwidth, number+i, int64(float64(i)*duration)))
+				}
+			}
+		}
+	}
+	return files, nil
+}
+
+var isoDurationPattern = regexp.MustCompile(`^P(?:(\d+(?:\.\d+)?)D)?(?:T(?:(\d+(?:\.\d+)?)H)?(?:(\d+(?:\.\d+)?)M)?(?:(\d+(?:\.\d+)?)S)?)?$`)
+
+// parseISODuration parses the subset of ISO 8601 durations used in MPDs
+// (e.g. "PT1M34.5S"). An empty string yields a zero duration.
+func parseISODuration(s string) (time.Duration, error) {
+	if s == "" {
+		return 0, nil
+	}
+	parts := isoDurationPattern.FindStringSubmatch(s)
+	if parts == nil {
+		return 0, fmt.Errorf("invalid duration %q", s)
+	}
+	units := []time.Duration{24 * time.Hour, time.Hour, time.Minute, time.Second}
+	var total time.Duration
+	for i, unit := range units {
+		if parts[i+1] == "" {
+			continue
+		}
+		v, _ := strconv.ParseFloat(parts[i+1], 64)
+		total += time.Duration(v * float64(unit))
+	}
+	return total, nil
+}
+
+// encodeMPD serializes a manifest tree back into an XML document
+func encodeMPD(root *mpdNode) []byte {
+	var buf bytes.Buffer
+	buf.WriteString(xml.Header)
+	root.write(&buf, 0)
+	return buf.Bytes()
+}
+
+func (n *mpdNode) write(buf *bytes.Buffer, depth int) {
+	indent := strings.Repeat("\t", depth)
+	buf.WriteString(indent + "<" + qualifiedName(n.Name))
+	for _, a := range n.Attrs {
+		buf.WriteString(" " + qualifiedName(a.Name) + `="`)
+		xml.EscapeText(buf, []byte(a.Value))
+		buf.WriteString(`"`)
+	}
+	if len(n.Children) == 0 && n.Text == "" {
+		buf.WriteString("/>\n")
+		return
+	}
+	buf.WriteString(">")
+	xml.EscapeText(buf, []byte(n.Text))
+	if len(n.Children) > 0 {
+		buf.WriteString("\n")
+		for _, c := range n.Children {
+			c.write(buf, depth+1)
+		}
+		buf.WriteString(indent)
+	}
+	buf.WriteString("</" + qualifiedName(n.Name) + ">\n")
+}
+
+// qualifiedName turns a raw (unresolved) XML name back into prefix:local form
+func qualifiedName(name xml.Name) string {
+	if name.Space == "" {
+		return name.Local
+	}
+	return name.Space + ":" + name.Local
+}
+
+// setAttr sets the named attribute, adding it if it is not there yet
+func (n *mpdNode) setAttr(name, value string) {
+	for i, a := range n.Attrs {
+		if a.Name.Space == "" && a.Name.Local == name {
+			n.Attrs[i].Value = value
+			return
+		}
+	}
+	n.Attrs = append(n.Attrs, xml.Attr{Name: xml.Name{Local: name}, Value: value})
+}
+
+// removeAttr removes the named attribute if it is set
+func (n *mpdNode) removeAttr(name string) {
+	attrs := n.Attrs[:0]
+	for _, a := range n.Attrs {
+		if a.Name.Space != "" || a.Name.Local != name {
+			attrs = append(attrs, a)
+		}
+	}
+	n.Attrs = attrs
+}
+
+// removeChildren removes every direct child with the given local name
+func (n *mpdNode) removeChildren(name string) {
+	children := n.Children[:0]
+	for _, c := range n.Children {
+		if c.Name.Local != name {
+			children = append(children, c)
+		}
+	}
+	n.Children = children
+}
+
+// formatISODuration formats d the way ffmpeg writes MPD durations
+func formatISODuration(d time.Duration) string {
+	hours := int64(d / time.Hour)
+	minutes := int64((d % time.Hour) / time.Minute)
+	seconds := (d % time.Minute).Seconds()
+	return fmt.Sprintf("PT%dH%dM%.3fS", hours, minutes, seconds)
+}
@@ -0,0 +1,111 @@
+package web
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestTimelineEntries(t *testing.T) {
+	tests := []struct {
+		name     string
+		timeline string
+		want     []mpdSegmentTimelineEntry
+		wantErr  bool
+	}{
+		{
+			name:     "plain",
+			timeline: `<S t="0" d="4"/><S d="2"/>`,
+			want:     []mpdSegmentTimelineEntry{{T: 0, D: 4}, {T: -1, D: 2}},
+		},
+		{
+			name:     "repeat",
+			timeline: `<S t="10" d="4" r="3"/>`,
+			want:     []mpdSegmentTimelineEntry{{T: 10, D: 4, R: 3}},
+		},
+		{
+			name:     "open-ended repeat",
+			timeline: `<S t="0" d="4" r="-1"/><S t="20" d="2"/>`,
+			want:     []mpdSegmentTimelineEntry{{T: 0, D: 4, R: -1}, {T: 20, D: 2}},
+		},
+		{
+			name:     "invalid duration",
+			timeline: `<S t="0" d="x"/>`,
+			wantErr:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root, err := parseMPD([]byte(`<MPD><SegmentTimeline>` + tt.timeline + `</SegmentTimeline></MPD>`))
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := timelineEntries(root.child("SegmentTimeline"))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("timelineEntries() error = %v, want error %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("timelineEntries() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMPDReferencedFiles(t *testing.T) {
+	tests := []struct {
+		name     string
+		duration string // MPD@mediaPresentationDuration
+		template string
+		want     []string
+		wantErr  error
+	}{
+		{
+			name:     "repeat",
+			template: `<SegmentTemplate initialization="init-$RepresentationID$.m4s" media="chunk-$RepresentationID$-$Number$.m4s"><SegmentTimeline><S t="0" d="4" r="2"/><S d="3"/></SegmentTimeline></SegmentTemplate>`,
+			want:     []string{"init-0.m4s", "chunk-0-1.m4s", "chunk-0-2.m4s", "chunk-0-3.m4s", "chunk-0-4.m4s"},
+		},
+		{
+			name:     "number format",
+			template: `<SegmentTemplate initialization="init-$RepresentationID$.m4s" media="chunk-$RepresentationID$-$Number%05d$.m4s" startNumber="9"><SegmentTimeline><S t="0" d="4" r="1"/></SegmentTimeline></SegmentTemplate>`,
+			want:     []string{"init-0.m4s", "chunk-0-00009.m4s", "chunk-0-00010.m4s"},
+		},
+		{
+			name:     "time",
+			template: `<SegmentTemplate media="seg-$Time$.m4s"><SegmentTimeline><S t="100" d="40" r="1"/><S t="200" d="50"/></SegmentTimeline></SegmentTemplate>`,
+			want:     []string{"seg-100.m4s", "seg-140.m4s", "seg-200.m4s"},
+		},
+		{
+			name:     "open-ended repeat up to the next S@t",
+			template: `<SegmentTemplate media="seg-$Time$.m4s"><SegmentTimeline><S t="0" d="4" r="-1"/><S t="10" d="2"/></SegmentTimeline></SegmentTemplate>`,
+			want:     []string{"seg-0.m4s", "seg-4.m4s", "seg-8.m4s", "seg-10.m4s"},
+		},
+		{
+			name:     "open-ended repeat up to the period end",
+			duration: "PT10S",
+			template: `<SegmentTemplate timescale="1000" media="seg-$Number$.m4s"><SegmentTimeline><S t="0" d="4000" r="-1"/></SegmentTimeline></SegmentTemplate>`,
+			want:     []string{"seg-1.m4s", "seg-2.m4s", "seg-3.m4s"},
+		},
+		{
+			name:     "open-ended repeat without a period end",
+			template: `<SegmentTemplate media="seg-$Number$.m4s"><SegmentTimeline><S t="0" d="4" r="-1"/></SegmentTimeline></SegmentTemplate>`,
+			wantErr:  errOpenEndedTimeline,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			manifest := `<MPD mediaPresentationDuration="` + tt.duration + `"><Period><AdaptationSet><Representation id="0" bandwidth="1000">` +
+				tt.template + `</Representation></AdaptationSet></Period></MPD>`
+			root, err := parseMPD([]byte(manifest))
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := mpdReferencedFiles(root)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("mpdReferencedFiles() error = %v, want %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("mpdReferencedFiles() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -5,15 +5,26 @@ package web
 import (
 	"context"
 	"crypto/sha256"
-	"encoding/binary"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
 	"sort"
 	"strings"
 	"sync"
 
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
 
+	"tritontube/internal/logging"
 	"tritontube/internal/proto"
 )
 
@@ -25,18 +36,44 @@ type NetworkVideoContentService struct {
 	// Admin server address
 	adminAddr string
 
-	// Map of node addresses to their gRPC clients
+	// Map of node addresses to their gRPC clients, and the connections
+	// they are made over
 	clients map[string]proto.StorageServiceClient
+	conns   map[string]*grpc.ClientConn
 
-	// Sorted list of node hashes for consistent hashing
-	nodeHashes []uint64
-	nodeMap    map[uint64]string
+	// Which node each file is stored on
+	placementPolicy PlacementPolicy
+	placement       Placement
 
-	migratedFiles map[string]bool // 记录已迁移的文件
+	// Transport credentials storage nodes are dialed with
+	creds credentials.TransportCredentials
+
+	// Cache of recently read files, nil if disabled
+	cache *ContentCache
+
+	readPolicy  ReadPolicy
+	readLatency latencyTracker
+
+	// Circuit breaker of each node
+	breakerPolicy BreakerPolicy
+	breakers      map[string]*breaker
+
+	// workCtx is cancelled when the web server gives up on running work at
+	// shutdown; nil if the service is not served by one
+	workCtx context.Context
 }
 
 // NewNetworkVideoContentService creates a new NetworkVideoContentService
+// that talks to storage nodes over plaintext connections
 func NewNetworkVideoContentService(options string) (*NetworkVideoContentService, error) {
+	return NewNetworkVideoContentServiceWithCredentials(options, insecure.NewCredentials())
+}
+
+// NewNetworkVideoContentServiceWithCredentials creates a new
+// NetworkVideoContentService that dials storage nodes, including ones added
+// later through the admin service, with the given credentials, e.g. mutual
+// TLS
+func NewNetworkVideoContentServiceWithCredentials(options string, creds credentials.TransportCredentials) (*NetworkVideoContentService, error) {
 	parts := strings.Split(options, ",")
 	if len(parts) < 2 {
 		return nil, fmt.Errorf("invalid options format: %s", options)
@@ -48,8 +85,15 @@ func NewNetworkVideoContentService(options string) (*NetworkVideoContentService,
 	service := &NetworkVideoContentService{
 		adminAddr:  adminAddr,
 		clients:    make(map[string]proto.StorageServiceClient),
-		nodeHashes: make([]uint64, 0, len(nodes)),
-		nodeMap:    make(map[uint64]string),
+		conns:      make(map[string]*grpc.ClientConn),
+		creds:      creds,
+		readPolicy: DefaultReadPolicy(),
+
+		placementPolicy: DefaultPlacementPolicy(),
+		placement:       newRingPlacement(),
+
+		breakerPolicy: DefaultBreakerPolicy(),
+		breakers:      make(map[string]*breaker),
 	}
 
 	// Connect to all nodes
@@ -62,106 +106,202 @@ func NewNetworkVideoContentService(options string) (*NetworkVideoContentService,
 	return service, nil
 }
 
-// hashStringToUint64 computes the hash of a string using SHA-256
-func hashStringToUint64(s string) uint64 {
-	sum := sha256.Sum256([]byte(s))
-	return binary.BigEndian.Uint64(sum[:8])
+// SetCache makes reads go through cache, which the service keeps up to date
+// as files are written, deleted and migrated. It must be called before the
+// service is used.
+func (s *NetworkVideoContentService) SetCache(cache *ContentCache) {
+	s.cache = cache
 }
 
-// addNode adds a new node to the consistent hash ring
+// invalidate drops a file from the cache, if any
+func (s *NetworkVideoContentService) invalidate(key string) {
+	if s.cache != nil {
+		s.cache.Invalidate(key)
+	}
+}
+
+// addNode connects to a node and places files on it
 func (s *NetworkVideoContentService) addNode(nodeAddr string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.conns[nodeAddr]; ok {
+		// Already connected; placement ignores nodes it already has
+		return nil
+	}
+
 	// Connect to the node
-	conn, err := grpc.Dial(nodeAddr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	b := newBreaker(nodeAddr, &s.breakerPolicy)
+	conn, err := grpc.Dial(nodeAddr,
+		grpc.WithTransportCredentials(s.creds),
+		// Calls a breaker fails are not made, so they are not counted as
+		// calls to the node either
+		grpc.WithChainUnaryInterceptor(breakerInterceptor(b), storageClientInterceptor(nodeAddr), logging.UnaryClientInterceptor()),
+		// Storage calls become child spans of the request they are made
+		// for, and the trace continues on the node
+		grpc.WithStatsHandler(otelgrpc.NewClientHandler()),
+	)
 	if err != nil {
 		return fmt.Errorf("failed to connect to node: %v", err)
 	}
+	b.publish()
+	s.breakers[nodeAddr] = b
+	s.conns[nodeAddr] = conn
 
 	client := proto.NewStorageServiceClient(conn)
 	s.clients[nodeAddr] = client
 
-	// Add to hash ring
-	hash := hashStringToUint64(nodeAddr)
-	s.nodeHashes = append(s.nodeHashes, hash)
-	s.nodeMap[hash] = nodeAddr
-	sort.Slice(s.nodeHashes, func(i, j int) bool {
-		return s.nodeHashes[i] < s.nodeHashes[j]
-	})
+	s.placement.Add(nodeAddr)
+	ringNodes.Set(float64(len(s.placement.Nodes())))
 
 	return nil
 }
 
-// removeNode removes a node from the consistent hash ring
+// removeNode stops placing files on a node, drops its client and breaker
+// and closes its connection
 func (s *NetworkVideoContentService) removeNode(nodeAddr string) error {
-	hash := hashStringToUint64(nodeAddr)
-
-	// Remove from hash ring
-	for i, h := range s.nodeHashes {
-		if h == hash {
-			s.nodeHashes = append(s.nodeHashes[:i], s.nodeHashes[i+1:]...)
-			delete(s.nodeMap, hash)
-			delete(s.clients, nodeAddr)
-			return nil
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.placement.Remove(nodeAddr) {
+		return fmt.Errorf("node not found: %s", nodeAddr)
+	}
+	delete(s.clients, nodeAddr)
+	if b := s.breakers[nodeAddr]; b != nil {
+		b.unpublish()
+		delete(s.breakers, nodeAddr)
+	}
+	if conn := s.conns[nodeAddr]; conn != nil {
+		if err := conn.Close(); err != nil {
+			slog.Warn("Failed to close connection to removed node", "node", nodeAddr, "error", err)
 		}
+		delete(s.conns, nodeAddr)
 	}
-
-	return fmt.Errorf("node not found: %s", nodeAddr)
+	ringNodes.Set(float64(len(s.placement.Nodes())))
+	return nil
 }
 
-// getNodeForKey returns the node that should store the given key
-func (s *NetworkVideoContentService) getNodeForKey(key string) string {
-	if len(s.nodeHashes) == 0 {
-		return ""
+// replicasForKey returns the nodes a read of the given key goes to, the one
+// placement locates it on leading. Files are stored on a single node, but
+// the file may still be on the next one while it is being migrated. s.mu must
+// be held.
+func (s *NetworkVideoContentService) replicasForKey(key string) []readTarget {
+	var targets []readTarget
+	for _, nodeAddr := range s.placement.LocateN(key, readCandidates) {
+		targets = append(targets, readTarget{nodeAddr: nodeAddr, client: s.clients[nodeAddr]})
 	}
+	return targets
+}
 
-	hash := hashStringToUint64(key)
+// ownerOf returns the node that should store the given key and its client,
+// "" if there are no nodes. s.mu must not be held.
+func (s *NetworkVideoContentService) ownerOf(key string) (string, proto.StorageServiceClient) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
 
-	// Find the first node with hash greater than the key's hash
-	for _, nodeHash := range s.nodeHashes {
-		if nodeHash >= hash {
-			return s.nodeMap[nodeHash]
-		}
+	nodeAddr := s.getNodeForKey(key)
+	return nodeAddr, s.clients[nodeAddr]
+}
+
+// nodeClients returns the client of every node, so calls to them are made
+// without holding s.mu
+func (s *NetworkVideoContentService) nodeClients() map[string]proto.StorageServiceClient {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	clients := make(map[string]proto.StorageServiceClient, len(s.clients))
+	for nodeAddr, client := range s.clients {
+		clients[nodeAddr] = client
 	}
+	return clients
+}
+
+// client returns the client of a node, nil if it is not in the cluster. s.mu
+// must not be held.
+func (s *NetworkVideoContentService) client(nodeAddr string) proto.StorageServiceClient {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
 
-	// If no node has a greater hash, wrap around to the first node
-	return s.nodeMap[s.nodeHashes[0]]
+	return s.clients[nodeAddr]
 }
 
-// Read implements VideoContentService.Read
-func (s *NetworkVideoContentService) Read(videoID string, filename string) ([]byte, error) {
+// getNodeForKey returns the node that should store the given key
+func (s *NetworkVideoContentService) getNodeForKey(key string) string {
+	return s.placement.Locate(key)
+}
+
+// nodeForKey returns the node currently responsible for a file of a video
+func (s *NetworkVideoContentService) nodeForKey(videoID string, filename string) string {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
-	key := fmt.Sprintf("%s/%s", videoID, filename)
-	nodeAddr := s.getNodeForKey(key)
-	if nodeAddr == "" {
+	return s.getNodeForKey(fmt.Sprintf("%s/%s", videoID, filename))
+}
+
+// Read implements VideoContentService.Read
+func (s *NetworkVideoContentService) Read(videoID string, filename string) ([]byte, error) {
+	return s.ReadContext(context.Background(), videoID, filename)
+}
+
+// ReadContext implements ContextVideoContentService.ReadContext
+func (s *NetworkVideoContentService) ReadContext(ctx context.Context, videoID string, filename string) (data []byte, err error) {
+	ctx, span := startSpan(ctx, "NetworkVideoContentService.Read", videoID, filename)
+	defer func() { endSpan(span, err) }()
+
+	if s.cache == nil {
+		return s.readFromNode(ctx, videoID, filename)
+	}
+	return s.cache.Read(ctx, fmt.Sprintf("%s/%s", videoID, filename), func(ctx context.Context) ([]byte, error) {
+		return s.readFromNode(ctx, videoID, filename)
+	})
+}
+
+// readFromNode reads a file from the node responsible for it
+func (s *NetworkVideoContentService) readFromNode(ctx context.Context, videoID string, filename string) ([]byte, error) {
+	// The lock is not held over the calls, so a slow node does not hold up
+	// nodes joining or leaving
+	s.mu.RLock()
+	targets := s.replicasForKey(fmt.Sprintf("%s/%s", videoID, filename))
+	s.mu.RUnlock()
+	if len(targets) == 0 {
 		return nil, fmt.Errorf("no storage nodes available")
 	}
+	trace.SpanFromContext(ctx).SetAttributes(attribute.String("tritontube.node", targets[0].nodeAddr))
 
-	client := s.clients[nodeAddr]
-	resp, err := client.Read(context.Background(), &proto.ReadRequest{
+	data, nodeAddr, err := s.readWithPolicy(ctx, targets, &proto.ReadRequest{
 		VideoId:  videoID,
 		Filename: filename,
 	})
+	if status.Code(err) == codes.NotFound {
+		// Reported like the filesystem would, so handlers can tell it apart
+		return nil, fmt.Errorf("no file %s/%s on node %s: %w", videoID, filename, nodeAddr, fs.ErrNotExist)
+	}
 	if err != nil {
 		return nil, fmt.Errorf("failed to read from node %s: %v", nodeAddr, err)
 	}
 
-	return resp.Content, nil
+	return data, nil
 }
 
 // Write implements VideoContentService.Write
 func (s *NetworkVideoContentService) Write(videoID string, filename string, content []byte) error {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
+	return s.WriteContext(context.Background(), videoID, filename, content)
+}
+
+// WriteContext implements ContextVideoContentService.WriteContext
+func (s *NetworkVideoContentService) WriteContext(ctx context.Context, videoID string, filename string, content []byte) (err error) {
+	ctx, span := startSpan(ctx, "NetworkVideoContentService.Write", videoID, filename)
+	defer func() { endSpan(span, err) }()
 
 	key := fmt.Sprintf("%s/%s", videoID, filename)
-	nodeAddr := s.getNodeForKey(key)
+	nodeAddr, client := s.ownerOf(key)
 	if nodeAddr == "" {
 		return fmt.Errorf("no storage nodes available")
 	}
+	span.SetAttributes(attribute.String("tritontube.node", nodeAddr))
+	defer s.invalidate(key)
 
-	client := s.clients[nodeAddr]
-	_, err := client.Write(context.Background(), &proto.WriteRequest{
+	_, err = client.Write(ctx, &proto.WriteRequest{
 		VideoId:  videoID,
 		Filename: filename,
 		Content:  content,
@@ -173,18 +313,55 @@ func (s *NetworkVideoContentService) Write(videoID string, filename string, cont
 	return nil
 }
 
-// Delete implements VideoContentService.Delete
-func (s *NetworkVideoContentService) Delete(videoID string, filename string) error {
+// WriteBatch writes several files of a video, with one call to each node
+// that owns any of them, and returns the error of every file, nil where it
+// was written
+func (s *NetworkVideoContentService) WriteBatch(ctx context.Context, videoID string, files []batchFile) []error {
+	ctx, span := startSpan(ctx, "NetworkVideoContentService.WriteBatch", videoID, "")
+	span.SetAttributes(attribute.Int("tritontube.files", len(files)))
+	errs := make([]error, len(files))
+	defer func() { endSpan(span, errors.Join(errs...)) }()
+
+	// Indexes into files of the files each node owns
+	owned := make(map[string][]int)
+	clients := make(map[string]proto.StorageServiceClient)
 	s.mu.RLock()
-	defer s.mu.RUnlock()
+	for i, file := range files {
+		nodeAddr := s.getNodeForKey(fmt.Sprintf("%s/%s", videoID, file.filename))
+		if nodeAddr == "" {
+			errs[i] = fmt.Errorf("no storage nodes available")
+			continue
+		}
+		owned[nodeAddr] = append(owned[nodeAddr], i)
+		clients[nodeAddr] = s.clients[nodeAddr]
+	}
+	s.mu.RUnlock()
 
+	for nodeAddr, indexes := range owned {
+		items := make([]*proto.WriteRequest, len(indexes))
+		for j, i := range indexes {
+			items[j] = &proto.WriteRequest{VideoId: videoID, Filename: files[i].filename, Content: files[i].data}
+		}
+		for j, err := range batchWrite(ctx, clients[nodeAddr], items) {
+			i := indexes[j]
+			s.invalidate(fmt.Sprintf("%s/%s", videoID, files[i].filename))
+			if err != nil {
+				errs[i] = fmt.Errorf("failed to write to node %s: %v", nodeAddr, err)
+			}
+		}
+	}
+	return errs
+}
+
+// Delete implements VideoContentService.Delete
+func (s *NetworkVideoContentService) Delete(videoID string, filename string) error {
 	key := fmt.Sprintf("%s/%s", videoID, filename)
-	nodeAddr := s.getNodeForKey(key)
+	nodeAddr, client := s.ownerOf(key)
 	if nodeAddr == "" {
 		return fmt.Errorf("no storage nodes available")
 	}
+	defer s.invalidate(key)
 
-	client := s.clients[nodeAddr]
 	_, err := client.Delete(context.Background(), &proto.DeleteRequest{
 		VideoId:  videoID,
 		Filename: filename,
@@ -196,21 +373,92 @@ func (s *NetworkVideoContentService) Delete(videoID string, filename string) err
 	return nil
 }
 
+// ListVideos implements VideoContentService.ListVideos by merging the video IDs of every node
+func (s *NetworkVideoContentService) ListVideos() ([]string, error) {
+
+	seen := make(map[string]bool)
+	videoIDs := []string{}
+	for nodeAddr, client := range s.nodeClients() {
+		ids, err := s.listVideoIDs(client)
+		if err != nil {
+			return nil, fmt.Errorf("node %s: %v", nodeAddr, err)
+		}
+		for _, id := range ids {
+			if !seen[id] {
+				seen[id] = true
+				videoIDs = append(videoIDs, id)
+			}
+		}
+	}
+	sort.Strings(videoIDs)
+	return videoIDs, nil
+}
+
+// ListFiles implements VideoContentService.ListFiles by merging the files of a video on every node
+func (s *NetworkVideoContentService) ListFiles(videoID string) ([]string, error) {
+
+	seen := make(map[string]bool)
+	filenames := []string{}
+	for nodeAddr, client := range s.nodeClients() {
+		files, err := s.listFiles(client, videoID)
+		if err != nil {
+			return nil, fmt.Errorf("node %s: %v", nodeAddr, err)
+		}
+		for _, filename := range files {
+			if !seen[filename] {
+				seen[filename] = true
+				filenames = append(filenames, filename)
+			}
+		}
+	}
+	sort.Strings(filenames)
+	return filenames, nil
+}
+
+// WalkFiles implements InventoryVideoContentService.WalkFiles by walking
+// the files of every node in turn
+func (s *NetworkVideoContentService) WalkFiles(fn func(videoID string, filename string) error) error {
+
+	for nodeAddr, client := range s.nodeClients() {
+		err := s.walkKeys(context.Background(), client, func(key *proto.KeyInfo) error {
+			return fn(key.VideoId, key.Filename)
+		})
+		if err != nil {
+			return fmt.Errorf("node %s: %v", nodeAddr, err)
+		}
+	}
+	return nil
+}
+
 // listNodesInternal returns the list of nodes in the cluster
 func (s *NetworkVideoContentService) listNodesInternal() []string {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
-	nodes := make([]string, 0, len(s.nodeHashes))
-	for _, hash := range s.nodeHashes {
-		nodes = append(nodes, s.nodeMap[hash])
+	return s.placement.Nodes()
+}
+
+// migrationContext detaches a migration from the admin call that started
+// it, since moving the files can take far longer than the caller waits. The
+// migration keeps the call's values, such as its request ID, and is only
+// cancelled when a shutdown runs out of time.
+func (s *NetworkVideoContentService) migrationContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	if s.workCtx == nil {
+		return ctx, cancel
+	}
+	stop := context.AfterFunc(s.workCtx, cancel)
+	return ctx, func() {
+		stop()
+		cancel()
 	}
-	return nodes
 }
 
 // AddNode implements VideoContentAdminServiceServer.AddNode
 func (s *NetworkVideoContentService) AddNode(ctx context.Context, req *proto.AddNodeRequest) (*proto.AddNodeResponse, error) {
-	count, err := s.addNodeInternal(req.NodeAddress)
+	ctx, cancel := s.migrationContext(ctx)
+	defer cancel()
+	count, err := s.addNodeInternal(ctx, req.NodeAddress)
 	if err != nil {
 		return nil, err
 	}
@@ -219,7 +467,9 @@ func (s *NetworkVideoContentService) AddNode(ctx context.Context, req *proto.Add
 
 // RemoveNode implements VideoContentAdminServiceServer.RemoveNode
 func (s *NetworkVideoContentService) RemoveNode(ctx context.Context, req *proto.RemoveNodeRequest) (*proto.RemoveNodeResponse, error) {
-	count, err := s.removeNodeInternal(req.NodeAddress)
+	ctx, cancel := s.migrationContext(ctx)
+	defer cancel()
+	count, err := s.removeNodeInternal(ctx, req.NodeAddress)
 	if err != nil {
 		return nil, err
 	}
@@ -229,166 +479,360 @@ func (s *NetworkVideoContentService) RemoveNode(ctx context.Context, req *proto.
 // ListNodes implements VideoContentAdminServiceServer.ListNodes
 func (s *NetworkVideoContentService) ListNodes(ctx context.Context, req *proto.ListNodesRequest) (*proto.ListNodesResponse, error) {
 	nodes := s.listNodesInternal()
-	return &proto.ListNodesResponse{Nodes: nodes}, nil
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	statuses := make([]*proto.NodeStatus, 0, len(nodes))
+	for _, node := range nodes {
+		state := breakerClosed
+		if b := s.breakers[node]; b != nil {
+			state = b.currentState()
+		}
+		statuses = append(statuses, &proto.NodeStatus{NodeAddress: node, BreakerState: state.String()})
+	}
+	return &proto.ListNodesResponse{Nodes: nodes, Statuses: statuses}, nil
 }
 
-// Rename the internal methods
-func (s *NetworkVideoContentService) addNodeInternal(nodeAddr string) (int, error) {
-	// 1. 先把新节点加到哈希环
-	if err := s.addNode(nodeAddr); err != nil {
-		return 0, err
+// migrationInterrupted reports whether a migration must stop before the next
+// file because a shutdown ran out of time. Files are only moved whole, so an interrupted migration leaves every
+// file either on its old node or on its new one.
+func migrationInterrupted(ctx context.Context, migratedCount int) error {
+	if err := ctx.Err(); err != nil {
+		slog.WarnContext(ctx, "Migration interrupted", "files_migrated", migratedCount, "error", err)
+		return fmt.Errorf("migration interrupted after %d files: %v", migratedCount, err)
 	}
+	return nil
+}
 
-	migratedCount := 0
-	migratedFiles := make(map[string]bool)
+// moveFiles moves files from one node to another and returns the ones
+// moved, with their size. The source node copies each file straight to the
+// destination ("direct"); only nodes without CopyTo have them relayed
+// through the web server ("relay"). The source's copies are deleted, in one
+// call, once the destination's match them.
+func (s *NetworkVideoContentService) moveFiles(ctx context.Context, keys []*proto.KeyInfo,
+	srcAddr string, src proto.StorageServiceClient, dstAddr string, dst proto.StorageServiceClient) ([]*proto.KeyInfo, string, error) {
+	transfer := "direct"
+	copied := make([]*proto.CopyToResponse, 0, len(keys))
+	for _, key := range keys {
+		resp, err := src.CopyTo(ctx, &proto.CopyToRequest{
+			VideoId:     key.VideoId,
+			Filename:    key.Filename,
+			Destination: dstAddr,
+		})
+		if status.Code(err) == codes.Unimplemented {
+			transfer = "relay"
+			if copied, err = relayFiles(ctx, keys, src, dst); err != nil {
+				return nil, transfer, fmt.Errorf("failed to relay files from node %s to node %s: %v", srcAddr, dstAddr, err)
+			}
+			break
+		}
+		if err != nil {
+			return nil, transfer, fmt.Errorf("failed to copy %s/%s from node %s to node %s: %v", key.VideoId, key.Filename, srcAddr, dstAddr, err)
+		}
+		copied = append(copied, resp)
+	}
 
-	// 2. 遍历所有节点，收集所有文件
-	for srcAddr, client := range s.clients {
-		if srcAddr == nodeAddr {
-			// 新节点上本来就没有文件，跳过
-			continue
+	deletes := make([]*proto.DeleteRequest, len(keys))
+	for i, key := range keys {
+		stat, err := dst.Stat(ctx, &proto.StatRequest{VideoId: key.VideoId, Filename: key.Filename})
+		if status.Code(err) == codes.Unimplemented && transfer == "relay" {
+			// A node that predates Stat; the write succeeding has to do
+			stat, err = &proto.StatResponse{Size: copied[i].Size, Checksum: copied[i].Checksum}, nil
 		}
-		videoIDs, err := s.listVideoIDs(client)
 		if err != nil {
-			return migratedCount, err
+			return nil, transfer, fmt.Errorf("failed to check %s/%s on node %s: %v", key.VideoId, key.Filename, dstAddr, err)
 		}
-		for _, videoID := range videoIDs {
-			files, err := s.listFiles(client, videoID)
+		if stat.Size != copied[i].Size || stat.Checksum != copied[i].Checksum {
+			return nil, transfer, fmt.Errorf("copy of %s/%s on node %s does not match node %s: %d bytes with checksum %s, want %d bytes with checksum %s",
+				key.VideoId, key.Filename, dstAddr, srcAddr, stat.Size, stat.Checksum, copied[i].Size, copied[i].Checksum)
+		}
+		deletes[i] = &proto.DeleteRequest{VideoId: key.VideoId, Filename: key.Filename}
+	}
+
+	// A file whose source copy is not deleted is left on both nodes, which
+	// the next migration off the source cleans up
+	moved := make([]*proto.KeyInfo, 0, len(keys))
+	var deleteErr error
+	for i, err := range batchDelete(ctx, src, deletes) {
+		key := keys[i]
+		if err != nil {
+			if deleteErr == nil {
+				deleteErr = fmt.Errorf("failed to delete %s/%s from node %s: %v", key.VideoId, key.Filename, srcAddr, err)
+			}
+			continue
+		}
+		s.invalidate(fmt.Sprintf("%s/%s", key.VideoId, key.Filename))
+		moved = append(moved, &proto.KeyInfo{VideoId: key.VideoId, Filename: key.Filename, Size: copied[i].Size, Checksum: copied[i].Checksum})
+	}
+	return moved, transfer, deleteErr
+}
+
+// relayFiles copies files by reading them from one node and writing them to
+// another, a batch at a time, and describes each like CopyTo does
+func relayFiles(ctx context.Context, keys []*proto.KeyInfo, src proto.StorageServiceClient, dst proto.StorageServiceClient) ([]*proto.CopyToResponse, error) {
+	reads := make([]*proto.ReadRequest, len(keys))
+	for i, key := range keys {
+		reads[i] = &proto.ReadRequest{VideoId: key.VideoId, Filename: key.Filename}
+	}
+	contents, errs := batchRead(ctx, src, reads)
+
+	writes := make([]*proto.WriteRequest, len(keys))
+	copied := make([]*proto.CopyToResponse, len(keys))
+	for i, key := range keys {
+		if errs[i] != nil {
+			return nil, fmt.Errorf("%s/%s: %v", key.VideoId, key.Filename, errs[i])
+		}
+		writes[i] = &proto.WriteRequest{VideoId: key.VideoId, Filename: key.Filename, Content: contents[i]}
+		sum := sha256.Sum256(contents[i])
+		copied[i] = &proto.CopyToResponse{Size: int64(len(contents[i])), Checksum: hex.EncodeToString(sum[:])}
+	}
+
+	// The walk may not have known their sizes, so the writes are batched
+	// again by what was read
+	for start := 0; start < len(writes); {
+		end, size := start+1, len(writes[start].Content)
+		for end < len(writes) && end-start < maxBatchFiles && size+len(writes[end].Content) <= maxBatchBytes {
+			size += len(writes[end].Content)
+			end++
+		}
+		for i, err := range batchWrite(ctx, dst, writes[start:end]) {
 			if err != nil {
-				return migratedCount, err
+				return nil, fmt.Errorf("%s/%s: %v", keys[start+i].VideoId, keys[start+i].Filename, err)
 			}
-			for _, filename := range files {
-				key := fmt.Sprintf("%s/%s", videoID, filename)
-				if migratedFiles[key] {
-					continue
-				}
-				// 3. 计算该文件现在应该属于哪个节点
-				targetAddr := s.getNodeForKey(key)
-				if targetAddr == nodeAddr {
-					// 4. 迁移：只迁移那些目标节点是新节点的文件
-					// 读取
-					resp, err := client.Read(context.Background(), &proto.ReadRequest{
-						VideoId:  videoID,
-						Filename: filename,
-					})
-					if err != nil {
-						return migratedCount, err
-					}
-					// 写入
-					newClient := s.clients[nodeAddr]
-					_, err = newClient.Write(context.Background(), &proto.WriteRequest{
-						VideoId:  videoID,
-						Filename: filename,
-						Content:  resp.Content,
-					})
-					if err != nil {
-						return migratedCount, err
-					}
-					// 删除
-					_, err = client.Delete(context.Background(), &proto.DeleteRequest{
-						VideoId:  videoID,
-						Filename: filename,
-					})
-					if err != nil {
-						return migratedCount, err
-					}
-					migratedFiles[key] = true
-					migratedCount++
-					fmt.Printf("[MIGRATE-ADD] %s from %s to %s\n", key, srcAddr, nodeAddr)
-				}
+		}
+		start = end
+	}
+	return copied, nil
+}
+
+// migrationBatch gathers the files a migration moves off one node by their
+// destination, and moves those bound for the same node together once they
+// fill a batch. Sizes unknown to the walk count as 0; the nodes and
+// relayFiles bound the calls by the files' actual sizes.
+type migrationBatch struct {
+	s         *NetworkVideoContentService
+	operation string // "add", "remove" or "placement", as in the migration metrics
+
+	srcAddr string
+	src     proto.StorageServiceClient
+	pending map[string][]*proto.KeyInfo // destination -> files waiting to be moved
+	bytes   map[string]int64            // destination -> size of the files waiting
+
+	moved map[string]bool // 记录已迁移的文件
+	count int
+}
+
+func (s *NetworkVideoContentService) newMigrationBatch(operation string) *migrationBatch {
+	return &migrationBatch{
+		s:         s,
+		operation: operation,
+		pending:   make(map[string][]*proto.KeyInfo),
+		bytes:     make(map[string]int64),
+		moved:     make(map[string]bool),
+	}
+}
+
+// add queues a file of srcAddr to be moved to dstAddr. Files already moved
+// are skipped.
+func (m *migrationBatch) add(ctx context.Context, srcAddr string, src proto.StorageServiceClient, dstAddr string, key *proto.KeyInfo) error {
+	if m.moved[fmt.Sprintf("%s/%s", key.VideoId, key.Filename)] {
+		return nil
+	}
+	if srcAddr != m.srcAddr {
+		if err := m.flush(ctx); err != nil {
+			return err
+		}
+		m.srcAddr, m.src = srcAddr, src
+	}
+	if len(m.pending[dstAddr]) > 0 && m.bytes[dstAddr]+key.Size > maxBatchBytes {
+		if err := m.move(ctx, dstAddr); err != nil {
+			return err
+		}
+	}
+	m.pending[dstAddr] = append(m.pending[dstAddr], key)
+	m.bytes[dstAddr] += key.Size
+	if len(m.pending[dstAddr]) >= maxBatchFiles {
+		return m.move(ctx, dstAddr)
+	}
+	return nil
+}
+
+// flush moves every file still waiting
+func (m *migrationBatch) flush(ctx context.Context) error {
+	for dstAddr := range m.pending {
+		if err := m.move(ctx, dstAddr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// move moves the files waiting to go to dstAddr
+func (m *migrationBatch) move(ctx context.Context, dstAddr string) error {
+	keys := m.pending[dstAddr]
+	delete(m.pending, dstAddr)
+	delete(m.bytes, dstAddr)
+	if err := migrationInterrupted(ctx, m.count); err != nil {
+		return err
+	}
+
+	// The batch being moved is finished even if the call is cancelled
+	moved, transfer, err := m.s.moveFiles(context.WithoutCancel(ctx), keys, m.srcAddr, m.src, dstAddr, m.s.client(dstAddr))
+	for _, key := range moved {
+		name := fmt.Sprintf("%s/%s", key.VideoId, key.Filename)
+		m.moved[name] = true
+		m.count++
+		migrationFiles.WithLabelValues(m.operation).Inc()
+		migrationBytes.WithLabelValues(m.operation).Add(float64(key.Size))
+		slog.InfoContext(ctx, "Migrated file", "operation", m.operation, "key", name, "from", m.srcAddr, "to", dstAddr, "bytes", key.Size, "transfer", transfer)
+	}
+	return err
+}
+
+// rebalance moves the files stored on the given nodes to the node placement
+// locates them on, where that is another one, and returns how many files
+// were moved. placement may be the service's own, so it is only used under
+// s.mu.
+func (s *NetworkVideoContentService) rebalance(ctx context.Context, operation string, placement Placement, sources []string) (int, error) {
+	batch := s.newMigrationBatch(operation)
+	for _, srcAddr := range sources {
+		client := s.client(srcAddr)
+		err := s.walkKeys(ctx, client, func(key *proto.KeyInfo) error {
+			// 计算该文件现在应该属于哪个节点，发往同一节点的文件一起迁移
+			s.mu.RLock()
+			targetAddr := placement.Locate(fmt.Sprintf("%s/%s", key.VideoId, key.Filename))
+			s.mu.RUnlock()
+			if targetAddr == "" || targetAddr == srcAddr {
+				return nil
 			}
+			return batch.add(ctx, srcAddr, client, targetAddr, key)
+		})
+		if err != nil {
+			return batch.count, err
 		}
 	}
-	return migratedCount, nil
+	err := batch.flush(ctx)
+	return batch.count, err
 }
 
-func (s *NetworkVideoContentService) removeNodeInternal(nodeAddr string) (int, error) {
-	client := s.clients[nodeAddr]
-	if client == nil {
-		return 0, fmt.Errorf("node not found: %s", nodeAddr)
+// Rename the internal methods
+func (s *NetworkVideoContentService) addNodeInternal(ctx context.Context, nodeAddr string) (int, error) {
+	// 1. 先把新节点加到哈希环
+	if err := s.addNode(nodeAddr); err != nil {
+		return 0, err
 	}
 
-	migratedCount := 0
-	migratedFiles := make(map[string]bool)
+	// 2. 遍历所有节点，迁移位置变了的文件。环和 rendezvous 只会把文件迁到新节点，
+	// 其他策略也可能在旧节点之间挪动文件
+	return s.rebalance(ctx, "add", s.placement, s.listNodesInternal())
+}
 
-	// 1. 获取要移除节点上的所有文件
-	videoIDs, err := s.listVideoIDs(client)
+func (s *NetworkVideoContentService) removeNodeInternal(ctx context.Context, nodeAddr string) (int, error) {
+	if s.client(nodeAddr) == nil {
+		return 0, fmt.Errorf("node not found: %s", nodeAddr)
+	}
+
+	// 1. 计算移除节点后每个文件应该属于哪个节点，节点本身在迁移完成前继续服务
+	after, err := NewPlacement(s.placementPolicy)
 	if err != nil {
 		return 0, err
 	}
-	for _, videoID := range videoIDs {
-		files, err := s.listFiles(client, videoID)
-		if err != nil {
-			return migratedCount, err
-		}
-		for _, filename := range files {
-			key := fmt.Sprintf("%s/%s", videoID, filename)
-			if migratedFiles[key] {
-				continue
-			}
-			// 2. 计算该文件移除节点后应该属于哪个节点
-			// 先临时把节点移除哈希环
-			s.removeNode(nodeAddr)
-			targetAddr := s.getNodeForKey(key)
-			// 再加回来，保证后续循环不影响
-			s.addNode(nodeAddr)
-			if targetAddr == nodeAddr {
-				// 该文件依然属于本节点，不迁移
-				continue
-			}
-			// 3. 迁移到新节点
-			resp, err := client.Read(context.Background(), &proto.ReadRequest{
-				VideoId:  videoID,
-				Filename: filename,
-			})
-			if err != nil {
-				return migratedCount, err
-			}
-			targetClient := s.clients[targetAddr]
-			_, err = targetClient.Write(context.Background(), &proto.WriteRequest{
-				VideoId:  videoID,
-				Filename: filename,
-				Content:  resp.Content,
-			})
-			if err != nil {
-				return migratedCount, err
-			}
-			_, err = client.Delete(context.Background(), &proto.DeleteRequest{
-				VideoId:  videoID,
-				Filename: filename,
-			})
-			if err != nil {
-				return migratedCount, err
-			}
-			migratedFiles[key] = true
-			migratedCount++
-			fmt.Printf("[MIGRATE-REMOVE] %s from %s to %s\n", key, nodeAddr, targetAddr)
+	nodes := s.listNodesInternal()
+	for _, node := range nodes {
+		if node != nodeAddr {
+			after.Add(node)
 		}
 	}
-	// 4. 最后真正移除节点
+
+	// 2. 迁移到新节点
+	count, err := s.rebalance(ctx, "remove", after, nodes)
+	if err != nil {
+		return count, err
+	}
+	// 3. 最后真正移除节点
 	s.removeNode(nodeAddr)
-	return migratedCount, nil
+	return count, nil
 }
 
+// listPageSize is how many entries each page of a node's listings holds
+const listPageSize = 1000
+
 // listVideoIDs returns a list of all video IDs stored on a node
 func (s *NetworkVideoContentService) listVideoIDs(client proto.StorageServiceClient) ([]string, error) {
-	resp, err := client.ListVideoIDs(context.Background(), &proto.ListVideoIDsRequest{})
-	if err != nil {
-		return nil, fmt.Errorf("failed to list video IDs: %v", err)
+	videoIDs := []string{}
+	req := &proto.ListVideoIDsRequest{PageSize: listPageSize}
+	for {
+		resp, err := client.ListVideoIDs(context.Background(), req)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list video IDs: %v", err)
+		}
+		videoIDs = append(videoIDs, resp.VideoIds...)
+		if resp.NextPageToken == "" {
+			return videoIDs, nil
+		}
+		req.PageToken = resp.NextPageToken
 	}
-	return resp.VideoIds, nil
 }
 
 // listFiles returns a list of all files for a video stored on a node
 func (s *NetworkVideoContentService) listFiles(client proto.StorageServiceClient, videoID string) ([]string, error) {
-	resp, err := client.ListFiles(context.Background(), &proto.ListFilesRequest{
-		VideoId: videoID,
-	})
+	filenames := []string{}
+	req := &proto.ListFilesRequest{VideoId: videoID, PageSize: listPageSize}
+	for {
+		resp, err := client.ListFiles(context.Background(), req)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list files: %v", err)
+		}
+		filenames = append(filenames, resp.Filenames...)
+		if resp.NextPageToken == "" {
+			return filenames, nil
+		}
+		req.PageToken = resp.NextPageToken
+	}
+}
+
+// walkKeys calls fn for every file stored on a node, in one pass over the
+// node's ListAllKeys stream, and stops at the first error fn returns. Nodes
+// without ListAllKeys are listed video by video instead, and their files'
+// sizes and checksums are left out.
+func (s *NetworkVideoContentService) walkKeys(ctx context.Context, client proto.StorageServiceClient, fn func(key *proto.KeyInfo) error) error {
+	// The walk is ended by fn, e.g. when a migration is interrupted, rather
+	// than by the stream breaking off
+	streamCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	defer cancel()
+
+	stream, err := client.ListAllKeys(streamCtx, &proto.ListAllKeysRequest{})
+	if err == nil {
+		var key *proto.KeyInfo
+		for key, err = stream.Recv(); err == nil; key, err = stream.Recv() {
+			if err := fn(key); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+	}
+	if status.Code(err) != codes.Unimplemented {
+		return fmt.Errorf("failed to list files: %v", err)
+	}
+
+	videoIDs, err := s.listVideoIDs(client)
 	if err != nil {
-		return nil, fmt.Errorf("failed to list files: %v", err)
+		return err
+	}
+	for _, videoID := range videoIDs {
+		files, err := s.listFiles(client, videoID)
+		if err != nil {
+			return err
+		}
+		for _, filename := range files {
+			if err := fn(&proto.KeyInfo{VideoId: videoID, Filename: filename}); err != nil {
+				return err
+			}
+		}
 	}
-	return resp.Filenames, nil
+	return nil
 }
 
-// Uncomment the following line to ensure NetworkVideoContentService implements VideoContentService
-// var _ VideoContentService = (*NetworkVideoContentService)(nil)
+var _ ContextVideoContentService = (*NetworkVideoContentService)(nil)
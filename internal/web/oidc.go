@@ -0,0 +1,346 @@
+package web
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"golang.org/x/oauth2"
+)
+
+// oidcLoginTimeout is how long a user may take at the identity provider
+// before the login attempt is forgotten
+const oidcLoginTimeout = 10 * time.Minute
+
+// oidcStateCookieName is the cookie tying a login attempt's state to the
+// browser that started it
+const oidcStateCookieName = "tritontube_oidc_state"
+
+// OIDCConfig describes the OpenID Connect provider users log in with and how
+// the claims of its ID tokens map to local users and roles
+type OIDCConfig struct {
+	IssuerURL    string
+	ClientID     string
+	ClientSecret string
+	// RedirectURL is this server's /login/oidc/callback as the provider reaches it
+	RedirectURL string
+	// ProviderName is shown on the login button
+	ProviderName string
+	// Scopes are requested in addition to openid, profile and email, e.g.
+	// one the provider needs to include group claims
+	Scopes []string
+
+	// UsernameClaim names the claim that becomes the local username
+	UsernameClaim string
+	// RolesClaim names a claim holding a list of group or role names; RoleMap
+	// maps those names to roles. A user gets the most privileged role any of
+	// their names maps to, or DefaultRole if none does.
+	RolesClaim  string
+	RoleMap     map[string]Role
+	DefaultRole Role
+
+	// DisablePasswordLogin turns off local passwords and registration
+	DisablePasswordLogin bool
+}
+
+// oidcLogin runs the authorization code flow with PKCE against one provider
+type oidcLogin struct {
+	config   OIDCConfig
+	oauth2   oauth2.Config
+	verifier *oidc.IDTokenVerifier
+
+	mu      sync.Mutex
+	pending map[string]oidcPendingLogin // state -> login waiting for the provider
+}
+
+// oidcPendingLogin is what the callback needs to finish a login. The state
+// cookie set with it makes sure the callback comes from the browser that
+// started the login.
+type oidcPendingLogin struct {
+	codeVerifier string
+	nonce        string
+	next         string
+	expires      time.Time
+}
+
+// EnableOIDC lets users log in through an OpenID Connect provider. The
+// provider's discovery document is fetched right away, so a misconfigured
+// issuer is reported at startup. Accounts must be enabled first.
+func (s *server) EnableOIDC(ctx context.Context, config OIDCConfig) error {
+	if s.users == nil {
+		return fmt.Errorf("single sign-on needs accounts to be enabled")
+	}
+	if config.UsernameClaim == "" {
+		config.UsernameClaim = "preferred_username"
+	}
+	if config.DefaultRole == "" {
+		config.DefaultRole = RoleUploader
+	}
+	if !config.DefaultRole.Valid() {
+		return fmt.Errorf("invalid default role %q", config.DefaultRole)
+	}
+	for name, role := range config.RoleMap {
+		if !role.Valid() {
+			return fmt.Errorf("invalid role %q for %q", role, name)
+		}
+	}
+	if config.ProviderName == "" {
+		config.ProviderName = "SSO"
+	}
+
+	provider, err := oidc.NewProvider(ctx, config.IssuerURL)
+	if err != nil {
+		return fmt.Errorf("failed to discover OIDC provider %s: %v", config.IssuerURL, err)
+	}
+
+	scopes := append([]string{oidc.ScopeOpenID, "profile", "email"}, config.Scopes...)
+	s.oidc = &oidcLogin{
+		config: config,
+		oauth2: oauth2.Config{
+			ClientID:     config.ClientID,
+			ClientSecret: config.ClientSecret,
+			RedirectURL:  config.RedirectURL,
+			Endpoint:     provider.Endpoint(),
+			Scopes:       scopes,
+		},
+		verifier: provider.Verifier(&oidc.Config{ClientID: config.ClientID}),
+		pending:  make(map[string]oidcPendingLogin),
+	}
+	return nil
+}
+
+// begin remembers a new login attempt and returns the provider URL to send
+// the browser to, along with the attempt's state
+func (o *oidcLogin) begin(next string) (string, string, error) {
+	state, err := randomToken()
+	if err != nil {
+		return "", "", err
+	}
+	nonce, err := randomToken()
+	if err != nil {
+		return "", "", err
+	}
+	codeVerifier := oauth2.GenerateVerifier()
+
+	o.mu.Lock()
+	now := time.Now()
+	for key, login := range o.pending {
+		if now.After(login.expires) {
+			delete(o.pending, key)
+		}
+	}
+	o.pending[state] = oidcPendingLogin{
+		codeVerifier: codeVerifier,
+		nonce:        nonce,
+		next:         next,
+		expires:      now.Add(oidcLoginTimeout),
+	}
+	o.mu.Unlock()
+
+	return o.oauth2.AuthCodeURL(state, oauth2.S256ChallengeOption(codeVerifier), oidc.Nonce(nonce)), state, nil
+}
+
+// finish looks up the login attempt a callback belongs to. Each state can
+// only be used once.
+func (o *oidcLogin) finish(state string) (oidcPendingLogin, bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	login, ok := o.pending[state]
+	delete(o.pending, state)
+	if !ok || time.Now().After(login.expires) {
+		return oidcPendingLogin{}, false
+	}
+	return login, true
+}
+
+// exchange redeems an authorization code and returns the verified claims of
+// the ID token
+func (o *oidcLogin) exchange(ctx context.Context, code string, login oidcPendingLogin) (*oidc.IDToken, map[string]interface{}, error) {
+	token, err := o.oauth2.Exchange(ctx, code, oauth2.VerifierOption(login.codeVerifier))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to exchange authorization code: %v", err)
+	}
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		return nil, nil, fmt.Errorf("token response has no id_token")
+	}
+	idToken, err := o.verifier.Verify(ctx, rawIDToken)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid ID token: %v", err)
+	}
+	if idToken.Nonce != login.nonce {
+		return nil, nil, fmt.Errorf("ID token nonce does not match")
+	}
+
+	var claims map[string]interface{}
+	if err := idToken.Claims(&claims); err != nil {
+		return nil, nil, fmt.Errorf("failed to decode ID token claims: %v", err)
+	}
+	return idToken, claims, nil
+}
+
+// username returns the local username the claims map to
+func (o *oidcLogin) username(claims map[string]interface{}) (string, error) {
+	username, _ := claims[o.config.UsernameClaim].(string)
+	if !usernamePattern.MatchString(username) {
+		return "", fmt.Errorf("claim %s (%q) is not a valid username", o.config.UsernameClaim, username)
+	}
+	return username, nil
+}
+
+// role returns the most privileged role that any of the user's group or role
+// names maps to
+func (o *oidcLogin) role(claims map[string]interface{}) Role {
+	var names []string
+	switch v := claims[o.config.RolesClaim].(type) {
+	case string:
+		names = []string{v}
+	case []interface{}:
+		for _, name := range v {
+			if s, ok := name.(string); ok {
+				names = append(names, s)
+			}
+		}
+	}
+
+	rank := map[Role]int{RoleViewer: 0, RoleUploader: 1, RoleAdmin: 2}
+	role, mapped := o.config.DefaultRole, false
+	for _, name := range names {
+		if r, ok := o.config.RoleMap[name]; ok && (!mapped || rank[r] > rank[role]) {
+			role, mapped = r, true
+		}
+	}
+	return role
+}
+
+// oidcUser finds or creates the local user for an identity and brings its
+// role in line with the latest claims
+func (s *server) oidcUser(idToken *oidc.IDToken, claims map[string]interface{}) (string, error) {
+	role := s.oidc.role(claims)
+
+	username, err := s.users.ReadIdentity(idToken.Issuer, idToken.Subject)
+	if err != nil {
+		return "", err
+	}
+	if username != "" {
+		if err := s.users.SetRole(username, role); err != nil {
+			return "", fmt.Errorf("failed to update role of %s: %v", username, err)
+		}
+		return username, nil
+	}
+
+	// First login: the claimed name must not belong to someone else already,
+	// or the provider could be used to take over a local account
+	if username, err = s.oidc.username(claims); err != nil {
+		return "", err
+	}
+	existing, err := s.users.ReadUser(username)
+	if err != nil {
+		return "", err
+	}
+	if existing != nil {
+		return "", fmt.Errorf("username %s is already taken by another account", username)
+	}
+	if err := s.users.CreateUser(username, nil, role); err != nil {
+		return "", fmt.Errorf("failed to create user %s: %v", username, err)
+	}
+	if err := s.users.LinkIdentity(idToken.Issuer, idToken.Subject, username); err != nil {
+		return "", fmt.Errorf("failed to link identity of %s: %v", username, err)
+	}
+	slog.Info("Created user on first single sign-on", "username", username, "role", role)
+	return username, nil
+}
+
+func (s *server) handleOIDCLogin(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if s.oidc == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	authURL, state, err := s.oidc.begin(safeRedirectTarget(r.FormValue("next")))
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	// Lax lets the cookie through on the provider's redirect back
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcStateCookieName,
+		Value:    state,
+		Path:     "/login/oidc/",
+		MaxAge:   int(oidcLoginTimeout / time.Second),
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(w, r, authURL, http.StatusFound)
+}
+
+func (s *server) handleOIDCCallback(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if s.oidc == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	// A callback carrying a state this browser was not given is someone
+	// else's login; finishing it would log the browser in as them
+	query := r.URL.Query()
+	state := query.Get("state")
+	cookie, err := r.Cookie(oidcStateCookieName)
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcStateCookieName,
+		Value:    "",
+		Path:     "/login/oidc/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+	if err != nil || state == "" || subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(state)) != 1 {
+		slog.WarnContext(r.Context(), "Single sign-on callback without a matching state cookie")
+		s.renderAuthPage(w, r, loginHTML, http.StatusBadRequest, "/", "The login was not started in this browser, please try again")
+		return
+	}
+	login, ok := s.oidc.finish(state)
+	if !ok {
+		s.renderAuthPage(w, r, loginHTML, http.StatusBadRequest, "/", "The login attempt expired, please try again")
+		return
+	}
+	if providerErr := query.Get("error"); providerErr != "" {
+		slog.WarnContext(r.Context(), "Single sign-on failed", "error", providerErr, "description", query.Get("error_description"))
+		s.renderAuthPage(w, r, loginHTML, http.StatusUnauthorized, login.next, "Single sign-on failed: "+providerErr)
+		return
+	}
+
+	idToken, claims, err := s.oidc.exchange(r.Context(), query.Get("code"), login)
+	if err != nil {
+		slog.WarnContext(r.Context(), "Single sign-on failed", "error", err)
+		s.renderAuthPage(w, r, loginHTML, http.StatusUnauthorized, login.next, "Single sign-on failed")
+		return
+	}
+	username, err := s.oidcUser(idToken, claims)
+	if err != nil {
+		slog.WarnContext(r.Context(), "Single sign-on failed", "subject", idToken.Subject, "error", err)
+		s.renderAuthPage(w, r, loginHTML, http.StatusForbidden, login.next, "Single sign-on failed: "+err.Error())
+		return
+	}
+
+	if err := s.startSession(w, r, username); err != nil {
+		slog.ErrorContext(r.Context(), "Login failed", "username", username, "error", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, login.next, http.StatusSeeOther)
+}
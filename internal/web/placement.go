@@ -0,0 +1,457 @@
+package web
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"log/slog"
+	"math"
+	"sort"
+	"strings"
+)
+
+// Placement decides which storage node a file is stored on. Implementations
+// are not safe for concurrent use; NetworkVideoContentService guards its
+// placement with its lock.
+type Placement interface {
+	// Add places files on node as well; adding a node twice has no effect
+	Add(node string)
+	// Remove stops placing files on node, reporting whether it was placed on
+	Remove(node string) bool
+	// Nodes returns the nodes files are placed on
+	Nodes() []string
+	// Locate returns the node the file with the given "videoId/filename" key
+	// belongs on, "" if there are no nodes
+	Locate(key string) string
+	// LocateN returns up to n distinct nodes for the key, Locate's first.
+	// The next is where the file most likely was before the last node
+	// joined, or goes once the first node leaves, so reads can find files
+	// that are being migrated.
+	LocateN(key string, n int) []string
+}
+
+// Placement strategies
+const (
+	// PlacementRing puts a file on the first node clockwise of it on a
+	// consistent hash ring with one point per node
+	PlacementRing = "ring"
+	// PlacementRendezvous puts a file on the node scoring highest for it
+	// (highest random weight hashing)
+	PlacementRendezvous = "rendezvous"
+	// PlacementBoundedLoad is the ring with no node taking more than
+	// LoadFactor times its share of the key space
+	PlacementBoundedLoad = "bounded-load"
+	// PlacementJump numbers the nodes by address and picks one with jump
+	// consistent hashing
+	PlacementJump = "jump"
+)
+
+// PlacementPolicy selects how NetworkVideoContentService places files
+type PlacementPolicy struct {
+	// Strategy is one of the Placement* strategies
+	Strategy string
+	// LoadFactor bounds the share of the key space each node gets with
+	// PlacementBoundedLoad, as a multiple of an even share; at least 1
+	LoadFactor float64
+}
+
+// DefaultPlacementPolicy keeps the ring files have always been placed with
+func DefaultPlacementPolicy() PlacementPolicy {
+	return PlacementPolicy{Strategy: PlacementRing, LoadFactor: 1.25}
+}
+
+// NewPlacement returns an empty placement following policy
+func NewPlacement(policy PlacementPolicy) (Placement, error) {
+	switch policy.Strategy {
+	case PlacementRing:
+		return newRingPlacement(), nil
+	case PlacementRendezvous:
+		return &rendezvousPlacement{}, nil
+	case PlacementBoundedLoad:
+		if policy.LoadFactor < 1 {
+			return nil, fmt.Errorf("load factor must be at least 1, got %g", policy.LoadFactor)
+		}
+		return &boundedLoadPlacement{ringPlacement: newRingPlacement(), loadFactor: policy.LoadFactor}, nil
+	case PlacementJump:
+		return &jumpPlacement{}, nil
+	}
+	return nil, fmt.Errorf("unknown placement strategy %q", policy.Strategy)
+}
+
+// String identifies the policy in settings and logs. The load factor only
+// matters to PlacementBoundedLoad.
+func (p PlacementPolicy) String() string {
+	if p.Strategy == PlacementBoundedLoad {
+		return fmt.Sprintf("%s/%g", p.Strategy, p.LoadFactor)
+	}
+	return p.Strategy
+}
+
+const (
+	// placementSetting records the policy files were last moved to
+	placementSetting = "placement"
+	// placementMoving prefixes the policy files are being moved to; a move
+	// that did not finish matches no policy, so the next start moves them
+	// again, to whichever policy it has
+	placementMoving = "moving to "
+)
+
+// storedPlacement returns the policy files were last moved to. Before it was
+// recorded, files were always placed on the ring.
+func storedPlacement(settings SettingService) (string, error) {
+	stored, err := settings.Setting(placementSetting)
+	if err != nil {
+		return "", fmt.Errorf("failed to read placement setting: %v", err)
+	}
+	if stored == "" {
+		return PlacementRing, nil
+	}
+	return stored, nil
+}
+
+// CheckPlacement fails if the files were last moved to another placement
+// policy than policy, which would look for them on the wrong nodes. Without
+// a SettingService nothing is known and nothing is checked.
+func CheckPlacement(metadataService VideoMetadataService, policy PlacementPolicy) error {
+	settings, ok := metadataService.(SettingService)
+	if !ok {
+		return nil
+	}
+	stored, err := storedPlacement(settings)
+	if err != nil {
+		return err
+	}
+	if strings.HasPrefix(stored, placementMoving) {
+		return fmt.Errorf("files were being %s when the web server stopped; start it again to finish moving them", stored)
+	}
+	if stored != policy.String() {
+		return fmt.Errorf("files are placed with %s, not %s; start the web server with %s to move them first", stored, policy, policy)
+	}
+	return nil
+}
+
+// migratePlacement moves every file to the node the service's placement
+// locates it on if the files were last moved to another policy, and then
+// records the new one. Until a file is moved it is not found.
+func (s *NetworkVideoContentService) migratePlacement(ctx context.Context, settings SettingService) error {
+	stored, err := storedPlacement(settings)
+	if err != nil {
+		return err
+	}
+	policy := s.placementPolicy.String()
+	if stored == policy {
+		return nil
+	}
+
+	slog.WarnContext(ctx, "Placement changed; moving every file, and files not moved yet cannot be read", "from", stored, "to", policy)
+	if err := settings.SetSetting(placementSetting, placementMoving+policy); err != nil {
+		return fmt.Errorf("failed to record placement: %v", err)
+	}
+	count, err := s.rebalance(ctx, "placement", s.placement, s.listNodesInternal())
+	if err != nil {
+		return fmt.Errorf("failed to move files to the new placement after %d files: %v", count, err)
+	}
+	if err := settings.SetSetting(placementSetting, policy); err != nil {
+		return fmt.Errorf("failed to record placement: %v", err)
+	}
+	slog.InfoContext(ctx, "Moved files to the new placement", "placement", policy, "files_migrated", count)
+	return nil
+}
+
+// SetPlacementPolicy replaces DefaultPlacementPolicy, keeping the nodes. It
+// must be called before the service is used. If the metadata service keeps
+// settings, the web server moves files stored under another policy when it
+// starts.
+func (s *NetworkVideoContentService) SetPlacementPolicy(policy PlacementPolicy) error {
+	placement, err := NewPlacement(policy)
+	if err != nil {
+		return err
+	}
+	for _, node := range s.placement.Nodes() {
+		placement.Add(node)
+	}
+	s.placementPolicy = policy
+	s.placement = placement
+	return nil
+}
+
+// hashStringToUint64 computes the hash of a string using SHA-256
+func hashStringToUint64(s string) uint64 {
+	sum := sha256.Sum256([]byte(s))
+	return binary.BigEndian.Uint64(sum[:8])
+}
+
+// ringPlacement is a consistent hash ring with one point per node
+type ringPlacement struct {
+	// Sorted list of node hashes for consistent hashing
+	nodeHashes []uint64
+	nodeMap    map[uint64]string
+}
+
+func newRingPlacement() *ringPlacement {
+	return &ringPlacement{nodeMap: make(map[uint64]string)}
+}
+
+func (r *ringPlacement) Add(node string) {
+	hash := hashStringToUint64(node)
+	if _, ok := r.nodeMap[hash]; ok {
+		return
+	}
+	r.nodeHashes = append(r.nodeHashes, hash)
+	r.nodeMap[hash] = node
+	sort.Slice(r.nodeHashes, func(i, j int) bool {
+		return r.nodeHashes[i] < r.nodeHashes[j]
+	})
+}
+
+func (r *ringPlacement) Remove(node string) bool {
+	hash := hashStringToUint64(node)
+	for i, h := range r.nodeHashes {
+		if h == hash {
+			r.nodeHashes = append(r.nodeHashes[:i], r.nodeHashes[i+1:]...)
+			delete(r.nodeMap, hash)
+			return true
+		}
+	}
+	return false
+}
+
+// Nodes returns the nodes in ring order
+func (r *ringPlacement) Nodes() []string {
+	nodes := make([]string, 0, len(r.nodeHashes))
+	for _, hash := range r.nodeHashes {
+		nodes = append(nodes, r.nodeMap[hash])
+	}
+	return nodes
+}
+
+func (r *ringPlacement) Locate(key string) string {
+	if len(r.nodeHashes) == 0 {
+		return ""
+	}
+	return r.nodeMap[r.nodeHashes[r.successor(hashStringToUint64(key))]]
+}
+
+func (r *ringPlacement) LocateN(key string, n int) []string {
+	if len(r.nodeHashes) == 0 {
+		return nil
+	}
+	return r.walk(r.successor(hashStringToUint64(key)), n)
+}
+
+// walk returns up to n nodes clockwise from the one at index start. Every
+// node has a single point, so they are distinct.
+func (r *ringPlacement) walk(start, n int) []string {
+	n = min(n, len(r.nodeHashes))
+	nodes := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		nodes = append(nodes, r.nodeMap[r.nodeHashes[(start+i)%len(r.nodeHashes)]])
+	}
+	return nodes
+}
+
+// successor returns the index of the first node with a hash not below hash,
+// wrapping around to the first node
+func (r *ringPlacement) successor(hash uint64) int {
+	i := sort.Search(len(r.nodeHashes), func(i int) bool {
+		return r.nodeHashes[i] >= hash
+	})
+	if i == len(r.nodeHashes) {
+		return 0
+	}
+	return i
+}
+
+// sortedNodes keeps the nodes of a placement in order of their address
+type sortedNodes struct {
+	nodes []string
+}
+
+func (l *sortedNodes) Add(node string) {
+	i := sort.SearchStrings(l.nodes, node)
+	if i < len(l.nodes) && l.nodes[i] == node {
+		return
+	}
+	l.nodes = append(l.nodes, "")
+	copy(l.nodes[i+1:], l.nodes[i:])
+	l.nodes[i] = node
+}
+
+func (l *sortedNodes) Remove(node string) bool {
+	i := sort.SearchStrings(l.nodes, node)
+	if i == len(l.nodes) || l.nodes[i] != node {
+		return false
+	}
+	l.nodes = append(l.nodes[:i], l.nodes[i+1:]...)
+	return true
+}
+
+func (l *sortedNodes) Nodes() []string {
+	return append([]string(nil), l.nodes...)
+}
+
+// rendezvousPlacement gives every file to the node whose hash of the node
+// and the key is highest, so a node joining or leaving only moves the files
+// it wins or held
+type rendezvousPlacement struct {
+	sortedNodes
+}
+
+func (r *rendezvousPlacement) Locate(key string) string {
+	best, bestScore := "", uint64(0)
+	for _, node := range r.nodes {
+		// Nodes are sorted, so a tie goes to the lowest address
+		if score := hashStringToUint64(node + "/" + key); best == "" || score > bestScore {
+			best, bestScore = node, score
+		}
+	}
+	return best
+}
+
+// LocateN returns the nodes in order of their score for the key
+func (r *rendezvousPlacement) LocateN(key string, n int) []string {
+	scores := make(map[string]uint64, len(r.nodes))
+	for _, node := range r.nodes {
+		scores[node] = hashStringToUint64(node + "/" + key)
+	}
+	nodes := append([]string(nil), r.nodes...)
+	sort.SliceStable(nodes, func(i, j int) bool {
+		return scores[nodes[i]] > scores[nodes[j]]
+	})
+	return nodes[:min(n, len(nodes))]
+}
+
+const (
+	// boundedLoadPartitions is how many equal ranges of the key space
+	// boundedLoadPlacement hands out to nodes
+	boundedLoadPartitions = 1024
+	// boundedLoadShift turns a key hash into its partition
+	boundedLoadShift = 64 - 10
+)
+
+// boundedLoadPlacement splits the key space into fixed partitions and walks
+// the ring from each partition to the first node that holds fewer than
+// LoadFactor times an even share of them. A single point per node leaves the
+// plain ring badly balanced; the bound spills the excess over to the next
+// nodes. Adding or removing a node can also move partitions between other
+// nodes.
+type boundedLoadPlacement struct {
+	*ringPlacement
+	loadFactor float64
+	owners     []string // partition -> node
+}
+
+func (b *boundedLoadPlacement) Add(node string) {
+	b.ringPlacement.Add(node)
+	b.distribute()
+}
+
+func (b *boundedLoadPlacement) Remove(node string) bool {
+	if !b.ringPlacement.Remove(node) {
+		return false
+	}
+	b.distribute()
+	return true
+}
+
+func (b *boundedLoadPlacement) Locate(key string) string {
+	if len(b.owners) == 0 {
+		return ""
+	}
+	return b.owners[hashStringToUint64(key)>>boundedLoadShift]
+}
+
+// LocateN returns the partition's node, then the others clockwise of the
+// partition
+func (b *boundedLoadPlacement) LocateN(key string, n int) []string {
+	if len(b.owners) == 0 {
+		return nil
+	}
+	partition := hashStringToUint64(key) >> boundedLoadShift
+	owner := b.owners[partition]
+	nodes := []string{owner}
+	for _, node := range b.walk(b.successor(partition<<boundedLoadShift), len(b.nodeHashes)) {
+		if len(nodes) >= n {
+			break
+		}
+		if node != owner {
+			nodes = append(nodes, node)
+		}
+	}
+	return nodes
+}
+
+// distribute assigns every partition to a node, in partition order
+func (b *boundedLoadPlacement) distribute() {
+	n := len(b.nodeHashes)
+	if n == 0 {
+		b.owners = nil
+		return
+	}
+	capacity := int(math.Ceil(float64(boundedLoadPartitions) / float64(n) * b.loadFactor))
+	load := make(map[string]int, n)
+	owners := make([]string, boundedLoadPartitions)
+	for p := range owners {
+		start := b.successor(uint64(p) << boundedLoadShift)
+		for i := 0; i < n; i++ {
+			node := b.nodeMap[b.nodeHashes[(start+i)%n]]
+			if load[node] < capacity {
+				owners[p] = node
+				load[node]++
+				break
+			}
+		}
+	}
+	b.owners = owners
+}
+
+// jumpPlacement numbers the nodes in order of their address and picks one
+// with jump consistent hashing, which needs no memory per node and spreads
+// files evenly. Only a node numbered last joins or leaves with as few files
+// moved as the ring; any other shifts the numbers of the nodes after it.
+type jumpPlacement struct {
+	sortedNodes
+}
+
+func (j *jumpPlacement) Locate(key string) string {
+	if len(j.nodes) == 0 {
+		return ""
+	}
+	return j.nodes[jumpHash(hashStringToUint64(key), len(j.nodes))]
+}
+
+// LocateN returns the nodes the key jumps to with all the nodes, then with
+// one node fewer, and so on, followed by the rest in order. Every node count
+// either keeps the key in its bucket or moves it to a lower one, so the
+// buckets only repeat one after the other.
+func (j *jumpPlacement) LocateN(key string, n int) []string {
+	hash := hashStringToUint64(key)
+	n = min(n, len(j.nodes))
+	nodes := make([]string, 0, n)
+	picked := make(map[int]bool, n)
+	for buckets := len(j.nodes); buckets > 0 && len(nodes) < n; buckets-- {
+		if bucket := jumpHash(hash, buckets); !picked[bucket] {
+			nodes = append(nodes, j.nodes[bucket])
+			picked[bucket] = true
+		}
+	}
+	for bucket := 0; len(nodes) < n; bucket++ {
+		if !picked[bucket] {
+			nodes = append(nodes, j.nodes[bucket])
+		}
+	}
+	return nodes
+}
+
+// jumpHash maps key to one of buckets buckets (Lamping and Veach, "A Fast,
+// Minimal Memory, Consistent Hash Algorithm")
+func jumpHash(key uint64, buckets int) int {
+	b, j := int64(-1), int64(0)
+	for j < int64(buckets) {
+		b = j
+		key = key*2862933555777941757 + 1
+		j = int64(float64(b+1) * (float64(int64(1)<<31) / float64((key>>33)+1)))
+	}
+	return int(b)
+}
@@ -0,0 +1,224 @@
+package web
+
+import (
+	"fmt"
+	"math"
+	"testing"
+)
+
+var placementStrategies = []string{PlacementRing, PlacementRendezvous, PlacementBoundedLoad, PlacementJump}
+
+// testPlacement returns a placement following strategy with the given nodes
+// added in order
+func testPlacement(t *testing.T, strategy string, nodes ...string) Placement {
+	t.Helper()
+	policy := DefaultPlacementPolicy()
+	policy.Strategy = strategy
+	placement, err := NewPlacement(policy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, node := range nodes {
+		placement.Add(node)
+	}
+	return placement
+}
+
+func testNodes(n int) []string {
+	nodes := make([]string, n)
+	for i := range nodes {
+		nodes[i] = fmt.Sprintf("localhost:%d", 8090+i)
+	}
+	return nodes
+}
+
+func testKeys(n int) []string {
+	keys := make([]string, n)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("video%d/chunk-%d.m4s", i%50, i)
+	}
+	return keys
+}
+
+func TestPlacementLocateDeterministic(t *testing.T) {
+	nodes := testNodes(5)
+	reversed := make([]string, len(nodes))
+	for i, node := range nodes {
+		reversed[len(nodes)-1-i] = node
+	}
+	for _, strategy := range placementStrategies {
+		t.Run(strategy, func(t *testing.T) {
+			if got := testPlacement(t, strategy).Locate("video/manifest.mpd"); got != "" {
+				t.Errorf("Locate() without nodes = %q, want \"\"", got)
+			}
+
+			a := testPlacement(t, strategy, nodes...)
+			b := testPlacement(t, strategy, reversed...)
+			used := make(map[string]bool)
+			for _, key := range testKeys(2000) {
+				node := a.Locate(key)
+				if again := a.Locate(key); again != node {
+					t.Fatalf("Locate(%q) = %q, then %q", key, node, again)
+				}
+				if other := b.Locate(key); other != node {
+					t.Fatalf("Locate(%q) = %q, but %q with the nodes added in another order", key, node, other)
+				}
+				used[node] = true
+			}
+			if len(used) != len(nodes) {
+				t.Errorf("files placed on %d of %d nodes", len(used), len(nodes))
+			}
+		})
+	}
+}
+
+func TestPlacementLocateN(t *testing.T) {
+	nodes := testNodes(5)
+	for _, strategy := range placementStrategies {
+		t.Run(strategy, func(t *testing.T) {
+			if got := testPlacement(t, strategy).LocateN("video/manifest.mpd", 2); len(got) != 0 {
+				t.Errorf("LocateN() without nodes = %v, want none", got)
+			}
+
+			placement := testPlacement(t, strategy, nodes...)
+			for _, key := range testKeys(500) {
+				for _, n := range []int{1, 2, 5, 8} {
+					got := placement.LocateN(key, n)
+					if len(got) != min(n, len(nodes)) {
+						t.Fatalf("LocateN(%q, %d) = %v, want %d nodes", key, n, got, min(n, len(nodes)))
+					}
+					if got[0] != placement.Locate(key) {
+						t.Fatalf("LocateN(%q, %d) = %v, want %q first", key, n, got, placement.Locate(key))
+					}
+					seen := make(map[string]bool)
+					for _, node := range got {
+						if seen[node] {
+							t.Fatalf("LocateN(%q, %d) = %v, want distinct nodes", key, n, got)
+						}
+						seen[node] = true
+					}
+				}
+			}
+		})
+	}
+}
+
+// The node added last sorts last, so jump placement moves as few files as
+// the others
+func TestPlacementAddMovesOnlyToNewNode(t *testing.T) {
+	nodes := testNodes(6)
+	keys := testKeys(2000)
+	for _, strategy := range []string{PlacementRing, PlacementRendezvous, PlacementJump} {
+		t.Run(strategy, func(t *testing.T) {
+			placement := testPlacement(t, strategy, nodes[:5]...)
+			before := make(map[string]string, len(keys))
+			for _, key := range keys {
+				before[key] = placement.Locate(key)
+			}
+
+			placement.Add(nodes[5])
+			moved := 0
+			for _, key := range keys {
+				if node := placement.Locate(key); node != before[key] {
+					if node != nodes[5] {
+						t.Fatalf("Locate(%q) moved from %q to %q, not to the new node", key, before[key], node)
+					}
+					// Reads find the file where it was until it is migrated
+					if next := placement.LocateN(key, 2)[1]; next != before[key] {
+						t.Fatalf("LocateN(%q, 2) = %q next, want %q it moved from", key, next, before[key])
+					}
+					moved++
+				}
+			}
+			if moved == 0 {
+				t.Errorf("no file moved to the new node")
+			}
+
+			if !placement.Remove(nodes[5]) {
+				t.Fatalf("Remove(%q) = false", nodes[5])
+			}
+			for _, key := range keys {
+				if node := placement.Locate(key); node != before[key] {
+					t.Fatalf("Locate(%q) = %q after removing the new node, want %q", key, node, before[key])
+				}
+			}
+		})
+	}
+}
+
+func TestBoundedLoadPlacementLoad(t *testing.T) {
+	for _, loadFactor := range []float64{1, 1.25, 2} {
+		for n := 1; n <= 7; n++ {
+			t.Run(fmt.Sprintf("factor %g/%d nodes", loadFactor, n), func(t *testing.T) {
+				placement, err := NewPlacement(PlacementPolicy{Strategy: PlacementBoundedLoad, LoadFactor: loadFactor})
+				if err != nil {
+					t.Fatal(err)
+				}
+				for _, node := range testNodes(n) {
+					placement.Add(node)
+				}
+
+				capacity := int(math.Ceil(float64(boundedLoadPartitions) / float64(n) * loadFactor))
+				load := make(map[string]int)
+				for _, owner := range placement.(*boundedLoadPlacement).owners {
+					if owner == "" {
+						t.Fatal("partition without a node")
+					}
+					load[owner]++
+				}
+				for node, partitions := range load {
+					if partitions > capacity {
+						t.Errorf("node %s holds %d partitions, want at most %d", node, partitions, capacity)
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestNewPlacementRejects(t *testing.T) {
+	for _, policy := range []PlacementPolicy{
+		{Strategy: "random"},
+		{Strategy: PlacementBoundedLoad, LoadFactor: 0.9},
+	} {
+		if _, err := NewPlacement(policy); err == nil {
+			t.Errorf("NewPlacement(%+v) succeeded, want an error", policy)
+		}
+	}
+}
+
+func TestCheckPlacement(t *testing.T) {
+	ring := DefaultPlacementPolicy()
+	boundedLoad := PlacementPolicy{Strategy: PlacementBoundedLoad, LoadFactor: 1.25}
+	tests := []struct {
+		name    string
+		stored  string
+		policy  PlacementPolicy
+		wantErr bool
+	}{
+		{"nothing recorded is the ring", "", ring, false},
+		{"nothing recorded, other strategy", "", PlacementPolicy{Strategy: PlacementJump}, true},
+		{"same strategy", "rendezvous", PlacementPolicy{Strategy: PlacementRendezvous}, false},
+		{"same load factor", "bounded-load/1.25", boundedLoad, false},
+		{"other load factor", "bounded-load/1.5", boundedLoad, true},
+		{"move not finished", placementMoving + "ring", ring, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			metadata, err := NewSQLiteVideoMetadataService(t.TempDir() + "/metadata.db")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer metadata.Close()
+			if tt.stored != "" {
+				if err := metadata.SetSetting(placementSetting, tt.stored); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if err := CheckPlacement(metadata, tt.policy); (err != nil) != tt.wantErr {
+				t.Errorf("CheckPlacement(%v) with %q recorded = %v, want error %v", tt.policy, tt.stored, err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,503 @@
+package web
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// publishConcurrencyPerNode bounds the number of concurrent writes to one storage node
+	publishConcurrencyPerNode = 4
+	// publishQueueSize is the number of files that may wait for a node's writers
+	publishQueueSize = 64
+	// publishMaxAttempts is the number of times a file write is tried before giving up
+	publishMaxAttempts = 4
+	// publishInitialBackoff is the delay before the first retry; it doubles after every attempt
+	publishInitialBackoff = 200 * time.Millisecond
+)
+
+// retryWithBackoff calls fn until it succeeds or maxAttempts calls have
+// failed, sleeping an exponentially growing, jittered delay between attempts.
+// It returns the last error, without waiting for another attempt once ctx is
+// done.
+func retryWithBackoff(ctx context.Context, maxAttempts int, initialBackoff time.Duration, fn func() error) error {
+	backoff := initialBackoff
+	var err error
+	for attempt := 1; attempt <= maxAttempts; attempt++ {
+		if err = fn(); err == nil {
+			return nil
+		}
+		if attempt < maxAttempts {
+			// Full jitter keeps concurrent writers from retrying in lockstep
+			timer := time.NewTimer(backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1)))
+			select {
+			case <-timer.C:
+			case <-ctx.Done():
+				timer.Stop()
+				return err
+			}
+			backoff *= 2
+		}
+	}
+	return err
+}
+
+// segmentPublisher uploads the files of one video to a content service. With
+// network storage files are grouped by the node that owns them, and each node
+// gets its own bounded pool of writers so a slow node does not hold up the
+// others. A writer takes the files already waiting for its node along in a
+// single batch call.
+type segmentPublisher struct {
+	ctx            context.Context // carries the trace the writes belong to
+	contentService VideoContentService
+	videoId        string
+
+	mu     sync.Mutex
+	queues map[string]chan string // node address -> local paths waiting to be written
+	err    error                  // first write that failed for good
+
+	wg       sync.WaitGroup // worker goroutines
+	inflight sync.WaitGroup // files queued but not yet written
+}
+
+func newSegmentPublisher(ctx context.Context, contentService VideoContentService, videoId string) *segmentPublisher {
+	return &segmentPublisher{
+		ctx:            ctx,
+		contentService: contentService,
+		videoId:        videoId,
+		queues:         make(map[string]chan string),
+	}
+}
+
+// publish queues the local file at path for upload to the node that owns it.
+// It blocks while that node's queue is full.
+func (p *segmentPublisher) publish(path string) {
+	nodeAddr := ""
+	if nwService, ok := p.contentService.(*NetworkVideoContentService); ok {
+		nodeAddr = nwService.nodeForKey(p.videoId, filepath.Base(path))
+	}
+
+	p.mu.Lock()
+	queue, ok := p.queues[nodeAddr]
+	if !ok {
+		queue = make(chan string, publishQueueSize)
+		p.queues[nodeAddr] = queue
+		for i := 0; i < publishConcurrencyPerNode; i++ {
+			p.wg.Add(1)
+			go p.worker(queue)
+		}
+	}
+	p.mu.Unlock()
+
+	p.inflight.Add(1)
+	queue <- path
+}
+
+func (p *segmentPublisher) worker(queue chan string) {
+	defer p.wg.Done()
+	for path := range queue {
+		for path != "" {
+			var paths []string
+			paths, path = gatherBatch(path, queue)
+			// Once a write has failed the rest of the queue is only drained;
+			// the video is lost anyway
+			if p.failed() == nil {
+				if err := p.writeBatch(paths); err != nil {
+					p.mu.Lock()
+					if p.err == nil {
+						p.err = err
+					}
+					p.mu.Unlock()
+				}
+			}
+			for range paths {
+				p.inflight.Done()
+			}
+		}
+	}
+}
+
+// gatherBatch returns path along with the paths waiting in queue, as many as
+// fit in a batch, without waiting for more to arrive. A path taken from the
+// queue that does not fit is returned on its own to start the next batch.
+func gatherBatch(path string, queue chan string) ([]string, string) {
+	paths := []string{path}
+	size := fileSize(path)
+	for len(paths) < maxBatchFiles {
+		select {
+		case next, ok := <-queue:
+			if !ok {
+				return paths, ""
+			}
+			nextSize := fileSize(next)
+			if size+nextSize > maxBatchBytes {
+				return paths, next
+			}
+			paths = append(paths, next)
+			size += nextSize
+		default:
+			return paths, ""
+		}
+	}
+	return paths, ""
+}
+
+// fileSize returns the size of the file at path, 0 if it cannot be read; the
+// write reports the error then
+func fileSize(path string) int64 {
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0
+	}
+	return info.Size()
+}
+
+// failed returns the error of the first write that failed for good, if any
+func (p *segmentPublisher) failed() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.err
+}
+
+// write uploads a single file, retrying transient failures. The local copy
+// is removed once it is stored.
+func (p *segmentPublisher) write(path string) error {
+	filename := filepath.Base(path)
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read file %s: %v", filename, err)
+	}
+	if err := p.writeData(filename, data); err != nil {
+		return err
+	}
+	os.Remove(path)
+	return nil
+}
+
+// writeBatch uploads several files with a single call per node, retrying
+// the files that failed. The local copies are removed once they are stored.
+// Content services other than network storage write them one by one.
+func (p *segmentPublisher) writeBatch(paths []string) error {
+	nwService, ok := p.contentService.(*NetworkVideoContentService)
+	if !ok || len(paths) == 1 {
+		for _, path := range paths {
+			if err := p.write(path); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	pending := make([]batchFile, 0, len(paths))
+	for _, path := range paths {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("failed to read file %s: %v", filepath.Base(path), err)
+		}
+		pending = append(pending, batchFile{filename: filepath.Base(path), data: data})
+	}
+	err := retryWithBackoff(p.ctx, publishMaxAttempts, publishInitialBackoff, func() error {
+		var failed []batchFile
+		var firstErr error
+		for i, err := range nwService.WriteBatch(p.ctx, p.videoId, pending) {
+			if err != nil {
+				failed = append(failed, pending[i])
+				if firstErr == nil {
+					firstErr = err
+				}
+			}
+		}
+		pending = failed
+		return firstErr
+	})
+	if err != nil {
+		return fmt.Errorf("failed to write file %s to storage: %v", pending[0].filename, err)
+	}
+	for _, path := range paths {
+		os.Remove(path)
+	}
+	return nil
+}
+
+// writeData stores data under filename, retrying transient failures
+func (p *segmentPublisher) writeData(filename string, data []byte) error {
+	err := retryWithBackoff(p.ctx, publishMaxAttempts, publishInitialBackoff, func() error {
+		return writeContent(p.ctx, p.contentService, p.videoId, filename, data)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to write file %s to storage: %v", filename, err)
+	}
+	return nil
+}
+
+// flush waits until every file queued so far has been written and returns
+// the first error
+func (p *segmentPublisher) flush() error {
+	p.inflight.Wait()
+	return p.failed()
+}
+
+// wait closes the queues, waits for every queued file to be written and
+// returns the first error. publish must not be called afterwards.
+func (p *segmentPublisher) wait() error {
+	p.mu.Lock()
+	for _, queue := range p.queues {
+		close(queue)
+	}
+	p.mu.Unlock()
+
+	p.wg.Wait()
+	return p.err
+}
+
+// segmentPollInterval is how often the ffmpeg output directory is scanned for finished segments
+const segmentPollInterval = 500 * time.Millisecond
+
+// segmentWatcher polls an ffmpeg DASH output directory while ffmpeg is still
+// running and hands every segment to a publisher as soon as it is complete.
+// For an upload the manifest is left alone since ffmpeg keeps rewriting it
+// until it exits; for a live stream each new version of the manifest is
+// handed to onManifest and published once the segments it references are
+// stored.
+type segmentWatcher struct {
+	dir        string
+	publisher  *segmentPublisher
+	live       bool
+	onManifest func(root *mpdNode) error // called with every new version of a live manifest
+	onFailure  func()                    // called once when publishing has failed for good
+
+	sizes     map[string]int64 // size seen at the previous scan of files not yet published
+	published map[string]bool
+	manifest  []byte // last manifest published for a live stream
+	failed    bool
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// watchSegments starts polling dir in the background. onManifest is only
+// used for live streams.
+func watchSegments(dir string, publisher *segmentPublisher, live bool, onManifest func(*mpdNode) error, onFailure func()) *segmentWatcher {
+	w := &segmentWatcher{
+		dir:        dir,
+		publisher:  publisher,
+		live:       live,
+		onManifest: onManifest,
+		onFailure:  onFailure,
+		sizes:      make(map[string]int64),
+		published:  make(map[string]bool),
+		stop:       make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+	go w.run()
+	return w
+}
+
+func (w *segmentWatcher) run() {
+	defer close(w.done)
+
+	ticker := time.NewTicker(segmentPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-w.stop:
+			return
+		case <-ticker.C:
+			// A failed scan is simply retried at the next tick, unless a
+			// write has failed for good and there is no point going on
+			w.scan(false)
+			if w.publisher.failed() != nil && !w.failed {
+				w.failed = true
+				w.onFailure()
+			}
+		}
+	}
+}
+
+// finish stops polling and hands over every segment not published yet. It
+// must only be called once ffmpeg has exited.
+func (w *segmentWatcher) finish() error {
+	close(w.stop)
+	<-w.done
+	return w.scan(true)
+}
+
+// scan publishes the segments that are complete. ffmpeg writes each segment
+// under a ".tmp" name and renames it when done; for an ffmpeg build that
+// writes in place, a segment must also be non-empty, keep the same size
+// across two scans and not be the highest-numbered chunk of its
+// representation, which ffmpeg may still have open. With final set every
+// remaining segment is published.
+func (w *segmentWatcher) scan(final bool) error {
+	// ffmpeg only lists a segment in a live manifest once it is finished, so
+	// the segments it references need not wait for a second scan. The
+	// manifest is read before the directory so it cannot name a segment the
+	// listing below has not seen yet.
+	var manifest []byte
+	var referenced []string
+	if w.live {
+		var err error
+		if manifest, referenced, err = w.readManifest(); err != nil {
+			return err
+		}
+	}
+	complete := make(map[string]bool, len(referenced))
+	for _, filename := range referenced {
+		complete[filename] = true
+	}
+
+	files, err := ioutil.ReadDir(w.dir)
+	if err != nil {
+		return fmt.Errorf("failed to read output directory: %v", err)
+	}
+
+	// The chunk ffmpeg is writing is the newest of its representation
+	latest := make(map[string]int)
+	for _, file := range files {
+		if representation, number, ok := parseChunkName(file.Name()); ok && number > latest[representation] {
+			latest[representation] = number
+		}
+	}
+
+	for _, file := range files {
+		name := file.Name()
+		if file.IsDir() || name == manifestFilename || strings.HasSuffix(name, ".tmp") || w.published[name] {
+			continue
+		}
+		if !final && !complete[name] {
+			if representation, number, ok := parseChunkName(name); file.Size() == 0 || ok && number == latest[representation] {
+				continue
+			}
+			if previous, seen := w.sizes[name]; !seen || previous != file.Size() {
+				w.sizes[name] = file.Size()
+				continue
+			}
+		}
+
+		delete(w.sizes, name)
+		w.published[name] = true
+		w.publisher.publish(filepath.Join(w.dir, name))
+	}
+
+	if manifest != nil {
+		return w.publishManifest(manifest, referenced)
+	}
+	return nil
+}
+
+// parseChunkName splits the name of a media segment written by ffmpeg,
+// "chunk-$RepresentationID$-$Number%05d$.m4s", into its representation and
+// number
+func parseChunkName(name string) (string, int, bool) {
+	rest, ok := strings.CutPrefix(name, "chunk-")
+	if !ok {
+		return "", 0, false
+	}
+	if rest, ok = strings.CutSuffix(rest, ".m4s"); !ok {
+		return "", 0, false
+	}
+	i := strings.LastIndexByte(rest, '-')
+	if i < 0 {
+		return "", 0, false
+	}
+	number, err := strconv.Atoi(rest[i+1:])
+	if err != nil {
+		return "", 0, false
+	}
+	return rest[:i], number, true
+}
+
+// readManifest returns a live stream's current manifest and the files it
+// references, or nil if there is no new version to publish
+func (w *segmentWatcher) readManifest() ([]byte, []string, error) {
+	data, err := ioutil.ReadFile(filepath.Join(w.dir, manifestFilename))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil, nil
+		}
+		return nil, nil, fmt.Errorf("failed to read manifest: %v", err)
+	}
+	if bytes.Equal(data, w.manifest) {
+		return nil, nil, nil
+	}
+
+	root, err := parseMPD(data)
+	if err != nil {
+		// Caught while ffmpeg was replacing it; the next scan sees the whole file
+		return nil, nil, nil
+	}
+	referenced, err := mpdReferencedFiles(root)
+	if err != nil {
+		return nil, nil, err
+	}
+	if w.onManifest != nil {
+		if err := w.onManifest(root); err != nil {
+			return nil, nil, err
+		}
+	}
+	return data, referenced, nil
+}
+
+// publishManifest stores a new version of a live stream's manifest once every
+// file it references has been written, so players polling it never see a
+// segment that is not there yet.
+func (w *segmentWatcher) publishManifest(data []byte, referenced []string) error {
+	for _, filename := range referenced {
+		if !w.published[filename] {
+			return nil
+		}
+	}
+
+	if err := w.publisher.flush(); err != nil {
+		return err
+	}
+	if err := w.publisher.writeData(manifestFilename, data); err != nil {
+		return err
+	}
+	w.manifest = data
+	return nil
+}
+
+// transcodeAndPublish runs an ffmpeg command that writes DASH output to dir
+// and streams every segment to network storage while ffmpeg is still running,
+// so segments don't pile up locally until the whole video is transcoded. The
+// manifest is written last, once all segments are stored, so a video whose
+// upload fails part way never has a manifest pointing at missing segments.
+func transcodeAndPublish(ctx context.Context, cmd *exec.Cmd, contentService VideoContentService, videoId string, dir string) error {
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("failed to convert video: %v", err)
+	}
+
+	publisher := newSegmentPublisher(ctx, contentService, videoId)
+	// There is no point transcoding the rest once a segment could not be stored
+	watcher := watchSegments(dir, publisher, false, nil, func() { cmd.Process.Kill() })
+
+	runErr := cmd.Wait()
+	scanErr := watcher.finish()
+	publishErr := publisher.wait()
+	if publishErr != nil {
+		return publishErr
+	}
+	if runErr != nil {
+		return fmt.Errorf("failed to convert video: %v", runErr)
+	}
+	if scanErr != nil {
+		return scanErr
+	}
+
+	manifestPath := filepath.Join(dir, manifestFilename)
+	if _, err := os.Stat(manifestPath); os.IsNotExist(err) {
+		return fmt.Errorf("manifest file was not created at %s", manifestPath)
+	}
+	return publisher.write(manifestPath)
+}
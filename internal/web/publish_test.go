@@ -0,0 +1,47 @@
+package web
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestRetryWithBackoff(t *testing.T) {
+	errFailed := errors.New("failed")
+	tests := []struct {
+		name      string
+		failures  int // calls that fail before one succeeds
+		cancelled bool
+		wantCalls int
+		wantErr   error
+	}{
+		{"first call succeeds", 0, false, 1, nil},
+		{"succeeds on a retry", 2, false, 3, nil},
+		{"every attempt fails", 5, false, 3, errFailed},
+		{"context done", 5, true, 1, errFailed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			backoff := time.Millisecond
+			if tt.cancelled {
+				// Long enough that the test times out unless the wait is cut short
+				backoff = time.Hour
+				cancel()
+			}
+			calls := 0
+			err := retryWithBackoff(ctx, 3, backoff, func() error {
+				calls++
+				if calls <= tt.failures {
+					return errFailed
+				}
+				return nil
+			})
+			if err != tt.wantErr || calls != tt.wantCalls {
+				t.Errorf("retryWithBackoff() = %v after %d calls, want %v after %d", err, calls, tt.wantErr, tt.wantCalls)
+			}
+		})
+	}
+}
@@ -0,0 +1,219 @@
+package web
+
+import (
+	"context"
+	"log/slog"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"tritontube/internal/proto"
+)
+
+// ReadPolicy bounds, retries and hedges the reads NetworkVideoContentService
+// makes from storage nodes
+type ReadPolicy struct {
+	// Timeout bounds each attempt to read a file from a node
+	Timeout time.Duration
+	// Attempts is how many times a read failing with a transient error is
+	// tried in total
+	Attempts int
+	// Backoff is the base of the jittered exponential wait between attempts
+	Backoff time.Duration
+	// HedgePercentile picks how long a read waits before it is also sent to
+	// the next node placement names for the file, as a percentile of recent
+	// read latencies; 0 disables hedging
+	HedgePercentile float64
+}
+
+// DefaultReadPolicy gives a hung node ten seconds per attempt, tries three
+// times, and hedges reads slower than 95% of recent ones
+func DefaultReadPolicy() ReadPolicy {
+	return ReadPolicy{
+		Timeout:         10 * time.Second,
+		Attempts:        3,
+		Backoff:         50 * time.Millisecond,
+		HedgePercentile: 95,
+	}
+}
+
+const (
+	// readCandidates is how many nodes a read may go to: the one placement
+	// locates the file on, and the one it was on before the last node
+	// joined or goes to once that node leaves
+	readCandidates = 2
+	// maxBackoff caps the wait between attempts
+	maxBackoff = 2 * time.Second
+	// latencyWindow is how many recent read latencies the hedge delay is
+	// computed from
+	latencyWindow = 512
+	// Until enough reads were timed, hedges wait defaultHedgeDelay
+	minLatencySamples = 20
+	defaultHedgeDelay = 100 * time.Millisecond
+)
+
+// SetReadPolicy replaces DefaultReadPolicy. It must be called before the
+// service is used.
+func (s *NetworkVideoContentService) SetReadPolicy(policy ReadPolicy) {
+	s.readPolicy = policy
+}
+
+// transient reports whether a failed read may succeed if tried again
+func transient(err error) bool {
+	switch status.Code(err) {
+	case codes.Unavailable, codes.DeadlineExceeded, codes.ResourceExhausted, codes.Aborted:
+		return true
+	}
+	return false
+}
+
+// backoff returns the wait before the given retry: a random duration up to
+// the exponentially growing bound ("full jitter"), so that clients retrying
+// together spread out
+func (p ReadPolicy) backoff(retry int) time.Duration {
+	bound := p.Backoff << (retry - 1)
+	if bound <= 0 || bound > maxBackoff {
+		bound = maxBackoff
+	}
+	return time.Duration(rand.Int63n(int64(bound) + 1))
+}
+
+// readTarget is a node a read may go to. Its client is looked up under the
+// service's lock, so the read itself is made without holding it.
+type readTarget struct {
+	nodeAddr string
+	client   proto.StorageServiceClient
+}
+
+// readWithPolicy reads a file from the first of targets that answers, trying
+// again after transient failures. It returns the node the error came from,
+// for error messages.
+func (s *NetworkVideoContentService) readWithPolicy(ctx context.Context, targets []readTarget, req *proto.ReadRequest) ([]byte, string, error) {
+	policy := s.readPolicy
+	var data []byte
+	var nodeAddr string
+	var err error
+	for attempt := 1; ; attempt++ {
+		data, nodeAddr, err = s.hedgedRead(ctx, targets, req)
+		if err == nil || attempt >= policy.Attempts || !transient(err) || ctx.Err() != nil {
+			return data, nodeAddr, err
+		}
+		wait := policy.backoff(attempt)
+		slog.WarnContext(ctx, "Retrying read from storage node", "node", nodeAddr, "video_id", req.VideoId, "filename", req.Filename, "attempt", attempt, "wait", wait, "error", err)
+		storageReadRetries.Inc()
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return nil, nodeAddr, err
+		}
+	}
+}
+
+type readResult struct {
+	nodeAddr string
+	hedge    bool
+	data     []byte
+	err      error
+}
+
+// hedgedRead sends a read to the first target, and to the next one whenever
+// the reads so far have failed or taken longer than the hedge delay. The
+// first successful answer wins and the other reads are cancelled. If all of
+// them fail, a node that does not have the file is only blamed when no other
+// error came up.
+func (s *NetworkVideoContentService) hedgedRead(ctx context.Context, targets []readTarget, req *proto.ReadRequest) ([]byte, string, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make(chan readResult, len(targets))
+	next := 0
+	send := func(hedge bool) {
+		nodeAddr, client := targets[next].nodeAddr, targets[next].client
+		next++
+		go func() {
+			attemptCtx, cancel := context.WithTimeout(ctx, s.readPolicy.Timeout)
+			defer cancel()
+			start := time.Now()
+			resp, err := client.Read(attemptCtx, req)
+			if err != nil {
+				results <- readResult{nodeAddr: nodeAddr, hedge: hedge, err: err}
+				return
+			}
+			s.readLatency.observe(time.Since(start))
+			results <- readResult{nodeAddr: nodeAddr, hedge: hedge, data: resp.Content}
+		}()
+	}
+
+	hedging := s.readPolicy.HedgePercentile > 0 && len(targets) > 1
+	var delay time.Duration
+	if hedging {
+		delay = s.readLatency.percentile(s.readPolicy.HedgePercentile)
+	}
+
+	send(false)
+	pending := 1
+	var last readResult
+	for pending > 0 {
+		var hedgeTimer <-chan time.Time
+		if hedging && next < len(targets) {
+			hedgeTimer = time.After(delay)
+		}
+		select {
+		case result := <-results:
+			pending--
+			if result.err == nil {
+				if result.hedge {
+					hedgedReads.WithLabelValues("won").Inc()
+				}
+				return result.data, result.nodeAddr, nil
+			}
+			if last.err == nil || status.Code(last.err) == codes.NotFound {
+				last = result
+			}
+			if next < len(targets) {
+				send(false)
+				pending++
+			}
+		case <-hedgeTimer:
+			hedgedReads.WithLabelValues("sent").Inc()
+			send(true)
+			pending++
+		}
+	}
+	return nil, last.nodeAddr, last.err
+}
+
+// latencyTracker keeps the most recent read latencies
+type latencyTracker struct {
+	mu      sync.Mutex
+	samples []time.Duration
+	next    int
+}
+
+func (t *latencyTracker) observe(d time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.samples) < latencyWindow {
+		t.samples = append(t.samples, d)
+		return
+	}
+	t.samples[t.next] = d
+	t.next = (t.next + 1) % latencyWindow
+}
+
+// percentile returns the p-th percentile of the recent latencies
+func (t *latencyTracker) percentile(p float64) time.Duration {
+	t.mu.Lock()
+	sorted := append([]time.Duration(nil), t.samples...)
+	t.mu.Unlock()
+	if len(sorted) < minLatencySamples {
+		return defaultHedgeDelay
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	index := int(p / 100 * float64(len(sorted)-1))
+	return sorted[index]
+}
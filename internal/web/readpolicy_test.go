@@ -0,0 +1,238 @@
+package web
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"tritontube/internal/proto"
+)
+
+// fakeStorageClient answers reads with read and counts them, and hands
+// writes and deletes to write and del. Batch calls go to batchRead and
+// batchWrite, and are unimplemented while those are nil, like on older
+// nodes; the other methods are not implemented.
+type fakeStorageClient struct {
+	proto.StorageServiceClient
+	read       func(ctx context.Context, req *proto.ReadRequest) (*proto.ReadResponse, error)
+	write      func(req *proto.WriteRequest)
+	del        func(req *proto.DeleteRequest)
+	batchRead  func(req *proto.BatchReadRequest) (*proto.BatchReadResponse, error)
+	batchWrite func(req *proto.BatchWriteRequest) (*proto.BatchWriteResponse, error)
+	calls      atomic.Int32
+}
+
+func (c *fakeStorageClient) Read(ctx context.Context, req *proto.ReadRequest, opts ...grpc.CallOption) (*proto.ReadResponse, error) {
+	c.calls.Add(1)
+	return c.read(ctx, req)
+}
+
+func (c *fakeStorageClient) Write(ctx context.Context, req *proto.WriteRequest, opts ...grpc.CallOption) (*proto.WriteResponse, error) {
+	c.write(req)
+	return &proto.WriteResponse{Success: true}, nil
+}
+
+func (c *fakeStorageClient) BatchRead(ctx context.Context, req *proto.BatchReadRequest, opts ...grpc.CallOption) (*proto.BatchReadResponse, error) {
+	if c.batchRead == nil {
+		return nil, status.Error(codes.Unimplemented, "BatchRead")
+	}
+	return c.batchRead(req)
+}
+
+func (c *fakeStorageClient) BatchWrite(ctx context.Context, req *proto.BatchWriteRequest, opts ...grpc.CallOption) (*proto.BatchWriteResponse, error) {
+	if c.batchWrite == nil {
+		return nil, status.Error(codes.Unimplemented, "BatchWrite")
+	}
+	return c.batchWrite(req)
+}
+
+func (c *fakeStorageClient) Delete(ctx context.Context, req *proto.DeleteRequest, opts ...grpc.CallOption) (*proto.DeleteResponse, error) {
+	c.del(req)
+	return &proto.DeleteResponse{Success: true}, nil
+}
+
+// answers returns a read answering with the given codes in turn, the
+// content on OK
+func answers(answered ...codes.Code) func(context.Context, *proto.ReadRequest) (*proto.ReadResponse, error) {
+	var call atomic.Int32
+	return func(ctx context.Context, req *proto.ReadRequest) (*proto.ReadResponse, error) {
+		code := answered[min(int(call.Add(1)), len(answered))-1]
+		if code != 0 {
+			return nil, status.Error(code, code.String())
+		}
+		return &proto.ReadResponse{Content: []byte(req.Filename)}, nil
+	}
+}
+
+// hang blocks a read until it is cancelled or times out
+func hang(ctx context.Context, req *proto.ReadRequest) (*proto.ReadResponse, error) {
+	<-ctx.Done()
+	return nil, status.FromContextError(ctx.Err()).Err()
+}
+
+func TestReadWithPolicyRetries(t *testing.T) {
+	tests := []struct {
+		name      string
+		answers   []codes.Code
+		wantCalls int32
+		wantCode  codes.Code
+	}{
+		{"first attempt", []codes.Code{codes.OK}, 1, codes.OK},
+		{"retry unavailable", []codes.Code{codes.Unavailable, codes.Unavailable, codes.OK}, 3, codes.OK},
+		{"retry deadline exceeded", []codes.Code{codes.DeadlineExceeded, codes.OK}, 2, codes.OK},
+		{"retry resource exhausted", []codes.Code{codes.ResourceExhausted, codes.OK}, 2, codes.OK},
+		{"give up after attempts", []codes.Code{codes.Unavailable}, 3, codes.Unavailable},
+		{"no retry on not found", []codes.Code{codes.NotFound}, 1, codes.NotFound},
+		{"no retry on internal", []codes.Code{codes.Internal}, 1, codes.Internal},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &NetworkVideoContentService{readPolicy: ReadPolicy{Timeout: time.Second, Attempts: 3, Backoff: time.Millisecond}}
+			client := &fakeStorageClient{read: answers(tt.answers...)}
+
+			data, _, err := s.readWithPolicy(context.Background(), []readTarget{{"node", client}}, &proto.ReadRequest{VideoId: "v", Filename: "f"})
+			if code := status.Code(err); code != tt.wantCode {
+				t.Fatalf("readWithPolicy() error = %v, want code %v", err, tt.wantCode)
+			}
+			if err == nil && string(data) != "f" {
+				t.Errorf("readWithPolicy() = %q, want %q", data, "f")
+			}
+			if calls := client.calls.Load(); calls != tt.wantCalls {
+				t.Errorf("read %d times, want %d", calls, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestReadWithPolicyAttemptDeadline(t *testing.T) {
+	const timeout = 50 * time.Millisecond
+	s := &NetworkVideoContentService{readPolicy: ReadPolicy{Timeout: timeout, Attempts: 2, Backoff: time.Millisecond}}
+	var budgets []time.Duration
+	client := &fakeStorageClient{read: func(ctx context.Context, req *proto.ReadRequest) (*proto.ReadResponse, error) {
+		deadline, ok := ctx.Deadline()
+		if !ok {
+			t.Error("read without a deadline")
+		}
+		budgets = append(budgets, time.Until(deadline))
+		return hang(ctx, req)
+	}}
+
+	start := time.Now()
+	_, _, err := s.readWithPolicy(context.Background(), []readTarget{{"node", client}}, &proto.ReadRequest{})
+	if code := status.Code(err); code != codes.DeadlineExceeded {
+		t.Fatalf("readWithPolicy() error = %v, want code %v", err, codes.DeadlineExceeded)
+	}
+	if calls := client.calls.Load(); calls != 2 {
+		t.Errorf("read %d times, want 2", calls)
+	}
+	for _, budget := range budgets {
+		if budget > timeout {
+			t.Errorf("attempt given %v, want at most %v", budget, timeout)
+		}
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("readWithPolicy() took %v", elapsed)
+	}
+}
+
+func TestReadWithPolicyCallerCancels(t *testing.T) {
+	s := &NetworkVideoContentService{readPolicy: ReadPolicy{Timeout: time.Minute, Attempts: 3, Backoff: time.Minute}}
+	client := &fakeStorageClient{read: hang}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, _, err := s.readWithPolicy(ctx, []readTarget{{"node", client}}, &proto.ReadRequest{}); err == nil {
+		t.Fatal("readWithPolicy() succeeded after the caller's deadline")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("readWithPolicy() took %v, want it to stop at the caller's deadline", elapsed)
+	}
+	if calls := client.calls.Load(); calls != 1 {
+		t.Errorf("read %d times, want 1", calls)
+	}
+}
+
+func TestReadPolicyBackoff(t *testing.T) {
+	policy := ReadPolicy{Backoff: 50 * time.Millisecond}
+	for retry := 1; retry <= 10; retry++ {
+		bound := min(policy.Backoff<<(retry-1), maxBackoff)
+		for i := 0; i < 100; i++ {
+			if wait := policy.backoff(retry); wait < 0 || wait > bound {
+				t.Fatalf("backoff(%d) = %v, want between 0 and %v", retry, wait, bound)
+			}
+		}
+	}
+}
+
+func TestHedgedRead(t *testing.T) {
+	tests := []struct {
+		name       string
+		first      func(context.Context, *proto.ReadRequest) (*proto.ReadResponse, error)
+		second     func(context.Context, *proto.ReadRequest) (*proto.ReadResponse, error)
+		percentile float64
+		wantNode   string
+		wantCode   codes.Code
+	}{
+		{"first answers", answers(codes.OK), answers(codes.OK), 95, "first", codes.OK},
+		{"hedge to the second after the delay", hang, answers(codes.OK), 95, "second", codes.OK},
+		{"fail over once the first times out", hang, answers(codes.OK), 0, "second", codes.OK},
+		{"file moved to the second", answers(codes.NotFound), answers(codes.OK), 0, "second", codes.OK},
+		{"missing everywhere", answers(codes.NotFound), answers(codes.NotFound), 95, "second", codes.NotFound},
+		{"first fails, second lacks the file", answers(codes.Unavailable), answers(codes.NotFound), 95, "first", codes.Unavailable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &NetworkVideoContentService{readPolicy: ReadPolicy{Timeout: 500 * time.Millisecond, Attempts: 1, HedgePercentile: tt.percentile}}
+			targets := []readTarget{
+				{"first", &fakeStorageClient{read: tt.first}},
+				{"second", &fakeStorageClient{read: tt.second}},
+			}
+
+			_, nodeAddr, err := s.readWithPolicy(context.Background(), targets, &proto.ReadRequest{Filename: "f"})
+			if code := status.Code(err); code != tt.wantCode {
+				t.Fatalf("readWithPolicy() error = %v, want code %v", err, tt.wantCode)
+			}
+			if nodeAddr != tt.wantNode {
+				t.Errorf("readWithPolicy() node = %q, want %q", nodeAddr, tt.wantNode)
+			}
+		})
+	}
+}
+
+func TestReadFromNodeNotFound(t *testing.T) {
+	tests := []struct {
+		name        string
+		answer      codes.Code
+		wantMissing bool
+	}{
+		{"not found", codes.NotFound, true},
+		{"unavailable", codes.Unavailable, false},
+		{"older node", codes.Unknown, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &NetworkVideoContentService{
+				clients:    map[string]proto.StorageServiceClient{"node": &fakeStorageClient{read: answers(tt.answer)}},
+				placement:  newRingPlacement(),
+				readPolicy: ReadPolicy{Timeout: time.Second, Attempts: 1},
+			}
+			s.placement.Add("node")
+
+			_, err := s.readFromNode(context.Background(), "video", "chunk-1.m4s")
+			if err == nil {
+				t.Fatal("readFromNode() succeeded")
+			}
+			if missing := errors.Is(err, fs.ErrNotExist); missing != tt.wantMissing {
+				t.Errorf("readFromNode() error = %v, errors.Is(err, fs.ErrNotExist) = %v, want %v", err, missing, tt.wantMissing)
+			}
+		})
+	}
+}
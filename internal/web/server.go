@@ -3,20 +3,31 @@
 package web
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"html/template"
-	"io/ioutil"
+	"io/fs"
+	"log/slog"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
+	"tritontube/internal/logging"
+	"tritontube/internal/metrics"
 	"tritontube/internal/proto"
 
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
 )
 
 type server struct {
@@ -28,45 +39,129 @@ type server struct {
 
 	mux        *http.ServeMux
 	grpcServer *grpc.Server
+
+	live  *liveManager // nil unless live streaming is enabled
+	users UserService  // nil unless accounts are enabled
+	oidc  *oidcLogin   // nil unless single sign-on is configured
+
+	registerRole Role // role of self-registered accounts; empty closes registration
+
+	signer *urlSigner // signs links to private videos
+
+	adminAuth      *AdminAuthenticator // nil refuses every admin call
+	adminTLSConfig *tls.Config         // nil serves the admin service in plaintext
+
+	tlsConfig *tls.Config // nil serves plain HTTP
+
+	profile       TranscodeProfile
+	maxUploadSize int64 // 0 means unlimited
+
+	// serveMu guards httpServer, grpcServer and shuttingDown between Start
+	// and Shutdown
+	serveMu      sync.Mutex
+	httpServer   *http.Server
+	shuttingDown bool
+
+	// Transcodes and live streams run under workCtx, which is cancelled when
+	// a shutdown runs out of time. work counts them; draining refuses new ones.
+	workCtx    context.Context
+	cancelWork context.CancelFunc
+	workMu     sync.Mutex
+	work       sync.WaitGroup
+	draining   bool
 }
 
 func NewServer(
 	metadataService VideoMetadataService,
 	contentService VideoContentService,
 ) *server {
+	workCtx, cancelWork := context.WithCancel(context.Background())
 	return &server{
 		metadataService: metadataService,
 		contentService:  contentService,
-		grpcServer:      grpc.NewServer(),
+		signer:          newURLSigner(),
+		profile:         DefaultTranscodeProfile,
+		workCtx:         workCtx,
+		cancelWork:      cancelWork,
 	}
 }
 
 func (s *server) Start(lis net.Listener) error {
 	// Start HTTP server
 	s.mux = http.NewServeMux()
-	s.mux.HandleFunc("/upload", s.handleUpload)
-	s.mux.HandleFunc("/videos/", s.handleVideo)
-	s.mux.HandleFunc("/content/", s.handleVideoContent)
-	s.mux.HandleFunc("/", s.handleIndex)
+	// Every handler is counted and timed under its pattern
+	handle := func(pattern string, handler http.HandlerFunc) {
+		s.mux.Handle(pattern, instrument(pattern, handler))
+	}
+	handle("/upload", s.handleUpload)
+	handle("/videos/", s.handleVideo)
+	handle("/content/", s.handleVideoContent)
+	handle("/live/start", s.handleLiveStart)
+	handle("/live/stop", s.handleLiveStop)
+	handle("/login", s.handleLogin)
+	handle("/register", s.handleRegister)
+	handle("/logout", s.handleLogout)
+	handle("/login/oidc", s.handleOIDCLogin)
+	handle("/login/oidc/callback", s.handleOIDCCallback)
+	handle("/visibility", s.handleSetVisibility)
+	handle("/", s.handleIndex)
+
+	s.serveMu.Lock()
+	if s.shuttingDown {
+		s.serveMu.Unlock()
+		return http.ErrServerClosed
+	}
 
 	// Start gRPC server
+	grpcOptions := []grpc.ServerOption{
+		grpc.ChainUnaryInterceptor(metrics.UnaryServerInterceptor(), logging.UnaryServerInterceptor(), s.adminAuth.UnaryInterceptor()),
+		grpc.ChainStreamInterceptor(metrics.StreamServerInterceptor(), logging.StreamServerInterceptor(), s.adminAuth.StreamInterceptor()),
+		// Let Shutdown wait for cancelled migrations to stop
+		grpc.WaitForHandlers(true),
+		grpc.StatsHandler(otelgrpc.NewServerHandler()),
+	}
+	if s.adminTLSConfig != nil {
+		grpcOptions = append(grpcOptions, grpc.Creds(credentials.NewTLS(s.adminTLSConfig)))
+	}
+	s.grpcServer = grpc.NewServer(grpcOptions...)
 	if nwService, ok := s.contentService.(*NetworkVideoContentService); ok {
+		// Migrations outlive the admin calls that start them until a
+		// shutdown gives up on running work
+		nwService.workCtx = s.workCtx
 		proto.RegisterVideoContentAdminServiceServer(s.grpcServer, nwService)
+		if settings, ok := s.metadataService.(SettingService); ok && s.beginWork() {
+			// Files stored under another placement are moved in the
+			// background, like a migration started by an admin call
+			go func() {
+				defer s.work.Done()
+				if err := nwService.migratePlacement(s.workCtx, settings); err != nil {
+					slog.Error("Failed to move files to the new placement", "error", err)
+				}
+			}()
+		}
 		go func() {
 			adminAddr := nwService.adminAddr
 			adminLis, err := net.Listen("tcp", adminAddr)
 			if err != nil {
-				fmt.Printf("Failed to listen for admin service: %v\n", err)
+				slog.Error("Failed to listen for admin service", "error", err)
 				return
 			}
-			fmt.Printf("Starting admin service on %s\n", adminAddr)
+			slog.Info("Starting admin service", "addr", adminAddr, "tls", s.adminTLSConfig != nil)
 			if err := s.grpcServer.Serve(adminLis); err != nil {
-				fmt.Printf("Failed to serve admin service: %v\n", err)
+				slog.Error("Failed to serve admin service", "error", err)
 			}
 		}()
 	}
 
-	return http.Serve(lis, s.mux)
+	s.httpServer = &http.Server{Handler: s.mux, TLSConfig: s.tlsConfig}
+	s.serveMu.Unlock()
+
+	if s.tlsConfig != nil {
+		// ServeTLS adds HTTP/2 to the protocols the configuration offers;
+		// the certificate comes from the configuration, not from files
+		return s.httpServer.ServeTLS(lis, "", "")
+	}
+	return s.httpServer.Serve(lis)
 }
 
 func (s *server) handleIndex(w http.ResponseWriter, r *http.Request) {
@@ -87,28 +182,133 @@ func (s *server) handleIndex(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	session := s.currentSession(r)
+
 	// Add escaped ID for template
 	type VideoWithEscapedID struct {
 		VideoMetadata
 		EscapedId  string
 		UploadTime string
+		Live       bool
+		Hidden     bool // unlisted or private; only listed for its owner
 	}
 	var videosWithEscapedID []VideoWithEscapedID
 	for _, v := range videos {
+		// Videos that are still being uploaded are not listed
+		if v.Status != VideoStatusReady && v.Status != VideoStatusLive {
+			continue
+		}
+		// Unlisted and private videos only show up for the users who manage them
+		if v.Visibility != VisibilityPublic && !canManage(session, &v) {
+			continue
+		}
 		videosWithEscapedID = append(videosWithEscapedID, VideoWithEscapedID{
 			VideoMetadata: v,
 			EscapedId:     template.HTMLEscapeString(v.Id),
 			UploadTime:    v.UploadedAt.Format("2006-01-02 15:04:05"),
+			Live:          v.Status == VideoStatusLive,
+			Hidden:        v.Visibility != VisibilityPublic,
 		})
 	}
 
-	if err := tmpl.Execute(w, videosWithEscapedID); err != nil {
+	data := struct {
+		Videos          []VideoWithEscapedID
+		LiveEnabled     bool
+		AccountsEnabled bool
+		Username        string
+		CanUpload       bool
+		CSRFToken       string
+	}{
+		Videos:          videosWithEscapedID,
+		LiveEnabled:     s.live != nil,
+		AccountsEnabled: s.users != nil,
+		CanUpload:       s.users == nil,
+	}
+	if session != nil {
+		data.Username = session.Username
+		data.CanUpload = session.canUpload()
+		data.CSRFToken = session.CSRFToken
+	}
+
+	if err := tmpl.Execute(w, data); err != nil {
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
 		return
 	}
 }
 
-func (s *server) convertToDASH(videoId string, inputPath string) error {
+// TranscodeProfile holds the ffmpeg encoding settings shared by uploads and
+// live streams
+type TranscodeProfile struct {
+	VideoCodec   string
+	AudioCodec   string
+	VideoBitrate string // e.g. 3000k
+	AudioBitrate string // e.g. 128k
+	// KeyframeInterval is in frames; segments can only start on keyframes
+	KeyframeInterval int
+	// SegmentDuration is in seconds
+	SegmentDuration int
+}
+
+// DefaultTranscodeProfile is used unless SetTranscodeProfile is called
+var DefaultTranscodeProfile = TranscodeProfile{
+	VideoCodec:       "libx264",
+	AudioCodec:       "aac",
+	VideoBitrate:     "3000k",
+	AudioBitrate:     "128k",
+	KeyframeInterval: 120,
+	SegmentDuration:  4,
+}
+
+// SetTranscodeProfile sets the encoding settings of new uploads and live
+// streams
+func (s *server) SetTranscodeProfile(profile TranscodeProfile) {
+	s.profile = profile
+}
+
+// SetMaxUploadSize limits the size of uploaded files; 0 means unlimited
+func (s *server) SetMaxUploadSize(bytes int64) {
+	s.maxUploadSize = bytes
+}
+
+// dashEncodingArgs returns the ffmpeg encoding and DASH muxer options for a
+// profile
+func (p TranscodeProfile) dashEncodingArgs() []string {
+	keyint := strconv.Itoa(p.KeyframeInterval)
+	return []string{
+		"-c:v", p.VideoCodec, // video codec
+		"-c:a", p.AudioCodec, // audio codec
+		"-bf", "1", // max 1 b-frame
+		"-keyint_min", keyint, // minimum keyframe interval
+		"-g", keyint, // keyframe interval
+		"-sc_threshold", "0", // scene change threshold
+		"-b:v", p.VideoBitrate, // video bitrate
+		"-b:a", p.AudioBitrate, // audio bitrate
+		"-f", "dash", // dash format
+		"-use_timeline", "1", // use timeline
+		"-use_template", "1", // use template
+		"-init_seg_name", "init-$RepresentationID$.m4s", // init segment naming
+		"-media_seg_name", "chunk-$RepresentationID$-$Number%05d$.m4s", // media segment naming
+		"-seg_duration", strconv.Itoa(p.SegmentDuration), // segment duration in seconds
+	}
+}
+
+func (s *server) convertToDASH(ctx context.Context, videoId string, inputPath string) (err error) {
+	ctx, span := startSpan(ctx, "convertToDASH", videoId, "")
+	// ffmpeg's output is logged line by line at debug level; the last lines
+	// explain a failure
+	output := logging.NewOutput(ctx, "video_id", videoId)
+	start := time.Now()
+	defer func() {
+		transcodeDuration.Observe(time.Since(start).Seconds())
+		if err != nil {
+			transcodeFailures.Inc()
+			slog.ErrorContext(ctx, "Transcode failed", "video_id", videoId, "error", err, "ffmpeg_output", output.Tail())
+		} else {
+			slog.InfoContext(ctx, "Transcoded video", "video_id", videoId, "duration", time.Since(start))
+		}
+		endSpan(span, err)
+	}()
+
 	// Create output directory for DASH files
 	var outputDir string
 	if fsService, ok := s.contentService.(*FSVideoContentService); ok {
@@ -120,31 +320,30 @@ func (s *server) convertToDASH(videoId string, inputPath string) error {
 	if err := os.MkdirAll(outputDir, 0755); err != nil {
 		return fmt.Errorf("failed to create output directory: %v", err)
 	}
+	_, isFS := s.contentService.(*FSVideoContentService)
+	defer func() {
+		// With network storage the local copy is only a staging area; with the
+		// filesystem backend it is the video itself and is only removed on failure
+		if !isFS || err != nil {
+			os.RemoveAll(outputDir)
+		}
+	}()
 
-	manifestPath := filepath.Join(outputDir, "manifest.mpd")
+	manifestPath := filepath.Join(outputDir, manifestFilename)
 
 	// FFmpeg command to convert to DASH format with recommended parameters
-	cmd := exec.Command("ffmpeg",
-		"-i", inputPath, // input file
-		"-c:v", "libx264", // video codec
-		"-c:a", "aac", // audio codec
-		"-bf", "1", // max 1 b-frame
-		"-keyint_min", "120", // minimum keyframe interval
-		"-g", "120", // keyframe every 120 frames
-		"-sc_threshold", "0", // scene change threshold
-		"-b:v", "3000k", // video bitrate
-		"-b:a", "128k", // audio bitrate
-		"-f", "dash", // dash format
-		"-use_timeline", "1", // use timeline
-		"-use_template", "1", // use template
-		"-init_seg_name", "init-$RepresentationID$.m4s", // init segment naming
-		"-media_seg_name", "chunk-$RepresentationID$-$Number%05d$.m4s", // media segment naming
-		"-seg_duration", "4", // segment duration in seconds
-		manifestPath) // output file
+	args := append([]string{"-i", inputPath}, s.profile.dashEncodingArgs()...)     // input file
+	cmd := exec.CommandContext(s.workCtx, "ffmpeg", append(args, manifestPath)...) // output file
 
 	// Capture both stdout and stderr
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
+	cmd.Stdout = output
+	cmd.Stderr = output
+
+	// If using NetworkVideoContentService, push the files to the network
+	// storage while ffmpeg is still producing them
+	if nwService, ok := s.contentService.(*NetworkVideoContentService); ok {
+		return transcodeAndPublish(ctx, cmd, nwService, videoId, outputDir)
+	}
 
 	// Run the command
 	if err := cmd.Run(); err != nil {
@@ -156,34 +355,6 @@ func (s *server) convertToDASH(videoId string, inputPath string) error {
 		return fmt.Errorf("manifest file was not created at %s", manifestPath)
 	}
 
-	// If using NetworkVideoContentService, write the files to the network storage
-	if nwService, ok := s.contentService.(*NetworkVideoContentService); ok {
-		// Read all files in the output directory
-		files, err := ioutil.ReadDir(outputDir)
-		if err != nil {
-			return fmt.Errorf("failed to read output directory: %v", err)
-		}
-
-		// Write each file to the network storage
-		for _, file := range files {
-			if file.IsDir() {
-				continue
-			}
-			data, err := ioutil.ReadFile(filepath.Join(outputDir, file.Name()))
-			if err != nil {
-				return fmt.Errorf("failed to read file %s: %v", file.Name(), err)
-			}
-			if err := nwService.Write(videoId, file.Name(), data); err != nil {
-				return fmt.Errorf("failed to write file %s to network storage: %v", file.Name(), err)
-			}
-		}
-
-		// Clean up local files after successful upload
-		if err := os.RemoveAll(outputDir); err != nil {
-			return fmt.Errorf("failed to clean up local files: %v", err)
-		}
-	}
-
 	return nil
 }
 
@@ -193,11 +364,42 @@ func (s *server) handleUpload(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	session, ok := s.requireUploader(w, r)
+	if !ok {
+		return
+	}
+	owner := ""
+	if session != nil {
+		owner = session.Username
+	}
+
 	// Parse multipart form
+	if s.maxUploadSize > 0 {
+		// Leave room for the other form fields and the multipart framing
+		r.Body = http.MaxBytesReader(w, r.Body, s.maxUploadSize+1<<20)
+	}
 	if err := r.ParseMultipartForm(32 << 20); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			http.Error(w, fmt.Sprintf("Upload is larger than %d MB", s.maxUploadSize>>20), http.StatusRequestEntityTooLarge)
+			return
+		}
 		http.Error(w, "Bad request", http.StatusBadRequest)
 		return
 	}
+	if !s.checkCSRF(w, r, session) {
+		return
+	}
+
+	visibility := VisibilityPublic
+	if v := Visibility(r.FormValue("visibility")); v != "" && s.users != nil {
+		// Without accounts nobody could watch a private video
+		if !v.Valid() {
+			http.Error(w, "Invalid visibility", http.StatusBadRequest)
+			return
+		}
+		visibility = v
+	}
 
 	// Get file from form
 	file, header, err := r.FormFile("file")
@@ -207,13 +409,6 @@ func (s *server) handleUpload(w http.ResponseWriter, r *http.Request) {
 	}
 	defer file.Close()
 
-	// Read file data
-	data, err := ioutil.ReadAll(file)
-	if err != nil {
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
-		return
-	}
-
 	// Generate video ID from filename
 	videoId := strings.TrimSuffix(header.Filename, filepath.Ext(header.Filename))
 	if videoId == "" {
@@ -221,27 +416,10 @@ func (s *server) handleUpload(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Check if video already exists
-	metadata, err := s.metadataService.Read(videoId)
-	if err != nil {
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
-		return
-	}
-	if metadata != nil {
-		http.Error(w, "Video already exists", http.StatusConflict)
-		return
-	}
-
-	// Create video metadata
-	if err := s.metadataService.Create(videoId, time.Now()); err != nil {
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
-		return
-	}
-
 	// Create temp directory based on content service type
 	var tempDir string
 	if fsService, ok := s.contentService.(*FSVideoContentService); ok {
-		tempDir = filepath.Join(fsService.baseDir, "temp")
+		tempDir = filepath.Join(fsService.baseDir, fsTempDirName)
 	} else {
 		tempDir = filepath.Join("tmp", "temp")
 	}
@@ -251,15 +429,22 @@ func (s *server) handleUpload(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	tempFile := filepath.Join(tempDir, header.Filename)
-	if err := ioutil.WriteFile(tempFile, data, 0644); err != nil {
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
+	if !s.beginWork() {
+		http.Error(w, "Server is shutting down", http.StatusServiceUnavailable)
 		return
 	}
-	defer os.Remove(tempFile)
+	defer s.work.Done()
 
-	// Convert to DASH format
-	if err := s.convertToDASH(videoId, tempFile); err != nil {
+	// Reserve the ID, save the file, convert it to DASH format and publish
+	// the video, undoing everything if a step fails
+	// The upload is finished even if the browser goes away, but its spans
+	// stay part of the request's trace
+	ctx := context.WithoutCancel(r.Context())
+	if err := s.runUploadSaga(ctx, videoId, owner, visibility, file, tempDir, time.Now()); errors.Is(err, ErrVideoExists) {
+		http.Error(w, "Video already exists", http.StatusConflict)
+		return
+	} else if err != nil {
+		slog.ErrorContext(ctx, "Upload failed", "video_id", videoId, "error", err)
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
 		return
 	}
@@ -286,7 +471,19 @@ func (s *server) handleVideo(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
 		return
 	}
-	if metadata == nil {
+	if metadata == nil || (metadata.Status != VideoStatusReady && metadata.Status != VideoStatusLive) {
+		http.NotFound(w, r)
+		return
+	}
+
+	allowed, viaSignature := s.canWatch(r, metadata)
+	session := s.currentSession(r)
+	if !allowed {
+		if session == nil && s.users != nil {
+			// The owner may just not be logged in yet
+			s.requireLogin(w, r)
+			return
+		}
 		http.NotFound(w, r)
 		return
 	}
@@ -294,11 +491,29 @@ func (s *server) handleVideo(w http.ResponseWriter, r *http.Request) {
 	// Add formatted time for template
 	type VideoWithFormattedTime struct {
 		VideoMetadata
-		UploadedAt string
+		UploadedAt   string
+		ManifestURL  string
+		CanManage    bool
+		CSRFToken    string
+		ShareURL     string
+		Visibilities []Visibility
 	}
 	data := VideoWithFormattedTime{
 		VideoMetadata: *metadata,
 		UploadedAt:    metadata.UploadedAt.Format("2006-01-02 15:04:05"),
+		ManifestURL:   "/content/" + url.PathEscape(videoId) + "/" + manifestFilename,
+		CanManage:     s.users != nil && canManage(session, metadata),
+		Visibilities:  []Visibility{VisibilityPublic, VisibilityUnlisted, VisibilityPrivate},
+	}
+	if viaSignature {
+		// Hand the signature on to the player
+		data.ManifestURL += "?" + signedQuery(r)
+	}
+	if data.CanManage {
+		data.CSRFToken = session.CSRFToken
+		if metadata.Visibility == VisibilityPrivate {
+			data.ShareURL = "/videos/" + url.PathEscape(videoId) + "?" + s.signer.sign(videoId, time.Now().Add(shareLinkTTL))
+		}
 	}
 
 	// Render video page
@@ -329,26 +544,49 @@ func (s *server) handleVideoContent(w http.ResponseWriter, r *http.Request) {
 	}
 	videoId := parts[0]
 	filename := parts[1]
-	
-	fmt.Printf("Serving video content: videoId=%s, filename=%s\n", videoId, filename)
 
 	// Check if video exists
-	if _, err := s.metadataService.Read(videoId); err != nil {
+	_, span := startSpan(r.Context(), "metadata.Read", videoId, "")
+	metadata, err := s.metadataService.Read(videoId)
+	endSpan(span, err)
+	if err != nil {
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
 		return
 	}
+	if metadata == nil {
+		http.NotFound(w, r)
+		return
+	}
+	allowed, viaSignature := s.canWatch(r, metadata)
+	if !allowed {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
 
 	// Get content using the interface method
-	data, err := s.contentService.Read(videoId, filename)
+	data, err := readContent(r.Context(), s.contentService, videoId, filename)
 	if err != nil {
-		if os.IsNotExist(err) {
+		if errors.Is(err, fs.ErrNotExist) {
 			http.NotFound(w, r)
 			return
 		}
+		slog.ErrorContext(r.Context(), "Failed to read video content", "video_id", videoId, "filename", filename, "error", err)
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
 		return
 	}
 
+	// A player that got the manifest through a signed link must present the
+	// signature for the segments too
+	if viaSignature && filename == manifestFilename {
+		if data, err = signManifest(data, signedQuery(r)); err != nil {
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+	}
+	if metadata.Visibility == VisibilityPrivate {
+		w.Header().Set("Cache-Control", "private")
+	}
+
 	// Set content type based on file extension
 	switch filepath.Ext(filename) {
 	case ".mpd":
@@ -359,5 +597,10 @@ func (s *server) handleVideoContent(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/octet-stream")
 	}
 
-	w.Write(data)
+	n, _ := w.Write(data)
+	if filename == manifestFilename {
+		contentBytesServed.WithLabelValues("manifest").Add(float64(n))
+	} else {
+		contentBytesServed.WithLabelValues("segment").Add(float64(n))
+	}
 }
@@ -0,0 +1,98 @@
+package web
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+)
+
+// beginWork registers a transcode or live stream with the server. It
+// returns false once a shutdown no longer accepts new work; otherwise the
+// caller must call s.work.Done when the work is finished.
+func (s *server) beginWork() bool {
+	s.workMu.Lock()
+	defer s.workMu.Unlock()
+	if s.draining {
+		return false
+	}
+	s.work.Add(1)
+	return true
+}
+
+// Shutdown stops the server gracefully. It stops accepting connections and
+// new live streams, ends running live streams as if their publishers had
+// disconnected, and waits for in-flight requests, transcodes, live stream
+// archiving and admin calls (such as node migrations) to finish.
+//
+// If ctx expires first, the remaining work is cancelled: transcodes are
+// killed and rolled back, live streams are archived with what was streamed
+// so far, and migrations stop after the file they are moving. Shutdown
+// returns once all of it has stopped; the metadata and content services may
+// then be closed.
+func (s *server) Shutdown(ctx context.Context) error {
+	s.serveMu.Lock()
+	s.shuttingDown = true
+	httpServer, grpcServer := s.httpServer, s.grpcServer
+	s.serveMu.Unlock()
+
+	if s.live != nil {
+		for _, stream := range s.live.close() {
+			slog.Info("Ending live stream for shutdown", "stream_id", stream.id)
+			stream.cmd.Process.Signal(os.Interrupt)
+		}
+	}
+
+	grpcStopped := make(chan struct{})
+	go func() {
+		if grpcServer != nil {
+			grpcServer.GracefulStop()
+		}
+		close(grpcStopped)
+	}()
+
+	// Uploads are transcoded inside their requests, so this also waits for
+	// the transcodes that have started
+	var err error
+	if httpServer != nil {
+		if err = httpServer.Shutdown(ctx); err != nil && err != http.ErrServerClosed {
+			err = fmt.Errorf("requests still running: %v", err)
+		} else {
+			err = nil
+		}
+	}
+
+	s.workMu.Lock()
+	s.draining = true
+	s.workMu.Unlock()
+	workDone := make(chan struct{})
+	go func() {
+		s.work.Wait()
+		close(workDone)
+	}()
+
+	select {
+	case <-workDone:
+	case <-ctx.Done():
+	}
+	select {
+	case <-grpcStopped:
+	case <-ctx.Done():
+	}
+
+	if ctx.Err() != nil {
+		slog.Warn("Shutdown deadline passed, cancelling remaining work")
+		if err == nil {
+			err = ctx.Err()
+		}
+		s.cancelWork()
+		if grpcServer != nil {
+			grpcServer.Stop()
+		}
+		<-workDone
+		<-grpcStopped
+	}
+	s.cancelWork()
+	return err
+}
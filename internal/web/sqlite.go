@@ -3,10 +3,15 @@
 package web
 
 import (
+	"crypto/sha256"
 	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
 	"time"
 
-	_ "github.com/mattn/go-sqlite3"
+	"github.com/mattn/go-sqlite3"
 )
 
 type SQLiteVideoMetadataService struct {
@@ -14,7 +19,13 @@ type SQLiteVideoMetadataService struct {
 }
 
 func NewSQLiteVideoMetadataService(dbPath string) (*SQLiteVideoMetadataService, error) {
-	db, err := sql.Open("sqlite3", dbPath)
+	// Every connection enforces foreign keys, so deleting a user cascades
+	// to their sessions and single sign-on identities
+	dsn := dbPath + "?_foreign_keys=on"
+	if strings.Contains(dbPath, "?") {
+		dsn = dbPath + "&_foreign_keys=on"
+	}
+	db, err := sql.Open("sqlite3", dsn)
 	if err != nil {
 		return nil, err
 	}
@@ -23,7 +34,69 @@ func NewSQLiteVideoMetadataService(dbPath string) (*SQLiteVideoMetadataService,
 	_, err = db.Exec(`
 		CREATE TABLE IF NOT EXISTS videos (
 			id TEXT PRIMARY KEY,
-			uploaded_at DATETIME NOT NULL
+			uploaded_at DATETIME NOT NULL,
+			status TEXT NOT NULL DEFAULT 'ready',
+			owner TEXT NOT NULL DEFAULT '',
+			visibility TEXT NOT NULL DEFAULT 'public'
+		)
+	`)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	// Databases created before videos had a status only hold finished uploads
+	if err := addColumnIfMissing(db, "videos", "status", "TEXT NOT NULL DEFAULT 'ready'"); err != nil {
+		db.Close()
+		return nil, err
+	}
+	// Videos uploaded before accounts existed have no owner
+	if err := addColumnIfMissing(db, "videos", "owner", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		db.Close()
+		return nil, err
+	}
+	// Every video was public before visibility existed
+	if err := addColumnIfMissing(db, "videos", "visibility", "TEXT NOT NULL DEFAULT 'public'"); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	// User accounts live next to the videos they own
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS users (
+			username TEXT PRIMARY KEY,
+			password_hash BLOB NOT NULL,
+			role TEXT NOT NULL DEFAULT 'uploader',
+			created_at DATETIME NOT NULL
+		);
+		CREATE TABLE IF NOT EXISTS identities (
+			issuer TEXT NOT NULL,
+			subject TEXT NOT NULL,
+			username TEXT NOT NULL REFERENCES users(username) ON DELETE CASCADE,
+			PRIMARY KEY (issuer, subject)
+		);
+		CREATE TABLE IF NOT EXISTS sessions (
+			token_hash TEXT PRIMARY KEY,
+			username TEXT NOT NULL REFERENCES users(username) ON DELETE CASCADE,
+			csrf_token TEXT NOT NULL,
+			expires_at DATETIME NOT NULL
+		)
+	`)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	// Accounts created before roles existed could all upload
+	if err := addColumnIfMissing(db, "users", "role", "TEXT NOT NULL DEFAULT 'uploader'"); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS settings (
+			key TEXT PRIMARY KEY,
+			value TEXT NOT NULL
 		)
 	`)
 	if err != nil {
@@ -34,10 +107,41 @@ func NewSQLiteVideoMetadataService(dbPath string) (*SQLiteVideoMetadataService,
 	return &SQLiteVideoMetadataService{db: db}, nil
 }
 
+// addColumnIfMissing adds a column to an existing table so databases created
+// by older versions keep working
+func addColumnIfMissing(db *sql.DB, table, column, definition string) error {
+	rows, err := db.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			cid          int
+			name, ctype  string
+			notNull, pk  int
+			defaultValue sql.NullString
+		)
+		if err := rows.Scan(&cid, &name, &ctype, &notNull, &defaultValue, &pk); err != nil {
+			return err
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	_, err = db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+	return err
+}
+
 func (s *SQLiteVideoMetadataService) Read(id string) (*VideoMetadata, error) {
 	var metadata VideoMetadata
-	err := s.db.QueryRow("SELECT id, uploaded_at FROM videos WHERE id = ?", id).
-		Scan(&metadata.Id, &metadata.UploadedAt)
+	err := s.db.QueryRow("SELECT id, uploaded_at, status, owner, visibility FROM videos WHERE id = ?", id).
+		Scan(&metadata.Id, &metadata.UploadedAt, &metadata.Status, &metadata.Owner, &metadata.Visibility)
 	if err == sql.ErrNoRows {
 		return nil, nil
 	}
@@ -48,7 +152,7 @@ func (s *SQLiteVideoMetadataService) Read(id string) (*VideoMetadata, error) {
 }
 
 func (s *SQLiteVideoMetadataService) List() ([]VideoMetadata, error) {
-	rows, err := s.db.Query("SELECT id, uploaded_at FROM videos ORDER BY uploaded_at DESC")
+	rows, err := s.db.Query("SELECT id, uploaded_at, status, owner, visibility FROM videos ORDER BY uploaded_at DESC")
 	if err != nil {
 		return nil, err
 	}
@@ -57,7 +161,7 @@ func (s *SQLiteVideoMetadataService) List() ([]VideoMetadata, error) {
 	var videos []VideoMetadata
 	for rows.Next() {
 		var video VideoMetadata
-		if err := rows.Scan(&video.Id, &video.UploadedAt); err != nil {
+		if err := rows.Scan(&video.Id, &video.UploadedAt, &video.Status, &video.Owner, &video.Visibility); err != nil {
 			return nil, err
 		}
 		videos = append(videos, video)
@@ -65,9 +169,142 @@ func (s *SQLiteVideoMetadataService) List() ([]VideoMetadata, error) {
 	return videos, rows.Err()
 }
 
-func (s *SQLiteVideoMetadataService) Create(videoId string, uploadedAt time.Time) error {
-	_, err := s.db.Exec("INSERT INTO videos (id, uploaded_at) VALUES (?, ?)",
-		videoId, uploadedAt)
+func (s *SQLiteVideoMetadataService) Create(videoId string, owner string, uploadedAt time.Time) error {
+	_, err := s.db.Exec("INSERT INTO videos (id, uploaded_at, status, owner) VALUES (?, ?, ?, ?)",
+		videoId, uploadedAt, VideoStatusPending, owner)
+	var sqliteErr sqlite3.Error
+	if errors.As(err, &sqliteErr) && sqliteErr.ExtendedCode == sqlite3.ErrConstraintPrimaryKey {
+		return ErrVideoExists
+	}
+	return err
+}
+
+func (s *SQLiteVideoMetadataService) SetStatus(id string, status VideoStatus) error {
+	result, err := s.db.Exec("UPDATE videos SET status = ? WHERE id = ?", status, id)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return fmt.Errorf("video not found: %s", id)
+	}
+	return nil
+}
+
+func (s *SQLiteVideoMetadataService) SetVisibility(id string, visibility Visibility) error {
+	result, err := s.db.Exec("UPDATE videos SET visibility = ? WHERE id = ?", visibility, id)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return fmt.Errorf("video not found: %s", id)
+	}
+	return nil
+}
+
+func (s *SQLiteVideoMetadataService) Delete(id string) error {
+	_, err := s.db.Exec("DELETE FROM videos WHERE id = ?", id)
+	return err
+}
+
+func (s *SQLiteVideoMetadataService) CreateUser(username string, passwordHash []byte, role Role) error {
+	if passwordHash == nil {
+		passwordHash = []byte{}
+	}
+	_, err := s.db.Exec("INSERT INTO users (username, password_hash, role, created_at) VALUES (?, ?, ?, ?)",
+		username, passwordHash, role, time.Now())
+	return err
+}
+
+func (s *SQLiteVideoMetadataService) ReadUser(username string) (*User, error) {
+	var user User
+	err := s.db.QueryRow("SELECT username, password_hash, role, created_at FROM users WHERE username = ?", username).
+		Scan(&user.Username, &user.PasswordHash, &user.Role, &user.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+func (s *SQLiteVideoMetadataService) SetRole(username string, role Role) error {
+	result, err := s.db.Exec("UPDATE users SET role = ? WHERE username = ?", role, username)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return fmt.Errorf("user not found: %s", username)
+	}
+	return nil
+}
+
+func (s *SQLiteVideoMetadataService) ReadIdentity(issuer string, subject string) (string, error) {
+	var username string
+	err := s.db.QueryRow("SELECT username FROM identities WHERE issuer = ? AND subject = ?", issuer, subject).
+		Scan(&username)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return username, err
+}
+
+func (s *SQLiteVideoMetadataService) LinkIdentity(issuer string, subject string, username string) error {
+	_, err := s.db.Exec("INSERT INTO identities (issuer, subject, username) VALUES (?, ?, ?)",
+		issuer, subject, username)
+	return err
+}
+
+// sessionTokenHash is the key a session is stored under. Only a hash of the
+// token is kept so a leaked database cannot be used to hijack sessions.
+func sessionTokenHash(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func (s *SQLiteVideoMetadataService) CreateSession(session Session) error {
+	_, err := s.db.Exec("INSERT INTO sessions (token_hash, username, csrf_token, expires_at) VALUES (?, ?, ?, ?)",
+		sessionTokenHash(session.Token), session.Username, session.CSRFToken, session.ExpiresAt)
+	return err
+}
+
+func (s *SQLiteVideoMetadataService) ReadSession(token string) (*Session, error) {
+	session := Session{Token: token}
+	err := s.db.QueryRow(`
+		SELECT sessions.username, users.role, sessions.csrf_token, sessions.expires_at
+		FROM sessions JOIN users ON users.username = sessions.username
+		WHERE sessions.token_hash = ?`, sessionTokenHash(token)).
+		Scan(&session.Username, &session.Role, &session.CSRFToken, &session.ExpiresAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if time.Now().After(session.ExpiresAt) {
+		// Expired sessions are dropped the first time they are presented again
+		s.DeleteSession(token)
+		return nil, nil
+	}
+	return &session, nil
+}
+
+func (s *SQLiteVideoMetadataService) DeleteSession(token string) error {
+	_, err := s.db.Exec("DELETE FROM sessions WHERE token_hash = ?", sessionTokenHash(token))
+	return err
+}
+
+func (s *SQLiteVideoMetadataService) Setting(key string) (string, error) {
+	var value string
+	err := s.db.QueryRow("SELECT value FROM settings WHERE key = ?", key).Scan(&value)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return value, err
+}
+
+func (s *SQLiteVideoMetadataService) SetSetting(key string, value string) error {
+	_, err := s.db.Exec("INSERT INTO settings (key, value) VALUES (?, ?) ON CONFLICT (key) DO UPDATE SET value = excluded.value", key, value)
 	return err
 }
 
@@ -77,3 +314,5 @@ func (s *SQLiteVideoMetadataService) Close() error {
 }
 
 var _ VideoMetadataService = (*SQLiteVideoMetadataService)(nil)
+var _ UserService = (*SQLiteVideoMetadataService)(nil)
+var _ SettingService = (*SQLiteVideoMetadataService)(nil)
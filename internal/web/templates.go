@@ -11,16 +11,48 @@ const indexHTML = `
   </head>
   <body>
     <h1>Welcome to TritonTube</h1>
+    {{if .AccountsEnabled}}
+    {{if .Username}}
+    <form action="/logout" method="post">
+      Logged in as <strong>{{.Username}}</strong>
+      <input type="hidden" name="csrf_token" value="{{.CSRFToken}}" />
+      <input type="submit" value="Log out" />
+    </form>
+    {{else}}
+    <p><a href="/login">Log in</a> to upload videos.</p>
+    {{end}}
+    {{end}}
+    {{if .CanUpload}}
     <h2>Upload an MP4 Video</h2>
     <form action="/upload" method="post" enctype="multipart/form-data">
+      <input type="hidden" name="csrf_token" value="{{.CSRFToken}}" />
       <input type="file" name="file" accept="video/mp4" required />
+      {{if .AccountsEnabled}}
+      <select name="visibility">
+        <option value="public">Public</option>
+        <option value="unlisted">Unlisted</option>
+        <option value="private">Private</option>
+      </select>
+      {{end}}
       <input type="submit" value="Upload" />
     </form>
+    {{if .LiveEnabled}}
+    <h2>Go Live</h2>
+    <form action="/live/start" method="post">
+      <input type="hidden" name="csrf_token" value="{{.CSRFToken}}" />
+      <input type="text" name="id" placeholder="Stream name" pattern="[A-Za-z0-9_-]+" required />
+      <input type="submit" value="Start Stream" />
+    </form>
+    {{end}}
+    {{end}}
     <h2>Watchlist</h2>
     <ul>
-      {{range .}}
+      {{range .Videos}}
       <li>
+        {{if .Live}}<strong style="color: red">LIVE</strong>{{end}}
         <a href="/videos/{{.EscapedId}}">{{.Id}} ({{.UploadTime}})</a>
+        {{if .Owner}}by {{.Owner}}{{end}}
+        {{if .Hidden}}<em>({{.Visibility}})</em>{{end}}
       </li>
       {{else}}
       <li>No videos uploaded yet.</li>
@@ -41,14 +73,113 @@ const videoHTML = `
   <body>
     <h1>{{.Id}}</h1>
 	  <p>Uploaded at: {{.UploadedAt}}</p>
+    {{if .Owner}}<p>Uploaded by: {{.Owner}}</p>{{end}}
 
     <video id="dashPlayer" controls style="width: 640px; height: 360px"></video>
     <script>
-      var url = "/content/{{.Id}}/manifest.mpd";
+      var url = {{.ManifestURL}};
       var player = dashjs.MediaPlayer().create();
       player.initialize(document.querySelector("#dashPlayer"), url, false);
     </script>
 
+    {{if .CanManage}}
+    <form action="/visibility" method="post">
+      <input type="hidden" name="csrf_token" value="{{.CSRFToken}}" />
+      <input type="hidden" name="id" value="{{.Id}}" />
+      Visibility:
+      <select name="visibility">
+        {{$current := .Visibility}}
+        {{range .Visibilities}}
+        <option value="{{.}}" {{if eq . $current}}selected{{end}}>{{.}}</option>
+        {{end}}
+      </select>
+      <input type="submit" value="Save" />
+    </form>
+    {{if .ShareURL}}
+    <p>Share link (valid for 24 hours): <a href="{{.ShareURL}}">{{.ShareURL}}</a></p>
+    {{end}}
+    {{end}}
+
+    <p><a href="/">Back to Home</a></p>
+  </body>
+</html>
+`
+
+const liveHTML = `
+<!DOCTYPE html>
+<html>
+  <head>
+    <meta charset="UTF-8" />
+    <title>{{.Id}} - TritonTube Live</title>
+  </head>
+  <body>
+    <h1>{{.Id}} is ready to go live</h1>
+    <p>Publish your stream to:</p>
+    <pre>{{.PublishURL}}</pre>
+    <p>For example with ffmpeg:</p>
+    <pre>ffmpeg -re -i input.mp4 -c copy -f flv {{.PublishURL}}</pre>
+
+    <p><a href="/videos/{{.Id}}">Watch the stream</a></p>
+    <form action="/live/stop" method="post">
+      <input type="hidden" name="csrf_token" value="{{.CSRFToken}}" />
+      <input type="hidden" name="id" value="{{.Id}}" />
+      <input type="submit" value="End Stream" />
+    </form>
+
+    <p><a href="/">Back to Home</a></p>
+  </body>
+</html>
+`
+
+const loginHTML = `
+<!DOCTYPE html>
+<html>
+  <head>
+    <meta charset="UTF-8" />
+    <title>Log in - TritonTube</title>
+  </head>
+  <body>
+    <h1>Log in to TritonTube</h1>
+    {{if .Error}}<p style="color: red">{{.Error}}</p>{{end}}
+    {{if .SSOName}}
+    <p><a href="/login/oidc?next={{.Next}}">Log in with {{.SSOName}}</a></p>
+    {{end}}
+    {{if .PasswordLogin}}
+    <form action="/login" method="post">
+      <input type="hidden" name="csrf_token" value="{{.CSRFToken}}" />
+      <input type="hidden" name="next" value="{{.Next}}" />
+      <p><input type="text" name="username" placeholder="Username" required autofocus /></p>
+      <p><input type="password" name="password" placeholder="Password" required /></p>
+      <input type="submit" value="Log in" />
+    </form>
+
+    {{if .Registration}}<p>No account yet? <a href="/register?next={{.Next}}">Register</a></p>{{end}}
+    {{end}}
+    <p><a href="/">Back to Home</a></p>
+  </body>
+</html>
+`
+
+const registerHTML = `
+<!DOCTYPE html>
+<html>
+  <head>
+    <meta charset="UTF-8" />
+    <title>Register - TritonTube</title>
+  </head>
+  <body>
+    <h1>Create a TritonTube account</h1>
+    {{if .Error}}<p style="color: red">{{.Error}}</p>{{end}}
+    <form action="/register" method="post">
+      <input type="hidden" name="csrf_token" value="{{.CSRFToken}}" />
+      <input type="hidden" name="next" value="{{.Next}}" />
+      <p><input type="text" name="username" placeholder="Username" pattern="[A-Za-z0-9_.\-]{1,32}" required autofocus /></p>
+      <p><input type="password" name="password" placeholder="Password (at least 8 characters)" minlength="8" maxlength="72" required /></p>
+      <p><input type="password" name="confirm" placeholder="Repeat password" required /></p>
+      <input type="submit" value="Register" />
+    </form>
+
+    <p>Already registered? <a href="/login?next={{.Next}}">Log in</a></p>
     <p><a href="/">Back to Home</a></p>
   </body>
 </html>
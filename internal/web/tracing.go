@@ -0,0 +1,49 @@
+package web
+
+import (
+	"context"
+	"net/http"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracer creates the spans of the web server. It goes through the global
+// provider, so spans are dropped unless tracing.Setup chose an exporter.
+var tracer = otel.Tracer("tritontube/internal/web")
+
+// startRequestSpan starts the span of an HTTP request handled under the
+// given pattern. It continues the trace of the caller if the request carries
+// a traceparent header.
+func startRequestSpan(r *http.Request, pattern string) (*http.Request, trace.Span) {
+	ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+	ctx, span := tracer.Start(ctx, r.Method+" "+pattern,
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			attribute.String("http.request.method", r.Method),
+			attribute.String("http.route", pattern),
+			attribute.String("url.path", r.URL.Path),
+		))
+	return r.WithContext(ctx), span
+}
+
+// startSpan starts a span for work on a file of a video
+func startSpan(ctx context.Context, name string, videoId string, filename string) (context.Context, trace.Span) {
+	attrs := []attribute.KeyValue{attribute.String("tritontube.video_id", videoId)}
+	if filename != "" {
+		attrs = append(attrs, attribute.String("tritontube.filename", filename))
+	}
+	return tracer.Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// endSpan ends a span, marking it failed if err is not nil
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
@@ -0,0 +1,89 @@
+package web
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"time"
+)
+
+// uploadSaga remembers how to undo each step of an upload (or the start of
+// a live stream) that has taken effect, so a failure part way through leaves
+// neither metadata nor content behind.
+type uploadSaga struct {
+	videoId       string
+	compensations []func() error
+}
+
+// compensate registers fn to be run if the upload is rolled back
+func (u *uploadSaga) compensate(fn func() error) {
+	u.compensations = append(u.compensations, fn)
+}
+
+// rollback undoes the registered steps in reverse order. It keeps going when a
+// compensation fails so the remaining ones still get a chance to run.
+func (u *uploadSaga) rollback() {
+	for i := len(u.compensations) - 1; i >= 0; i-- {
+		if err := u.compensations[i](); err != nil {
+			slog.Error("Failed to roll back", "video_id", u.videoId, "error", err)
+		}
+	}
+	u.compensations = nil
+}
+
+// runUploadSaga publishes a file uploaded by owner as a new video with the
+// given visibility: it reserves the ID with a pending catalog entry, saves
+// the upload to a temporary file in tempDir, transcodes and writes the
+// content, then marks the video ready. If any step fails the partial content
+// and the catalog entry are removed again. It fails with ErrVideoExists if
+// the ID is taken, before anything is written.
+func (s *server) runUploadSaga(ctx context.Context, videoId string, owner string, visibility Visibility, upload io.Reader, tempDir string, uploadedAt time.Time) error {
+	saga := &uploadSaga{videoId: videoId}
+
+	if err := s.metadataService.Create(videoId, owner, uploadedAt); errors.Is(err, ErrVideoExists) {
+		return err
+	} else if err != nil {
+		return fmt.Errorf("failed to create metadata: %v", err)
+	}
+	saga.compensate(func() error { return s.metadataService.Delete(videoId) })
+
+	// Concurrent uploads of files with the same name each get their own
+	// input file
+	input, err := os.CreateTemp(tempDir, "upload-*")
+	if err != nil {
+		saga.rollback()
+		return fmt.Errorf("failed to create input file: %v", err)
+	}
+	defer os.Remove(input.Name())
+	_, err = io.Copy(input, upload)
+	if closeErr := input.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		saga.rollback()
+		return fmt.Errorf("failed to save upload: %v", err)
+	}
+
+	if err := s.metadataService.SetVisibility(videoId, visibility); err != nil {
+		saga.rollback()
+		return fmt.Errorf("failed to set visibility: %v", err)
+	}
+
+	// Content may be partially written when the conversion fails, so its
+	// compensation is registered before the step runs
+	saga.compensate(func() error { return deleteVideoContent(s.contentService, videoId) })
+	if err := s.convertToDASH(ctx, videoId, input.Name()); err != nil {
+		saga.rollback()
+		return err
+	}
+
+	if err := s.metadataService.SetStatus(videoId, VideoStatusReady); err != nil {
+		saga.rollback()
+		return fmt.Errorf("failed to mark video ready: %v", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,168 @@
+package web
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// shareLinkTTL is how long a signed link to a private video stays valid
+const shareLinkTTL = 24 * time.Hour
+
+// urlSigner signs links to private videos. A signature covers a video and an
+// expiry time rather than a single file, so the one token on a share link
+// also unlocks the manifest and every segment of the video.
+type urlSigner struct {
+	key []byte
+}
+
+// newURLSigner returns a signer with a random key. Links it signs stop
+// working when the server restarts unless SetURLSigningKey is used.
+func newURLSigner() *urlSigner {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		panic(fmt.Sprintf("failed to generate URL signing key: %v", err))
+	}
+	return &urlSigner{key: key}
+}
+
+// SetURLSigningKey sets the key signed links are made with, so they survive
+// restarts and work across web servers sharing the key
+func (s *server) SetURLSigningKey(key []byte) {
+	s.signer = &urlSigner{key: key}
+}
+
+func (u *urlSigner) signature(videoId string, expires int64) string {
+	mac := hmac.New(sha256.New, u.key)
+	fmt.Fprintf(mac, "%s\n%d", videoId, expires)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// sign returns the query string that grants access to a video until expires
+func (u *urlSigner) sign(videoId string, expires time.Time) string {
+	unix := expires.Unix()
+	return url.Values{
+		"expires": {strconv.FormatInt(unix, 10)},
+		"sig":     {u.signature(videoId, unix)},
+	}.Encode()
+}
+
+// verify reports whether query carries an unexpired signature for the video
+func (u *urlSigner) verify(videoId string, query url.Values) bool {
+	expires, err := strconv.ParseInt(query.Get("expires"), 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		return false
+	}
+	expected := u.signature(videoId, expires)
+	return hmac.Equal([]byte(query.Get("sig")), []byte(expected))
+}
+
+// signedQuery returns the signature part of a request's query string, to be
+// handed on to the URLs the response points at
+func signedQuery(r *http.Request) string {
+	query := r.URL.Query()
+	return url.Values{"expires": {query.Get("expires")}, "sig": {query.Get("sig")}}.Encode()
+}
+
+// canManage reports whether the session's user may change a video: its owner
+// or an admin
+func canManage(session *Session, video *VideoMetadata) bool {
+	if session == nil {
+		return false
+	}
+	return (video.Owner != "" && session.Username == video.Owner) || session.Role == RoleAdmin
+}
+
+// canWatch reports whether a request may play a video. Private videos need
+// their owner (or an admin) to be logged in, or a signed link.
+func (s *server) canWatch(r *http.Request, video *VideoMetadata) (allowed bool, viaSignature bool) {
+	if video.Visibility != VisibilityPrivate {
+		return true, false
+	}
+	if canManage(s.currentSession(r), video) {
+		return true, false
+	}
+	if s.signer.verify(video.Id, r.URL.Query()) {
+		return true, true
+	}
+	return false, false
+}
+
+// signManifest appends a signed query string to every segment URL template
+// in a manifest, so a player given a signed manifest URL also presents the
+// signature when it fetches the segments
+func signManifest(data []byte, query string) ([]byte, error) {
+	root, err := parseMPD(data)
+	if err != nil {
+		return nil, err
+	}
+
+	var walk func(n *mpdNode)
+	walk = func(n *mpdNode) {
+		if n.Name.Local == "SegmentTemplate" {
+			for _, name := range []string{"initialization", "media"} {
+				if value := n.attr(name); value != "" {
+					separator := "?"
+					if strings.Contains(value, "?") {
+						separator = "&"
+					}
+					n.setAttr(name, value+separator+query)
+				}
+			}
+		}
+		for _, c := range n.Children {
+			walk(c)
+		}
+	}
+	walk(root)
+	return encodeMPD(root), nil
+}
+
+func (s *server) handleSetVisibility(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if s.users == nil {
+		http.NotFound(w, r)
+		return
+	}
+	session, ok := s.requireLogin(w, r)
+	if !ok || !s.checkCSRF(w, r, session) {
+		return
+	}
+
+	videoId := r.FormValue("id")
+	visibility := Visibility(r.FormValue("visibility"))
+	if !visibility.Valid() {
+		http.Error(w, "Invalid visibility", http.StatusBadRequest)
+		return
+	}
+
+	metadata, err := s.metadataService.Read(videoId)
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if metadata == nil {
+		http.NotFound(w, r)
+		return
+	}
+	if !canManage(session, metadata) {
+		http.Error(w, "Only the owner may change a video's visibility", http.StatusForbidden)
+		return
+	}
+
+	if err := s.metadataService.SetVisibility(videoId, visibility); err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/videos/"+url.PathEscape(videoId), http.StatusSeeOther)
+}
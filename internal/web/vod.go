@@ -0,0 +1,209 @@
+package web
+
+import (
+	"encoding/xml"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// liveSegment is one media segment of a live representation, in the
+// timescale of its SegmentTemplate
+type liveSegment struct {
+	t int64
+	d int64
+}
+
+// liveArchive remembers every segment a live stream has announced. A live
+// manifest only lists the last few segments, so each version is recorded as
+// it is published; when the stream ends the whole timeline is written into a
+// static manifest that turns the stream into an on-demand video.
+type liveArchive struct {
+	mu        sync.Mutex
+	last      *mpdNode                         // most recent manifest
+	timescale map[string]int64                 // representation ID -> SegmentTemplate timescale
+	segments  map[string]map[int64]liveSegment // representation ID -> segment number -> timing
+}
+
+func newLiveArchive() *liveArchive {
+	return &liveArchive{
+		timescale: make(map[string]int64),
+		segments:  make(map[string]map[int64]liveSegment),
+	}
+}
+
+// record adds the segments listed in a version of the live manifest
+func (a *liveArchive) record(root *mpdNode) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	for _, period := range root.children("Period") {
+		for _, adaptationSet := range period.children("AdaptationSet") {
+			for _, representation := range adaptationSet.children("Representation") {
+				template := representationTemplate(adaptationSet, representation)
+				if template == nil || template.child("SegmentTimeline") == nil {
+					continue
+				}
+				id := representation.attr("id")
+
+				number := int64(1)
+				if v := template.attr("startNumber"); v != "" {
+					var err error
+					if number, err = strconv.ParseInt(v, 10, 64); err != nil {
+						return fmt.Errorf("invalid startNumber %q: %v", v, err)
+					}
+				}
+				timescale := int64(1)
+				if v := template.attr("timescale"); v != "" {
+					var err error
+					if timescale, err = strconv.ParseInt(v, 10, 64); err != nil || timescale <= 0 {
+						return fmt.Errorf("invalid timescale %q", v)
+					}
+				}
+				entries, err := timelineEntries(template.child("SegmentTimeline"))
+				if err != nil {
+					return err
+				}
+
+				segments, ok := a.segments[id]
+				if !ok {
+					segments = make(map[int64]liveSegment)
+					a.segments[id] = segments
+				}
+				a.timescale[id] = timescale
+				var t int64
+				for _, entry := range entries {
+					if entry.T >= 0 {
+						t = entry.T
+					}
+					for i := int64(0); i <= entry.R; i++ {
+						segments[number] = liveSegment{t: t, d: entry.D}
+						number++
+						t += entry.D
+					}
+				}
+			}
+		}
+	}
+	a.last = root
+	return nil
+}
+
+// empty reports whether the stream never produced a segment, e.g. because
+// nobody ever published to it
+func (a *liveArchive) empty() bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, segments := range a.segments {
+		if len(segments) > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// staticManifest rewrites the last live manifest into a static one whose
+// timelines list every recorded segment. The segment files keep their names,
+// so the stored init-*.m4s and chunk-*.m4s files play as they are.
+func (a *liveArchive) staticManifest() ([]byte, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.last == nil {
+		return nil, fmt.Errorf("no manifest was recorded")
+	}
+	root := a.last
+
+	var duration time.Duration
+	for _, period := range root.children("Period") {
+		for _, adaptationSet := range period.children("AdaptationSet") {
+			for _, representation := range adaptationSet.children("Representation") {
+				template := representationTemplate(adaptationSet, representation)
+				if template == nil || template.child("SegmentTimeline") == nil {
+					continue
+				}
+				id := representation.attr("id")
+				startNumber, timeline, end := a.timeline(id)
+				if timeline == nil {
+					continue
+				}
+
+				template.setAttr("startNumber", strconv.FormatInt(startNumber, 10))
+				template.removeChildren("SegmentTimeline")
+				template.Children = append(template.Children, timeline)
+
+				first, _ := strconv.ParseInt(timeline.Children[0].attr("t"), 10, 64)
+				if d := time.Duration(float64(end-first) / float64(a.timescale[id]) * float64(time.Second)); d > duration {
+					duration = d
+				}
+			}
+		}
+	}
+	if duration == 0 {
+		return nil, fmt.Errorf("no segments were recorded")
+	}
+
+	// A static presentation is fetched once and played from the start, so
+	// everything that tells players to keep refreshing it goes away
+	root.setAttr("type", "static")
+	root.setAttr("mediaPresentationDuration", formatISODuration(duration))
+	for _, name := range []string{"availabilityStartTime", "minimumUpdatePeriod", "timeShiftBufferDepth", "suggestedPresentationDelay"} {
+		root.removeAttr(name)
+	}
+	root.removeChildren("UTCTiming")
+
+	return encodeMPD(root), nil
+}
+
+// timeline builds the SegmentTimeline of a representation from its recorded
+// segments. Segment numbers are implied by position, so it stops at the
+// first number that was never seen. It returns the first segment number, the
+// timeline and the end time of its last segment.
+func (a *liveArchive) timeline(id string) (int64, *mpdNode, int64) {
+	segments := a.segments[id]
+	if len(segments) == 0 {
+		return 0, nil, 0
+	}
+	numbers := make([]int64, 0, len(segments))
+	for number := range segments {
+		numbers = append(numbers, number)
+	}
+	sort.Slice(numbers, func(i, j int) bool { return numbers[i] < numbers[j] })
+
+	timeline := &mpdNode{Name: xml.Name{Local: "SegmentTimeline"}}
+	var last *mpdNode
+	var repeat, end int64
+	for i, number := range numbers {
+		if i > 0 && number != numbers[i-1]+1 {
+			slog.Warn("Live archive: dropping segments that were never announced",
+				"representation", id, "after", numbers[i-1], "dropped", len(numbers)-i)
+			break
+		}
+		segment := segments[number]
+		// Consecutive segments of equal length share one <S> element
+		if last != nil && segment.t == end && strconv.FormatInt(segment.d, 10) == last.attr("d") {
+			repeat++
+			last.setAttr("r", strconv.FormatInt(repeat, 10))
+		} else {
+			last = &mpdNode{Name: xml.Name{Local: "S"}}
+			last.setAttr("t", strconv.FormatInt(segment.t, 10))
+			last.setAttr("d", strconv.FormatInt(segment.d, 10))
+			timeline.Children = append(timeline.Children, last)
+			repeat = 0
+		}
+		end = segment.t + segment.d
+	}
+	return numbers[0], timeline, end
+}
+
+// representationTemplate returns the SegmentTemplate that applies to a
+// Representation; one on the Representation overrides the AdaptationSet one
+func representationTemplate(adaptationSet, representation *mpdNode) *mpdNode {
+	if template := representation.child("SegmentTemplate"); template != nil {
+		return template
+	}
+	return adaptationSet.child("SegmentTemplate")
+}
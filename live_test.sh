@@ -0,0 +1,105 @@
+#!/bin/bash
+
+# Live streaming test: feeds an ffmpeg test source into the RTMP ingest and
+# checks that segments and the sliding-window manifest reach the storage nodes.
+set -e
+rm -rf tmp  # comment out this line if you want to keep the data from ./tmp during testing
+
+# Ctrl+C or exit
+cleanup() {
+    echo "🧹 Cleaning up background processes..."
+    ps aux | grep go-build | awk '{print $2}' | xargs kill 2>/dev/null || true
+    ps aux | grep cmd/storage | awk '{print $2}' | xargs kill 2>/dev/null || true
+    ps aux | grep testsrc | awk '{print $2}' | xargs kill 2>/dev/null || true
+    echo "😉 Cleanup complete."
+}
+trap cleanup EXIT
+
+mkdir -p tmp
+> tmp/test.log
+
+echo "🚀 Step 1: Launching 3 storage nodes on ports 8090–8092..."
+for i in {0..2}; do
+    port=$((8090 + i))
+    mkdir -p tmp/$port
+    go run cmd/storage/main.go -port $port tmp/$port >> tmp/test.log 2>&1 &
+done
+sleep 2
+
+echo
+echo "🌐 Step 2: Starting web server with RTMP ingest on port 1935..."
+go run cmd/web/main.go -rtmp-port 1935 -register-role uploader -admin-insecure sqlite ./tmp/metadata.db nw localhost:8081,localhost:8090,localhost:8091,localhost:8092 >> tmp/test.log 2>&1 &
+sleep 3
+
+echo
+echo "📡 Step 3: Registering a streamer and starting live stream 'TESTSRC'..."
+cookies=tmp/cookies.txt
+csrf=$(curl -s -c $cookies -b $cookies http://localhost:8080/register | grep -o 'name="csrf_token" value="[^"]*"' | head -1 | sed 's/.*value="//; s/"$//')
+curl -s -c $cookies -b $cookies -o /dev/null -d csrf_token=$csrf \
+    -d username=streamer -d password=streamer-password -d confirm=streamer-password \
+    http://localhost:8080/register
+csrf=$(curl -s -b $cookies http://localhost:8080/ | grep -o 'name="csrf_token" value="[^"]*"' | head -1 | sed 's/.*value="//; s/"$//')
+curl -s -b $cookies -X POST -d id=TESTSRC -d csrf_token=$csrf http://localhost:8080/live/start | grep -o 'rtmp://[^<]*' | head -1
+sleep 1
+
+echo
+echo "🎥 Step 4: Publishing a 40 second ffmpeg test source..."
+ffmpeg -loglevel error -re \
+    -f lavfi -i testsrc=size=640x360:rate=30 \
+    -f lavfi -i sine=frequency=440:sample_rate=44100 \
+    -t 40 -c:v libx264 -preset veryfast -pix_fmt yuv420p -c:a aac \
+    -f flv rtmp://localhost:1935/live/TESTSRC >> tmp/test.log 2>&1 &
+sleep 20
+
+echo
+echo "🔍 Step 5: Checking the stream while it is live..."
+if curl -s http://localhost:8080/ | grep -q 'LIVE'; then
+    echo "✅ PASS: index page shows the LIVE badge"
+else
+    echo "❌ FAIL: index page does not show the LIVE badge"
+fi
+if curl -s http://localhost:8080/content/TESTSRC/manifest.mpd | grep -q 'type="dynamic"'; then
+    echo "✅ PASS: dynamic manifest is served"
+else
+    echo "❌ FAIL: dynamic manifest is not served"
+fi
+segments=$(ls tmp/809*/TESTSRC/chunk-* 2>/dev/null | wc -l)
+if [ "$segments" -gt 0 ]; then
+    echo "✅ PASS: $segments segments stored on the storage nodes"
+else
+    echo "❌ FAIL: no segments stored on the storage nodes"
+fi
+
+echo
+echo "🧪 You can watch the stream at http://localhost:8080/videos/TESTSRC"
+echo "⌛ Waiting for the test source to finish..."
+sleep 25
+
+echo
+echo "🔍 Step 6: Checking that the ended stream was archived..."
+if curl -s http://localhost:8080/ | grep -q 'LIVE'; then
+    echo "❌ FAIL: index page still shows the LIVE badge"
+else
+    echo "✅ PASS: LIVE badge is gone"
+fi
+if curl -s http://localhost:8080/ | grep -q '/videos/TESTSRC'; then
+    echo "✅ PASS: archived stream is listed as a video"
+else
+    echo "❌ FAIL: archived stream is not listed"
+fi
+if curl -s http://localhost:8080/ | grep -q 'by streamer'; then
+    echo "✅ PASS: archived stream shows its owner"
+else
+    echo "❌ FAIL: archived stream does not show its owner"
+fi
+manifest=$(curl -s http://localhost:8080/content/TESTSRC/manifest.mpd)
+if echo "$manifest" | grep -q 'type="static"' && echo "$manifest" | grep -q 'startNumber="1"'; then
+    echo "✅ PASS: static manifest starts at the first segment"
+else
+    echo "❌ FAIL: manifest was not rewritten into a static one"
+fi
+if curl -s -o /dev/null -w '%{http_code}' http://localhost:8080/content/TESTSRC/chunk-0-00001.m4s | grep -q 200; then
+    echo "✅ PASS: first segment is still stored"
+else
+    echo "❌ FAIL: first segment is gone"
+fi
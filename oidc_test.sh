@@ -0,0 +1,105 @@
+#!/bin/bash
+
+# Single sign-on test: logs in through a local mock OpenID Connect provider
+# and checks that the user and role are mapped from the ID token claims.
+set -e
+rm -rf tmp  # comment out this line if you want to keep the data from ./tmp during testing
+
+# Ctrl+C or exit
+cleanup() {
+    echo "🧹 Cleaning up background processes..."
+    ps aux | grep go-build | awk '{print $2}' | xargs kill 2>/dev/null || true
+    echo "😉 Cleanup complete."
+}
+trap cleanup EXIT
+
+mkdir -p tmp/videos
+> tmp/test.log
+cookies=tmp/cookies.txt
+failed=0
+
+pass() { echo "✅ PASS: $1"; }
+fail() { echo "❌ FAIL: $1"; failed=1; }
+
+echo "🔑 Step 1: Starting the mock OIDC provider on port 9000 (user alice in group video-admins)..."
+go run cmd/mockoidc/main.go -port 9000 -username alice -subject alice-sub -groups staff,video-admins >> tmp/test.log 2>&1 &
+sleep 3
+
+echo
+echo "🌐 Step 2: Starting web server with single sign-on..."
+go run cmd/web/main.go \
+    -oidc-issuer http://localhost:9000 \
+    -oidc-client-id tritontube -oidc-client-secret secret \
+    -oidc-redirect-url http://localhost:8080/login/oidc/callback \
+    -oidc-name MockIdP -oidc-role-map video-admins=admin,staff=viewer \
+    sqlite ./tmp/metadata.db fs ./tmp/videos >> tmp/test.log 2>&1 &
+sleep 4
+
+echo
+echo "🔍 Step 3: Checking the login page..."
+if curl -s http://localhost:8080/login | grep -q 'Log in with MockIdP'; then
+    pass "login page offers single sign-on"
+else
+    fail "login page does not offer single sign-on"
+fi
+
+echo
+echo "🔐 Step 4: Logging in through the provider..."
+final=$(curl -s -L -c $cookies -b $cookies -o /dev/null -w '%{url_effective}' 'http://localhost:8080/login/oidc?next=/')
+if [ "$final" = "http://localhost:8080/" ]; then
+    pass "login flow ended back on the index page"
+else
+    fail "login flow ended at $final"
+fi
+index=$(curl -s -b $cookies http://localhost:8080/)
+if echo "$index" | grep -q 'Logged in as <strong>alice</strong>'; then
+    pass "user alice was created from the preferred_username claim"
+else
+    fail "index page does not show alice as logged in"
+fi
+if echo "$index" | grep -q 'action="/upload"'; then
+    pass "the admin role mapped from video-admins may upload"
+else
+    fail "alice may not upload"
+fi
+if sqlite3 tmp/metadata.db "SELECT role FROM users WHERE username = 'alice'" 2>/dev/null | grep -q admin; then
+    pass "alice has the admin role"
+elif ! command -v sqlite3 >/dev/null; then
+    echo "⚠️  sqlite3 not installed, skipping role check"
+else
+    fail "alice does not have the admin role"
+fi
+
+echo
+echo "🚫 Step 5: A callback for a login that was never started must fail..."
+status=$(curl -s -o /dev/null -w '%{http_code}' 'http://localhost:8080/login/oidc/callback?state=replayed&code=replayed')
+if [ "$status" = "400" ]; then
+    pass "unknown state is rejected"
+else
+    fail "unknown state returned $status"
+fi
+
+echo
+echo "🕵️  Step 6: A callback taken from another browser's login must fail..."
+provider=$(curl -s -o /dev/null -c tmp/attacker.txt -w '%{redirect_url}' 'http://localhost:8080/login/oidc?next=/')
+callback=$(curl -s -o /dev/null -w '%{redirect_url}' "$provider")
+status=$(curl -s -o /dev/null -w '%{http_code}' "$callback")
+if [ "$status" = "400" ]; then
+    pass "callback without the state cookie is rejected"
+else
+    fail "callback without the state cookie returned $status"
+fi
+status=$(curl -s -o /dev/null -b tmp/attacker.txt -w '%{http_code}' "$callback")
+if [ "$status" = "303" ]; then
+    pass "the browser that started the login can still finish it"
+else
+    fail "the browser that started the login got $status"
+fi
+
+echo
+if [ $failed -eq 0 ]; then
+    echo "🎉 All single sign-on checks passed"
+else
+    echo "💥 Some single sign-on checks failed, see tmp/test.log"
+    exit 1
+fi
@@ -0,0 +1,117 @@
+#!/bin/bash
+
+# Mutual TLS test: generates a throwaway CA and certificates, starts storage
+# nodes that require client certificates, and checks that only clients with a
+# certificate from that CA get through and that rotated certificates are
+# picked up without a restart.
+set -e
+rm -rf tmp  # comment out this line if you want to keep the data from ./tmp during testing
+
+# Ctrl+C or exit
+cleanup() {
+    echo "🧹 Cleaning up background processes..."
+    ps aux | grep go-build | awk '{print $2}' | xargs kill 2>/dev/null || true
+    ps aux | grep cmd/storage | awk '{print $2}' | xargs kill 2>/dev/null || true
+    echo "😉 Cleanup complete."
+}
+trap cleanup EXIT
+
+mkdir -p tmp/certs tmp/8090 tmp/8091
+> tmp/test.log
+certs=tmp/certs
+failed=0
+
+pass() { echo "✅ PASS: $1"; }
+fail() { echo "❌ FAIL: $1"; failed=1; }
+
+# new_ca NAME creates a self-signed CA
+new_ca() {
+    openssl req -x509 -newkey rsa:2048 -nodes -days 1 -subj "/CN=$1" \
+        -keyout $certs/$1.key -out $certs/$1.crt 2>/dev/null
+}
+
+# new_cert CA NAME USAGE creates a certificate for localhost signed by CA,
+# for USAGE serverAuth or clientAuth
+new_cert() {
+    openssl req -newkey rsa:2048 -nodes -subj "/CN=$2" \
+        -keyout $certs/$2.key -out $certs/$2.csr 2>/dev/null
+    printf "subjectAltName=DNS:localhost,IP:127.0.0.1\nextendedKeyUsage=$3\n" > $certs/$2.ext
+    openssl x509 -req -in $certs/$2.csr -CA $certs/$1.crt -CAkey $certs/$1.key \
+        -set_serial 0x$(openssl rand -hex 8) -days 1 -extfile $certs/$2.ext -out $certs/$2.crt 2>/dev/null
+}
+
+serial() {
+    openssl s_client -connect localhost:8090 -servername localhost \
+        -cert $certs/client.crt -key $certs/client.key </dev/null 2>/dev/null |
+        openssl x509 -noout -serial
+}
+
+# fsck_with ARGS... checks both storage nodes through the given TLS flags
+fsck_with() {
+    go run cmd/fsck/main.go "$@" sqlite ./tmp/metadata.db nw localhost:8081,localhost:8090,localhost:8091 >> tmp/test.log 2>&1
+}
+
+echo "📜 Step 1: Generating a CA, server and client certificates, and a second, untrusted CA..."
+new_ca ca
+new_cert ca server serverAuth
+new_cert ca client clientAuth
+new_ca rogue
+new_cert rogue rogue-client clientAuth
+
+echo
+echo "🚀 Step 2: Launching 2 storage nodes with mutual TLS on ports 8090–8091..."
+for port in 8090 8091; do
+    go run cmd/storage/main.go -port $port \
+        -tls-cert $certs/server.crt -tls-key $certs/server.key -tls-ca $certs/ca.crt \
+        tmp/$port >> tmp/test.log 2>&1 &
+done
+sleep 3
+
+echo
+echo "🔐 Step 3: Connecting with and without a trusted client certificate..."
+if fsck_with -storage-tls-cert $certs/client.crt -storage-tls-key $certs/client.key -storage-tls-ca $certs/ca.crt; then
+    pass "client certificate from the shared CA is accepted"
+else
+    fail "client certificate from the shared CA is rejected"
+fi
+if fsck_with; then
+    fail "plaintext client is accepted"
+else
+    pass "plaintext client is rejected"
+fi
+if fsck_with -storage-tls-cert $certs/rogue-client.crt -storage-tls-key $certs/rogue-client.key -storage-tls-ca $certs/ca.crt; then
+    fail "client certificate from another CA is accepted"
+else
+    pass "client certificate from another CA is rejected"
+fi
+if fsck_with -storage-tls-cert $certs/client.crt -storage-tls-key $certs/client.key -storage-tls-ca $certs/rogue.crt; then
+    fail "storage node certificate from an untrusted CA is accepted"
+else
+    pass "storage node certificate from an untrusted CA is rejected"
+fi
+
+echo
+echo "🔄 Step 4: Rotating the server certificate without restarting the nodes..."
+before=$(serial)
+sleep 1  # make sure the rewritten files get a new modification time
+new_cert ca server serverAuth
+sleep 2  # nodes check for changed files at most once a second
+after=$(serial)
+if [ -n "$after" ] && [ "$before" != "$after" ]; then
+    pass "rotated certificate is served ($before → $after)"
+else
+    fail "rotated certificate is not served ($before → $after)"
+fi
+if fsck_with -storage-tls-cert $certs/client.crt -storage-tls-key $certs/client.key -storage-tls-ca $certs/ca.crt; then
+    pass "clients still connect after the rotation"
+else
+    fail "clients cannot connect after the rotation"
+fi
+
+echo
+if [ $failed -eq 0 ]; then
+    echo "🎉 All TLS checks passed"
+else
+    echo "💥 Some TLS checks failed, see tmp/test.log"
+    exit 1
+fi
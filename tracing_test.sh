@@ -0,0 +1,95 @@
+#!/bin/bash
+
+# Tracing test: runs the web server and two storage nodes with the stdout
+# span exporter, fetches a segment with a traceparent header, and checks that
+# the web server's spans and the storage node's span all belong to the
+# caller's trace.
+set -e
+rm -rf tmp  # comment out this line if you want to keep the data from ./tmp during testing
+
+# Ctrl+C or exit
+cleanup() {
+    echo "🧹 Cleaning up background processes..."
+    ps aux | grep go-build | awk '{print $2}' | xargs kill 2>/dev/null || true
+    ps aux | grep cmd/storage | awk '{print $2}' | xargs kill 2>/dev/null || true
+    ps aux | grep cmd/web | awk '{print $2}' | xargs kill 2>/dev/null || true
+    echo "😉 Cleanup complete."
+}
+trap cleanup EXIT
+
+mkdir -p tmp/8090 tmp/8091
+> tmp/test.log
+failed=0
+
+pass() { echo "✅ PASS: $1"; }
+fail() { echo "❌ FAIL: $1"; failed=1; }
+
+# spans FILE TRACE_ID prints the names of the spans of a trace in FILE
+spans() {
+    jq -r --arg trace "$2" 'select(.SpanContext.TraceID == $trace) | .Name' "$1" 2>/dev/null
+}
+
+# has_span FILE TRACE_ID NAME checks that the trace has a span called NAME
+has_span() {
+    spans "$1" "$2" | grep -qx "$3"
+}
+
+echo "🚀 Step 1: Launching 2 storage nodes and the web server with the stdout span exporter..."
+for port in 8090 8091; do
+    TRITONTUBE_STORAGE_TRACING_EXPORTER=stdout TRITONTUBE_STORAGE_TRACING_FILE=tmp/spans-$port.json \
+        go run cmd/storage/main.go -port $port tmp/$port >> tmp/test.log 2>&1 &
+done
+sleep 3
+TRITONTUBE_WEB_TRACING_EXPORTER=stdout TRITONTUBE_WEB_TRACING_FILE=tmp/spans-web.json \
+    go run cmd/web/main.go -port 8080 -admin-insecure sqlite ./tmp/metadata.db nw localhost:8081,localhost:8090,localhost:8091 >> tmp/test.log 2>&1 &
+sleep 5
+
+echo
+echo "🎬 Step 2: Storing a video directly on the nodes and fetching its manifest..."
+sqlite3 tmp/metadata.db "INSERT INTO videos (id, uploaded_at) VALUES ('traced', datetime('now'))"
+# Whichever node owns the manifest has it
+for port in 8090 8091; do
+    mkdir -p tmp/$port/traced
+    echo "<MPD/>" > tmp/$port/traced/manifest.mpd
+done
+trace_id=$(openssl rand -hex 16)
+parent_id=$(openssl rand -hex 8)
+status=$(curl -s -o /dev/null -w "%{http_code}" \
+    -H "traceparent: 00-$trace_id-$parent_id-01" \
+    http://localhost:8080/content/traced/manifest.mpd)
+if [ "$status" = "200" ]; then
+    pass "manifest served"
+else
+    fail "manifest request returned $status"
+fi
+
+echo
+echo "🔎 Step 3: Waiting for the spans to be exported and checking trace $trace_id..."
+sleep 7  # spans are exported in batches every 5 seconds
+for name in "GET /content/" "metadata.Read" "NetworkVideoContentService.Read" "proto.StorageService/Read"; do
+    if has_span tmp/spans-web.json $trace_id "$name"; then
+        pass "web server recorded span \"$name\""
+    else
+        fail "web server did not record span \"$name\""
+    fi
+done
+root_parent=$(jq -r --arg trace $trace_id 'select(.SpanContext.TraceID == $trace and .Name == "GET /content/") | .Parent.SpanID' tmp/spans-web.json)
+if [ "$root_parent" = "$parent_id" ]; then
+    pass "request span continues the caller's trace"
+else
+    fail "request span has parent $root_parent, want $parent_id"
+fi
+if has_span tmp/spans-8090.json $trace_id "proto.StorageService/Read" ||
+    has_span tmp/spans-8091.json $trace_id "proto.StorageService/Read"; then
+    pass "storage node recorded its Read span in the same trace"
+else
+    fail "no storage node recorded a Read span in the trace"
+fi
+
+echo
+if [ $failed -eq 0 ]; then
+    echo "🎉 All tracing checks passed"
+else
+    echo "💥 Some tracing checks failed, see tmp/test.log"
+    exit 1
+fi